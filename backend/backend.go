@@ -0,0 +1,185 @@
+package backend
+
+import (
+	"errors"
+	"github.com/gopistolet/imap/parser"
+	"github.com/gopistolet/imap/sasl"
+	"strings"
+	"time"
+)
+
+// Errors which backends return, so the server can send the matching response
+var (
+	ErrInvalidCredentials   = errors.New("Backend: invalid credentials")
+	ErrNoSuchMailbox        = errors.New("Backend: no such mailbox")
+	ErrMailboxAlreadyExists = errors.New("Backend: mailbox already exists")
+	ErrInvalidMailboxName   = errors.New("Backend: invalid mailbox name")
+	ErrHasChildren          = errors.New("Backend: mailbox has children")
+)
+
+// Backend is the storage behind the server
+type Backend interface {
+	// Login checks the credentials and returns the user,
+	// or ErrInvalidCredentials
+	Login(username, password string) (User, error)
+}
+
+// SecretBackend is a Backend which knows the passwords of its users,
+// so the server can offer mechanisms like CRAM-MD5 which need them
+type SecretBackend interface {
+	Backend
+
+	// Secret returns the password of username,
+	// or ErrInvalidCredentials if there is no such user
+	Secret(username string) (string, error)
+}
+
+// AuthorizationBackend is a Backend which lets users act as another
+// user, like with the authorization identity of SASL PLAIN
+type AuthorizationBackend interface {
+	Backend
+
+	// LoginAs checks the credentials of username, and whether it may
+	// act as identity. It returns the user identity,
+	// or ErrInvalidCredentials.
+	LoginAs(identity, username, password string) (User, error)
+}
+
+// UserBackend is a Backend which returns users without their password,
+// once the server authenticated them in another way
+type UserBackend interface {
+	Backend
+
+	// User returns username,
+	// or ErrInvalidCredentials if there is no such user
+	User(username string) (User, error)
+}
+
+// ScramBackend is a Backend which stores salted credentials of its
+// users instead of their passwords, for the SCRAM mechanisms
+type ScramBackend interface {
+	UserBackend
+
+	// ScramCredentials returns the credentials of username for the hash
+	// named like in sasl.ScramHashes, or ErrInvalidCredentials if there
+	// is no such user or no credentials for that hash
+	ScramCredentials(username, hash string) (sasl.ScramCredentials, error)
+}
+
+// User is a logged in user, with its mailboxes.
+// Mailbox names are full hierarchical names, like "INBOX" or
+// "work/reports", with "/" as hierarchy delimiter.
+type User interface {
+	Username() string
+
+	// ListMailboxes returns all mailboxes,
+	// or only the subscribed ones when subscribed is set
+	ListMailboxes(subscribed bool) ([]MailboxInfo, error)
+
+	// GetMailbox returns the mailbox or ErrNoSuchMailbox.
+	// Every call returns a new handle, so each connection can keep
+	// its own view of the mailbox.
+	GetMailbox(name string) (Mailbox, error)
+
+	CreateMailbox(name string) error
+	DeleteMailbox(name string) error
+	RenameMailbox(existingName, newName string) error
+	SetSubscribed(name string, subscribed bool) error
+
+	// Logout is called when the connection ends
+	Logout() error
+}
+
+// Delimiter is the hierarchy delimiter of mailbox names
+const Delimiter = "/"
+
+// MailboxInfo is a mailbox as returned by LIST and LSUB
+type MailboxInfo struct {
+	Name       string
+	Attributes []string // like \Noselect or \HasChildren
+}
+
+// MailboxStatus holds the counters of a mailbox
+type MailboxStatus struct {
+	Messages    uint32
+	Recent      uint32
+	Unseen      uint32 // number of messages without \Seen
+	FirstUnseen uint32 // sequence number of the first message without \Seen, 0 if none
+	UidNext     uint32
+	UidValidity uint32
+
+	Flags          []string // flags defined in the mailbox
+	PermanentFlags []string // flags which can be changed permanently
+}
+
+// Mailbox is a mailbox of a user. Messages are addressed by sequence
+// number, or by UID when uid is set.
+type Mailbox interface {
+	Name() string
+	Status() (MailboxStatus, error)
+
+	// Select is called when the mailbox is selected, before Status.
+	// Unless readOnly is set, the session takes over the \Recent flag:
+	// the messages which are \Recent now are only \Recent through
+	// this handle from then on.
+	Select(readOnly bool) error
+
+	// Fetch returns the messages in set, in sequence order.
+	// Message.Body only has to be filled when body is set.
+	Fetch(uid bool, set parser.SequenceSet, body bool) ([]Message, error)
+
+	// Search returns the sequence numbers, or UIDs when uid is set,
+	// of the messages which match all keys
+	Search(uid bool, keys []parser.SearchKey) ([]uint32, error)
+
+	// Append adds a message with the given flags and internal date
+	Append(flags []string, date time.Time, body []byte) error
+
+	// Store changes the flags of the messages in set: mode "+" adds
+	// flags, "-" removes them and "" replaces them. It returns the
+	// changed messages with their new flags, Body isn't filled.
+	Store(uid bool, set parser.SequenceSet, mode string, flags []string) ([]Message, error)
+
+	// Copy copies the messages in set to the mailbox named dest,
+	// or returns ErrNoSuchMailbox
+	Copy(uid bool, set parser.SequenceSet, dest string) error
+
+	// Expunge removes the messages with the \Deleted flag.
+	// It returns the sequence numbers to report in EXPUNGE responses,
+	// each one relative to the mailbox after the ones before it were
+	// removed.
+	Expunge() ([]uint32, error)
+}
+
+// WatchedMailbox is a Mailbox which publishes its changes on a Bus,
+// so the sessions which have it selected learn about the changes of
+// others right away, instead of checking now and then
+type WatchedMailbox interface {
+	Mailbox
+
+	// Watch subscribes to the changes of the mailbox, the ones made
+	// through this handle included. The caller closes the
+	// Subscription when it is done.
+	Watch() *Subscription
+}
+
+// Message is a message in a mailbox
+type Message struct {
+	SeqNum       uint32
+	Uid          uint32
+	Flags        []string // including \Recent for recent messages
+	InternalDate time.Time
+	Size         uint32
+	Body         []byte // the whole message, as in RFC822
+}
+
+// HasFlag reports whether the message has flag, which is
+// compared case-insensitively
+func (m *Message) HasFlag(flag string) bool {
+	for _, f := range m.Flags {
+		if strings.EqualFold(f, flag) {
+			return true
+		}
+	}
+	return false
+}
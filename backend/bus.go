@@ -0,0 +1,131 @@
+package backend
+
+import (
+	"sync"
+)
+
+// UpdateType is the kind of change of an Update
+type UpdateType int
+
+const (
+	// UpdateExists means messages were added
+	UpdateExists UpdateType = iota
+	// UpdateFlags means the flags of the message with Uid changed
+	UpdateFlags
+	// UpdateExpunge means the message with Uid was removed
+	UpdateExpunge
+)
+
+// Update is a change of a mailbox
+type Update struct {
+	Type UpdateType
+	Uid  uint32 // not set for UpdateExists
+}
+
+// maxUpdates is the number of updates a subscription holds. When more
+// are published before they are taken, they are dropped and the
+// subscription needs a resync instead.
+const maxUpdates = 1024
+
+// Bus passes the changes of mailboxes from the sessions which make
+// them to every session which has the mailbox selected. Backends
+// publish on it with a key of their own for each mailbox, which
+// stays the same as long as the mailbox exists, like the path of
+// its directory. The zero value is ready to use.
+type Bus struct {
+	mu            sync.Mutex
+	subscriptions map[string]map[*Subscription]bool
+}
+
+// Subscribe starts collecting the updates of the mailbox with key
+func (b *Bus) Subscribe(key string) *Subscription {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	s := &Subscription{bus: b, key: key, ready: make(chan struct{}, 1)}
+	if b.subscriptions == nil {
+		b.subscriptions = map[string]map[*Subscription]bool{}
+	}
+	if b.subscriptions[key] == nil {
+		b.subscriptions[key] = map[*Subscription]bool{}
+	}
+	b.subscriptions[key][s] = true
+	return s
+}
+
+// Publish passes updates of the mailbox with key to its subscriptions.
+// Backends publish the changes of a mailbox in the order they made
+// them, while nothing else changes it.
+func (b *Bus) Publish(key string, updates ...Update) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for s := range b.subscriptions[key] {
+		s.mu.Lock()
+		if !s.resync && len(s.updates)+len(updates) > maxUpdates {
+			s.updates = nil
+			s.resync = true
+		}
+		if !s.resync {
+			s.updates = append(s.updates, updates...)
+		}
+		s.mu.Unlock()
+		select {
+		case s.ready <- struct{}{}:
+		default:
+			// the updates before weren't taken yet
+		}
+	}
+}
+
+// Subscription collects the updates of a mailbox until they are taken
+type Subscription struct {
+	bus   *Bus
+	key   string
+	ready chan struct{}
+
+	mu      sync.Mutex
+	updates []Update
+	resync  bool // updates were dropped
+}
+
+// Ready returns a channel which receives a value when there are
+// updates to take
+func (s *Subscription) Ready() <-chan struct{} {
+	return s.ready
+}
+
+// Updates takes the updates which were published since the last call,
+// in the order they were published
+func (s *Subscription) Updates() []Update {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	updates := s.updates
+	s.updates = nil
+	return updates
+}
+
+// Resync reports whether updates were dropped since the last call,
+// because more than the subscription holds were published before they
+// were taken. Call it after Updates: when it is set, the mailbox has to
+// be compared with what the session knows instead.
+func (s *Subscription) Resync() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	resync := s.resync
+	s.resync = false
+	return resync
+}
+
+// Close stops collecting updates
+func (s *Subscription) Close() {
+	s.bus.mu.Lock()
+	defer s.bus.mu.Unlock()
+
+	delete(s.bus.subscriptions[s.key], s)
+	if len(s.bus.subscriptions[s.key]) == 0 {
+		delete(s.bus.subscriptions, s.key)
+	}
+}
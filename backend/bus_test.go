@@ -0,0 +1,57 @@
+package backend
+
+import (
+	. "github.com/smartystreets/goconvey/convey"
+	"testing"
+)
+
+func TestBus(t *testing.T) {
+
+	Convey("Testing Bus", t, func() {
+
+		bus := &Bus{}
+		inbox := bus.Subscribe("INBOX")
+		other := bus.Subscribe("INBOX")
+		saved := bus.Subscribe("saved")
+
+		bus.Publish("INBOX", Update{Type: UpdateFlags, Uid: 4})
+		bus.Publish("INBOX", Update{Type: UpdateExpunge, Uid: 4}, Update{Type: UpdateExists})
+		So(len(inbox.Ready()), ShouldEqual, 1)
+		So(len(saved.Ready()), ShouldEqual, 0)
+		So(inbox.Updates(), ShouldResemble, []Update{{Type: UpdateFlags, Uid: 4}, {Type: UpdateExpunge, Uid: 4}, {Type: UpdateExists}})
+		So(inbox.Updates(), ShouldBeEmpty)
+		So(len(other.Updates()), ShouldEqual, 3)
+
+		other.Close()
+		bus.Publish("INBOX", Update{Type: UpdateExists})
+		So(other.Updates(), ShouldBeEmpty)
+		So(inbox.Updates(), ShouldResemble, []Update{{Type: UpdateExists}})
+		inbox.Close()
+		So(bus.subscriptions["INBOX"], ShouldBeNil)
+		So(saved.Updates(), ShouldBeEmpty)
+	})
+
+	Convey("Testing a Bus with a subscription which doesn't take its updates", t, func() {
+
+		bus := &Bus{}
+		idle := bus.Subscribe("INBOX")
+		for i := 0; i < maxUpdates; i++ {
+			bus.Publish("INBOX", Update{Type: UpdateFlags, Uid: uint32(i + 1)})
+		}
+		So(len(idle.Updates()), ShouldEqual, maxUpdates)
+		So(idle.Resync(), ShouldBeFalse)
+
+		// too many updates are dropped, also the ones after them
+		for i := 0; i <= maxUpdates; i++ {
+			bus.Publish("INBOX", Update{Type: UpdateFlags, Uid: uint32(i + 1)})
+		}
+		bus.Publish("INBOX", Update{Type: UpdateExists})
+		So(len(idle.Ready()), ShouldEqual, 1)
+		So(idle.Updates(), ShouldBeEmpty)
+		So(idle.Resync(), ShouldBeTrue)
+		So(idle.Resync(), ShouldBeFalse)
+
+		bus.Publish("INBOX", Update{Type: UpdateExists})
+		So(idle.Updates(), ShouldResemble, []Update{{Type: UpdateExists}})
+	})
+}
@@ -0,0 +1,462 @@
+package maildir
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/gopistolet/imap/backend"
+	"github.com/gopistolet/imap/parser"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// Flags which can be stored in the info of a file name
+var flags = []string{`\Answered`, `\Flagged`, `\Deleted`, `\Seen`, `\Draft`}
+
+// deliveries counts the messages written by this process,
+// to make their file names unique
+var deliveries uint64
+
+// handle implements backend.Mailbox, it is the view of a mailbox
+// of a single session
+type handle struct {
+	backend *Backend
+	user    *user
+	name    string
+	path    string
+
+	selected bool
+	readOnly bool
+	recent   map[uint32]bool // UIDs of the messages which are \Recent for this session
+}
+
+// file is a message file of the Maildir
+type file struct {
+	uid     uint32
+	unique  string
+	dir     string // "new" or "cur"
+	name    string
+	letters string
+	size    uint32 // with CRLF line endings
+}
+
+func (f *file) path(root string) string {
+	return filepath.Join(root, f.dir, f.name)
+}
+
+func (h *handle) Name() string {
+	return h.name
+}
+
+func (h *handle) Select(readOnly bool) error {
+	h.backend.mu.Lock()
+	defer h.backend.mu.Unlock()
+
+	h.selected = true
+	h.readOnly = readOnly
+	h.recent = map[uint32]bool{}
+	_, unlock, err := h.scan()
+	if err != nil {
+		return err
+	}
+	unlock()
+	return nil
+}
+
+// scan returns the message files in UID order. New files get a UID,
+// and unless the mailbox is examined, the files in new/ are moved to
+// cur/ and are \Recent for this session. The caller holds mu, scan
+// takes the lock of the uidlist for other processes, which the caller
+// releases with unlock once it is done with the files.
+func (h *handle) scan() (files []*file, unlock func(), err error) {
+	if !isMaildir(h.path) {
+		return nil, nil, backend.ErrNoSuchMailbox
+	}
+	path := filepath.Join(h.path, "imap-uidlist")
+	if err := lockUidList(path); err != nil {
+		return nil, nil, err
+	}
+	unlock = func() { os.Remove(path + ".lock") }
+	if files, err = h.scanLocked(path); err != nil {
+		unlock()
+		return nil, nil, err
+	}
+	return files, unlock, nil
+}
+
+// scanLocked does the work of scan, with the uidlist at path locked
+func (h *handle) scanLocked(path string) ([]*file, error) {
+	list, err := readUidList(path)
+	if err != nil {
+		return nil, err
+	}
+
+	files := []*file{}
+	for _, dir := range []string{"new", "cur"} {
+		entries, err := os.ReadDir(filepath.Join(h.path, dir))
+		if err != nil {
+			return nil, err
+		}
+		for _, entry := range entries {
+			if entry.IsDir() || strings.HasPrefix(entry.Name(), ".") {
+				continue
+			}
+			unique, letters := parseFileName(entry.Name())
+			files = append(files, &file{unique: unique, dir: dir, name: entry.Name(), letters: letters})
+		}
+	}
+
+	// the files without UID are ordered by their unique names,
+	// which start with the time of delivery
+	sort.Slice(files, func(i, j int) bool { return files[i].unique < files[j].unique })
+	changed := false
+	seen := map[string]bool{}
+	for _, f := range files {
+		uid, ok := list.uids[f.unique]
+		if !ok {
+			uid = list.uidNext
+			list.uids[f.unique] = uid
+			list.uidNext++
+			changed = true
+		}
+		f.uid = uid
+		seen[f.unique] = true
+
+		// the size of a name without one is read once, and kept
+		// in the uidlist
+		if size, ok := virtualSize(f.unique); ok {
+			f.size = size
+		} else if size, ok := list.sizes[f.unique]; ok {
+			f.size = size
+		} else {
+			content, err := os.ReadFile(f.path(h.path))
+			if err != nil {
+				return nil, err
+			}
+			f.size = uint32(len(crlf(content)))
+			list.sizes[f.unique] = f.size
+			changed = true
+		}
+	}
+	for unique := range list.uids {
+		if !seen[unique] {
+			delete(list.uids, unique)
+			delete(list.sizes, unique)
+			changed = true
+		}
+	}
+	if changed || !list.stored {
+		if err := list.write(path); err != nil {
+			return nil, err
+		}
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].uid < files[j].uid })
+
+	if h.selected && !h.readOnly {
+		for _, f := range files {
+			if f.dir != "new" {
+				continue
+			}
+			name := fileName(f.unique, f.letters)
+			if err := os.Rename(f.path(h.path), filepath.Join(h.path, "cur", name)); err != nil {
+				return nil, err
+			}
+			f.dir, f.name = "cur", name
+			h.recent[f.uid] = true
+		}
+	}
+	return files, nil
+}
+
+// uidValidity returns the UIDVALIDITY and next UID of the mailbox,
+// after a scan
+func (h *handle) uidValidity() (uint32, uint32, error) {
+	list, err := readUidList(filepath.Join(h.path, "imap-uidlist"))
+	if err != nil {
+		return 0, 0, err
+	}
+	return list.uidValidity, list.uidNext, nil
+}
+
+func (h *handle) Status() (backend.MailboxStatus, error) {
+	h.backend.mu.Lock()
+	defer h.backend.mu.Unlock()
+
+	files, unlock, err := h.scan()
+	if err != nil {
+		return backend.MailboxStatus{}, err
+	}
+	defer unlock()
+	uidValidity, uidNext, err := h.uidValidity()
+	if err != nil {
+		return backend.MailboxStatus{}, err
+	}
+
+	status := backend.MailboxStatus{
+		Messages:       uint32(len(files)),
+		UidNext:        uidNext,
+		UidValidity:    uidValidity,
+		Flags:          flags,
+		PermanentFlags: flags,
+	}
+	for i, f := range files {
+		if h.isRecent(f) {
+			status.Recent++
+		}
+		if strings.IndexByte(f.letters, 'S') < 0 {
+			status.Unseen++
+			if status.FirstUnseen == 0 {
+				status.FirstUnseen = uint32(i + 1)
+			}
+		}
+	}
+	return status, nil
+}
+
+func (h *handle) Fetch(uid bool, set parser.SequenceSet, body bool) ([]backend.Message, error) {
+	h.backend.mu.Lock()
+	defer h.backend.mu.Unlock()
+
+	files, unlock, err := h.scan()
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+	messages := backend.Filter(h.messages(files), uid, set)
+	for i := range messages {
+		if err := h.load(&messages[i], files[messages[i].SeqNum-1], body); err != nil {
+			return nil, err
+		}
+	}
+	return messages, nil
+}
+
+func (h *handle) Search(uid bool, keys []parser.SearchKey) ([]uint32, error) {
+	h.backend.mu.Lock()
+	defer h.backend.mu.Unlock()
+
+	files, unlock, err := h.scan()
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+	messages := h.messages(files)
+	for i := range messages {
+		if err := h.load(&messages[i], files[i], true); err != nil {
+			return nil, err
+		}
+	}
+	return backend.Search(messages, uid, keys), nil
+}
+
+// Append delivers a message to new/, with the flags in its info
+func (h *handle) Append(flags []string, date time.Time, body []byte) error {
+	h.backend.mu.Lock()
+	defer h.backend.mu.Unlock()
+
+	if !isMaildir(h.path) {
+		return backend.ErrNoSuchMailbox
+	}
+	if err := deliver(h.path, flagsLetters("", flags), date, body); err != nil {
+		return err
+	}
+	h.backend.bus.Publish(h.path, backend.Update{Type: backend.UpdateExists})
+	return nil
+}
+
+func (h *handle) Store(uid bool, set parser.SequenceSet, mode string, flags []string) ([]backend.Message, error) {
+	h.backend.mu.Lock()
+	defer h.backend.mu.Unlock()
+
+	files, unlock, err := h.scan()
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+	changed := backend.Filter(h.messages(files), uid, set)
+	for i := range changed {
+		f := files[changed[i].SeqNum-1]
+		letters := flagsLetters(f.letters, backend.ApplyFlags(lettersFlags(f.letters), mode, flags))
+		if letters != f.letters {
+			name := fileName(f.unique, letters)
+			if err := os.Rename(f.path(h.path), filepath.Join(h.path, f.dir, name)); err != nil {
+				return nil, err
+			}
+			f.name, f.letters = name, letters
+			h.backend.bus.Publish(h.path, backend.Update{Type: backend.UpdateFlags, Uid: f.uid})
+		}
+		changed[i].Flags = h.flags(f)
+	}
+	return changed, nil
+}
+
+func (h *handle) Copy(uid bool, set parser.SequenceSet, dest string) error {
+	h.backend.mu.Lock()
+	defer h.backend.mu.Unlock()
+
+	target, err := h.user.path(dest)
+	if err != nil {
+		return err
+	}
+	if !isMaildir(target) {
+		return backend.ErrNoSuchMailbox
+	}
+	files, unlock, err := h.scan()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	defer h.backend.bus.Publish(target, backend.Update{Type: backend.UpdateExists})
+	for _, message := range backend.Filter(h.messages(files), uid, set) {
+		f := files[message.SeqNum-1]
+		body, err := os.ReadFile(f.path(h.path))
+		if err != nil {
+			return err
+		}
+		info, err := os.Stat(f.path(h.path))
+		if err != nil {
+			return err
+		}
+		if err := deliver(target, f.letters, info.ModTime(), body); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (h *handle) Expunge() ([]uint32, error) {
+	h.backend.mu.Lock()
+	defer h.backend.mu.Unlock()
+
+	files, unlock, err := h.scan()
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+	expunged := []uint32{}
+	kept := uint32(0)
+	for _, f := range files {
+		if strings.IndexByte(f.letters, 'T') < 0 {
+			kept++
+			continue
+		}
+		if err := os.Remove(f.path(h.path)); err != nil && !os.IsNotExist(err) {
+			return expunged, err
+		}
+		expunged = append(expunged, kept+1)
+		delete(h.recent, f.uid)
+		h.backend.bus.Publish(h.path, backend.Update{Type: backend.UpdateExpunge, Uid: f.uid})
+	}
+	return expunged, nil
+}
+
+func (h *handle) Watch() *backend.Subscription {
+	return h.backend.bus.Subscribe(h.path)
+}
+
+// messages returns the messages of files, without their date,
+// size and body
+func (h *handle) messages(files []*file) []backend.Message {
+	messages := make([]backend.Message, len(files))
+	for i, f := range files {
+		messages[i] = backend.Message{SeqNum: uint32(i + 1), Uid: f.uid, Flags: h.flags(f)}
+	}
+	return messages
+}
+
+// load fills in the date and size of a message, and its body
+// when body is set
+func (h *handle) load(message *backend.Message, f *file, body bool) error {
+	info, err := os.Stat(f.path(h.path))
+	if err != nil {
+		return err
+	}
+	message.InternalDate = info.ModTime()
+	message.Size = f.size
+
+	if body {
+		content, err := os.ReadFile(f.path(h.path))
+		if err != nil {
+			return err
+		}
+		message.Body = crlf(content)
+		message.Size = uint32(len(message.Body))
+	}
+	return nil
+}
+
+// flags returns the flags of f, with \Recent when it is recent
+// for this session
+func (h *handle) flags(f *file) []string {
+	flags := lettersFlags(f.letters)
+	if h.isRecent(f) {
+		flags = append(flags, `\Recent`)
+	}
+	return flags
+}
+
+// isRecent reports whether f is \Recent for this session: it was
+// moved from new/ by this session, or it is still in new/ and this
+// session doesn't take over \Recent
+func (h *handle) isRecent(f *file) bool {
+	return h.recent[f.uid] || f.dir == "new"
+}
+
+// deliver writes a message to tmp/ of the Maildir at path,
+// and moves it to new/
+func deliver(path, letters string, date time.Time, body []byte) error {
+	host, err := os.Hostname()
+	if err != nil {
+		host = "localhost"
+	}
+	host = strings.NewReplacer("/", `\057`, ":", `\072`).Replace(host)
+	now := time.Now()
+	unique := fmt.Sprintf("%d.M%dP%dQ%d.%s,S=%d,W=%d", now.Unix(), now.Nanosecond()/1000, os.Getpid(),
+		atomic.AddUint64(&deliveries, 1), host, len(body), len(crlf(body)))
+
+	tmp := filepath.Join(path, "tmp", unique)
+	if err := os.WriteFile(tmp, body, 0600); err != nil {
+		return err
+	}
+	if err := os.Chtimes(tmp, date, date); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	name := unique
+	if letters != "" {
+		name = fileName(unique, letters)
+	}
+	return os.Rename(tmp, filepath.Join(path, "new", name))
+}
+
+// virtualSize returns the size with CRLF line endings, from the
+// ",W=" field of the unique name of a file
+func virtualSize(unique string) (uint32, bool) {
+	for _, field := range strings.Split(unique, ",")[1:] {
+		if strings.HasPrefix(field, "W=") {
+			size, err := strconv.ParseUint(field[2:], 10, 32)
+			return uint32(size), err == nil
+		}
+	}
+	return 0, false
+}
+
+// crlf returns content with CRLF line endings, the MTA may have
+// stored the message with LF line endings
+func crlf(content []byte) []byte {
+	if bytes.Count(content, []byte("\n")) == bytes.Count(content, []byte("\r\n")) {
+		return content
+	}
+	converted := make([]byte, 0, len(content)+bytes.Count(content, []byte("\n")))
+	for i, c := range content {
+		if c == '\n' && (i == 0 || content[i-1] != '\r') {
+			converted = append(converted, '\r')
+		}
+		converted = append(converted, c)
+	}
+	return converted
+}
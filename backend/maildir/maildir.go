@@ -0,0 +1,377 @@
+/*
+Package maildir implements a backend.Backend on Maildir++ directories.
+
+INBOX is the Maildir at the root of a user, the other mailboxes are
+Maildirs in the root named after the mailbox, with a leading dot and
+the hierarchy delimiter replaced by a dot: "work/reports" is stored in
+".work.reports". Flags are kept in the ":2," info of the file names.
+
+The UIDs of the messages and the UIDVALIDITY of a mailbox are kept in
+its imap-uidlist file, the subscribed mailboxes in the subscriptions
+file of the root. The uidlist is locked with an imap-uidlist.lock file
+while UIDs are assigned, so other processes can share the Maildirs.
+
+Messages are delivered to new/ by the MTA, the first session which
+selects the mailbox moves them to cur/ and sees them as \Recent.
+*/
+package maildir
+
+import (
+	"bufio"
+	"github.com/gopistolet/imap/backend"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Backend serves the Maildirs of users
+type Backend struct {
+	// Authenticate checks the password of username and returns the
+	// root of its Maildir, or backend.ErrInvalidCredentials
+	Authenticate func(username, password string) (root string, err error)
+
+	// mu serializes the changes to the Maildirs made by this process
+	mu  sync.Mutex
+	bus backend.Bus // by path
+}
+
+// New creates a Backend which authenticates users with authenticate
+func New(authenticate func(username, password string) (root string, err error)) *Backend {
+	return &Backend{Authenticate: authenticate}
+}
+
+func (b *Backend) Login(username, password string) (backend.User, error) {
+	root, err := b.Authenticate(username, password)
+	if err != nil {
+		return nil, err
+	}
+	if err := createMaildir(root); err != nil {
+		return nil, err
+	}
+	return &user{backend: b, username: username, root: root}, nil
+}
+
+// user implements backend.User
+type user struct {
+	backend  *Backend
+	username string
+	root     string
+}
+
+func (u *user) Username() string {
+	return u.username
+}
+
+func (u *user) ListMailboxes(subscribed bool) ([]backend.MailboxInfo, error) {
+	u.backend.mu.Lock()
+	defer u.backend.mu.Unlock()
+
+	exists := map[string]bool{"INBOX": true}
+	entries, err := os.ReadDir(u.root)
+	if err != nil {
+		return nil, err
+	}
+	for _, entry := range entries {
+		name, ok := mailboxName(entry.Name())
+		if ok && entry.IsDir() && isMaildir(filepath.Join(u.root, entry.Name())) {
+			exists[name] = true
+		}
+	}
+
+	// Maildir++ doesn't need the levels above a mailbox to exist
+	names := map[string]bool{}
+	for name := range exists {
+		levels := strings.Split(name, backend.Delimiter)
+		for i := 1; i <= len(levels); i++ {
+			names[strings.Join(levels[:i], backend.Delimiter)] = true
+		}
+	}
+	if subscribed {
+		if names, err = u.subscriptions(); err != nil {
+			return nil, err
+		}
+	}
+
+	sorted := []string{}
+	for name := range names {
+		sorted = append(sorted, name)
+	}
+	sort.Strings(sorted)
+
+	list := []backend.MailboxInfo{}
+	for _, name := range sorted {
+		attributes := []string{}
+		if !exists[name] {
+			attributes = append(attributes, `\Noselect`)
+		}
+		hasChildren := false
+		for other := range exists {
+			if strings.HasPrefix(other, name+backend.Delimiter) {
+				hasChildren = true
+			}
+		}
+		if hasChildren {
+			attributes = append(attributes, `\HasChildren`)
+		} else {
+			attributes = append(attributes, `\HasNoChildren`)
+		}
+		list = append(list, backend.MailboxInfo{Name: name, Attributes: attributes})
+	}
+	return list, nil
+}
+
+func (u *user) GetMailbox(name string) (backend.Mailbox, error) {
+	u.backend.mu.Lock()
+	defer u.backend.mu.Unlock()
+
+	path, err := u.path(name)
+	if err != nil {
+		return nil, err
+	}
+	if !isMaildir(path) {
+		return nil, backend.ErrNoSuchMailbox
+	}
+	return &handle{backend: u.backend, user: u, name: canonicalName(name), path: path}, nil
+}
+
+func (u *user) CreateMailbox(name string) error {
+	u.backend.mu.Lock()
+	defer u.backend.mu.Unlock()
+
+	path, err := u.path(name)
+	if err != nil {
+		return err
+	}
+	if isMaildir(path) {
+		return backend.ErrMailboxAlreadyExists
+	}
+	if err := createMaildir(path); err != nil {
+		return err
+	}
+	// marks a Maildir++ folder, for the MTA
+	f, err := os.Create(filepath.Join(path, "maildirfolder"))
+	if err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+// DeleteMailbox removes the Maildir of name, the mailboxes below it
+// are kept
+func (u *user) DeleteMailbox(name string) error {
+	u.backend.mu.Lock()
+	defer u.backend.mu.Unlock()
+
+	path, err := u.path(name)
+	if err != nil {
+		return err
+	}
+	if path == u.root || !isMaildir(path) {
+		return backend.ErrNoSuchMailbox
+	}
+	return os.RemoveAll(path)
+}
+
+// RenameMailbox renames a mailbox with the mailboxes below it.
+// Renaming INBOX moves its messages to a new mailbox.
+func (u *user) RenameMailbox(existingName, newName string) error {
+	u.backend.mu.Lock()
+	defer u.backend.mu.Unlock()
+
+	from, err := u.path(existingName)
+	if err != nil {
+		return err
+	}
+	to, err := u.path(newName)
+	if err != nil {
+		return err
+	}
+	if !isMaildir(from) {
+		return backend.ErrNoSuchMailbox
+	}
+	if isMaildir(to) || to == u.root {
+		return backend.ErrMailboxAlreadyExists
+	}
+
+	if from == u.root {
+		if err := createMaildir(to); err != nil {
+			return err
+		}
+		for _, dir := range []string{"new", "cur"} {
+			files, err := os.ReadDir(filepath.Join(from, dir))
+			if err != nil {
+				return err
+			}
+			for _, file := range files {
+				if err := os.Rename(filepath.Join(from, dir, file.Name()), filepath.Join(to, dir, file.Name())); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	}
+
+	entries, err := os.ReadDir(u.root)
+	if err != nil {
+		return err
+	}
+	// the parent is renamed first, and on failure the renames
+	// which were done are undone, so the hierarchy stays whole
+	renames := [][2]string{{from, to}}
+	prefix := filepath.Base(from) + "."
+	for _, entry := range entries {
+		if strings.HasPrefix(entry.Name(), prefix) {
+			child := filepath.Join(u.root, filepath.Base(to)+"."+strings.TrimPrefix(entry.Name(), prefix))
+			if _, err := os.Lstat(child); err == nil {
+				return backend.ErrMailboxAlreadyExists
+			}
+			renames = append(renames, [2]string{filepath.Join(u.root, entry.Name()), child})
+		}
+	}
+	for i, r := range renames {
+		if err := os.Rename(r[0], r[1]); err != nil {
+			for j := i - 1; j >= 0; j-- {
+				os.Rename(renames[j][1], renames[j][0])
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+func (u *user) SetSubscribed(name string, subscribed bool) error {
+	u.backend.mu.Lock()
+	defer u.backend.mu.Unlock()
+
+	path, err := u.path(name)
+	if err != nil {
+		return err
+	}
+	if subscribed && !isMaildir(path) {
+		return backend.ErrNoSuchMailbox
+	}
+	names, err := u.subscriptions()
+	if err != nil {
+		return err
+	}
+	if subscribed {
+		names[canonicalName(name)] = true
+	} else {
+		delete(names, canonicalName(name))
+	}
+
+	sorted := []string{}
+	for name := range names {
+		sorted = append(sorted, name)
+	}
+	sort.Strings(sorted)
+	content := ""
+	for _, name := range sorted {
+		content += name + "\n"
+	}
+	return writeFile(filepath.Join(u.root, "subscriptions"), []byte(content))
+}
+
+func (u *user) Logout() error {
+	return nil
+}
+
+// subscriptions returns the names in the subscriptions file
+func (u *user) subscriptions() (map[string]bool, error) {
+	names := map[string]bool{}
+	f, err := os.Open(filepath.Join(u.root, "subscriptions"))
+	if os.IsNotExist(err) {
+		return names, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	lines := bufio.NewScanner(f)
+	for lines.Scan() {
+		if name := strings.TrimSpace(lines.Text()); name != "" {
+			names[name] = true
+		}
+	}
+	return names, lines.Err()
+}
+
+// path returns the directory of the mailbox name,
+// or backend.ErrInvalidMailboxName if it can't be stored
+func (u *user) path(name string) (string, error) {
+	dir, err := dirName(name)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(u.root, dir), nil
+}
+
+// dirName returns the directory in the root of a user which stores the
+// mailbox name. Names with levels which could escape the root, or which
+// don't map back to the same name, are refused.
+func dirName(name string) (string, error) {
+	name = canonicalName(name)
+	if name == "INBOX" {
+		return ".", nil
+	}
+	for _, level := range strings.Split(name, backend.Delimiter) {
+		if level == "" || strings.ContainsAny(level, `.\`) {
+			return "", backend.ErrInvalidMailboxName
+		}
+		for _, r := range level {
+			if r < ' ' || r == 0x7f {
+				return "", backend.ErrInvalidMailboxName
+			}
+		}
+	}
+	return "." + strings.Replace(name, backend.Delimiter, ".", -1), nil
+}
+
+// mailboxName returns the mailbox stored in the directory dir,
+// if dir is the directory of a mailbox
+func mailboxName(dir string) (string, bool) {
+	if !strings.HasPrefix(dir, ".") || dir == "." || dir == ".." {
+		return "", false
+	}
+	name := strings.Replace(dir[1:], ".", backend.Delimiter, -1)
+	if d, err := dirName(name); err != nil || d != dir {
+		return "", false
+	}
+	return name, true
+}
+
+// canonicalName returns name, with INBOX in upper case
+// since it is case-insensitive
+func canonicalName(name string) string {
+	if strings.EqualFold(name, "INBOX") {
+		return "INBOX"
+	}
+	return name
+}
+
+// isMaildir reports whether path is a Maildir
+func isMaildir(path string) bool {
+	info, err := os.Stat(filepath.Join(path, "cur"))
+	return err == nil && info.IsDir()
+}
+
+// createMaildir creates the directories of a Maildir at path
+func createMaildir(path string) error {
+	for _, dir := range []string{"cur", "new", "tmp"} {
+		if err := os.MkdirAll(filepath.Join(path, dir), 0700); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeFile replaces the file at path with content,
+// readers see either the old or the new content
+func writeFile(path string, content []byte) error {
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, content, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
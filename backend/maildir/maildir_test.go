@@ -0,0 +1,272 @@
+package maildir
+
+import (
+	"github.com/gopistolet/imap/backend"
+	"github.com/gopistolet/imap/parser"
+	. "github.com/smartystreets/goconvey/convey"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestMaildir(t *testing.T) {
+
+	root := t.TempDir()
+	b := New(func(username, password string) (string, error) {
+		if username != "mrc" || password != "secret" {
+			return "", backend.ErrInvalidCredentials
+		}
+		return filepath.Join(root, username), nil
+	})
+	ls := func(dir string) []string {
+		entries, err := os.ReadDir(filepath.Join(root, "mrc", dir))
+		if err != nil {
+			t.Fatal(err)
+		}
+		names := []string{}
+		for _, entry := range entries {
+			names = append(names, entry.Name())
+		}
+		return names
+	}
+
+	Convey("Testing mailbox names", t, func() {
+
+		for name, dir := range map[string]string{
+			"INBOX":          ".",
+			"inbox":          ".",
+			"work/reports":   ".work.reports",
+			"INBOX/archive":  ".INBOX.archive",
+			"Sent Items":     ".Sent Items",
+			"":               "",
+			"..":             "",
+			"../../etc":      "",
+			"/etc/passwd":    "",
+			"work/":          "",
+			"work//reports":  "",
+			"v1.2":           "",
+			`C:\Windows`:     "",
+			"new\r\nline":    "",
+			"work/../../etc": "",
+		} {
+			d, err := dirName(name)
+			if dir == "" {
+				So(err, ShouldEqual, backend.ErrInvalidMailboxName)
+			} else {
+				So(err, ShouldEqual, nil)
+				So(d, ShouldEqual, dir)
+			}
+		}
+
+		name, ok := mailboxName(".work.reports")
+		So(ok, ShouldBeTrue)
+		So(name, ShouldEqual, "work/reports")
+		for _, dir := range []string{".", "..", "cur", ".work..reports", ".inbox"} {
+			_, ok := mailboxName(dir)
+			So(ok, ShouldBeFalse)
+		}
+	})
+
+	Convey("Testing mailboxes", t, func() {
+
+		_, err := b.Login("mrc", "wrong")
+		So(err, ShouldEqual, backend.ErrInvalidCredentials)
+		u, err := b.Login("mrc", "secret")
+		So(err, ShouldEqual, nil)
+		So(ls(""), ShouldResemble, []string{"cur", "new", "tmp"})
+
+		So(u.CreateMailbox("work/reports"), ShouldEqual, nil)
+		So(u.CreateMailbox("work/reports"), ShouldEqual, backend.ErrMailboxAlreadyExists)
+		So(u.CreateMailbox("../escape"), ShouldEqual, backend.ErrInvalidMailboxName)
+		So(u.CreateMailbox("Sent"), ShouldEqual, nil)
+		So(ls(".work.reports"), ShouldResemble, []string{"cur", "maildirfolder", "new", "tmp"})
+
+		list, err := u.ListMailboxes(false)
+		So(err, ShouldEqual, nil)
+		So(list, ShouldResemble, []backend.MailboxInfo{
+			{Name: "INBOX", Attributes: []string{`\HasNoChildren`}},
+			{Name: "Sent", Attributes: []string{`\HasNoChildren`}},
+			{Name: "work", Attributes: []string{`\Noselect`, `\HasChildren`}},
+			{Name: "work/reports", Attributes: []string{`\HasNoChildren`}},
+		})
+
+		So(u.RenameMailbox("work", "archive"), ShouldEqual, backend.ErrNoSuchMailbox)
+		So(u.CreateMailbox("work"), ShouldEqual, nil)
+		So(u.RenameMailbox("work", "Sent"), ShouldEqual, backend.ErrMailboxAlreadyExists)
+		So(u.RenameMailbox("work", "archive"), ShouldEqual, nil)
+		So(u.SetSubscribed("archive/reports", true), ShouldEqual, nil)
+		So(u.SetSubscribed("work", true), ShouldEqual, backend.ErrNoSuchMailbox)
+		So(u.DeleteMailbox("archive"), ShouldEqual, nil)
+		So(u.DeleteMailbox("archive"), ShouldEqual, backend.ErrNoSuchMailbox)
+
+		list, _ = u.ListMailboxes(false)
+		So(list, ShouldResemble, []backend.MailboxInfo{
+			{Name: "INBOX", Attributes: []string{`\HasNoChildren`}},
+			{Name: "Sent", Attributes: []string{`\HasNoChildren`}},
+			{Name: "archive", Attributes: []string{`\Noselect`, `\HasChildren`}},
+			{Name: "archive/reports", Attributes: []string{`\HasNoChildren`}},
+		})
+		list, _ = u.ListMailboxes(true)
+		So(list, ShouldResemble, []backend.MailboxInfo{
+			{Name: "archive/reports", Attributes: []string{`\HasNoChildren`}},
+		})
+
+		// a child which would collide leaves the hierarchy alone
+		So(u.CreateMailbox("Sent/reports"), ShouldEqual, nil)
+		So(u.RenameMailbox("Sent", "archive"), ShouldEqual, backend.ErrMailboxAlreadyExists)
+		So(ls(""), ShouldResemble, []string{".Sent", ".Sent.reports", ".archive.reports", "cur", "new", "subscriptions", "tmp"})
+		So(u.RenameMailbox("Sent", "drafts"), ShouldEqual, nil)
+		So(ls(""), ShouldResemble, []string{".archive.reports", ".drafts", ".drafts.reports", "cur", "new", "subscriptions", "tmp"})
+		So(u.DeleteMailbox("drafts/reports"), ShouldEqual, nil)
+		So(u.RenameMailbox("drafts", "Sent"), ShouldEqual, nil)
+	})
+
+	Convey("Testing messages", t, func() {
+
+		u, _ := b.Login("mrc", "secret")
+		all := parser.SequenceSet{{Start: 1, Stop: 0}}
+
+		// delivered by the MTA, with LF line endings
+		mta := filepath.Join(root, "mrc", "new", "1468747465.M12P345.mx")
+		So(os.WriteFile(mta, []byte("Subject: first\n\nHello\n"), 0600), ShouldEqual, nil)
+		date := time.Date(2016, 7, 17, 9, 24, 25, 0, time.UTC)
+		So(os.Chtimes(mta, date, date), ShouldEqual, nil)
+
+		inbox, err := u.GetMailbox("inbox")
+		So(err, ShouldEqual, nil)
+		So(inbox.Append([]string{`\Seen`, `\Flagged`}, date, []byte("Subject: second\r\n\r\nHi\r\n")), ShouldEqual, nil)
+		So(len(ls("new")), ShouldEqual, 2)
+
+		status, err := inbox.Status()
+		So(err, ShouldEqual, nil)
+		So(status.Messages, ShouldEqual, 2)
+		So(status.Recent, ShouldEqual, 2)
+		So(status.Unseen, ShouldEqual, 1)
+		So(status.FirstUnseen, ShouldEqual, 1)
+		So(status.UidNext, ShouldEqual, 3)
+
+		// examining doesn't move the messages to cur/
+		examined, _ := u.GetMailbox("INBOX")
+		So(examined.Select(true), ShouldEqual, nil)
+		So(len(ls("new")), ShouldEqual, 2)
+
+		selected, _ := u.GetMailbox("INBOX")
+		So(selected.Select(false), ShouldEqual, nil)
+		So(ls("new"), ShouldBeEmpty)
+		So(ls("cur")[0], ShouldEqual, "1468747465.M12P345.mx:2,")
+
+		// the size of the MTA's file is kept in the uidlist
+		uidList, _ := os.ReadFile(filepath.Join(root, "mrc", "imap-uidlist"))
+		So(string(uidList), ShouldContainSubstring, "\n1 1468747465.M12P345.mx 25\n")
+
+		messages, err := selected.Fetch(false, all, true)
+		So(err, ShouldEqual, nil)
+		So(len(messages), ShouldEqual, 2)
+		So(messages[0].Uid, ShouldEqual, 1)
+		So(messages[0].Flags, ShouldResemble, []string{`\Recent`})
+		So(messages[0].InternalDate.Equal(date), ShouldBeTrue)
+		So(string(messages[0].Body), ShouldEqual, "Subject: first\r\n\r\nHello\r\n")
+		So(messages[0].Size, ShouldEqual, 25)
+		So(messages[1].Flags, ShouldResemble, []string{`\Flagged`, `\Seen`, `\Recent`})
+
+		// other sessions don't see them as \Recent anymore
+		other, _ := u.GetMailbox("INBOX")
+		status, _ = other.Status()
+		So(status.Recent, ShouldEqual, 0)
+		status, _ = selected.Status()
+		So(status.Recent, ShouldEqual, 2)
+
+		updates := other.(backend.WatchedMailbox).Watch()
+		defer updates.Close()
+		changed, err := selected.Store(true, parser.SequenceSet{{Start: 1, Stop: 1}}, "+", []string{`\Answered`, `\deleted`})
+		So(err, ShouldEqual, nil)
+		So(updates.Updates(), ShouldResemble, []backend.Update{{Type: backend.UpdateFlags, Uid: 1}})
+		So(changed[0].Flags, ShouldResemble, []string{`\Answered`, `\Deleted`, `\Recent`})
+		So(ls("cur")[0], ShouldEqual, "1468747465.M12P345.mx:2,RT")
+
+		results, err := other.Search(false, []parser.SearchKey{{Name: "BODY", Value: "hi"}})
+		So(err, ShouldEqual, nil)
+		So(results, ShouldResemble, []uint32{2})
+
+		So(u.CreateMailbox("Saved"), ShouldEqual, nil)
+		So(selected.Copy(false, all, "Missing"), ShouldEqual, backend.ErrNoSuchMailbox)
+		So(selected.Copy(false, parser.SequenceSet{{Start: 2, Stop: 2}}, "Saved"), ShouldEqual, nil)
+		saved, _ := u.GetMailbox("Saved")
+		messages, _ = saved.Fetch(false, all, false)
+		So(len(messages), ShouldEqual, 1)
+		So(messages[0].Flags, ShouldResemble, []string{`\Flagged`, `\Seen`, `\Recent`})
+
+		expunged, err := selected.Expunge()
+		So(err, ShouldEqual, nil)
+		So(expunged, ShouldResemble, []uint32{1})
+		So(updates.Updates(), ShouldResemble, []backend.Update{{Type: backend.UpdateExpunge, Uid: 1}})
+		So(len(ls("cur")), ShouldEqual, 1)
+
+		// the UIDs are kept by the uidlist
+		reopened, _ := u.GetMailbox("INBOX")
+		messages, _ = reopened.Fetch(false, all, false)
+		So(len(messages), ShouldEqual, 1)
+		So(messages[0].SeqNum, ShouldEqual, 1)
+		So(messages[0].Uid, ShouldEqual, 2)
+		So(messages[0].Size, ShouldEqual, 23)
+		later, _ := reopened.Status()
+		So(later.UidValidity, ShouldEqual, status.UidValidity)
+		So(later.UidNext, ShouldEqual, 3)
+
+		// renaming INBOX moves its messages
+		So(u.RenameMailbox("INBOX", "Old"), ShouldEqual, nil)
+		old, _ := u.GetMailbox("Old")
+		status, _ = old.Status()
+		So(status.Messages, ShouldEqual, 1)
+		status, _ = reopened.Status()
+		So(status.Messages, ShouldEqual, 0)
+	})
+
+	Convey("Testing the lock of the uidlist", t, func() {
+
+		u, _ := b.Login("mrc", "secret")
+		inbox, _ := u.GetMailbox("INBOX")
+
+		// another process assigns UIDs
+		lock := filepath.Join(root, "mrc", "imap-uidlist.lock")
+		So(os.WriteFile(lock, nil, 0600), ShouldEqual, nil)
+		go func() {
+			time.Sleep(100 * time.Millisecond)
+			os.Remove(lock)
+		}()
+		start := time.Now()
+		_, err := inbox.Status()
+		So(err, ShouldEqual, nil)
+		So(time.Since(start), ShouldBeGreaterThan, 90*time.Millisecond)
+		_, err = os.Stat(lock)
+		So(os.IsNotExist(err), ShouldBeTrue)
+
+		// left behind by a crashed process
+		So(os.WriteFile(lock, nil, 0600), ShouldEqual, nil)
+		old := time.Now().Add(-time.Hour)
+		os.Chtimes(lock, old, old)
+		_, err = inbox.Status()
+		So(err, ShouldEqual, nil)
+
+		// STORE renames the files before it releases the lock
+		So(inbox.Append(nil, time.Now(), []byte("Subject: locked\r\n\r\n")), ShouldEqual, nil)
+		changed, err := inbox.Store(false, parser.SequenceSet{{Start: 1, Stop: 0}}, "+", []string{`\Flagged`})
+		So(err, ShouldEqual, nil)
+		So(changed, ShouldNotBeEmpty)
+		_, err = os.Stat(lock)
+		So(os.IsNotExist(err), ShouldBeTrue)
+	})
+
+	Convey("Testing flag letters", t, func() {
+
+		unique, letters := parseFileName("1468747465.M12P345.mx,S=25:2,PSa")
+		So(unique, ShouldEqual, "1468747465.M12P345.mx,S=25")
+		So(letters, ShouldEqual, "PSa")
+		So(lettersFlags(letters), ShouldResemble, []string{`\Seen`})
+		So(flagsLetters(letters, []string{`\Draft`, `\Deleted`, "$Junk"}), ShouldEqual, "DPTa")
+		size, ok := virtualSize("1468747465.M12P345.mx,S=25,W=27")
+		So(ok, ShouldBeTrue)
+		So(size, ShouldEqual, 27)
+	})
+}
@@ -0,0 +1,202 @@
+package maildir
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// uidList is the imap-uidlist file of a Maildir. It has a header line
+// with the version, UIDVALIDITY and next UID, followed by a line for
+// every message with its UID and the unique part of its file name.
+// When that has no ",W=" size, like the names of most MTAs, the size of
+// the message with CRLF line endings follows, so it is only read once:
+//
+//	1 3857529045 19
+//	1 1468747465.M12P345.host 2817
+//	2 1468747502.M55P345.host,S=1204,W=1230
+type uidList struct {
+	uidValidity uint32
+	uidNext     uint32
+	uids        map[string]uint32 // by unique name
+	sizes       map[string]uint32 // by unique name, of the names without size
+	stored      bool              // read from the file
+}
+
+// lockTimeout is how long to wait for the lock of a uidlist,
+// locks older than staleLock were left behind by a crashed process
+const (
+	lockTimeout = 30 * time.Second
+	staleLock   = 2 * time.Minute
+)
+
+var errLockTimeout = errors.New("Maildir: timeout waiting for uidlist lock")
+
+// lockUidList creates the lock file path.lock of the uidlist at path,
+// waiting while another process has it, like Dovecot does before it
+// assigns UIDs. It is released by removing the file.
+func lockUidList(path string) error {
+	deadline := time.Now().Add(lockTimeout)
+	for {
+		f, err := os.OpenFile(path+".lock", os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+		if err == nil {
+			return f.Close()
+		}
+		if !os.IsExist(err) {
+			return err
+		}
+		if info, err := os.Stat(path + ".lock"); err == nil && time.Since(info.ModTime()) > staleLock {
+			os.Remove(path + ".lock")
+			continue
+		}
+		if time.Now().After(deadline) {
+			return errLockTimeout
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+// readUidList reads the uidlist at path, or returns an empty uidlist
+// with a new UIDVALIDITY if there is none yet
+func readUidList(path string) (*uidList, error) {
+	l := &uidList{uidValidity: uint32(time.Now().Unix()), uidNext: 1, uids: map[string]uint32{}, sizes: map[string]uint32{}}
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return l, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	l.stored = true
+
+	lines := bufio.NewScanner(f)
+	if !lines.Scan() {
+		return l, lines.Err()
+	}
+	header := strings.Fields(lines.Text())
+	if len(header) != 3 || header[0] != "1" {
+		return nil, fmt.Errorf("Maildir: unknown uidlist header in %s", path)
+	}
+	uidValidity, err1 := strconv.ParseUint(header[1], 10, 32)
+	uidNext, err2 := strconv.ParseUint(header[2], 10, 32)
+	if err1 != nil || err2 != nil {
+		return nil, fmt.Errorf("Maildir: invalid uidlist header in %s", path)
+	}
+	l.uidValidity, l.uidNext = uint32(uidValidity), uint32(uidNext)
+
+	for lines.Scan() {
+		fields := strings.Fields(lines.Text())
+		if len(fields) != 2 && len(fields) != 3 {
+			continue
+		}
+		uid, err := strconv.ParseUint(fields[0], 10, 32)
+		if err != nil {
+			continue
+		}
+		l.uids[fields[1]] = uint32(uid)
+		if len(fields) == 3 {
+			if size, err := strconv.ParseUint(fields[2], 10, 32); err == nil {
+				l.sizes[fields[1]] = uint32(size)
+			}
+		}
+		if uint32(uid) >= l.uidNext {
+			l.uidNext = uint32(uid) + 1
+		}
+	}
+	return l, lines.Err()
+}
+
+// write replaces the uidlist at path
+func (l *uidList) write(path string) error {
+	names := []string{}
+	for name := range l.uids {
+		names = append(names, name)
+	}
+	sort.Slice(names, func(i, j int) bool { return l.uids[names[i]] < l.uids[names[j]] })
+
+	content := fmt.Sprintf("1 %d %d\n", l.uidValidity, l.uidNext)
+	for _, name := range names {
+		if size, ok := l.sizes[name]; ok {
+			content += fmt.Sprintf("%d %s %d\n", l.uids[name], name, size)
+		} else {
+			content += fmt.Sprintf("%d %s\n", l.uids[name], name)
+		}
+	}
+	return writeFile(path, []byte(content))
+}
+
+// Flags and the letters which store them in the info of a file name,
+// in the order of the letters
+var infoFlags = []struct {
+	letter byte
+	flag   string
+}{
+	{'D', `\Draft`},
+	{'F', `\Flagged`},
+	{'R', `\Answered`},
+	{'S', `\Seen`},
+	{'T', `\Deleted`},
+}
+
+// parseFileName splits a file name in its unique part and the flag
+// letters of its info
+func parseFileName(name string) (unique, letters string) {
+	colon := strings.IndexByte(name, ':')
+	if colon < 0 {
+		return name, ""
+	}
+	unique, info := name[:colon], name[colon+1:]
+	if strings.HasPrefix(info, "2,") {
+		letters = info[2:]
+	}
+	return
+}
+
+// fileName returns the file name with unique and letters
+func fileName(unique, letters string) string {
+	return unique + ":2," + letters
+}
+
+// lettersFlags returns the flags of letters
+func lettersFlags(letters string) []string {
+	flags := []string{}
+	for _, f := range infoFlags {
+		if strings.IndexByte(letters, f.letter) >= 0 {
+			flags = append(flags, f.flag)
+		}
+	}
+	return flags
+}
+
+// flagsLetters returns letters with the letters of the flags of
+// infoFlags replaced by those of flags. Other letters, like the
+// keywords of other software, are kept.
+func flagsLetters(letters string, flags []string) string {
+	kept := []byte{}
+	for i := 0; i < len(letters); i++ {
+		known := false
+		for _, f := range infoFlags {
+			if letters[i] == f.letter {
+				known = true
+			}
+		}
+		if !known {
+			kept = append(kept, letters[i])
+		}
+	}
+	for _, f := range infoFlags {
+		for _, flag := range flags {
+			if strings.EqualFold(flag, f.flag) {
+				kept = append(kept, f.letter)
+				break
+			}
+		}
+	}
+	sort.Slice(kept, func(i, j int) bool { return kept[i] < kept[j] })
+	return string(kept)
+}
@@ -0,0 +1,483 @@
+package mbox
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// stateFields are the header fields which keep the state of a message
+// in the mbox, they are removed from the message served to clients
+var stateFields = []string{"Status", "X-Status", "X-Keywords", "X-UID", "X-IMAPbase"}
+
+// Flags stored as letters in the Status and X-Status fields, other
+// flags are keywords in the X-Keywords field. The O in Status marks
+// messages which aren't \Recent anymore.
+var letterFlags = []struct {
+	field  string
+	letter byte
+	flag   string
+}{
+	{"X-Status", 'A', `\Answered`},
+	{"X-Status", 'F', `\Flagged`},
+	{"X-Status", 'D', `\Deleted`},
+	{"Status", 'R', `\Seen`},
+	{"X-Status", 'T', `\Draft`},
+}
+
+// index holds the messages of an mbox with their offsets
+type index struct {
+	size    int64
+	modTime time.Time
+
+	uidValidity uint32 // 0 if the mbox has no X-IMAPbase yet
+	uidNext     uint32
+	base        string // X-IMAPbase of the first message, as stored
+	entries     []*entry
+}
+
+// entry is a message in the index of an mbox
+type entry struct {
+	offset int64     // of the From line
+	end    int64     // end of the message, before the empty line which separates it from the next
+	date   time.Time // internal date, from the From line
+	uid    uint32    // 0 if the message has no valid X-UID yet
+	flags  []string  // without \Recent
+	recent bool      // the Status field has no O
+	size   uint32    // of the message as served to clients
+
+	changed bool // its state must be written
+	removed bool // it must be removed
+}
+
+// readIndex reads the index of the mbox f
+func readIndex(f *os.File) (*index, error) {
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	idx := &index{size: info.Size(), modTime: info.ModTime(), uidNext: 1}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+
+	add := func(offset int64, raw []byte) {
+		raw = trimSeparator(raw)
+		m := parseMessage(raw)
+		e := &entry{offset: offset, end: offset + int64(len(raw)), size: uint32(len(m.served()))}
+		e.date = m.date(info.ModTime())
+		e.flags, e.recent, e.uid = m.state()
+		if len(idx.entries) == 0 {
+			idx.base = m.get("X-IMAPbase")
+			fields := strings.Fields(idx.base)
+			if len(fields) >= 2 {
+				uidValidity, err1 := strconv.ParseUint(fields[0], 10, 32)
+				uidNext, err2 := strconv.ParseUint(fields[1], 10, 32)
+				if err1 == nil && err2 == nil && uidValidity > 0 {
+					idx.uidValidity, idx.uidNext = uint32(uidValidity), uint32(uidNext)
+				}
+			}
+		}
+		if len(idx.entries) > 0 && e.uid <= idx.entries[len(idx.entries)-1].uid {
+			// UIDs must ascend, this one gets a new UID
+			e.uid = 0
+		}
+		if e.uid >= idx.uidNext {
+			idx.uidNext = e.uid + 1
+		}
+		idx.entries = append(idx.entries, e)
+	}
+
+	r := bufio.NewReader(f)
+	offset, start := int64(0), int64(-1)
+	current := []byte{}
+	blank := true // the line before is empty, so a From line starts a message
+	for {
+		line, err := r.ReadBytes('\n')
+		if len(line) > 0 {
+			if blank && bytes.HasPrefix(line, []byte("From ")) {
+				if start >= 0 {
+					add(start, current)
+				}
+				start, current = offset, []byte{}
+			}
+			if start >= 0 {
+				current = append(current, line...)
+			}
+			blank = len(bytes.TrimRight(line, "\r\n")) == 0
+			offset += int64(len(line))
+		}
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+	}
+	if start >= 0 {
+		add(start, current)
+	}
+	return idx, nil
+}
+
+// trimSeparator removes the empty line which separates
+// a message from the next one
+func trimSeparator(raw []byte) []byte {
+	switch {
+	case bytes.HasSuffix(raw, []byte("\r\n\r\n")):
+		return raw[:len(raw)-2]
+	case bytes.HasSuffix(raw, []byte("\n\n")):
+		return raw[:len(raw)-1]
+	}
+	return raw
+}
+
+// message is a message of an mbox, split in its parts
+type message struct {
+	from   string   // From line, without line ending
+	fields []string // header fields, with their folded lines and LF line endings
+	body   []byte   // after the empty line which ends the header, escaped as in the mbox
+}
+
+// parseMessage parses a message as stored in the mbox,
+// starting with its From line
+func parseMessage(raw []byte) *message {
+	raw = bytes.Replace(raw, []byte("\r\n"), []byte("\n"), -1)
+	m := &message{}
+	if i := bytes.IndexByte(raw, '\n'); i >= 0 {
+		m.from, raw = string(raw[:i]), raw[i+1:]
+	} else {
+		m.from, raw = string(raw), nil
+	}
+	m.fields, m.body = parseHeader(raw)
+	return m
+}
+
+// parseHeader splits content with LF line endings in the fields of
+// its header and its body
+func parseHeader(content []byte) (fields []string, body []byte) {
+	fields = []string{}
+	for len(content) > 0 {
+		end := bytes.IndexByte(content, '\n') + 1
+		if end == 0 {
+			end = len(content)
+		}
+		line := string(content[:end])
+		content = content[end:]
+		if strings.TrimRight(line, "\n") == "" {
+			return fields, content
+		}
+		if (line[0] == ' ' || line[0] == '\t') && len(fields) > 0 {
+			fields[len(fields)-1] += line
+		} else {
+			fields = append(fields, line)
+		}
+	}
+	return fields, nil
+}
+
+// fieldName returns the name of a header field
+func fieldName(field string) string {
+	if colon := strings.IndexByte(field, ':'); colon >= 0 {
+		return strings.TrimSpace(field[:colon])
+	}
+	return ""
+}
+
+// get returns the unfolded value of the first field with name
+func (m *message) get(name string) string {
+	for _, field := range m.fields {
+		if strings.EqualFold(fieldName(field), name) {
+			value := field[strings.IndexByte(field, ':')+1:]
+			return strings.Join(strings.Fields(value), " ")
+		}
+	}
+	return ""
+}
+
+// date returns the date of the From line, or def if it has none
+func (m *message) date(def time.Time) time.Time {
+	fields := strings.Fields(m.from)
+	if len(fields) < 3 {
+		return def
+	}
+	value := strings.Join(fields[2:], " ")
+	for _, layout := range []string{time.ANSIC, "Mon Jan _2 15:04:05 2006 -0700", "Mon Jan _2 15:04:05 MST 2006"} {
+		if date, err := time.Parse(layout, value); err == nil {
+			return date
+		}
+	}
+	return def
+}
+
+// state returns the flags, \Recent and UID stored in the header
+func (m *message) state() (flags []string, recent bool, uid uint32) {
+	flags = []string{}
+	for _, f := range letterFlags {
+		if strings.IndexByte(m.get(f.field), f.letter) >= 0 {
+			flags = append(flags, f.flag)
+		}
+	}
+	flags = append(flags, strings.Fields(m.get("X-Keywords"))...)
+	recent = strings.IndexByte(m.get("Status"), 'O') < 0
+	if n, err := strconv.ParseUint(m.get("X-UID"), 10, 32); err == nil {
+		uid = uint32(n)
+	}
+	return
+}
+
+// served returns the message as served to clients:
+// without From line and state fields, unescaped and with CRLF
+func (m *message) served() []byte {
+	buf := &bytes.Buffer{}
+	for _, field := range m.fields {
+		if !isStateField(field) {
+			buf.WriteString(field)
+		}
+	}
+	buf.WriteString("\n")
+	for _, line := range bytes.SplitAfter(m.body, []byte("\n")) {
+		if bytes.HasPrefix(bytes.TrimLeft(line, ">"), []byte("From ")) && line[0] == '>' {
+			line = line[1:]
+		}
+		buf.Write(line)
+	}
+	return bytes.Replace(buf.Bytes(), []byte("\n"), []byte("\r\n"), -1)
+}
+
+// encode returns the message as stored in the mbox, with the state
+// of e in its header. base is the X-IMAPbase, for the first message.
+func (m *message) encode(e *entry, base string) []byte {
+	buf := &bytes.Buffer{}
+	buf.WriteString(m.from + "\n")
+	for _, field := range m.fields {
+		if !isStateField(field) {
+			buf.WriteString(field)
+		}
+	}
+	if base != "" {
+		buf.WriteString("X-IMAPbase: " + base + "\n")
+	}
+	if e.uid > 0 {
+		buf.WriteString("X-UID: " + strconv.FormatUint(uint64(e.uid), 10) + "\n")
+	}
+
+	letters, keywords := map[string]string{}, []string{}
+	for _, f := range letterFlags {
+		if hasFlag(e.flags, f.flag) {
+			letters[f.field] += string(f.letter)
+		}
+	}
+	for _, flag := range e.flags {
+		if !isSystemFlag(flag) {
+			keywords = append(keywords, flag)
+		}
+	}
+	if !e.recent {
+		letters["Status"] += "O"
+	}
+	for _, field := range []string{"Status", "X-Status"} {
+		if letters[field] != "" {
+			buf.WriteString(field + ": " + letters[field] + "\n")
+		}
+	}
+	if len(keywords) > 0 {
+		buf.WriteString("X-Keywords: " + strings.Join(keywords, " ") + "\n")
+	}
+
+	buf.WriteString("\n")
+	buf.Write(m.body)
+	if len(m.body) > 0 && m.body[len(m.body)-1] != '\n' {
+		buf.WriteString("\n")
+	}
+	return buf.Bytes()
+}
+
+func isSystemFlag(flag string) bool {
+	for _, f := range letterFlags {
+		if f.flag == flag {
+			return true
+		}
+	}
+	return false
+}
+
+func isStateField(field string) bool {
+	name := fieldName(field)
+	for _, state := range stateFields {
+		if strings.EqualFold(name, state) {
+			return true
+		}
+	}
+	return false
+}
+
+// newMessage returns a message to add to an mbox,
+// content is the message as sent by the client
+func newMessage(content []byte, date time.Time) *message {
+	content = bytes.Replace(content, []byte("\r\n"), []byte("\n"), -1)
+	m := &message{from: "From MAILER-DAEMON " + date.UTC().Format(time.ANSIC)}
+	fields, body := parseHeader(content)
+	m.fields = fields
+
+	// lines which would start a message are escaped with a >
+	escaped := &bytes.Buffer{}
+	for _, line := range bytes.SplitAfter(body, []byte("\n")) {
+		if bytes.HasPrefix(bytes.TrimLeft(line, ">"), []byte("From ")) {
+			escaped.WriteByte('>')
+		}
+		escaped.Write(line)
+	}
+	m.body = escaped.Bytes()
+	return m
+}
+
+// read returns the message of e
+func (l *lockedFile) read(e *entry) (*message, error) {
+	raw := make([]byte, e.end-e.offset)
+	if _, err := l.ReadAt(raw, e.offset); err != nil {
+		return nil, err
+	}
+	return parseMessage(raw), nil
+}
+
+// add appends encoded messages to the mbox
+func (l *lockedFile) add(messages ...[]byte) error {
+	info, err := l.Stat()
+	if err != nil {
+		return err
+	}
+	buf := &bytes.Buffer{}
+	if size := info.Size(); size > 0 {
+		// the messages before end with an empty line
+		last := make([]byte, 2)
+		if size == 1 {
+			last = last[1:]
+		}
+		if _, err := l.ReadAt(last, size-int64(len(last))); err != nil {
+			return err
+		}
+		if last[len(last)-1] != '\n' {
+			buf.WriteString("\n\n")
+		} else if len(last) == 2 && last[0] != '\n' {
+			buf.WriteString("\n")
+		}
+	}
+	for _, m := range messages {
+		buf.Write(m)
+		buf.WriteString("\n")
+	}
+	if _, err := l.WriteAt(buf.Bytes(), info.Size()); err != nil {
+		return err
+	}
+	return l.Sync()
+}
+
+// rewrite writes the changed and removed messages of idx. The mbox is
+// only rewritten from the first changed message on, after writing a
+// complete copy of the new mbox to path.rewrite, which openLocked
+// restores if the rewrite is interrupted.
+func (l *lockedFile) rewrite(idx *index) error {
+	if idx.uidValidity == 0 {
+		idx.uidValidity = uint32(time.Now().Unix())
+	}
+	base := fmt.Sprintf("%d %d", idx.uidValidity, idx.uidNext)
+
+	from := len(idx.entries)
+	for i, e := range idx.entries {
+		if e.changed || e.removed {
+			from = i
+			break
+		}
+	}
+	if idx.base != base {
+		from = 0
+	}
+	if from == len(idx.entries) {
+		return nil
+	}
+
+	offset := idx.entries[from].offset
+	tail := &bytes.Buffer{}
+	first := from == 0
+	for _, e := range idx.entries[from:] {
+		if e.removed {
+			continue
+		}
+		m, err := l.read(e)
+		if err != nil {
+			return err
+		}
+		if first {
+			tail.Write(m.encode(e, base))
+			first = false
+		} else {
+			tail.Write(m.encode(e, ""))
+		}
+		tail.WriteString("\n")
+	}
+
+	backup, err := os.OpenFile(l.path+".rewrite.tmp", os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(backup, io.NewSectionReader(l, 0, offset))
+	if err == nil {
+		_, err = backup.Write(tail.Bytes())
+	}
+	if err == nil {
+		err = backup.Sync()
+	}
+	if e := backup.Close(); err == nil {
+		err = e
+	}
+	if err == nil {
+		err = os.Rename(l.path+".rewrite.tmp", l.path+".rewrite")
+	}
+	if err != nil {
+		os.Remove(l.path + ".rewrite.tmp")
+		return err
+	}
+
+	if _, err := l.WriteAt(tail.Bytes(), offset); err != nil {
+		return err
+	}
+	if err := l.Truncate(offset + int64(tail.Len())); err != nil {
+		return err
+	}
+	if err := l.Sync(); err != nil {
+		return err
+	}
+	return os.Remove(l.path + ".rewrite")
+}
+
+// recover restores the mbox from the copy of an interrupted rewrite
+func (l *lockedFile) recover() error {
+	os.Remove(l.path + ".rewrite.tmp")
+	backup, err := os.Open(l.path + ".rewrite")
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	defer backup.Close()
+
+	if _, err := l.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	n, err := io.Copy(l.File, backup)
+	if err != nil {
+		return err
+	}
+	if err := l.Truncate(n); err != nil {
+		return err
+	}
+	if err := l.Sync(); err != nil {
+		return err
+	}
+	return os.Remove(l.path + ".rewrite")
+}
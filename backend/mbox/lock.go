@@ -0,0 +1,86 @@
+package mbox
+
+import (
+	"errors"
+	"io"
+	"os"
+	"strconv"
+	"time"
+)
+
+// lockTimeout is how long to wait for a dotlock,
+// dotlocks older than staleLock were left behind by a crashed process
+const (
+	lockTimeout = 30 * time.Second
+	staleLock   = 5 * time.Minute
+)
+
+var errLockTimeout = errors.New("Mbox: timeout waiting for lock")
+
+// lockedFile is an mbox opened for reading and writing, locked with
+// a dotlock and an fcntl lock like MDAs do before they deliver
+type lockedFile struct {
+	*os.File
+	path string
+}
+
+// openLocked opens and locks the mbox at path, creating it when create
+// is set. If a rewrite was interrupted, the file is restored first.
+func openLocked(path string, create bool) (*lockedFile, error) {
+	if err := dotlock(path); err != nil {
+		return nil, err
+	}
+	flag := os.O_RDWR
+	if create {
+		flag |= os.O_CREATE
+	}
+	f, err := os.OpenFile(path, flag, 0600)
+	if err != nil {
+		os.Remove(path + ".lock")
+		return nil, err
+	}
+	if err := fcntlLock(f); err != nil {
+		f.Close()
+		os.Remove(path + ".lock")
+		return nil, err
+	}
+	l := &lockedFile{File: f, path: path}
+	if err := l.recover(); err != nil {
+		l.Close()
+		return nil, err
+	}
+	return l, nil
+}
+
+// Close unlocks and closes the mbox
+func (l *lockedFile) Close() error {
+	err := l.File.Close() // releases the fcntl lock
+	if e := os.Remove(l.path + ".lock"); err == nil {
+		err = e
+	}
+	return err
+}
+
+// dotlock creates the lock file path.lock, waiting while another
+// process has it
+func dotlock(path string) error {
+	deadline := time.Now().Add(lockTimeout)
+	for {
+		f, err := os.OpenFile(path+".lock", os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+		if err == nil {
+			io.WriteString(f, strconv.Itoa(os.Getpid())+"\n")
+			return f.Close()
+		}
+		if !os.IsExist(err) {
+			return err
+		}
+		if info, err := os.Stat(path + ".lock"); err == nil && time.Since(info.ModTime()) > staleLock {
+			os.Remove(path + ".lock")
+			continue
+		}
+		if time.Now().After(deadline) {
+			return errLockTimeout
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
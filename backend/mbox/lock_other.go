@@ -0,0 +1,14 @@
+//go:build !aix && !darwin && !dragonfly && !freebsd && !linux && !netbsd && !openbsd && !solaris
+// +build !aix,!darwin,!dragonfly,!freebsd,!linux,!netbsd,!openbsd,!solaris
+
+package mbox
+
+import (
+	"os"
+)
+
+// fcntlLock does nothing on systems without fcntl locks,
+// the dotlock is the only lock there
+func fcntlLock(f *os.File) error {
+	return nil
+}
@@ -0,0 +1,21 @@
+//go:build aix || darwin || dragonfly || freebsd || linux || netbsd || openbsd || solaris
+// +build aix darwin dragonfly freebsd linux netbsd openbsd solaris
+
+package mbox
+
+import (
+	"io"
+	"os"
+	"syscall"
+)
+
+// fcntlLock waits for a write lock on the whole file f
+func fcntlLock(f *os.File) error {
+	lock := syscall.Flock_t{Type: syscall.F_WRLCK, Whence: io.SeekStart}
+	for {
+		err := syscall.FcntlFlock(f.Fd(), syscall.F_SETLKW, &lock)
+		if err != syscall.EINTR {
+			return err
+		}
+	}
+}
@@ -0,0 +1,362 @@
+package mbox
+
+import (
+	"fmt"
+	"github.com/gopistolet/imap/backend"
+	"github.com/gopistolet/imap/parser"
+	"os"
+	"time"
+)
+
+// Flags which can be stored, any keyword can be stored as well
+var (
+	flags          = []string{`\Answered`, `\Flagged`, `\Deleted`, `\Seen`, `\Draft`}
+	permanentFlags = append(append([]string{}, flags...), `\*`)
+)
+
+// handle implements backend.Mailbox, it is the view of a mailbox
+// of a single session
+type handle struct {
+	backend *Backend
+	user    *user
+	name    string
+	path    string
+
+	selected bool
+	readOnly bool
+	recent   map[uint32]bool // UIDs of the messages which are \Recent for this session
+}
+
+func (h *handle) Name() string {
+	return h.name
+}
+
+func (h *handle) Select(readOnly bool) error {
+	h.backend.mu.Lock()
+	defer h.backend.mu.Unlock()
+
+	h.selected = true
+	h.readOnly = readOnly
+	h.recent = map[uint32]bool{}
+	l, _, err := h.open()
+	if err != nil {
+		return err
+	}
+	return l.Close()
+}
+
+// open locks the mbox and returns its index. Messages without UID get
+// one, and unless the mailbox is examined, this session takes over the
+// \Recent flag of the messages. The caller holds the lock of the
+// backend, and closes the file.
+func (h *handle) open() (*lockedFile, *index, error) {
+	l, err := openLocked(h.path, false)
+	if os.IsNotExist(err) {
+		return nil, nil, backend.ErrNoSuchMailbox
+	} else if err != nil {
+		return nil, nil, err
+	}
+	idx, err := h.backend.index(l)
+	if err != nil {
+		l.Close()
+		return nil, nil, err
+	}
+
+	// the UIDVALIDITY of a new mbox is stored with its first message
+	changed := idx.uidValidity == 0 && len(idx.entries) > 0
+	for _, e := range idx.entries {
+		if e.uid == 0 {
+			e.uid = idx.uidNext
+			idx.uidNext++
+			e.changed, changed = true, true
+		}
+		if e.recent && h.selected && !h.readOnly {
+			e.recent = false
+			e.changed, changed = true, true
+			h.recent[e.uid] = true
+		}
+	}
+	if changed {
+		if idx, err = h.commit(l, idx); err != nil {
+			l.Close()
+			return nil, nil, err
+		}
+	}
+	return l, idx, nil
+}
+
+// commit rewrites the mbox with the changes in idx,
+// and returns the new index
+func (h *handle) commit(l *lockedFile, idx *index) (*index, error) {
+	err := l.rewrite(idx)
+	delete(h.backend.indexes, h.path)
+	if err != nil {
+		return nil, err
+	}
+	return h.backend.index(l)
+}
+
+func (h *handle) Status() (backend.MailboxStatus, error) {
+	h.backend.mu.Lock()
+	defer h.backend.mu.Unlock()
+
+	l, idx, err := h.open()
+	if err != nil {
+		return backend.MailboxStatus{}, err
+	}
+	defer l.Close()
+
+	uidValidity := idx.uidValidity
+	if uidValidity == 0 {
+		// an empty mbox doesn't have a first message to store it,
+		// the index keeps it while the mbox doesn't change
+		uidValidity = uint32(time.Now().Unix())
+		idx.uidValidity = uidValidity
+	}
+	status := backend.MailboxStatus{
+		Messages:       uint32(len(idx.entries)),
+		UidNext:        idx.uidNext,
+		UidValidity:    uidValidity,
+		Flags:          flags,
+		PermanentFlags: permanentFlags,
+	}
+	for i, message := range h.messages(idx) {
+		if message.HasFlag(`\Recent`) {
+			status.Recent++
+		}
+		if !message.HasFlag(`\Seen`) {
+			status.Unseen++
+			if status.FirstUnseen == 0 {
+				status.FirstUnseen = uint32(i + 1)
+			}
+		}
+	}
+	return status, nil
+}
+
+func (h *handle) Fetch(uid bool, set parser.SequenceSet, body bool) ([]backend.Message, error) {
+	h.backend.mu.Lock()
+	defer h.backend.mu.Unlock()
+
+	l, idx, err := h.open()
+	if err != nil {
+		return nil, err
+	}
+	defer l.Close()
+
+	messages := backend.Filter(h.messages(idx), uid, set)
+	if body {
+		for i := range messages {
+			m, err := l.read(idx.entries[messages[i].SeqNum-1])
+			if err != nil {
+				return nil, err
+			}
+			messages[i].Body = m.served()
+		}
+	}
+	return messages, nil
+}
+
+func (h *handle) Search(uid bool, keys []parser.SearchKey) ([]uint32, error) {
+	h.backend.mu.Lock()
+	defer h.backend.mu.Unlock()
+
+	l, idx, err := h.open()
+	if err != nil {
+		return nil, err
+	}
+	defer l.Close()
+
+	messages := h.messages(idx)
+	for i := range messages {
+		m, err := l.read(idx.entries[i])
+		if err != nil {
+			return nil, err
+		}
+		messages[i].Body = m.served()
+	}
+	return backend.Search(messages, uid, keys), nil
+}
+
+func (h *handle) Append(flags []string, date time.Time, body []byte) error {
+	h.backend.mu.Lock()
+	defer h.backend.mu.Unlock()
+
+	l, idx, err := h.open()
+	if err != nil {
+		return err
+	}
+	defer l.Close()
+	return h.add(l, idx, []*message{newMessage(body, date)}, [][]string{flags})
+}
+
+// add appends messages with their flags to the mbox l with index idx
+func (h *handle) add(l *lockedFile, idx *index, messages []*message, flags [][]string) error {
+	entries := []*entry{}
+	for i := range messages {
+		entries = append(entries, &entry{uid: idx.uidNext, flags: backend.ApplyFlags(nil, "", flags[i]), recent: true})
+		idx.uidNext++
+	}
+	base := ""
+	if len(idx.entries) == 0 {
+		// the first message of the mbox stores its UIDVALIDITY
+		if idx.uidValidity == 0 {
+			idx.uidValidity = uint32(time.Now().Unix())
+		}
+		base = fmt.Sprintf("%d %d", idx.uidValidity, idx.uidNext)
+	}
+	encoded := [][]byte{}
+	for i, m := range messages {
+		encoded = append(encoded, m.encode(entries[i], base))
+		base = ""
+	}
+	err := l.add(encoded...)
+	delete(h.backend.indexes, l.path)
+	if err == nil {
+		h.backend.bus.Publish(l.path, backend.Update{Type: backend.UpdateExists})
+	}
+	return err
+}
+
+func (h *handle) Store(uid bool, set parser.SequenceSet, mode string, flags []string) ([]backend.Message, error) {
+	h.backend.mu.Lock()
+	defer h.backend.mu.Unlock()
+
+	l, idx, err := h.open()
+	if err != nil {
+		return nil, err
+	}
+	defer l.Close()
+
+	changed := backend.Filter(h.messages(idx), uid, set)
+	for i := range changed {
+		e := idx.entries[changed[i].SeqNum-1]
+		e.flags = backend.ApplyFlags(e.flags, mode, flags)
+		e.changed = true
+		changed[i].Flags = h.flags(e)
+	}
+	if len(changed) > 0 {
+		if _, err := h.commit(l, idx); err != nil {
+			return nil, err
+		}
+	}
+	for _, message := range changed {
+		h.backend.bus.Publish(h.path, backend.Update{Type: backend.UpdateFlags, Uid: message.Uid})
+	}
+	return changed, nil
+}
+
+func (h *handle) Copy(uid bool, set parser.SequenceSet, dest string) error {
+	h.backend.mu.Lock()
+	defer h.backend.mu.Unlock()
+
+	target, err := h.user.path(dest)
+	if err != nil {
+		return err
+	}
+	if !isMbox(target) {
+		return backend.ErrNoSuchMailbox
+	}
+	l, idx, err := h.open()
+	if err != nil {
+		return err
+	}
+	defer l.Close()
+
+	messages, flags := []*message{}, [][]string{}
+	for _, message := range backend.Filter(h.messages(idx), uid, set) {
+		e := idx.entries[message.SeqNum-1]
+		m, err := l.read(e)
+		if err != nil {
+			return err
+		}
+		messages = append(messages, newMessage(m.served(), e.date))
+		flags = append(flags, e.flags)
+	}
+	if len(messages) == 0 {
+		return nil
+	}
+
+	if target == h.path {
+		return h.add(l, idx, messages, flags)
+	}
+	t := &handle{backend: h.backend, user: h.user, path: target}
+	tl, tidx, err := t.open()
+	if err != nil {
+		return err
+	}
+	defer tl.Close()
+	return t.add(tl, tidx, messages, flags)
+}
+
+func (h *handle) Expunge() ([]uint32, error) {
+	h.backend.mu.Lock()
+	defer h.backend.mu.Unlock()
+
+	l, idx, err := h.open()
+	if err != nil {
+		return nil, err
+	}
+	defer l.Close()
+
+	expunged, uids := []uint32{}, []uint32{}
+	kept := uint32(0)
+	for _, e := range idx.entries {
+		if !hasFlag(e.flags, `\Deleted`) {
+			kept++
+			continue
+		}
+		e.removed = true
+		expunged = append(expunged, kept+1)
+		uids = append(uids, e.uid)
+		delete(h.recent, e.uid)
+	}
+	if len(expunged) > 0 {
+		if _, err := h.commit(l, idx); err != nil {
+			return nil, err
+		}
+	}
+	for _, uid := range uids {
+		h.backend.bus.Publish(h.path, backend.Update{Type: backend.UpdateExpunge, Uid: uid})
+	}
+	return expunged, nil
+}
+
+func (h *handle) Watch() *backend.Subscription {
+	return h.backend.bus.Subscribe(h.path)
+}
+
+// messages returns the messages of idx as this session sees them,
+// without their body
+func (h *handle) messages(idx *index) []backend.Message {
+	messages := make([]backend.Message, len(idx.entries))
+	for i, e := range idx.entries {
+		messages[i] = backend.Message{
+			SeqNum:       uint32(i + 1),
+			Uid:          e.uid,
+			Flags:        h.flags(e),
+			InternalDate: e.date,
+			Size:         e.size,
+		}
+	}
+	return messages
+}
+
+// flags returns the flags of e, with \Recent when it is recent
+// for this session
+func (h *handle) flags(e *entry) []string {
+	flags := append([]string{}, e.flags...)
+	if h.recent[e.uid] || (e.recent && (!h.selected || h.readOnly)) {
+		flags = append(flags, `\Recent`)
+	}
+	return flags
+}
+
+func hasFlag(flags []string, flag string) bool {
+	for _, f := range flags {
+		if f == flag {
+			return true
+		}
+	}
+	return false
+}
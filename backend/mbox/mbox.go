@@ -0,0 +1,433 @@
+/*
+Package mbox implements a backend.Backend on mbox files.
+
+INBOX is the spool file of a user, its other mailboxes are mbox files
+in its mail directory, with directories for the levels of the
+hierarchy: "work/reports" is the file "work/reports" in that directory.
+
+The flags of a message are stored in its Status, X-Status and
+X-Keywords header fields, its UID in X-UID, and the UIDVALIDITY
+and next UID of the mbox in the X-IMAPbase field of the first message.
+These fields aren't part of the message served to clients.
+
+Every access locks the mbox with a dotlock and an fcntl lock, like
+MDAs do before they deliver, and indexes its messages by offset.
+Changes rewrite the mbox from the first changed message on.
+*/
+package mbox
+
+import (
+	"bufio"
+	"github.com/gopistolet/imap/backend"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Backend serves the mbox files of users
+type Backend struct {
+	// Authenticate checks the password of username and returns the
+	// path of its spool file, and of its mail directory, which is ""
+	// if the user only has INBOX. It returns
+	// backend.ErrInvalidCredentials for a wrong password.
+	Authenticate func(username, password string) (inbox, dir string, err error)
+
+	// mu serializes the access to the mboxes by this process,
+	// fcntl locks don't lock out goroutines of the same process
+	mu      sync.Mutex
+	indexes map[string]*index // by path
+	bus     backend.Bus       // by path
+}
+
+// New creates a Backend which authenticates users with authenticate
+func New(authenticate func(username, password string) (inbox, dir string, err error)) *Backend {
+	return &Backend{Authenticate: authenticate, indexes: map[string]*index{}}
+}
+
+func (b *Backend) Login(username, password string) (backend.User, error) {
+	inbox, dir, err := b.Authenticate(username, password)
+	if err != nil {
+		return nil, err
+	}
+	return &user{backend: b, username: username, inbox: inbox, dir: dir, subscribed: map[string]bool{}}, nil
+}
+
+// index returns the index of the mbox l, which is only read again
+// when the file changed. The caller holds mu.
+func (b *Backend) index(l *lockedFile) (*index, error) {
+	info, err := l.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if idx, ok := b.indexes[l.path]; ok && idx.size == info.Size() && idx.modTime.Equal(info.ModTime()) {
+		return idx, nil
+	}
+	idx, err := readIndex(l.File)
+	if err != nil {
+		return nil, err
+	}
+	b.indexes[l.path] = idx
+	return idx, nil
+}
+
+// evict drops the indexes of the mbox at path and of the mboxes
+// below it. The caller holds mu.
+func (b *Backend) evict(path string) {
+	for p := range b.indexes {
+		if p == path || strings.HasPrefix(p, path+string(filepath.Separator)) {
+			delete(b.indexes, p)
+		}
+	}
+}
+
+// user implements backend.User
+type user struct {
+	backend  *Backend
+	username string
+	inbox    string
+	dir      string
+
+	subscribed map[string]bool // without mail directory, the subscriptions are kept in memory
+}
+
+func (u *user) Username() string {
+	return u.username
+}
+
+func (u *user) ListMailboxes(subscribed bool) ([]backend.MailboxInfo, error) {
+	u.backend.mu.Lock()
+	defer u.backend.mu.Unlock()
+
+	// mailboxes are files, levels of the hierarchy are directories
+	files, dirs := map[string]bool{"INBOX": true}, map[string]bool{}
+	if u.dir != "" {
+		err := filepath.Walk(u.dir, func(path string, info os.FileInfo, err error) error {
+			if err != nil || path == u.dir {
+				return err
+			}
+			rel, _ := filepath.Rel(u.dir, path)
+			name := filepath.ToSlash(rel)
+			switch {
+			case !validName(name):
+				if info.IsDir() {
+					return filepath.SkipDir
+				}
+			case info.IsDir():
+				dirs[canonicalName(name)] = true
+			case info.Mode().IsRegular() && canonicalName(name) != "INBOX":
+				files[name] = true
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	names := map[string]bool{}
+	if subscribed {
+		var err error
+		if names, err = u.subscriptions(); err != nil {
+			return nil, err
+		}
+	} else {
+		for name := range files {
+			names[name] = true
+		}
+		for name := range dirs {
+			names[name] = true
+		}
+	}
+
+	sorted := []string{}
+	for name := range names {
+		sorted = append(sorted, name)
+	}
+	sort.Strings(sorted)
+
+	list := []backend.MailboxInfo{}
+	for _, name := range sorted {
+		attributes := []string{}
+		switch {
+		case files[name] && dirs[name]:
+			// INBOX with a directory of the same name
+			attributes = append(attributes, `\HasChildren`)
+		case files[name]:
+			attributes = append(attributes, `\NoInferiors`)
+		default:
+			// a level of the hierarchy, or subscribed but it doesn't exist
+			attributes = append(attributes, `\Noselect`)
+		}
+		list = append(list, backend.MailboxInfo{Name: name, Attributes: attributes})
+	}
+	return list, nil
+}
+
+func (u *user) GetMailbox(name string) (backend.Mailbox, error) {
+	u.backend.mu.Lock()
+	defer u.backend.mu.Unlock()
+
+	path, err := u.path(name)
+	if err != nil {
+		return nil, err
+	}
+	if !isMbox(path) {
+		return nil, backend.ErrNoSuchMailbox
+	}
+	return &handle{backend: u.backend, user: u, name: canonicalName(name), path: path}, nil
+}
+
+func (u *user) CreateMailbox(name string) error {
+	u.backend.mu.Lock()
+	defer u.backend.mu.Unlock()
+
+	path, err := u.path(name)
+	if err != nil {
+		return err
+	}
+	if _, err := os.Lstat(path); err == nil {
+		return backend.ErrMailboxAlreadyExists
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		// a level above is an mbox, which can't have children
+		return backend.ErrInvalidMailboxName
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+// DeleteMailbox removes an mbox, or a level of the hierarchy
+// without mailboxes below it
+func (u *user) DeleteMailbox(name string) error {
+	u.backend.mu.Lock()
+	defer u.backend.mu.Unlock()
+
+	path, err := u.path(name)
+	if err != nil {
+		return err
+	}
+	if path == u.inbox {
+		return backend.ErrNoSuchMailbox
+	}
+	info, err := os.Lstat(path)
+	if err != nil {
+		return backend.ErrNoSuchMailbox
+	}
+	if info.IsDir() {
+		if err := os.Remove(path); err != nil {
+			return backend.ErrNoSuchMailbox
+		}
+		return nil
+	}
+
+	l, err := openLocked(path, false)
+	if err != nil {
+		return err
+	}
+	defer l.Close()
+	delete(u.backend.indexes, path)
+	return os.Remove(path)
+}
+
+// RenameMailbox renames an mbox or a level of the hierarchy with the
+// mailboxes below it. Renaming INBOX moves its messages to a new mbox.
+func (u *user) RenameMailbox(existingName, newName string) error {
+	u.backend.mu.Lock()
+	defer u.backend.mu.Unlock()
+
+	from, err := u.path(existingName)
+	if err != nil {
+		return err
+	}
+	to, err := u.path(newName)
+	if err != nil {
+		return err
+	}
+	if _, err := os.Lstat(from); err != nil {
+		return backend.ErrNoSuchMailbox
+	}
+	if _, err := os.Lstat(to); err == nil || to == u.inbox {
+		return backend.ErrMailboxAlreadyExists
+	}
+	if err := os.MkdirAll(filepath.Dir(to), 0700); err != nil {
+		return backend.ErrInvalidMailboxName
+	}
+	u.backend.evict(from)
+	u.backend.evict(to)
+
+	if from != u.inbox {
+		return os.Rename(from, to)
+	}
+
+	l, err := openLocked(from, false)
+	if err != nil {
+		return err
+	}
+	defer l.Close()
+	if err := copyLocked(l, to); err != nil {
+		return err
+	}
+	if err := l.Truncate(0); err != nil {
+		return err
+	}
+	return l.Sync()
+}
+
+// copyLocked copies the mbox l to the new mbox at path. The copy is
+// written to a temporary file under the dotlock of path, and only
+// renamed into place once it is synced, so path is never partial.
+func copyLocked(l *lockedFile, path string) error {
+	if err := dotlock(path); err != nil {
+		return err
+	}
+	defer os.Remove(path + ".lock")
+	if _, err := os.Lstat(path); err == nil {
+		// delivered to while waiting for the lock
+		return backend.ErrMailboxAlreadyExists
+	}
+
+	tmp := path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err = l.Seek(0, io.SeekStart); err == nil {
+		_, err = io.Copy(f, l)
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	if e := f.Close(); err == nil {
+		err = e
+	}
+	if err == nil {
+		err = os.Rename(tmp, path)
+	}
+	if err != nil {
+		os.Remove(tmp)
+	}
+	return err
+}
+
+func (u *user) SetSubscribed(name string, subscribed bool) error {
+	u.backend.mu.Lock()
+	defer u.backend.mu.Unlock()
+
+	path, err := u.path(name)
+	if err != nil {
+		return err
+	}
+	if subscribed && !isMbox(path) {
+		return backend.ErrNoSuchMailbox
+	}
+	names, err := u.subscriptions()
+	if err != nil {
+		return err
+	}
+	if subscribed {
+		names[canonicalName(name)] = true
+	} else {
+		delete(names, canonicalName(name))
+	}
+	if u.dir == "" {
+		u.subscribed = names
+		return nil
+	}
+
+	sorted := []string{}
+	for name := range names {
+		sorted = append(sorted, name)
+	}
+	sort.Strings(sorted)
+	content := ""
+	for _, name := range sorted {
+		content += name + "\n"
+	}
+	tmp := filepath.Join(u.dir, ".subscriptions.tmp")
+	if err := os.WriteFile(tmp, []byte(content), 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, filepath.Join(u.dir, ".subscriptions"))
+}
+
+func (u *user) Logout() error {
+	return nil
+}
+
+// subscriptions returns the subscribed names, which are kept in the
+// .subscriptions file of the mail directory
+func (u *user) subscriptions() (map[string]bool, error) {
+	names := map[string]bool{}
+	if u.dir == "" {
+		for name := range u.subscribed {
+			names[name] = true
+		}
+		return names, nil
+	}
+	f, err := os.Open(filepath.Join(u.dir, ".subscriptions"))
+	if os.IsNotExist(err) {
+		return names, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	lines := bufio.NewScanner(f)
+	for lines.Scan() {
+		if name := strings.TrimSpace(lines.Text()); name != "" {
+			names[name] = true
+		}
+	}
+	return names, lines.Err()
+}
+
+// path returns the file of the mailbox name,
+// or backend.ErrInvalidMailboxName if it can't be stored
+func (u *user) path(name string) (string, error) {
+	name = canonicalName(name)
+	if name == "INBOX" {
+		return u.inbox, nil
+	}
+	if u.dir == "" || !validName(name) {
+		return "", backend.ErrInvalidMailboxName
+	}
+	return filepath.Join(u.dir, filepath.FromSlash(name)), nil
+}
+
+// validName reports whether name can be stored in the mail directory.
+// Levels which could escape it, or which are used for the files of the
+// backend itself, aren't valid.
+func validName(name string) bool {
+	for _, level := range strings.Split(name, backend.Delimiter) {
+		if level == "" || strings.HasPrefix(level, ".") || strings.ContainsRune(level, '\\') ||
+			strings.HasSuffix(level, ".lock") || strings.HasSuffix(level, ".rewrite") || strings.HasSuffix(level, ".tmp") {
+			return false
+		}
+		for _, r := range level {
+			if r < ' ' || r == 0x7f {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// canonicalName returns name, with INBOX in upper case
+// since it is case-insensitive
+func canonicalName(name string) string {
+	if strings.EqualFold(name, "INBOX") {
+		return "INBOX"
+	}
+	return name
+}
+
+// isMbox reports whether path is an mbox file
+func isMbox(path string) bool {
+	info, err := os.Stat(path)
+	return err == nil && info.Mode().IsRegular()
+}
@@ -0,0 +1,263 @@
+package mbox
+
+import (
+	"fmt"
+	"github.com/gopistolet/imap/backend"
+	"github.com/gopistolet/imap/parser"
+	. "github.com/smartystreets/goconvey/convey"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMbox(t *testing.T) {
+
+	root := t.TempDir()
+	inbox := filepath.Join(root, "spool", "mrc")
+	dir := filepath.Join(root, "mail")
+	os.MkdirAll(filepath.Dir(inbox), 0700)
+	os.MkdirAll(dir, 0700)
+	b := New(func(username, password string) (string, string, error) {
+		if username != "mrc" || password != "secret" {
+			return "", "", backend.ErrInvalidCredentials
+		}
+		return inbox, dir, nil
+	})
+	read := func(path string) string {
+		content, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(content)
+	}
+	all := parser.SequenceSet{{Start: 1, Stop: 0}}
+
+	Convey("Testing mailbox names", t, func() {
+
+		u := &user{inbox: inbox, dir: dir}
+		for name, path := range map[string]string{
+			"INBOX":        inbox,
+			"inbox":        inbox,
+			"work/reports": filepath.Join(dir, "work", "reports"),
+			"Sent Items":   filepath.Join(dir, "Sent Items"),
+			"v1.2":         filepath.Join(dir, "v1.2"),
+			"":             "",
+			"..":           "",
+			"../../etc":    "",
+			"/etc/passwd":  "",
+			"work/":        "",
+			".subscribed":  "",
+			"Sent.lock":    "",
+			"work/../..":   "",
+			`..\..\etc`:    "",
+			"new\nline":    "",
+		} {
+			p, err := u.path(name)
+			if path == "" {
+				So(err, ShouldEqual, backend.ErrInvalidMailboxName)
+			} else {
+				So(err, ShouldEqual, nil)
+				So(p, ShouldEqual, path)
+			}
+		}
+
+		_, err := (&user{inbox: inbox}).path("Sent")
+		So(err, ShouldEqual, backend.ErrInvalidMailboxName)
+	})
+
+	Convey("Testing mailboxes", t, func() {
+
+		_, err := b.Login("mrc", "wrong")
+		So(err, ShouldEqual, backend.ErrInvalidCredentials)
+		u, err := b.Login("mrc", "secret")
+		So(err, ShouldEqual, nil)
+
+		So(u.CreateMailbox("work/reports"), ShouldEqual, nil)
+		So(u.CreateMailbox("work/reports"), ShouldEqual, backend.ErrMailboxAlreadyExists)
+		So(u.CreateMailbox("work/reports/2016"), ShouldEqual, backend.ErrInvalidMailboxName)
+		So(u.CreateMailbox("Sent"), ShouldEqual, nil)
+		So(u.SetSubscribed("Sent", true), ShouldEqual, nil)
+		So(u.SetSubscribed("Drafts", true), ShouldEqual, backend.ErrNoSuchMailbox)
+
+		list, err := u.ListMailboxes(false)
+		So(err, ShouldEqual, nil)
+		So(list, ShouldResemble, []backend.MailboxInfo{
+			{Name: "INBOX", Attributes: []string{`\NoInferiors`}},
+			{Name: "Sent", Attributes: []string{`\NoInferiors`}},
+			{Name: "work", Attributes: []string{`\Noselect`}},
+			{Name: "work/reports", Attributes: []string{`\NoInferiors`}},
+		})
+
+		So(u.RenameMailbox("work", "archive"), ShouldEqual, nil)
+		So(u.RenameMailbox("archive/reports", "Sent"), ShouldEqual, backend.ErrMailboxAlreadyExists)
+		So(u.DeleteMailbox("archive"), ShouldEqual, backend.ErrNoSuchMailbox)
+		So(u.DeleteMailbox("archive/reports"), ShouldEqual, nil)
+		So(u.DeleteMailbox("archive"), ShouldEqual, nil)
+		So(u.DeleteMailbox("Sent"), ShouldEqual, nil)
+
+		list, _ = u.ListMailboxes(false)
+		So(list, ShouldResemble, []backend.MailboxInfo{{Name: "INBOX", Attributes: []string{`\NoInferiors`}}})
+		list, _ = u.ListMailboxes(true)
+		So(list, ShouldResemble, []backend.MailboxInfo{{Name: "Sent", Attributes: []string{`\Noselect`}}})
+	})
+
+	Convey("Testing messages", t, func() {
+
+		// delivered by an MDA
+		So(os.WriteFile(inbox, []byte("From alice@example.com Sun Jul 17 09:24:25 2016\n"+
+			"Subject: first\n"+
+			"Status: RO\n"+
+			"\n"+
+			"Hello\n"+
+			">From the start\n"+
+			"From here on\n"+
+			"\n"+
+			"From bob@example.com Mon Jul 18 10:00:00 2016\n"+
+			"Subject: second\n"+
+			"\n"+
+			"Hi\n"+
+			"\n"), 0600), ShouldEqual, nil)
+
+		u, _ := b.Login("mrc", "secret")
+		other, err := u.GetMailbox("INBOX")
+		So(err, ShouldEqual, nil)
+		status, err := other.Status()
+		So(err, ShouldEqual, nil)
+		So(status.Messages, ShouldEqual, 2)
+		So(status.Recent, ShouldEqual, 1)
+		So(status.Unseen, ShouldEqual, 1)
+		So(status.FirstUnseen, ShouldEqual, 2)
+		So(status.UidNext, ShouldEqual, 3)
+		So(read(inbox), ShouldContainSubstring, "Subject: first\nX-IMAPbase: "+fmt.Sprint(status.UidValidity)+" 3\nX-UID: 1\nStatus: RO\n\nHello\n")
+
+		selected, _ := u.GetMailbox("INBOX")
+		So(selected.Select(false), ShouldEqual, nil)
+		So(read(inbox), ShouldEndWith, "Subject: second\nX-UID: 2\nStatus: O\n\nHi\n\n")
+
+		messages, err := selected.Fetch(false, all, true)
+		So(err, ShouldEqual, nil)
+		So(len(messages), ShouldEqual, 2)
+		So(string(messages[0].Body), ShouldEqual, "Subject: first\r\n\r\nHello\r\nFrom the start\r\nFrom here on\r\n")
+		So(messages[0].Size, ShouldEqual, len(messages[0].Body))
+		So(messages[0].Flags, ShouldResemble, []string{`\Seen`})
+		So(messages[0].InternalDate.Equal(time.Date(2016, 7, 17, 9, 24, 25, 0, time.UTC)), ShouldBeTrue)
+		So(messages[1].Flags, ShouldResemble, []string{`\Recent`})
+		status, _ = other.Status()
+		So(status.Recent, ShouldEqual, 0)
+
+		updates := other.(backend.WatchedMailbox).Watch()
+		defer updates.Close()
+		changed, err := selected.Store(false, parser.SequenceSet{{Start: 1, Stop: 1}}, "+", []string{`\flagged`, `\Answered`, "$Junk"})
+		So(err, ShouldEqual, nil)
+		So(updates.Updates(), ShouldResemble, []backend.Update{{Type: backend.UpdateFlags, Uid: 1}})
+		So(changed[0].Flags, ShouldResemble, []string{`\Seen`, `\Flagged`, `\Answered`, "$Junk"})
+		So(read(inbox), ShouldContainSubstring, "X-UID: 1\nStatus: RO\nX-Status: AF\nX-Keywords: $Junk\n\nHello\n>From the start\n")
+
+		// delivered by the MDA while the mailbox is selected
+		f, _ := os.OpenFile(inbox, os.O_WRONLY|os.O_APPEND, 0600)
+		f.WriteString("From carol@example.com Tue Jul 19 08:00:00 2016\nSubject: third\n\nHey\n\n")
+		f.Close()
+		So(selected.Append([]string{`\Draft`}, time.Date(2016, 7, 20, 12, 0, 0, 0, time.UTC), []byte("Subject: fourth\r\n\r\nFrom me\r\n")), ShouldEqual, nil)
+
+		messages, _ = other.Fetch(true, parser.SequenceSet{{Start: 3, Stop: 0}}, true)
+		So(len(messages), ShouldEqual, 2)
+		So(messages[0].Uid, ShouldEqual, 3)
+		So(messages[1].Uid, ShouldEqual, 4)
+		So(messages[1].Flags, ShouldResemble, []string{`\Draft`, `\Recent`})
+		So(string(messages[1].Body), ShouldEqual, "Subject: fourth\r\n\r\nFrom me\r\n")
+		So(read(inbox), ShouldContainSubstring, "\n\n>From me\n")
+		So(updates.Updates(), ShouldResemble, []backend.Update{{Type: backend.UpdateExists}})
+		results, _ := selected.Search(true, []parser.SearchKey{{Name: "RECENT"}})
+		So(results, ShouldResemble, []uint32{2, 3, 4})
+
+		So(u.CreateMailbox("Saved"), ShouldEqual, nil)
+		So(selected.Copy(false, all, "Missing"), ShouldEqual, backend.ErrNoSuchMailbox)
+		So(selected.Copy(false, parser.SequenceSet{{Start: 1, Stop: 2}}, "Saved"), ShouldEqual, nil)
+		saved, _ := u.GetMailbox("Saved")
+		messages, _ = saved.Fetch(false, all, true)
+		So(len(messages), ShouldEqual, 2)
+		So(messages[0].Flags, ShouldResemble, []string{`\Answered`, `\Flagged`, `\Seen`, "$Junk", `\Recent`})
+		So(string(messages[0].Body), ShouldEqual, "Subject: first\r\n\r\nHello\r\nFrom the start\r\nFrom here on\r\n")
+
+		selected.Store(false, parser.SequenceSet{{Start: 1, Stop: 1}, {Start: 4, Stop: 4}}, "+", []string{`\Deleted`})
+		expunged, err := selected.Expunge()
+		So(err, ShouldEqual, nil)
+		So(expunged, ShouldResemble, []uint32{1, 3})
+		So(updates.Updates(), ShouldResemble, []backend.Update{
+			{Type: backend.UpdateFlags, Uid: 1}, {Type: backend.UpdateFlags, Uid: 4},
+			{Type: backend.UpdateExpunge, Uid: 1}, {Type: backend.UpdateExpunge, Uid: 4},
+		})
+		So(strings.Count(read(inbox), "\nFrom "), ShouldEqual, 1)
+		So(read(inbox), ShouldStartWith, "From bob@example.com Mon Jul 18 10:00:00 2016\nSubject: second\nX-IMAPbase: ")
+
+		messages, _ = other.Fetch(false, all, false)
+		So(len(messages), ShouldEqual, 2)
+		So(messages[0].Uid, ShouldEqual, 2)
+		So(messages[1].Uid, ShouldEqual, 3)
+		later, _ := other.Status()
+		So(later.UidNext, ShouldEqual, 5)
+		So(later.UidValidity, ShouldEqual, status.UidValidity)
+		_, err = os.Stat(inbox + ".rewrite")
+		So(os.IsNotExist(err), ShouldBeTrue)
+	})
+
+	Convey("Testing locking", t, func() {
+
+		u, _ := b.Login("mrc", "secret")
+		mailbox, _ := u.GetMailbox("INBOX")
+
+		// an MDA holds the dotlock
+		So(os.WriteFile(inbox+".lock", []byte("1\n"), 0644), ShouldEqual, nil)
+		go func() {
+			time.Sleep(100 * time.Millisecond)
+			os.Remove(inbox + ".lock")
+		}()
+		start := time.Now()
+		_, err := mailbox.Status()
+		So(err, ShouldEqual, nil)
+		So(time.Since(start), ShouldBeGreaterThan, 90*time.Millisecond)
+		_, err = os.Stat(inbox + ".lock")
+		So(os.IsNotExist(err), ShouldBeTrue)
+
+		// left behind by a crashed process
+		So(os.WriteFile(inbox+".lock", []byte("1\n"), 0644), ShouldEqual, nil)
+		old := time.Now().Add(-time.Hour)
+		os.Chtimes(inbox+".lock", old, old)
+		_, err = mailbox.Status()
+		So(err, ShouldEqual, nil)
+
+		// an interrupted rewrite is finished from its copy
+		content := read(inbox)
+		So(os.WriteFile(inbox+".rewrite", []byte(content), 0600), ShouldEqual, nil)
+		So(os.WriteFile(inbox, []byte(content[:10]), 0600), ShouldEqual, nil)
+		status, err := mailbox.Status()
+		So(err, ShouldEqual, nil)
+		So(status.Messages, ShouldEqual, 2)
+		So(read(inbox), ShouldEqual, content)
+
+		// renaming INBOX moves its messages, through a temporary file
+		// under the lock of the new mbox
+		b.indexes[filepath.Join(dir, "Sent")] = &index{}
+		So(u.RenameMailbox("INBOX", "Old"), ShouldEqual, nil)
+		So(read(inbox), ShouldEqual, "")
+		So(read(filepath.Join(dir, "Old")), ShouldEqual, content)
+		for _, leftover := range []string{"Old.tmp", "Old.lock"} {
+			_, err = os.Stat(filepath.Join(dir, leftover))
+			So(os.IsNotExist(err), ShouldBeTrue)
+		}
+		So(b.indexes, ShouldContainKey, filepath.Join(dir, "Sent"))
+		So(b.indexes, ShouldNotContainKey, inbox)
+
+		// the new mbox is locked while it is written
+		So(os.WriteFile(filepath.Join(dir, "Newer.lock"), []byte("1\n"), 0644), ShouldEqual, nil)
+		go func() {
+			time.Sleep(100 * time.Millisecond)
+			os.Remove(filepath.Join(dir, "Newer.lock"))
+		}()
+		start = time.Now()
+		So(u.RenameMailbox("INBOX", "Newer"), ShouldEqual, nil)
+		So(time.Since(start), ShouldBeGreaterThan, 90*time.Millisecond)
+	})
+}
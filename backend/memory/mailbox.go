@@ -0,0 +1,279 @@
+package memory
+
+import (
+	"github.com/gopistolet/imap/backend"
+	"github.com/gopistolet/imap/parser"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Flags which clients can set, any keyword can be set as well
+var (
+	systemFlags    = []string{`\Answered`, `\Flagged`, `\Deleted`, `\Seen`, `\Draft`}
+	permanentFlags = append(append([]string{}, systemFlags...), `\*`)
+)
+
+type mailbox struct {
+	name        string
+	uidValidity uint32
+	uidNext     uint32
+	messages    []*message
+
+	noSelect bool // only a level of the hierarchy, without messages
+	deleted  bool // removed, handles to it fail
+}
+
+// key names the mailbox on the Bus of the backend,
+// UIDVALIDITY is unique and survives a rename
+func (m *mailbox) key() string {
+	return strconv.FormatUint(uint64(m.uidValidity), 10)
+}
+
+type message struct {
+	uid    uint32
+	flags  []string // without \Recent
+	date   time.Time
+	body   []byte
+	recent bool // \Recent, and not taken over by a session yet
+}
+
+// add appends a message which is \Recent
+func (m *mailbox) add(flags []string, date time.Time, body []byte) {
+	stored := []string{}
+	for _, flag := range flags {
+		if !strings.EqualFold(flag, `\Recent`) {
+			stored = append(stored, backend.CanonicalFlag(flag))
+		}
+	}
+	m.messages = append(m.messages, &message{uid: m.uidNext, flags: stored, date: date, body: body, recent: true})
+	m.uidNext++
+}
+
+// removeAll removes all messages, and publishes their removal
+// on bus. The caller holds the lock.
+func (m *mailbox) removeAll(bus *backend.Bus) {
+	for _, message := range m.messages {
+		bus.Publish(m.key(), backend.Update{Type: backend.UpdateExpunge, Uid: message.uid})
+	}
+	m.messages = nil
+}
+
+// handle implements backend.Mailbox, it is the view of a mailbox
+// of a single session
+type handle struct {
+	backend *Backend
+	user    *user
+	mailbox *mailbox
+
+	selected bool
+	readOnly bool
+	recent   map[uint32]bool // UIDs of the messages which are \Recent for this session
+}
+
+func (h *handle) Name() string {
+	h.backend.mu.Lock()
+	defer h.backend.mu.Unlock()
+	return h.mailbox.name
+}
+
+func (h *handle) Select(readOnly bool) error {
+	h.backend.mu.Lock()
+	defer h.backend.mu.Unlock()
+
+	if h.mailbox.deleted {
+		return backend.ErrNoSuchMailbox
+	}
+	h.selected = true
+	h.readOnly = readOnly
+	h.recent = map[uint32]bool{}
+	h.takeRecent()
+	return nil
+}
+
+// takeRecent takes over the \Recent flag of the messages which arrived
+// since the last call, the caller holds the lock
+func (h *handle) takeRecent() {
+	if !h.selected || h.readOnly {
+		return
+	}
+	for _, m := range h.mailbox.messages {
+		if m.recent {
+			m.recent = false
+			h.recent[m.uid] = true
+		}
+	}
+}
+
+func (h *handle) Status() (backend.MailboxStatus, error) {
+	h.backend.mu.Lock()
+	defer h.backend.mu.Unlock()
+
+	if h.mailbox.deleted {
+		return backend.MailboxStatus{}, backend.ErrNoSuchMailbox
+	}
+	h.takeRecent()
+
+	status := backend.MailboxStatus{
+		Messages:       uint32(len(h.mailbox.messages)),
+		UidNext:        h.mailbox.uidNext,
+		UidValidity:    h.mailbox.uidValidity,
+		Flags:          systemFlags,
+		PermanentFlags: permanentFlags,
+	}
+	for _, message := range h.messages(false) {
+		if message.HasFlag(`\Recent`) {
+			status.Recent++
+		}
+		if !message.HasFlag(`\Seen`) {
+			status.Unseen++
+			if status.FirstUnseen == 0 {
+				status.FirstUnseen = message.SeqNum
+			}
+		}
+	}
+	return status, nil
+}
+
+func (h *handle) Fetch(uid bool, set parser.SequenceSet, body bool) ([]backend.Message, error) {
+	h.backend.mu.Lock()
+	defer h.backend.mu.Unlock()
+
+	if h.mailbox.deleted {
+		return nil, backend.ErrNoSuchMailbox
+	}
+	h.takeRecent()
+	return backend.Filter(h.messages(body), uid, set), nil
+}
+
+func (h *handle) Search(uid bool, keys []parser.SearchKey) ([]uint32, error) {
+	h.backend.mu.Lock()
+	defer h.backend.mu.Unlock()
+
+	if h.mailbox.deleted {
+		return nil, backend.ErrNoSuchMailbox
+	}
+	h.takeRecent()
+	return backend.Search(h.messages(true), uid, keys), nil
+}
+
+func (h *handle) Append(flags []string, date time.Time, body []byte) error {
+	h.backend.mu.Lock()
+	defer h.backend.mu.Unlock()
+
+	if h.mailbox.deleted {
+		return backend.ErrNoSuchMailbox
+	}
+	h.mailbox.add(flags, date, body)
+	h.backend.bus.Publish(h.mailbox.key(), backend.Update{Type: backend.UpdateExists})
+	return nil
+}
+
+func (h *handle) Store(uid bool, set parser.SequenceSet, mode string, flags []string) ([]backend.Message, error) {
+	h.backend.mu.Lock()
+	defer h.backend.mu.Unlock()
+
+	if h.mailbox.deleted {
+		return nil, backend.ErrNoSuchMailbox
+	}
+	h.takeRecent()
+
+	changed := backend.Filter(h.messages(false), uid, set)
+	for i := range changed {
+		m := h.mailbox.messages[changed[i].SeqNum-1]
+		m.flags = backend.ApplyFlags(m.flags, mode, flags)
+		changed[i].Flags = h.flags(m)
+		h.backend.bus.Publish(h.mailbox.key(), backend.Update{Type: backend.UpdateFlags, Uid: m.uid})
+	}
+	return changed, nil
+}
+
+func (h *handle) Copy(uid bool, set parser.SequenceSet, dest string) error {
+	h.backend.mu.Lock()
+	defer h.backend.mu.Unlock()
+
+	if h.mailbox.deleted {
+		return backend.ErrNoSuchMailbox
+	}
+	target, err := h.user.mailbox(dest)
+	if err != nil {
+		return err
+	}
+
+	copied := backend.Filter(h.messages(false), uid, set)
+	for _, message := range copied {
+		m := h.mailbox.messages[message.SeqNum-1]
+		target.add(m.flags, m.date, m.body)
+	}
+	if len(copied) > 0 {
+		h.backend.bus.Publish(target.key(), backend.Update{Type: backend.UpdateExists})
+	}
+	return nil
+}
+
+func (h *handle) Expunge() ([]uint32, error) {
+	h.backend.mu.Lock()
+	defer h.backend.mu.Unlock()
+
+	if h.mailbox.deleted {
+		return nil, backend.ErrNoSuchMailbox
+	}
+
+	expunged := []uint32{}
+	kept := []*message{}
+	for _, m := range h.mailbox.messages {
+		if hasFlag(m.flags, `\Deleted`) {
+			expunged = append(expunged, uint32(len(kept)+1))
+			delete(h.recent, m.uid)
+			h.backend.bus.Publish(h.mailbox.key(), backend.Update{Type: backend.UpdateExpunge, Uid: m.uid})
+			continue
+		}
+		kept = append(kept, m)
+	}
+	h.mailbox.messages = kept
+	return expunged, nil
+}
+
+func (h *handle) Watch() *backend.Subscription {
+	h.backend.mu.Lock()
+	defer h.backend.mu.Unlock()
+	return h.backend.bus.Subscribe(h.mailbox.key())
+}
+
+// messages returns the messages of the mailbox as this session sees
+// them, the caller holds the lock
+func (h *handle) messages(body bool) []backend.Message {
+	messages := make([]backend.Message, len(h.mailbox.messages))
+	for i, m := range h.mailbox.messages {
+		messages[i] = backend.Message{
+			SeqNum:       uint32(i + 1),
+			Uid:          m.uid,
+			Flags:        h.flags(m),
+			InternalDate: m.date,
+			Size:         uint32(len(m.body)),
+		}
+		if body {
+			messages[i].Body = m.body
+		}
+	}
+	return messages
+}
+
+// flags returns the flags of m, with \Recent when it is recent
+// for this session
+func (h *handle) flags(m *message) []string {
+	flags := append([]string{}, m.flags...)
+	if h.recent[m.uid] || (m.recent && (!h.selected || h.readOnly)) {
+		flags = append(flags, `\Recent`)
+	}
+	return flags
+}
+
+func hasFlag(flags []string, flag string) bool {
+	for _, f := range flags {
+		if strings.EqualFold(f, flag) {
+			return true
+		}
+	}
+	return false
+}
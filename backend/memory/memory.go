@@ -0,0 +1,356 @@
+/*
+Package memory implements a backend.Backend which keeps everything in
+memory. It is meant for tests and demo servers:
+
+	b := memory.New()
+	b.AddUser("mrc", "secret")
+	s := server.NewServer(b)
+
+All users and mailboxes of a Backend share a single lock, so it can be
+used by any number of connections at once.
+*/
+package memory
+
+import (
+	"crypto/rand"
+	"github.com/gopistolet/imap/backend"
+	"github.com/gopistolet/imap/sasl"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Backend holds users with their mailboxes
+type Backend struct {
+	mu          sync.Mutex
+	users       map[string]*user
+	uidValidity uint32 // UIDVALIDITY of the last created mailbox
+	bus         backend.Bus
+}
+
+// New creates a Backend without users
+func New() *Backend {
+	return &Backend{
+		users:       map[string]*user{},
+		uidValidity: uint32(time.Now().Unix()),
+	}
+}
+
+// AddUser adds a user with an empty INBOX,
+// or changes the password of an existing user
+func (b *Backend) AddUser(username, password string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	salt := make([]byte, 16)
+	rand.Read(salt)
+	if u, ok := b.users[username]; ok {
+		u.password = password
+		u.salt = salt
+		return
+	}
+	u := &user{
+		backend:    b,
+		username:   username,
+		password:   password,
+		salt:       salt,
+		mailboxes:  map[string]*mailbox{},
+		subscribed: map[string]bool{},
+	}
+	u.mailboxes["INBOX"] = b.newMailbox("INBOX")
+	b.users[username] = u
+}
+
+func (b *Backend) Login(username, password string) (backend.User, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	u, ok := b.users[username]
+	if !ok || u.password != password {
+		return nil, backend.ErrInvalidCredentials
+	}
+	return u, nil
+}
+
+// Secret returns the password of username, for CRAM-MD5
+func (b *Backend) Secret(username string) (string, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	u, ok := b.users[username]
+	if !ok {
+		return "", backend.ErrInvalidCredentials
+	}
+	return u.password, nil
+}
+
+// User returns username, for mechanisms which don't need its password
+func (b *Backend) User(username string) (backend.User, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	u, ok := b.users[username]
+	if !ok {
+		return nil, backend.ErrInvalidCredentials
+	}
+	return u, nil
+}
+
+// ScramCredentials derives the credentials of username for SCRAM
+func (b *Backend) ScramCredentials(username, hash string) (sasl.ScramCredentials, error) {
+	b.mu.Lock()
+	u, ok := b.users[username]
+	var password string
+	var salt []byte
+	if ok {
+		password, salt = u.password, u.salt
+	}
+	b.mu.Unlock()
+
+	h := sasl.ScramHashes[hash]
+	if !ok || h == nil {
+		return sasl.ScramCredentials{}, backend.ErrInvalidCredentials
+	}
+	return sasl.NewScramCredentials(h, password, salt, 4096), nil
+}
+
+// newMailbox creates an empty mailbox with a new UIDVALIDITY,
+// so a mailbox which is created again doesn't reuse UIDs
+func (b *Backend) newMailbox(name string) *mailbox {
+	b.uidValidity++
+	return &mailbox{name: name, uidValidity: b.uidValidity, uidNext: 1}
+}
+
+// user implements backend.User
+type user struct {
+	backend    *Backend
+	username   string
+	password   string
+	salt       []byte // for SCRAM
+	mailboxes  map[string]*mailbox
+	subscribed map[string]bool
+}
+
+func (u *user) Username() string {
+	return u.username
+}
+
+func (u *user) ListMailboxes(subscribed bool) ([]backend.MailboxInfo, error) {
+	u.backend.mu.Lock()
+	defer u.backend.mu.Unlock()
+
+	names := []string{}
+	if subscribed {
+		for name := range u.subscribed {
+			names = append(names, name)
+		}
+	} else {
+		for name := range u.mailboxes {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	list := []backend.MailboxInfo{}
+	for _, name := range names {
+		attributes := []string{}
+		if m, ok := u.mailboxes[name]; !ok || m.noSelect {
+			attributes = append(attributes, `\Noselect`)
+		}
+		if u.hasChildren(name) {
+			attributes = append(attributes, `\HasChildren`)
+		} else {
+			attributes = append(attributes, `\HasNoChildren`)
+		}
+		list = append(list, backend.MailboxInfo{Name: name, Attributes: attributes})
+	}
+	return list, nil
+}
+
+func (u *user) GetMailbox(name string) (backend.Mailbox, error) {
+	u.backend.mu.Lock()
+	defer u.backend.mu.Unlock()
+
+	m, err := u.mailbox(name)
+	if err != nil {
+		return nil, err
+	}
+	return &handle{backend: u.backend, user: u, mailbox: m}, nil
+}
+
+// CreateMailbox creates name, and the levels of the hierarchy
+// above it which don't exist yet as \Noselect
+func (u *user) CreateMailbox(name string) error {
+	u.backend.mu.Lock()
+	defer u.backend.mu.Unlock()
+
+	name = canonicalName(name)
+	if m, ok := u.mailboxes[name]; ok && !m.noSelect {
+		return backend.ErrMailboxAlreadyExists
+	}
+	u.createParents(name)
+	u.mailboxes[name] = u.backend.newMailbox(name)
+	return nil
+}
+
+// DeleteMailbox removes name. A mailbox with children can't be
+// removed, its messages are removed and it becomes \Noselect. The
+// \Noselect levels above it which are left without children go too.
+func (u *user) DeleteMailbox(name string) error {
+	u.backend.mu.Lock()
+	defer u.backend.mu.Unlock()
+
+	m, ok := u.mailboxes[canonicalName(name)]
+	if !ok {
+		return backend.ErrNoSuchMailbox
+	}
+	if m.noSelect {
+		return backend.ErrHasChildren
+	}
+	m.removeAll(&u.backend.bus)
+	m.deleted = true
+	if u.hasChildren(m.name) {
+		// the name stays, as the level above its children
+		replacement := u.backend.newMailbox(m.name)
+		replacement.noSelect = true
+		u.mailboxes[m.name] = replacement
+		return nil
+	}
+	delete(u.mailboxes, m.name)
+	u.removeParents(m.name)
+	return nil
+}
+
+// RenameMailbox renames a mailbox with its children, and creates the
+// levels above the new name which don't exist yet. A \Noselect level
+// can be renamed too. Renaming INBOX moves its messages to a new
+// mailbox, and leaves INBOX empty.
+func (u *user) RenameMailbox(existingName, newName string) error {
+	u.backend.mu.Lock()
+	defer u.backend.mu.Unlock()
+
+	m, ok := u.mailboxes[canonicalName(existingName)]
+	if !ok {
+		return backend.ErrNoSuchMailbox
+	}
+	newName = canonicalName(newName)
+	if _, ok := u.mailboxes[newName]; ok {
+		return backend.ErrMailboxAlreadyExists
+	}
+
+	if m.name == "INBOX" {
+		moved := u.backend.newMailbox(newName)
+		moved.messages = m.messages
+		moved.uidNext = m.uidNext
+		m.removeAll(&u.backend.bus)
+		u.createParents(newName)
+		u.mailboxes[newName] = moved
+		return nil
+	}
+
+	// the new names of the children are checked before anything is
+	// renamed, so an existing mailbox is never overwritten
+	prefix := m.name + backend.Delimiter
+	children := map[string]*mailbox{}
+	for name, child := range u.mailboxes {
+		if strings.HasPrefix(name, prefix) {
+			target := newName + backend.Delimiter + strings.TrimPrefix(name, prefix)
+			if _, ok := u.mailboxes[target]; ok {
+				return backend.ErrMailboxAlreadyExists
+			}
+			children[target] = child
+		}
+	}
+	for target, child := range children {
+		delete(u.mailboxes, child.name)
+		child.name = target
+	}
+	for target, child := range children {
+		u.mailboxes[target] = child
+	}
+	delete(u.mailboxes, m.name)
+	u.removeParents(m.name)
+	m.name = newName
+	u.createParents(newName)
+	u.mailboxes[newName] = m
+	return nil
+}
+
+func (u *user) SetSubscribed(name string, subscribed bool) error {
+	u.backend.mu.Lock()
+	defer u.backend.mu.Unlock()
+
+	name = canonicalName(name)
+	if subscribed {
+		if _, err := u.mailbox(name); err != nil {
+			return err
+		}
+		u.subscribed[name] = true
+	} else {
+		delete(u.subscribed, name)
+	}
+	return nil
+}
+
+func (u *user) Logout() error {
+	return nil
+}
+
+// mailbox returns the selectable mailbox with name,
+// the caller holds the lock
+func (u *user) mailbox(name string) (*mailbox, error) {
+	m, ok := u.mailboxes[canonicalName(name)]
+	if !ok || m.noSelect {
+		return nil, backend.ErrNoSuchMailbox
+	}
+	return m, nil
+}
+
+// createParents creates the levels of the hierarchy above name
+// which don't exist yet as \Noselect, the caller holds the lock
+func (u *user) createParents(name string) {
+	levels := strings.Split(name, backend.Delimiter)
+	for i := 1; i < len(levels); i++ {
+		parent := strings.Join(levels[:i], backend.Delimiter)
+		if _, ok := u.mailboxes[parent]; !ok {
+			m := u.backend.newMailbox(parent)
+			m.noSelect = true
+			u.mailboxes[parent] = m
+		}
+	}
+}
+
+// removeParents removes the \Noselect levels of the hierarchy above
+// name which have no children anymore, the caller holds the lock
+func (u *user) removeParents(name string) {
+	levels := strings.Split(name, backend.Delimiter)
+	for i := len(levels) - 1; i > 0; i-- {
+		parent := strings.Join(levels[:i], backend.Delimiter)
+		m, ok := u.mailboxes[parent]
+		if !ok || !m.noSelect || u.hasChildren(parent) {
+			return
+		}
+		delete(u.mailboxes, parent)
+	}
+}
+
+// hasChildren reports whether there are mailboxes below name
+func (u *user) hasChildren(name string) bool {
+	prefix := name + backend.Delimiter
+	for other := range u.mailboxes {
+		if strings.HasPrefix(other, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// canonicalName returns name, with INBOX in upper case
+// since it is case-insensitive
+func canonicalName(name string) string {
+	if strings.EqualFold(name, "INBOX") {
+		return "INBOX"
+	}
+	return name
+}
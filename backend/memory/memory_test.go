@@ -0,0 +1,376 @@
+package memory
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"github.com/gopistolet/imap/backend"
+	"github.com/gopistolet/imap/parser"
+	"github.com/gopistolet/imap/sasl"
+	"github.com/gopistolet/imap/server"
+	. "github.com/smartystreets/goconvey/convey"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMemory(t *testing.T) {
+
+	Convey("Testing mailboxes", t, func() {
+
+		b := New()
+		b.AddUser("mrc", "secret")
+		_, err := b.Login("mrc", "wrong")
+		So(err, ShouldEqual, backend.ErrInvalidCredentials)
+		u, err := b.Login("mrc", "secret")
+		So(err, ShouldEqual, nil)
+		user, err := b.User("mrc")
+		So(err, ShouldEqual, nil)
+		So(user, ShouldEqual, u)
+		credentials, err := b.ScramCredentials("mrc", "SHA-256")
+		So(err, ShouldEqual, nil)
+		So(credentials, ShouldResemble, sasl.NewScramCredentials(sha256.New, "secret", credentials.Salt, 4096))
+		_, err = b.ScramCredentials("mrc", "MD5")
+		So(err, ShouldEqual, backend.ErrInvalidCredentials)
+		_, err = b.User("joe")
+		So(err, ShouldEqual, backend.ErrInvalidCredentials)
+		names := func(subscribed bool) []string {
+			list, err := u.ListMailboxes(subscribed)
+			So(err, ShouldEqual, nil)
+			names := []string{}
+			for _, info := range list {
+				names = append(names, info.Name+" "+strings.Join(info.Attributes, " "))
+			}
+			return names
+		}
+
+		So(u.CreateMailbox("work/reports/2016"), ShouldEqual, nil)
+		So(names(false), ShouldResemble, []string{
+			`INBOX \HasNoChildren`,
+			`work \Noselect \HasChildren`,
+			`work/reports \Noselect \HasChildren`,
+			`work/reports/2016 \HasNoChildren`,
+		})
+		So(u.CreateMailbox("work"), ShouldEqual, nil)
+		So(u.CreateMailbox("work/reports"), ShouldEqual, nil)
+		So(u.CreateMailbox("work"), ShouldEqual, backend.ErrMailboxAlreadyExists)
+		So(u.CreateMailbox("inbox"), ShouldEqual, backend.ErrMailboxAlreadyExists)
+		So(names(false), ShouldResemble, []string{
+			`INBOX \HasNoChildren`,
+			`work \HasChildren`,
+			`work/reports \HasChildren`,
+			`work/reports/2016 \HasNoChildren`,
+		})
+
+		So(u.RenameMailbox("work/reports", "archive"), ShouldEqual, nil)
+		So(u.RenameMailbox("work", "archive"), ShouldEqual, backend.ErrMailboxAlreadyExists)
+		So(u.RenameMailbox("missing", "other"), ShouldEqual, backend.ErrNoSuchMailbox)
+		So(u.DeleteMailbox("archive"), ShouldEqual, nil)
+		So(names(false), ShouldResemble, []string{
+			`INBOX \HasNoChildren`,
+			`archive \Noselect \HasChildren`,
+			`archive/2016 \HasNoChildren`,
+			`work \HasNoChildren`,
+		})
+		_, err = u.GetMailbox("archive")
+		So(err, ShouldEqual, backend.ErrNoSuchMailbox)
+		So(u.DeleteMailbox("archive"), ShouldEqual, backend.ErrHasChildren)
+
+		// the \Noselect level goes with its last child
+		So(u.DeleteMailbox("archive/2016"), ShouldEqual, nil)
+		So(names(false), ShouldResemble, []string{`INBOX \HasNoChildren`, `work \HasNoChildren`})
+		So(u.CreateMailbox("archive"), ShouldEqual, nil)
+
+		So(u.SetSubscribed("work", true), ShouldEqual, nil)
+		So(u.SetSubscribed("missing", true), ShouldEqual, backend.ErrNoSuchMailbox)
+		So(names(true), ShouldResemble, []string{`work \HasNoChildren`})
+		So(u.DeleteMailbox("work"), ShouldEqual, nil)
+		So(names(true), ShouldResemble, []string{`work \Noselect \HasNoChildren`})
+	})
+
+	Convey("Testing renaming", t, func() {
+
+		b := New()
+		b.AddUser("mrc", "secret")
+		u, _ := b.Login("mrc", "secret")
+		names := func() []string {
+			list, _ := u.ListMailboxes(false)
+			names := []string{}
+			for _, info := range list {
+				names = append(names, info.Name+" "+strings.Join(info.Attributes, " "))
+			}
+			return names
+		}
+
+		// a child of the new name exists, without its parent
+		So(u.CreateMailbox("a/x"), ShouldEqual, nil)
+		So(u.CreateMailbox("b/x"), ShouldEqual, nil)
+		delete(u.(*user).mailboxes, "b")
+		So(u.RenameMailbox("a", "b"), ShouldEqual, backend.ErrMailboxAlreadyExists)
+		So(names(), ShouldResemble, []string{
+			`INBOX \HasNoChildren`,
+			`a \Noselect \HasChildren`,
+			`a/x \HasNoChildren`,
+			`b/x \HasNoChildren`,
+		})
+		So(u.DeleteMailbox("b/x"), ShouldEqual, nil)
+
+		// the levels above the new name are created as \Noselect
+		So(u.RenameMailbox("a", "c/d/e"), ShouldEqual, nil)
+		So(u.RenameMailbox("INBOX", "old/inbox"), ShouldEqual, nil)
+		So(names(), ShouldResemble, []string{
+			`INBOX \HasNoChildren`,
+			`c \Noselect \HasChildren`,
+			`c/d \Noselect \HasChildren`,
+			`c/d/e \Noselect \HasChildren`,
+			`c/d/e/x \HasNoChildren`,
+			`old \Noselect \HasChildren`,
+			`old/inbox \HasNoChildren`,
+		})
+
+		// a \Noselect level can be renamed, the levels above it
+		// which are left without children go
+		So(u.DeleteMailbox("c/d/e"), ShouldEqual, backend.ErrHasChildren)
+		So(u.RenameMailbox("c/d/e", "f"), ShouldEqual, nil)
+		So(u.RenameMailbox("c/d/e", "g"), ShouldEqual, backend.ErrNoSuchMailbox)
+		So(names(), ShouldResemble, []string{
+			`INBOX \HasNoChildren`,
+			`f \Noselect \HasChildren`,
+			`f/x \HasNoChildren`,
+			`old \Noselect \HasChildren`,
+			`old/inbox \HasNoChildren`,
+		})
+	})
+
+	Convey("Testing messages", t, func() {
+
+		b := New()
+		b.AddUser("mrc", "secret")
+		u, _ := b.Login("mrc", "secret")
+		u.CreateMailbox("saved")
+		date := time.Date(1996, 7, 17, 2, 44, 25, 0, time.UTC)
+		all := parser.SequenceSet{{Start: 1, Stop: 0}}
+
+		inbox, _ := u.GetMailbox("INBOX")
+		So(inbox.Append([]string{`\Seen`, `\Recent`}, date, []byte("Subject: one\r\n\r\n")), ShouldEqual, nil)
+		So(inbox.Append(nil, date, []byte("Subject: two\r\n\r\n")), ShouldEqual, nil)
+
+		status, _ := inbox.Status()
+		So(status.Messages, ShouldEqual, 2)
+		So(status.Recent, ShouldEqual, 2)
+		So(status.Unseen, ShouldEqual, 1)
+		So(status.FirstUnseen, ShouldEqual, 2)
+		So(status.UidNext, ShouldEqual, 3)
+
+		// the first session which selects the mailbox takes over \Recent,
+		// EXAMINE doesn't
+		examined, _ := u.GetMailbox("INBOX")
+		So(examined.Select(true), ShouldEqual, nil)
+		first, _ := u.GetMailbox("INBOX")
+		So(first.Select(false), ShouldEqual, nil)
+		second, _ := u.GetMailbox("INBOX")
+		So(second.Select(false), ShouldEqual, nil)
+		status, _ = first.Status()
+		So(status.Recent, ShouldEqual, 2)
+		status, _ = second.Status()
+		So(status.Recent, ShouldEqual, 0)
+		second.Append(nil, date, []byte("Subject: three\r\n\r\n"))
+		status, _ = second.Status()
+		So(status.Recent, ShouldEqual, 1)
+		status, _ = first.Status()
+		So(status.Recent, ShouldEqual, 2)
+
+		messages, err := first.Fetch(true, parser.SequenceSet{{Start: 2, Stop: 0}}, false)
+		So(err, ShouldEqual, nil)
+		So(len(messages), ShouldEqual, 2)
+		So(messages[0], ShouldResemble, backend.Message{SeqNum: 2, Uid: 2, Flags: []string{`\Recent`}, InternalDate: date, Size: 16})
+		So(messages[1].Flags, ShouldBeEmpty)
+
+		updates := second.(backend.WatchedMailbox).Watch()
+		changed, err := first.Store(false, parser.SequenceSet{{Start: 1, Stop: 2}}, "+", []string{`\Deleted`})
+		So(err, ShouldEqual, nil)
+		So(len(updates.Ready()), ShouldEqual, 1)
+		So(updates.Updates(), ShouldResemble, []backend.Update{{Type: backend.UpdateFlags, Uid: 1}, {Type: backend.UpdateFlags, Uid: 2}})
+		So(changed[0].Flags, ShouldResemble, []string{`\Seen`, `\Deleted`, `\Recent`})
+		results, _ := second.Search(true, []parser.SearchKey{{Name: "DELETED"}})
+		So(results, ShouldResemble, []uint32{1, 2})
+
+		So(first.Copy(false, all, "missing"), ShouldEqual, backend.ErrNoSuchMailbox)
+		So(first.Copy(false, parser.SequenceSet{{Start: 2, Stop: 3}}, "saved"), ShouldEqual, nil)
+		saved, _ := u.GetMailbox("saved")
+		messages, _ = saved.Fetch(false, all, true)
+		So(len(messages), ShouldEqual, 2)
+		So(messages[0].Flags, ShouldResemble, []string{`\Deleted`, `\Recent`})
+		So(string(messages[1].Body), ShouldEqual, "Subject: three\r\n\r\n")
+
+		<-updates.Ready()
+		expunged, err := first.Expunge()
+		So(err, ShouldEqual, nil)
+		So(expunged, ShouldResemble, []uint32{1, 1})
+		So(updates.Updates(), ShouldResemble, []backend.Update{{Type: backend.UpdateExpunge, Uid: 1}, {Type: backend.UpdateExpunge, Uid: 2}})
+		messages, _ = second.Fetch(false, all, false)
+		So(len(messages), ShouldEqual, 1)
+		So(messages[0].SeqNum, ShouldEqual, 1)
+		So(messages[0].Uid, ShouldEqual, 3)
+
+		first.Append(nil, date, []byte("Subject: four\r\n\r\n"))
+		So(updates.Updates(), ShouldResemble, []backend.Update{{Type: backend.UpdateExists}})
+		updates.Close()
+		first.Append(nil, date, []byte("Subject: five\r\n\r\n"))
+		So(updates.Updates(), ShouldBeEmpty)
+
+		So(u.DeleteMailbox("saved"), ShouldEqual, nil)
+		_, err = saved.Status()
+		So(err, ShouldEqual, backend.ErrNoSuchMailbox)
+	})
+
+	Convey("Testing the session of parser/example.txt", t, func() {
+
+		b := New()
+		b.AddUser("mrc", "secret")
+		inbox := b.users["mrc"].mailboxes["INBOX"]
+		inbox.uidValidity = 3857529045
+
+		// 18 messages, 12 is the one of the example, 17 and 18 are
+		// \Recent and not \Seen
+		header := "Date: Wed, 17 Jul 1996 02:23:25 -0700 (PDT)\r\n" +
+			"From: Terry Gray <gray@cac.washington.edu>\r\n" +
+			"Subject: IMAP4rev1 WG mtg summary and minutes\r\n" +
+			"To: imap@cac.washington.edu\r\n" +
+			"cc: minutes@CNRI.Reston.VA.US, John Klensin <KLENSIN@MIT.EDU>\r\n" +
+			"Message-Id: <B27397-0100000@cac.washington.edu>\r\n" +
+			"MIME-Version: 1.0\r\n" +
+			"Content-Type: TEXT/PLAIN; CHARSET=US-ASCII\r\n" +
+			"\r\n"
+		text := ""
+		for i := 0; i < 92; i++ {
+			// 92 lines, 3028 octets
+			if i < 84 {
+				text += strings.Repeat("x", 31) + "\r\n"
+			} else {
+				text += strings.Repeat("x", 30) + "\r\n"
+			}
+		}
+		date := time.Date(1996, 7, 17, 2, 44, 25, 0, time.FixedZone("", -7*60*60))
+		for i := 1; i <= 18; i++ {
+			body := "Subject: message\r\n\r\n"
+			if i == 12 {
+				body = header + text
+			}
+			flags := []string{`\Seen`}
+			if i > 16 {
+				flags = nil
+			}
+			inbox.add(flags, date, []byte(body))
+			inbox.messages[i-1].recent = i > 16
+		}
+
+		client, conn := net.Pipe()
+		go server.NewServer(b).ServeConn(conn)
+		r := parser.NewResponseReader(client)
+		w := bufio.NewWriter(client)
+
+		// replay sends a command, and returns the responses to it
+		replay := func(command string) []interface{} {
+			w.WriteString(command + "\r\n")
+			w.Flush()
+			tag := strings.Fields(command)[0]
+			responses := []interface{}{}
+			for {
+				response, err := r.ReadResponse()
+				So(err, ShouldEqual, nil)
+				responses = append(responses, response)
+				if status, ok := response.(parser.StatusResponse); ok && status.Tag == tag {
+					return responses
+				}
+			}
+		}
+
+		example, err := os.Open("../../parser/example.txt")
+		So(err, ShouldEqual, nil)
+		defer example.Close()
+		commands := []string{}
+		lines := bufio.NewScanner(example)
+		for lines.Scan() {
+			if line := lines.Text(); strings.HasPrefix(line, "C:") {
+				commands = append(commands, strings.TrimSpace(line[2:]))
+			}
+		}
+		So(commands, ShouldResemble, []string{
+			"a001 login mrc secret",
+			"a002 select inbox",
+			"a003 fetch 12 full",
+			"a004 fetch 12 body[header]",
+			"a005 store 12 +flags \\deleted",
+			"a006 logout",
+		})
+
+		greeting, err := r.ReadResponse()
+		So(err, ShouldEqual, nil)
+		So(greeting, ShouldResemble, parser.StatusResponse{Type: parser.OK, Info: "IMAP4rev1 Service Ready"})
+
+		So(replay(commands[0]), ShouldResemble, []interface{}{
+			parser.StatusResponse{Tag: "a001", Type: parser.OK, Info: "LOGIN completed"},
+		})
+
+		flags := []interface{}{parser.Atom(`\Answered`), parser.Atom(`\Flagged`), parser.Atom(`\Deleted`), parser.Atom(`\Seen`), parser.Atom(`\Draft`)}
+		So(replay(commands[1]), ShouldResemble, []interface{}{
+			parser.DataResponse{Fields: []interface{}{uint32(18), parser.Atom("EXISTS")}},
+			parser.DataResponse{Fields: []interface{}{uint32(2), parser.Atom("RECENT")}},
+			parser.StatusResponse{Type: parser.OK, Code: parser.CodeUnseen, CodeArguments: []interface{}{uint32(17)}, Info: "Message 17 is first unseen"},
+			parser.StatusResponse{Type: parser.OK, Code: parser.CodeUidValidity, CodeArguments: []interface{}{uint32(3857529045)}, Info: "UIDs valid"},
+			parser.StatusResponse{Type: parser.OK, Code: parser.CodeUidNext, CodeArguments: []interface{}{uint32(19)}, Info: "Predicted next UID"},
+			parser.DataResponse{Fields: []interface{}{parser.Atom("FLAGS"), flags}},
+			parser.StatusResponse{Type: parser.OK, Code: parser.CodePermanentFlags, CodeArguments: []interface{}{append(flags, parser.Atom(`\*`))}, Info: "Limited"},
+			parser.StatusResponse{Tag: "a002", Type: parser.OK, Code: parser.CodeReadWrite, Info: "SELECT completed"},
+		})
+
+		// the example has RFC822.SIZE 4286, which doesn't add up to
+		// the 342 octets of the header and 3028 of the text it shows
+		terry := []interface{}{[]interface{}{"Terry Gray", nil, "gray", "cac.washington.edu"}}
+		So(replay(commands[2]), ShouldResemble, []interface{}{
+			parser.DataResponse{Fields: []interface{}{uint32(12), parser.Atom("FETCH"), []interface{}{
+				parser.Atom("FLAGS"), []interface{}{parser.Atom(`\Seen`)},
+				parser.Atom("INTERNALDATE"), "17-Jul-1996 02:44:25 -0700",
+				parser.Atom("RFC822.SIZE"), uint32(342 + 3028),
+				parser.Atom("ENVELOPE"), []interface{}{
+					"Wed, 17 Jul 1996 02:23:25 -0700 (PDT)",
+					"IMAP4rev1 WG mtg summary and minutes",
+					terry, terry, terry,
+					[]interface{}{[]interface{}{nil, nil, "imap", "cac.washington.edu"}},
+					[]interface{}{
+						[]interface{}{nil, nil, "minutes", "CNRI.Reston.VA.US"},
+						[]interface{}{"John Klensin", nil, "KLENSIN", "MIT.EDU"},
+					},
+					nil, nil,
+					"<B27397-0100000@cac.washington.edu>",
+				},
+				parser.Atom("BODY"), []interface{}{"TEXT", "PLAIN", []interface{}{"CHARSET", "US-ASCII"}, nil, nil, "7BIT", uint32(3028), uint32(92)},
+			}}},
+			parser.StatusResponse{Tag: "a003", Type: parser.OK, Info: "FETCH completed"},
+		})
+
+		So(replay(commands[3]), ShouldResemble, []interface{}{
+			parser.DataResponse{Fields: []interface{}{uint32(12), parser.Atom("FETCH"), []interface{}{
+				parser.Atom("BODY[HEADER]"), header,
+			}}},
+			parser.StatusResponse{Tag: "a004", Type: parser.OK, Info: "FETCH completed"},
+		})
+
+		So(replay(commands[4]), ShouldResemble, []interface{}{
+			parser.DataResponse{Fields: []interface{}{uint32(12), parser.Atom("FETCH"), []interface{}{
+				parser.Atom("FLAGS"), []interface{}{parser.Atom(`\Seen`), parser.Atom(`\Deleted`)},
+			}}},
+			parser.StatusResponse{Tag: "a005", Type: parser.OK, Info: "STORE completed"},
+		})
+
+		So(replay(commands[5]), ShouldResemble, []interface{}{
+			parser.StatusResponse{Type: parser.BYE, Info: "IMAP4rev1 Server logging out"},
+			parser.StatusResponse{Tag: "a006", Type: parser.OK, Info: "LOGOUT completed"},
+		})
+		_, err = r.ReadResponse()
+		So(err, ShouldEqual, io.EOF)
+	})
+}
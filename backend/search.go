@@ -0,0 +1,228 @@
+package backend
+
+import (
+	"bytes"
+	"github.com/gopistolet/imap/parser"
+	"io"
+	"net/mail"
+	"net/textproto"
+	"strings"
+	"time"
+)
+
+// Filter returns the messages in set, addressed by sequence number or
+// by UID. messages are all messages of a mailbox, in sequence order.
+func Filter(messages []Message, uid bool, set parser.SequenceSet) []Message {
+	if len(messages) == 0 {
+		return nil
+	}
+	max := messages[len(messages)-1].SeqNum
+	if uid {
+		max = messages[len(messages)-1].Uid
+	}
+	set = set.Resolve(max)
+
+	filtered := []Message{}
+	for _, message := range messages {
+		n := message.SeqNum
+		if uid {
+			n = message.Uid
+		}
+		if set.Contains(n) {
+			filtered = append(filtered, message)
+		}
+	}
+	return filtered
+}
+
+// Search returns the sequence numbers, or UIDs when uid is set, of
+// the messages which match all keys. messages are all messages of a
+// mailbox, in sequence order, with their Body.
+func Search(messages []Message, uid bool, keys []parser.SearchKey) []uint32 {
+	results := []uint32{}
+	if len(messages) == 0 {
+		return results
+	}
+	last := messages[len(messages)-1]
+	for i := range messages {
+		m := &matcher{message: &messages[i], maxSeqNum: last.SeqNum, maxUid: last.Uid}
+		if m.all(keys) {
+			if uid {
+				results = append(results, messages[i].Uid)
+			} else {
+				results = append(results, messages[i].SeqNum)
+			}
+		}
+	}
+	return results
+}
+
+// ApplyFlags returns flags changed by a STORE with mode "+", "-" or "".
+// \Recent can't be changed by clients, it is kept as it is.
+func ApplyFlags(flags []string, mode string, changes []string) []string {
+	has := func(list []string, flag string) bool {
+		for _, f := range list {
+			if strings.EqualFold(f, flag) {
+				return true
+			}
+		}
+		return false
+	}
+
+	result := []string{}
+	for _, flag := range flags {
+		switch {
+		case strings.EqualFold(flag, `\Recent`):
+			result = append(result, flag)
+		case mode == "+":
+			result = append(result, flag)
+		case mode == "-" && !has(changes, flag):
+			result = append(result, flag)
+		}
+	}
+	if mode != "-" {
+		for _, flag := range changes {
+			if !has(result, flag) && !strings.EqualFold(flag, `\Recent`) {
+				result = append(result, CanonicalFlag(flag))
+			}
+		}
+	}
+	return result
+}
+
+// CanonicalFlag returns flag with the case of the system flags of
+// RFC 3501, like \Seen for \SEEN. Keywords are returned as they are.
+func CanonicalFlag(flag string) string {
+	for _, system := range []string{`\Answered`, `\Flagged`, `\Deleted`, `\Seen`, `\Draft`, `\Recent`} {
+		if strings.EqualFold(flag, system) {
+			return system
+		}
+	}
+	return flag
+}
+
+// matcher matches a single message against search keys
+type matcher struct {
+	message   *Message
+	maxSeqNum uint32
+	maxUid    uint32
+
+	parsed bool
+	header mail.Header
+	text   []byte
+}
+
+func (m *matcher) all(keys []parser.SearchKey) bool {
+	for _, key := range keys {
+		if !m.match(key) {
+			return false
+		}
+	}
+	return true
+}
+
+// parse splits the message in header and text, once
+func (m *matcher) parse() {
+	if m.parsed {
+		return
+	}
+	m.parsed = true
+	msg, err := mail.ReadMessage(bytes.NewReader(m.message.Body))
+	if err != nil {
+		m.header = mail.Header{}
+		return
+	}
+	m.header = msg.Header
+	m.text, _ = io.ReadAll(msg.Body)
+}
+
+// headerContains reports whether a field of the header contains s,
+// or whether it is present at all when s is empty
+func (m *matcher) headerContains(field, s string) bool {
+	m.parse()
+	values, ok := m.header[textproto.CanonicalMIMEHeaderKey(field)]
+	if !ok {
+		return false
+	}
+	for _, value := range values {
+		if containsFold(value, s) {
+			return true
+		}
+	}
+	return false
+}
+
+func (m *matcher) match(key parser.SearchKey) bool {
+	msg := m.message
+	switch key.Name {
+	case "ALL":
+		return true
+	case "ANSWERED", "DELETED", "DRAFT", "FLAGGED", "RECENT", "SEEN":
+		return msg.HasFlag(`\` + key.Name[:1] + strings.ToLower(key.Name[1:]))
+	case "UNANSWERED", "UNDELETED", "UNDRAFT", "UNFLAGGED", "UNSEEN":
+		name := strings.TrimPrefix(key.Name, "UN")
+		return !msg.HasFlag(`\` + name[:1] + strings.ToLower(name[1:]))
+	case "NEW":
+		return msg.HasFlag(`\Recent`) && !msg.HasFlag(`\Seen`)
+	case "OLD":
+		return !msg.HasFlag(`\Recent`)
+	case "KEYWORD":
+		return msg.HasFlag(key.Value)
+	case "UNKEYWORD":
+		return !msg.HasFlag(key.Value)
+	case "BCC", "CC", "FROM", "SUBJECT", "TO":
+		return m.headerContains(key.Name, key.Value)
+	case "HEADER":
+		return m.headerContains(key.Field, key.Value)
+	case "BODY":
+		m.parse()
+		return containsFold(string(m.text), key.Value)
+	case "TEXT":
+		return containsFold(string(msg.Body), key.Value)
+	case "BEFORE":
+		return day(msg.InternalDate).Before(key.Date)
+	case "ON":
+		return day(msg.InternalDate).Equal(key.Date)
+	case "SINCE":
+		return !day(msg.InternalDate).Before(key.Date)
+	case "SENTBEFORE", "SENTON", "SENTSINCE":
+		m.parse()
+		date, err := m.header.Date()
+		if err != nil {
+			return false
+		}
+		sent := day(date)
+		switch key.Name {
+		case "SENTBEFORE":
+			return sent.Before(key.Date)
+		case "SENTON":
+			return sent.Equal(key.Date)
+		}
+		return !sent.Before(key.Date)
+	case "LARGER":
+		return msg.Size > key.Number
+	case "SMALLER":
+		return msg.Size < key.Number
+	case "UID":
+		return key.Sequence.Resolve(m.maxUid).Contains(msg.Uid)
+	case "SEQUENCE":
+		return key.Sequence.Resolve(m.maxSeqNum).Contains(msg.SeqNum)
+	case "NOT":
+		return !m.all(key.Keys)
+	case "OR":
+		return m.match(key.Keys[0]) || m.match(key.Keys[1])
+	case "AND":
+		return m.all(key.Keys)
+	}
+	return false
+}
+
+// day returns the date of t, disregarding time and timezone,
+// as SEARCH dates are parsed
+func day(t time.Time) time.Time {
+	return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+}
+
+func containsFold(s, substr string) bool {
+	return strings.Contains(strings.ToLower(s), strings.ToLower(substr))
+}
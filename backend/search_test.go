@@ -0,0 +1,73 @@
+package backend
+
+import (
+	"github.com/gopistolet/imap/parser"
+	. "github.com/smartystreets/goconvey/convey"
+	"testing"
+	"time"
+)
+
+func TestSearch(t *testing.T) {
+
+	messages := []Message{
+		{SeqNum: 1, Uid: 10, Flags: []string{`\Seen`}, InternalDate: time.Date(1994, 2, 1, 10, 0, 0, 0, time.UTC), Size: 100,
+			Body: []byte("From: Terry Gray <gray@cac.washington.edu>\r\nSubject: afternoon meeting\r\nDate: Mon, 7 Feb 1994 21:52:25 -0800\r\n\r\nHello Joe\r\n")},
+		{SeqNum: 2, Uid: 11, Flags: []string{`\Recent`, `\Flagged`, "$Junk"}, InternalDate: time.Date(1994, 2, 7, 23, 0, 0, 0, time.UTC), Size: 5000,
+			Body: []byte("From: smith@example.com\r\nX-Mailer: Some Client\r\nSubject: lunch\r\n\r\nSee you at noon\r\n")},
+		{SeqNum: 3, Uid: 14, Flags: []string{`\Deleted`, `\Recent`, `\Seen`}, InternalDate: time.Date(1994, 3, 1, 0, 0, 0, 0, time.UTC), Size: 20,
+			Body: []byte("Subject: no sender\r\n\r\nmeeting notes\r\n")},
+	}
+	search := func(uid bool, keys ...parser.SearchKey) []uint32 {
+		return Search(messages, uid, keys)
+	}
+	date := func(s string) time.Time {
+		d, err := parser.ParseDate(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return d
+	}
+
+	Convey("Testing Filter", t, func() {
+
+		So(len(Filter(messages, false, parser.SequenceSet{{Start: 2, Stop: 0}})), ShouldEqual, 2)
+		So(Filter(messages, true, parser.SequenceSet{{Start: 11, Stop: 13}})[0].SeqNum, ShouldEqual, 2)
+		So(Filter(messages, true, parser.SequenceSet{{Start: 0, Stop: 0}})[0].Uid, ShouldEqual, 14)
+		So(Filter(messages, false, parser.SequenceSet{{Start: 4, Stop: 5}}), ShouldBeEmpty)
+		So(Filter(nil, false, parser.SequenceSet{{Start: 1, Stop: 0}}), ShouldBeEmpty)
+	})
+
+	Convey("Testing Search", t, func() {
+
+		So(search(false, parser.SearchKey{Name: "ALL"}), ShouldResemble, []uint32{1, 2, 3})
+		So(search(true, parser.SearchKey{Name: "ALL"}), ShouldResemble, []uint32{10, 11, 14})
+		So(search(false, parser.SearchKey{Name: "SEEN"}), ShouldResemble, []uint32{1, 3})
+		So(search(false, parser.SearchKey{Name: "UNSEEN"}), ShouldResemble, []uint32{2})
+		So(search(false, parser.SearchKey{Name: "NEW"}), ShouldResemble, []uint32{2})
+		So(search(false, parser.SearchKey{Name: "OLD"}), ShouldResemble, []uint32{1})
+		So(search(false, parser.SearchKey{Name: "KEYWORD", Value: "$junk"}), ShouldResemble, []uint32{2})
+		So(search(false, parser.SearchKey{Name: "FROM", Value: "SMITH"}), ShouldResemble, []uint32{2})
+		So(search(false, parser.SearchKey{Name: "HEADER", Field: "x-mailer", Value: ""}), ShouldResemble, []uint32{2})
+		So(search(false, parser.SearchKey{Name: "BODY", Value: "meeting"}), ShouldResemble, []uint32{3})
+		So(search(false, parser.SearchKey{Name: "TEXT", Value: "meeting"}), ShouldResemble, []uint32{1, 3})
+		So(search(false, parser.SearchKey{Name: "SINCE", Date: date("7-Feb-1994")}), ShouldResemble, []uint32{2, 3})
+		So(search(false, parser.SearchKey{Name: "ON", Date: date("7-Feb-1994")}), ShouldResemble, []uint32{2})
+		So(search(false, parser.SearchKey{Name: "SENTON", Date: date("7-Feb-1994")}), ShouldResemble, []uint32{1})
+		So(search(false, parser.SearchKey{Name: "LARGER", Number: 100}), ShouldResemble, []uint32{2})
+		So(search(false, parser.SearchKey{Name: "SEQUENCE", Sequence: parser.SequenceSet{{Start: 0, Stop: 0}}}), ShouldResemble, []uint32{3})
+		So(search(false, parser.SearchKey{Name: "UID", Sequence: parser.SequenceSet{{Start: 11, Stop: 0}}}), ShouldResemble, []uint32{2, 3})
+		So(search(false, parser.SearchKey{Name: "NOT", Keys: []parser.SearchKey{{Name: "DELETED"}}}), ShouldResemble, []uint32{1, 2})
+		So(search(false, parser.SearchKey{Name: "OR", Keys: []parser.SearchKey{{Name: "FLAGGED"}, {Name: "SMALLER", Number: 50}}}), ShouldResemble, []uint32{2, 3})
+		So(search(false, parser.SearchKey{Name: "SEEN"}, parser.SearchKey{Name: "SUBJECT", Value: "meeting"}), ShouldResemble, []uint32{1})
+		So(Search(nil, false, []parser.SearchKey{{Name: "ALL"}}), ShouldBeEmpty)
+	})
+
+	Convey("Testing ApplyFlags", t, func() {
+
+		flags := []string{`\Recent`, `\Seen`}
+		So(ApplyFlags(flags, "+", []string{`\Deleted`, `\seen`}), ShouldResemble, []string{`\Recent`, `\Seen`, `\Deleted`})
+		So(ApplyFlags(flags, "-", []string{`\SEEN`, `\Recent`}), ShouldResemble, []string{`\Recent`})
+		So(ApplyFlags(flags, "", []string{`\Flagged`}), ShouldResemble, []string{`\Recent`, `\Flagged`})
+		So(ApplyFlags(nil, "+", []string{`\draft`, "$Junk"}), ShouldResemble, []string{`\Draft`, "$Junk"})
+	})
+}
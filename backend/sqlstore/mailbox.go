@@ -0,0 +1,486 @@
+package sqlstore
+
+import (
+	"bytes"
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"github.com/gopistolet/imap/backend"
+	"github.com/gopistolet/imap/parser"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Flags which clients can set, any keyword can be set as well
+var (
+	systemFlags    = []string{`\Answered`, `\Flagged`, `\Deleted`, `\Seen`, `\Draft`}
+	permanentFlags = append(append([]string{}, systemFlags...), `\*`)
+)
+
+// message is a row of the messages table, without its body
+type message struct {
+	id     int64
+	uid    uint32
+	flags  []string // without \Recent
+	recent bool     // \Recent, and not taken over by a session yet
+	date   time.Time
+	size   uint32
+	blob   string // file in BlobDir with the body, "" if it is in the table
+}
+
+// handle implements backend.Mailbox, it is the view of a mailbox
+// of a single session
+type handle struct {
+	backend *Backend
+	user    *user
+	id      int64
+	name    string
+
+	selected bool
+	readOnly bool
+	recent   map[uint32]bool // UIDs of the messages which are \Recent for this session
+	taken    map[uint32]bool // UIDs of the messages taken over by the running transaction
+}
+
+func (h *handle) Name() string {
+	// the mailbox may have been renamed since
+	h.backend.db.QueryRow(`SELECT name FROM mailboxes WHERE id = ?`, h.id).Scan(&h.name)
+	return h.name
+}
+
+func (h *handle) Select(readOnly bool) error {
+	h.selected = true
+	h.readOnly = readOnly
+	h.recent = map[uint32]bool{}
+	return h.transact(func(tx *sql.Tx) error {
+		_, err := h.open(tx)
+		return err
+	})
+}
+
+// transact runs f in a transaction of the backend. The \Recent flags
+// which open takes over in it only become the session's when the
+// transaction commits, otherwise they stay with the messages.
+func (h *handle) transact(f func(tx *sql.Tx) error) error {
+	h.taken = map[uint32]bool{}
+	err := h.backend.transact(f)
+	if err == nil {
+		for uid := range h.taken {
+			h.recent[uid] = true
+		}
+	}
+	h.taken = nil
+	return err
+}
+
+// open checks that the mailbox still exists, takes over the \Recent
+// flag of the messages which arrived since the last call, and returns
+// the messages
+func (h *handle) open(tx *sql.Tx) ([]*message, error) {
+	var exists bool
+	err := tx.QueryRow(`SELECT 1 FROM mailboxes WHERE id = ? AND noselect = 0`, h.id).Scan(&exists)
+	if err == sql.ErrNoRows {
+		return nil, backend.ErrNoSuchMailbox
+	} else if err != nil {
+		return nil, err
+	}
+
+	rows, err := tx.Query(`SELECT id, uid, flags, recent, date, size, COALESCE(blob, '') FROM messages WHERE mailbox_id = ? ORDER BY uid`, h.id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	messages := []*message{}
+	for rows.Next() {
+		m := &message{}
+		var flags, date string
+		if err := rows.Scan(&m.id, &m.uid, &flags, &m.recent, &date, &m.size, &m.blob); err != nil {
+			return nil, err
+		}
+		m.flags = strings.Fields(flags)
+		if m.date, err = time.Parse(time.RFC3339, date); err != nil {
+			return nil, err
+		}
+		messages = append(messages, m)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	if h.selected && !h.readOnly {
+		for _, m := range messages {
+			if !m.recent {
+				continue
+			}
+			// another session may take it over at the same time,
+			// only one of the updates changes the row
+			result, err := tx.Exec(`UPDATE messages SET recent = 0 WHERE id = ? AND recent = 1`, m.id)
+			if err != nil {
+				return nil, err
+			}
+			if n, err := result.RowsAffected(); err != nil {
+				return nil, err
+			} else if n == 1 {
+				h.taken[m.uid] = true
+			}
+			m.recent = false
+		}
+	}
+	return messages, nil
+}
+
+func (h *handle) Status() (backend.MailboxStatus, error) {
+	status := backend.MailboxStatus{Flags: systemFlags, PermanentFlags: permanentFlags}
+	err := h.transact(func(tx *sql.Tx) error {
+		messages, err := h.open(tx)
+		if err != nil {
+			return err
+		}
+		if err := tx.QueryRow(`SELECT uid_validity, uid_next FROM mailboxes WHERE id = ?`, h.id).Scan(&status.UidValidity, &status.UidNext); err != nil {
+			return err
+		}
+		status.Messages = uint32(len(messages))
+		for _, message := range h.messages(messages) {
+			if message.HasFlag(`\Recent`) {
+				status.Recent++
+			}
+			if !message.HasFlag(`\Seen`) {
+				status.Unseen++
+				if status.FirstUnseen == 0 {
+					status.FirstUnseen = message.SeqNum
+				}
+			}
+		}
+		return nil
+	})
+	return status, err
+}
+
+func (h *handle) Fetch(uid bool, set parser.SequenceSet, body bool) ([]backend.Message, error) {
+	var fetched []backend.Message
+	err := h.transact(func(tx *sql.Tx) error {
+		messages, err := h.open(tx)
+		if err != nil {
+			return err
+		}
+		fetched = backend.Filter(h.messages(messages), uid, set)
+		if body {
+			for i := range fetched {
+				if fetched[i].Body, err = h.backend.body(tx, messages[fetched[i].SeqNum-1]); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return fetched, nil
+}
+
+func (h *handle) Search(uid bool, keys []parser.SearchKey) ([]uint32, error) {
+	var results []uint32
+	err := h.transact(func(tx *sql.Tx) error {
+		messages, err := h.open(tx)
+		if err != nil {
+			return err
+		}
+		searched := h.messages(messages)
+		for i := range searched {
+			if searched[i].Body, err = h.backend.body(tx, messages[i]); err != nil {
+				return err
+			}
+		}
+		results = backend.Search(searched, uid, keys)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return results, nil
+}
+
+func (h *handle) Append(flags []string, date time.Time, body []byte) error {
+	blob, err := h.backend.writeBlob(body)
+	if err != nil {
+		return err
+	}
+	err = h.transact(func(tx *sql.Tx) error {
+		if _, err := h.open(tx); err != nil {
+			return err
+		}
+		uid, err := nextUid(tx, h.id)
+		if err != nil {
+			return err
+		}
+		stored := []string{}
+		for _, flag := range flags {
+			if !strings.EqualFold(flag, `\Recent`) {
+				stored = append(stored, backend.CanonicalFlag(flag))
+			}
+		}
+		var content interface{} = body
+		if blob != nil {
+			content = nil
+		}
+		_, err = tx.Exec(`INSERT INTO messages (mailbox_id, uid, flags, recent, date, size, body, blob) VALUES (?, ?, ?, 1, ?, ?, ?, ?)`,
+			h.id, uid, strings.Join(stored, " "), date.Format(time.RFC3339), len(body), content, blob)
+		return err
+	})
+	if err != nil && blob != nil {
+		h.backend.removeBlobs([]string{*blob})
+	}
+	if err == nil {
+		h.backend.publish(h.id, backend.Update{Type: backend.UpdateExists})
+	}
+	return err
+}
+
+func (h *handle) Store(uid bool, set parser.SequenceSet, mode string, flags []string) ([]backend.Message, error) {
+	var changed []backend.Message
+	err := h.transact(func(tx *sql.Tx) error {
+		messages, err := h.open(tx)
+		if err != nil {
+			return err
+		}
+		changed = backend.Filter(h.messages(messages), uid, set)
+		for i := range changed {
+			m := messages[changed[i].SeqNum-1]
+			m.flags = backend.ApplyFlags(m.flags, mode, flags)
+			if _, err := tx.Exec(`UPDATE messages SET flags = ? WHERE id = ?`, strings.Join(m.flags, " "), m.id); err != nil {
+				return err
+			}
+			changed[i].Flags = h.flags(m)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	for _, message := range changed {
+		h.backend.publish(h.id, backend.Update{Type: backend.UpdateFlags, Uid: message.Uid})
+	}
+	return changed, nil
+}
+
+func (h *handle) Copy(uid bool, set parser.SequenceSet, dest string) error {
+	blobs := []string{}
+	var target int64
+	copied := false
+	err := h.transact(func(tx *sql.Tx) error {
+		messages, err := h.open(tx)
+		if err != nil {
+			return err
+		}
+		target, err = h.user.mailbox(tx, dest)
+		if err != nil {
+			return err
+		}
+		for _, message := range backend.Filter(h.messages(messages), uid, set) {
+			copied = true
+			m := messages[message.SeqNum-1]
+			var blob *string
+			if m.blob != "" {
+				// every message has its own file, so expunging
+				// one doesn't affect the others
+				if blob, err = h.backend.linkBlob(m.blob); err != nil {
+					return err
+				}
+				blobs = append(blobs, *blob)
+			}
+			uid, err := nextUid(tx, target)
+			if err != nil {
+				return err
+			}
+			_, err = tx.Exec(`INSERT INTO messages (mailbox_id, uid, flags, recent, date, size, body, blob)
+				SELECT ?, ?, flags, 1, date, size, body, ? FROM messages WHERE id = ?`, target, uid, blob, m.id)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		h.backend.removeBlobs(blobs)
+	} else if copied {
+		h.backend.publish(target, backend.Update{Type: backend.UpdateExists})
+	}
+	return err
+}
+
+func (h *handle) Expunge() ([]uint32, error) {
+	expunged, uids, blobs := []uint32{}, []uint32{}, []string{}
+	err := h.transact(func(tx *sql.Tx) error {
+		messages, err := h.open(tx)
+		if err != nil {
+			return err
+		}
+		kept := uint32(0)
+		for _, m := range messages {
+			if !hasFlag(m.flags, `\Deleted`) {
+				kept++
+				continue
+			}
+			if _, err := tx.Exec(`DELETE FROM messages WHERE id = ?`, m.id); err != nil {
+				return err
+			}
+			expunged = append(expunged, kept+1)
+			uids = append(uids, m.uid)
+			if m.blob != "" {
+				blobs = append(blobs, m.blob)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	for _, uid := range uids {
+		delete(h.recent, uid)
+		h.backend.publish(h.id, backend.Update{Type: backend.UpdateExpunge, Uid: uid})
+	}
+	h.backend.removeBlobs(blobs)
+	return expunged, nil
+}
+
+func (h *handle) Watch() *backend.Subscription {
+	return h.backend.bus.Subscribe(strconv.FormatInt(h.id, 10))
+}
+
+// publish passes updates of the mailbox with id to the sessions which
+// watch it. Transactions of others may commit in between, so the
+// updates only tell what to look at again.
+func (b *Backend) publish(id int64, updates ...backend.Update) {
+	b.bus.Publish(strconv.FormatInt(id, 10), updates...)
+}
+
+// messages returns messages as this session sees them, without body
+func (h *handle) messages(messages []*message) []backend.Message {
+	seen := make([]backend.Message, len(messages))
+	for i, m := range messages {
+		seen[i] = backend.Message{
+			SeqNum:       uint32(i + 1),
+			Uid:          m.uid,
+			Flags:        h.flags(m),
+			InternalDate: m.date,
+			Size:         m.size,
+		}
+	}
+	return seen
+}
+
+// flags returns the flags of m, with \Recent when it is recent
+// for this session
+func (h *handle) flags(m *message) []string {
+	flags := append([]string{}, m.flags...)
+	if h.recent[m.uid] || h.taken[m.uid] || (m.recent && (!h.selected || h.readOnly)) {
+		flags = append(flags, `\Recent`)
+	}
+	return flags
+}
+
+// nextUid returns the UID for a new message in mailbox. The update
+// comes first, so concurrent transactions wait for each other.
+func nextUid(tx *sql.Tx, mailbox int64) (uint32, error) {
+	if _, err := tx.Exec(`UPDATE mailboxes SET uid_next = uid_next + 1 WHERE id = ?`, mailbox); err != nil {
+		return 0, err
+	}
+	var uid uint32
+	err := tx.QueryRow(`SELECT uid_next - 1 FROM mailboxes WHERE id = ?`, mailbox).Scan(&uid)
+	return uid, err
+}
+
+func hasFlag(flags []string, flag string) bool {
+	for _, f := range flags {
+		if strings.EqualFold(f, flag) {
+			return true
+		}
+	}
+	return false
+}
+
+// body returns the body of m
+func (b *Backend) body(tx *sql.Tx, m *message) ([]byte, error) {
+	if m.blob != "" {
+		return os.ReadFile(b.blobPath(m.blob))
+	}
+	var body []byte
+	err := tx.QueryRow(`SELECT body FROM messages WHERE id = ?`, m.id).Scan(&body)
+	return body, err
+}
+
+// writeBlob writes body to a new file in BlobDir and returns its name,
+// or nil when bodies are stored in the database
+func (b *Backend) writeBlob(body []byte) (*string, error) {
+	if b.BlobDir == "" {
+		return nil, nil
+	}
+	blob, err := b.newBlob()
+	if err != nil {
+		return nil, err
+	}
+	if err := writeFile(b.blobPath(blob), bytes.NewReader(body)); err != nil {
+		return nil, err
+	}
+	return &blob, nil
+}
+
+// linkBlob returns a new file in BlobDir with the content of blob,
+// which is a hard link when the file system supports them
+func (b *Backend) linkBlob(blob string) (*string, error) {
+	linked, err := b.newBlob()
+	if err != nil {
+		return nil, err
+	}
+	if os.Link(b.blobPath(blob), b.blobPath(linked)) != nil {
+		src, err := os.Open(b.blobPath(blob))
+		if err != nil {
+			return nil, err
+		}
+		defer src.Close()
+		if err := writeFile(b.blobPath(linked), src); err != nil {
+			return nil, err
+		}
+	}
+	return &linked, nil
+}
+
+// newBlob returns a new random name for a file in BlobDir,
+// files are spread over directories by their first two characters
+func (b *Backend) newBlob() (string, error) {
+	random := make([]byte, 16)
+	if _, err := rand.Read(random); err != nil {
+		return "", err
+	}
+	blob := hex.EncodeToString(random)
+	return blob, os.MkdirAll(filepath.Dir(b.blobPath(blob)), 0700)
+}
+
+func (b *Backend) blobPath(blob string) string {
+	return filepath.Join(b.BlobDir, blob[:2], blob)
+}
+
+// writeFile creates path with the content of r. It is synced before
+// the transaction which refers to it commits, and removed on errors.
+func writeFile(path string, r io.Reader) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(f, r)
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(path)
+	}
+	return err
+}
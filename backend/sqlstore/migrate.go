@@ -0,0 +1,96 @@
+package sqlstore
+
+import (
+	"database/sql"
+	"errors"
+)
+
+// migrations are the versions of the schema, each one is a list of
+// statements which brings the schema from the version before it to
+// this one. Released versions must not change, changes go in a new one.
+var migrations = [][]string{
+	// version 1
+	{
+		`CREATE TABLE users (
+			id INTEGER PRIMARY KEY,
+			username TEXT NOT NULL UNIQUE,
+			uid_validity INTEGER NOT NULL
+		)`,
+		`CREATE TABLE mailboxes (
+			id INTEGER PRIMARY KEY,
+			user_id INTEGER NOT NULL REFERENCES users (id),
+			name TEXT NOT NULL,
+			uid_validity INTEGER NOT NULL,
+			uid_next INTEGER NOT NULL,
+			noselect INTEGER NOT NULL DEFAULT 0,
+			UNIQUE (user_id, name)
+		)`,
+		`CREATE TABLE subscriptions (
+			user_id INTEGER NOT NULL REFERENCES users (id),
+			name TEXT NOT NULL,
+			PRIMARY KEY (user_id, name)
+		)`,
+		`CREATE TABLE messages (
+			id INTEGER PRIMARY KEY,
+			mailbox_id INTEGER NOT NULL REFERENCES mailboxes (id),
+			uid INTEGER NOT NULL,
+			flags TEXT NOT NULL,
+			recent INTEGER NOT NULL,
+			date TEXT NOT NULL,
+			size INTEGER NOT NULL,
+			body BLOB,
+			blob TEXT,
+			UNIQUE (mailbox_id, uid)
+		)`,
+	},
+}
+
+var errSchemaTooNew = errors.New("SQL: schema is newer than this backend")
+
+// migrate brings the schema of db to the last version. Each version is
+// applied in its own transaction, together with the update of the
+// version number in schema_version.
+func migrate(db *sql.DB) error {
+	if _, err := db.Exec(`CREATE TABLE IF NOT EXISTS schema_version (version INTEGER NOT NULL)`); err != nil {
+		return err
+	}
+	for {
+		done, err := migrateNext(db)
+		if err != nil || done {
+			return err
+		}
+	}
+}
+
+// migrateNext applies the version after the current one,
+// done is set when there is none
+func migrateNext(db *sql.DB) (done bool, err error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	var version int
+	if err := tx.QueryRow(`SELECT COALESCE(MAX(version), 0) FROM schema_version`).Scan(&version); err != nil {
+		return false, err
+	}
+	if version > len(migrations) {
+		return false, errSchemaTooNew
+	}
+	if version == len(migrations) {
+		return true, nil
+	}
+	for _, statement := range migrations[version] {
+		if _, err := tx.Exec(statement); err != nil {
+			return false, err
+		}
+	}
+	if _, err := tx.Exec(`DELETE FROM schema_version`); err != nil {
+		return false, err
+	}
+	if _, err := tx.Exec(`INSERT INTO schema_version (version) VALUES (?)`, version+1); err != nil {
+		return false, err
+	}
+	return false, tx.Commit()
+}
@@ -0,0 +1,402 @@
+/*
+Package sqlstore implements a backend.Backend on a database/sql
+database, so users of many domains can share a single database.
+
+Mailboxes, messages with their flags and UIDs, and subscriptions are
+stored in tables, bodies of messages either in the table of the
+messages or as files in a blob directory:
+
+	db, err := sql.Open("sqlite", "mail.db?_pragma=busy_timeout(5000)")
+	db.SetMaxOpenConns(1)
+	b, err := sqlstore.New(db, authenticate)
+	b.BlobDir = "/var/mail/blobs"
+
+New brings the schema up to date. Every command runs in a transaction,
+so concurrent sessions, also of other processes, see STORE, COPY and
+EXPUNGE either completely or not at all. Statements use "?"
+placeholders and the SQL dialect of SQLite. With SQLite the pool of a
+process should be limited to a single connection, since its
+transactions lock the whole database.
+*/
+package sqlstore
+
+import (
+	"database/sql"
+	"github.com/gopistolet/imap/backend"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Backend serves the users in a database
+type Backend struct {
+	// Authenticate checks the password of username, it returns
+	// backend.ErrInvalidCredentials for a wrong password.
+	// Users are added to the database when they log in
+	// for the first time.
+	Authenticate func(username, password string) error
+
+	// BlobDir is the directory for the bodies of new messages,
+	// when it is "" they are stored in the database
+	BlobDir string
+
+	db  *sql.DB
+	bus backend.Bus // by mailbox id
+}
+
+// New creates a Backend on db which authenticates users with
+// authenticate, and migrates the schema of db to the last version
+func New(db *sql.DB, authenticate func(username, password string) error) (*Backend, error) {
+	if err := migrate(db); err != nil {
+		return nil, err
+	}
+	return &Backend{Authenticate: authenticate, db: db}, nil
+}
+
+func (b *Backend) Login(username, password string) (backend.User, error) {
+	if err := b.Authenticate(username, password); err != nil {
+		return nil, err
+	}
+	u := &user{backend: b, username: username}
+	err := b.transact(func(tx *sql.Tx) error {
+		err := tx.QueryRow(`SELECT id FROM users WHERE username = ?`, username).Scan(&u.id)
+		if err != sql.ErrNoRows {
+			return err
+		}
+		result, err := tx.Exec(`INSERT INTO users (username, uid_validity) VALUES (?, ?)`, username, time.Now().Unix())
+		if err != nil {
+			return err
+		}
+		if u.id, err = result.LastInsertId(); err != nil {
+			return err
+		}
+		return u.createMailbox(tx, "INBOX", false)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return u, nil
+}
+
+// transact runs f in a transaction,
+// which is committed if f doesn't return an error
+func (b *Backend) transact(f func(tx *sql.Tx) error) error {
+	tx, err := b.db.Begin()
+	if err != nil {
+		return err
+	}
+	if err := f(tx); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// user implements backend.User
+type user struct {
+	backend  *Backend
+	id       int64
+	username string
+}
+
+func (u *user) Username() string {
+	return u.username
+}
+
+func (u *user) ListMailboxes(subscribed bool) ([]backend.MailboxInfo, error) {
+	list := []backend.MailboxInfo{}
+	err := u.backend.transact(func(tx *sql.Tx) error {
+		mailboxes, err := u.mailboxes(tx)
+		if err != nil {
+			return err
+		}
+
+		names := []string{}
+		if subscribed {
+			if names, err = column(tx, `SELECT name FROM subscriptions WHERE user_id = ?`, u.id); err != nil {
+				return err
+			}
+		} else {
+			for name := range mailboxes {
+				names = append(names, name)
+			}
+		}
+		sort.Strings(names)
+
+		for _, name := range names {
+			attributes := []string{}
+			if noSelect, ok := mailboxes[name]; !ok || noSelect {
+				attributes = append(attributes, `\Noselect`)
+			}
+			if hasChildren(mailboxes, name) {
+				attributes = append(attributes, `\HasChildren`)
+			} else {
+				attributes = append(attributes, `\HasNoChildren`)
+			}
+			list = append(list, backend.MailboxInfo{Name: name, Attributes: attributes})
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return list, nil
+}
+
+func (u *user) GetMailbox(name string) (backend.Mailbox, error) {
+	h := &handle{backend: u.backend, user: u, name: canonicalName(name)}
+	err := u.backend.transact(func(tx *sql.Tx) error {
+		var err error
+		h.id, err = u.mailbox(tx, name)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return h, nil
+}
+
+// CreateMailbox creates name, and the levels of the hierarchy
+// above it which don't exist yet
+func (u *user) CreateMailbox(name string) error {
+	name = canonicalName(name)
+	return u.backend.transact(func(tx *sql.Tx) error {
+		mailboxes, err := u.mailboxes(tx)
+		if err != nil {
+			return err
+		}
+		if noSelect, ok := mailboxes[name]; ok {
+			if !noSelect {
+				return backend.ErrMailboxAlreadyExists
+			}
+			if _, err := tx.Exec(`DELETE FROM mailboxes WHERE user_id = ? AND name = ?`, u.id, name); err != nil {
+				return err
+			}
+		}
+		levels := strings.Split(name, backend.Delimiter)
+		for i := 1; i < len(levels); i++ {
+			parent := strings.Join(levels[:i], backend.Delimiter)
+			if _, ok := mailboxes[parent]; !ok {
+				if err := u.createMailbox(tx, parent, false); err != nil {
+					return err
+				}
+			}
+		}
+		return u.createMailbox(tx, name, false)
+	})
+}
+
+// DeleteMailbox removes name with its messages. A mailbox with
+// children can't be removed, it is replaced by a \Noselect one,
+// which can only be removed once its children are.
+func (u *user) DeleteMailbox(name string) error {
+	blobs := []string{}
+	err := u.backend.transact(func(tx *sql.Tx) error {
+		id, noSelect, err := u.level(tx, name)
+		if err != nil {
+			return err
+		}
+		if noSelect {
+			mailboxes, err := u.mailboxes(tx)
+			if err != nil {
+				return err
+			}
+			if hasChildren(mailboxes, canonicalName(name)) {
+				return backend.ErrHasChildren
+			}
+		}
+		if blobs, err = column(tx, `SELECT blob FROM messages WHERE mailbox_id = ? AND blob IS NOT NULL`, id); err != nil {
+			return err
+		}
+		if _, err := tx.Exec(`DELETE FROM messages WHERE mailbox_id = ?`, id); err != nil {
+			return err
+		}
+		if _, err := tx.Exec(`DELETE FROM mailboxes WHERE id = ?`, id); err != nil {
+			return err
+		}
+		mailboxes, err := u.mailboxes(tx)
+		if err != nil {
+			return err
+		}
+		if hasChildren(mailboxes, canonicalName(name)) {
+			// the name stays, as the level above its children
+			return u.createMailbox(tx, canonicalName(name), true)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	u.backend.removeBlobs(blobs)
+	return nil
+}
+
+// RenameMailbox renames a mailbox with its children. Renaming INBOX
+// moves its messages to a new mailbox, and leaves INBOX empty.
+func (u *user) RenameMailbox(existingName, newName string) error {
+	existingName, newName = canonicalName(existingName), canonicalName(newName)
+	return u.backend.transact(func(tx *sql.Tx) error {
+		id, _, err := u.level(tx, existingName)
+		if err != nil {
+			return err
+		}
+		mailboxes, err := u.mailboxes(tx)
+		if err != nil {
+			return err
+		}
+		if _, ok := mailboxes[newName]; ok {
+			return backend.ErrMailboxAlreadyExists
+		}
+
+		if existingName == "INBOX" {
+			if err := u.createMailbox(tx, newName, false); err != nil {
+				return err
+			}
+			moved, err := u.mailbox(tx, newName)
+			if err != nil {
+				return err
+			}
+			if _, err := tx.Exec(`UPDATE messages SET mailbox_id = ? WHERE mailbox_id = ?`, moved, id); err != nil {
+				return err
+			}
+			_, err = tx.Exec(`UPDATE mailboxes SET uid_next = (SELECT uid_next FROM mailboxes WHERE id = ?) WHERE id = ?`, id, moved)
+			return err
+		}
+
+		prefix := existingName + backend.Delimiter
+		for name := range mailboxes {
+			if name == existingName || strings.HasPrefix(name, prefix) {
+				renamed := newName + strings.TrimPrefix(name, existingName)
+				if _, err := tx.Exec(`UPDATE mailboxes SET name = ? WHERE user_id = ? AND name = ?`, renamed, u.id, name); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+}
+
+func (u *user) SetSubscribed(name string, subscribed bool) error {
+	name = canonicalName(name)
+	return u.backend.transact(func(tx *sql.Tx) error {
+		if _, err := tx.Exec(`DELETE FROM subscriptions WHERE user_id = ? AND name = ?`, u.id, name); err != nil {
+			return err
+		}
+		if !subscribed {
+			return nil
+		}
+		if _, err := u.mailbox(tx, name); err != nil {
+			return err
+		}
+		_, err := tx.Exec(`INSERT INTO subscriptions (user_id, name) VALUES (?, ?)`, u.id, name)
+		return err
+	})
+}
+
+func (u *user) Logout() error {
+	return nil
+}
+
+// level returns the id of the mailbox with name, which may be a
+// \Noselect level of the hierarchy
+func (u *user) level(tx *sql.Tx, name string) (id int64, noSelect bool, err error) {
+	err = tx.QueryRow(`SELECT id, noselect FROM mailboxes WHERE user_id = ? AND name = ?`, u.id, canonicalName(name)).Scan(&id, &noSelect)
+	if err == sql.ErrNoRows {
+		return 0, false, backend.ErrNoSuchMailbox
+	}
+	return id, noSelect, err
+}
+
+// mailbox returns the id of the selectable mailbox with name
+func (u *user) mailbox(tx *sql.Tx, name string) (int64, error) {
+	var id int64
+	err := tx.QueryRow(`SELECT id FROM mailboxes WHERE user_id = ? AND name = ? AND noselect = 0`, u.id, canonicalName(name)).Scan(&id)
+	if err == sql.ErrNoRows {
+		return 0, backend.ErrNoSuchMailbox
+	}
+	return id, err
+}
+
+// mailboxes returns whether each mailbox of the user is \Noselect,
+// by name
+func (u *user) mailboxes(tx *sql.Tx) (map[string]bool, error) {
+	rows, err := tx.Query(`SELECT name, noselect FROM mailboxes WHERE user_id = ?`, u.id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	mailboxes := map[string]bool{}
+	for rows.Next() {
+		var name string
+		var noSelect bool
+		if err := rows.Scan(&name, &noSelect); err != nil {
+			return nil, err
+		}
+		mailboxes[name] = noSelect
+	}
+	return mailboxes, rows.Err()
+}
+
+// createMailbox adds an empty mailbox with a new UIDVALIDITY, so a
+// mailbox which is created again doesn't reuse UIDs. The last
+// UIDVALIDITY given out is kept with the user.
+func (u *user) createMailbox(tx *sql.Tx, name string, noSelect bool) error {
+	var uidValidity uint32
+	if err := tx.QueryRow(`SELECT uid_validity FROM users WHERE id = ?`, u.id).Scan(&uidValidity); err != nil {
+		return err
+	}
+	uidValidity++
+	if _, err := tx.Exec(`UPDATE users SET uid_validity = ? WHERE id = ?`, uidValidity, u.id); err != nil {
+		return err
+	}
+	_, err := tx.Exec(`INSERT INTO mailboxes (user_id, name, uid_validity, uid_next, noselect) VALUES (?, ?, ?, 1, ?)`,
+		u.id, name, uidValidity, noSelect)
+	return err
+}
+
+// hasChildren reports whether there are mailboxes below name
+func hasChildren(mailboxes map[string]bool, name string) bool {
+	prefix := name + backend.Delimiter
+	for other := range mailboxes {
+		if strings.HasPrefix(other, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// column returns the values of the single column of the rows of query
+func column(tx *sql.Tx, query string, args ...interface{}) ([]string, error) {
+	rows, err := tx.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	values := []string{}
+	for rows.Next() {
+		var value string
+		if err := rows.Scan(&value); err != nil {
+			return nil, err
+		}
+		values = append(values, value)
+	}
+	return values, rows.Err()
+}
+
+// canonicalName returns name, with INBOX in upper case
+// since it is case-insensitive
+func canonicalName(name string) string {
+	if strings.EqualFold(name, "INBOX") {
+		return "INBOX"
+	}
+	return name
+}
+
+// removeBlobs removes the files of bodies which are no longer
+// referred to, errors are ignored since the messages are gone
+func (b *Backend) removeBlobs(blobs []string) {
+	for _, blob := range blobs {
+		os.Remove(b.blobPath(blob))
+	}
+}
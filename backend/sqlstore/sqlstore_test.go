@@ -0,0 +1,261 @@
+package sqlstore
+
+import (
+	"database/sql"
+	_ "github.com/glebarez/go-sqlite"
+	"github.com/gopistolet/imap/backend"
+	"github.com/gopistolet/imap/parser"
+	. "github.com/smartystreets/goconvey/convey"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSqlstore(t *testing.T) {
+
+	open := func() *sql.DB {
+		db, err := sql.Open("sqlite", filepath.Join(t.TempDir(), "mail.db")+"?_pragma=busy_timeout(5000)")
+		if err != nil {
+			t.Fatal(err)
+		}
+		db.SetMaxOpenConns(1)
+		return db
+	}
+	authenticate := func(username, password string) error {
+		if password != "secret" {
+			return backend.ErrInvalidCredentials
+		}
+		return nil
+	}
+
+	Convey("Testing migrations", t, func() {
+
+		db := open()
+		defer db.Close()
+		_, err := New(db, authenticate)
+		So(err, ShouldEqual, nil)
+		_, err = New(db, authenticate)
+		So(err, ShouldEqual, nil)
+		var version int
+		db.QueryRow(`SELECT version FROM schema_version`).Scan(&version)
+		So(version, ShouldEqual, len(migrations))
+
+		db.Exec(`UPDATE schema_version SET version = ?`, len(migrations)+1)
+		_, err = New(db, authenticate)
+		So(err, ShouldEqual, errSchemaTooNew)
+	})
+
+	Convey("Testing mailboxes", t, func() {
+
+		db := open()
+		defer db.Close()
+		b, _ := New(db, authenticate)
+		_, err := b.Login("mrc", "wrong")
+		So(err, ShouldEqual, backend.ErrInvalidCredentials)
+		u, err := b.Login("mrc", "secret")
+		So(err, ShouldEqual, nil)
+		names := func(subscribed bool) []string {
+			list, err := u.ListMailboxes(subscribed)
+			So(err, ShouldEqual, nil)
+			names := []string{}
+			for _, info := range list {
+				names = append(names, info.Name+" "+strings.Join(info.Attributes, " "))
+			}
+			return names
+		}
+
+		So(u.CreateMailbox("work/reports/2016"), ShouldEqual, nil)
+		So(u.CreateMailbox("work"), ShouldEqual, backend.ErrMailboxAlreadyExists)
+		So(u.CreateMailbox("inbox"), ShouldEqual, backend.ErrMailboxAlreadyExists)
+		So(names(false), ShouldResemble, []string{
+			`INBOX \HasNoChildren`,
+			`work \HasChildren`,
+			`work/reports \HasChildren`,
+			`work/reports/2016 \HasNoChildren`,
+		})
+
+		So(u.RenameMailbox("work/reports", "archive"), ShouldEqual, nil)
+		So(u.RenameMailbox("work", "archive"), ShouldEqual, backend.ErrMailboxAlreadyExists)
+		So(u.RenameMailbox("missing", "other"), ShouldEqual, backend.ErrNoSuchMailbox)
+		So(u.DeleteMailbox("archive"), ShouldEqual, nil)
+		So(names(false), ShouldResemble, []string{
+			`INBOX \HasNoChildren`,
+			`archive \Noselect \HasChildren`,
+			`archive/2016 \HasNoChildren`,
+			`work \HasNoChildren`,
+		})
+		_, err = u.GetMailbox("archive")
+		So(err, ShouldEqual, backend.ErrNoSuchMailbox)
+
+		// \Noselect levels can be renamed, and deleted once they have
+		// no children
+		So(u.DeleteMailbox("archive"), ShouldEqual, backend.ErrHasChildren)
+		So(u.RenameMailbox("archive", "old"), ShouldEqual, nil)
+		So(names(false), ShouldContain, `old \Noselect \HasChildren`)
+		So(u.RenameMailbox("old", "archive"), ShouldEqual, nil)
+		So(u.DeleteMailbox("archive/2016"), ShouldEqual, nil)
+		So(u.DeleteMailbox("archive"), ShouldEqual, nil)
+		So(names(false), ShouldResemble, []string{`INBOX \HasNoChildren`, `work \HasNoChildren`})
+		So(u.CreateMailbox("archive"), ShouldEqual, nil)
+
+		So(u.SetSubscribed("work", true), ShouldEqual, nil)
+		So(u.SetSubscribed("work", true), ShouldEqual, nil)
+		So(u.SetSubscribed("missing", true), ShouldEqual, backend.ErrNoSuchMailbox)
+		So(names(true), ShouldResemble, []string{`work \HasNoChildren`})
+		So(u.DeleteMailbox("work"), ShouldEqual, nil)
+		So(names(true), ShouldResemble, []string{`work \Noselect \HasNoChildren`})
+
+		// users don't see each other's mailboxes
+		other, _ := b.Login("other", "secret")
+		list, _ := other.ListMailboxes(false)
+		So(list, ShouldResemble, []backend.MailboxInfo{{Name: "INBOX", Attributes: []string{`\HasNoChildren`}}})
+	})
+
+	for _, blobs := range []bool{false, true} {
+
+		Convey("Testing messages, with blob directory: "+map[bool]string{false: "no", true: "yes"}[blobs], t, func() {
+
+			db := open()
+			defer db.Close()
+			b, _ := New(db, authenticate)
+			if blobs {
+				b.BlobDir = t.TempDir()
+			}
+			files := func() int {
+				n := 0
+				if blobs {
+					filepath.Walk(b.BlobDir, func(path string, info os.FileInfo, err error) error {
+						if err == nil && info.Mode().IsRegular() {
+							n++
+						}
+						return nil
+					})
+				}
+				return n
+			}
+			u, _ := b.Login("mrc", "secret")
+			u.CreateMailbox("saved")
+			date := time.Date(1996, 7, 17, 2, 44, 25, 0, time.FixedZone("", -7*60*60))
+			all := parser.SequenceSet{{Start: 1, Stop: 0}}
+
+			inbox, _ := u.GetMailbox("INBOX")
+			So(inbox.Append([]string{`\seen`, `\Recent`}, date, []byte("Subject: one\r\n\r\n")), ShouldEqual, nil)
+			So(inbox.Append(nil, date, []byte("Subject: two\r\n\r\n")), ShouldEqual, nil)
+
+			status, _ := inbox.Status()
+			So(status.Messages, ShouldEqual, 2)
+			So(status.Recent, ShouldEqual, 2)
+			So(status.Unseen, ShouldEqual, 1)
+			So(status.FirstUnseen, ShouldEqual, 2)
+			So(status.UidNext, ShouldEqual, 3)
+
+			// the first session which selects the mailbox takes over \Recent,
+			// EXAMINE doesn't
+			examined, _ := u.GetMailbox("INBOX")
+			So(examined.Select(true), ShouldEqual, nil)
+			first, _ := u.GetMailbox("INBOX")
+			So(first.Select(false), ShouldEqual, nil)
+			second, _ := u.GetMailbox("INBOX")
+			So(second.Select(false), ShouldEqual, nil)
+			status, _ = first.Status()
+			So(status.Recent, ShouldEqual, 2)
+			status, _ = second.Status()
+			So(status.Recent, ShouldEqual, 0)
+			second.Append(nil, date, []byte("Subject: three\r\n\r\n"))
+			status, _ = second.Status()
+			So(status.Recent, ShouldEqual, 1)
+			status, _ = first.Status()
+			So(status.Recent, ShouldEqual, 2)
+
+			messages, err := first.Fetch(true, parser.SequenceSet{{Start: 2, Stop: 0}}, true)
+			So(err, ShouldEqual, nil)
+			So(len(messages), ShouldEqual, 2)
+			So(messages[0].Flags, ShouldResemble, []string{`\Recent`})
+			So(messages[0].InternalDate.Equal(date), ShouldBeTrue)
+			So(messages[0].InternalDate.Format(time.RFC1123Z), ShouldEqual, date.Format(time.RFC1123Z))
+			So(messages[0].Size, ShouldEqual, 16)
+			So(string(messages[0].Body), ShouldEqual, "Subject: two\r\n\r\n")
+			So(messages[1].Flags, ShouldBeEmpty)
+
+			updates := second.(backend.WatchedMailbox).Watch()
+			defer updates.Close()
+			changed, err := first.Store(false, parser.SequenceSet{{Start: 1, Stop: 2}}, "+", []string{`\Deleted`})
+			So(err, ShouldEqual, nil)
+			So(updates.Updates(), ShouldResemble, []backend.Update{{Type: backend.UpdateFlags, Uid: 1}, {Type: backend.UpdateFlags, Uid: 2}})
+			So(changed[0].Flags, ShouldResemble, []string{`\Seen`, `\Deleted`, `\Recent`})
+			results, _ := second.Search(true, []parser.SearchKey{{Name: "DELETED"}})
+			So(results, ShouldResemble, []uint32{1, 2})
+			results, _ = second.Search(false, []parser.SearchKey{{Name: "SUBJECT", Value: "three"}})
+			So(results, ShouldResemble, []uint32{3})
+
+			So(files(), ShouldEqual, map[bool]int{false: 0, true: 3}[blobs])
+			So(first.Copy(false, all, "missing"), ShouldEqual, backend.ErrNoSuchMailbox)
+			So(first.Copy(false, parser.SequenceSet{{Start: 2, Stop: 3}}, "saved"), ShouldEqual, nil)
+			So(files(), ShouldEqual, map[bool]int{false: 0, true: 5}[blobs])
+			saved, _ := u.GetMailbox("saved")
+			messages, _ = saved.Fetch(false, all, true)
+			So(len(messages), ShouldEqual, 2)
+			So(messages[0].Uid, ShouldEqual, 1)
+			So(messages[0].Flags, ShouldResemble, []string{`\Deleted`, `\Recent`})
+			So(string(messages[1].Body), ShouldEqual, "Subject: three\r\n\r\n")
+
+			expunged, err := first.Expunge()
+			So(err, ShouldEqual, nil)
+			So(expunged, ShouldResemble, []uint32{1, 1})
+			So(updates.Updates(), ShouldResemble, []backend.Update{{Type: backend.UpdateExpunge, Uid: 1}, {Type: backend.UpdateExpunge, Uid: 2}})
+			So(files(), ShouldEqual, map[bool]int{false: 0, true: 3}[blobs])
+			messages, _ = second.Fetch(false, all, false)
+			So(len(messages), ShouldEqual, 1)
+			So(messages[0].SeqNum, ShouldEqual, 1)
+			So(messages[0].Uid, ShouldEqual, 3)
+
+			// the copies don't depend on the expunged messages
+			messages, _ = saved.Fetch(false, all, true)
+			So(string(messages[0].Body), ShouldEqual, "Subject: two\r\n\r\n")
+
+			// everything is in the database
+			reopened, err := New(db, authenticate)
+			So(err, ShouldEqual, nil)
+			reopened.BlobDir = b.BlobDir
+			u, _ = reopened.Login("mrc", "secret")
+			again, _ := u.GetMailbox("inbox")
+			later, _ := again.Status()
+			So(later.UidValidity, ShouldEqual, status.UidValidity)
+			So(later.UidNext, ShouldEqual, 4)
+			So(later.Messages, ShouldEqual, 1)
+
+			So(u.RenameMailbox("INBOX", "old"), ShouldEqual, nil)
+			So(first.Name(), ShouldEqual, "INBOX")
+			status, _ = first.Status()
+			So(status.Messages, ShouldEqual, 0)
+			So(status.UidNext, ShouldEqual, 4)
+			old, _ := u.GetMailbox("old")
+			status, _ = old.Status()
+			So(status.Messages, ShouldEqual, 1)
+			So(status.UidNext, ShouldEqual, 4)
+			So(u.RenameMailbox("saved", "kept"), ShouldEqual, nil)
+			So(saved.Name(), ShouldEqual, "kept")
+
+			So(u.DeleteMailbox("kept"), ShouldEqual, nil)
+			So(files(), ShouldEqual, map[bool]int{false: 0, true: 1}[blobs])
+			_, err = saved.Status()
+			So(err, ShouldEqual, backend.ErrNoSuchMailbox)
+
+			// \Recent taken over by a transaction which fails stays
+			// with the message
+			u.CreateMailbox("drafts")
+			drafts, _ := u.GetMailbox("drafts")
+			So(drafts.Select(false), ShouldEqual, nil)
+			So(drafts.Append(nil, date, []byte("Subject: draft\r\n\r\n")), ShouldEqual, nil)
+			So(drafts.Copy(false, all, "missing"), ShouldEqual, backend.ErrNoSuchMailbox)
+			other, _ := u.GetMailbox("drafts")
+			So(other.Select(false), ShouldEqual, nil)
+			recent, _ := other.Status()
+			So(recent.Recent, ShouldEqual, 1)
+			recent, _ = drafts.Status()
+			So(recent.Recent, ShouldEqual, 0)
+		})
+	}
+}
@@ -0,0 +1,306 @@
+package oauth
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	_ "crypto/sha256"
+	_ "crypto/sha512"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// clockSkew is how far the clocks of the server and the identity
+// provider may be apart
+const clockSkew = time.Minute
+
+// JWKSValidator validates JSON Web Tokens (RFC 7519) which are signed
+// with a key of a JWK Set file (RFC 7517), like the one an identity
+// provider publishes at its jwks_uri. The file is read again when it
+// changes, so keys can be rotated without a restart.
+type JWKSValidator struct {
+	// Issuer is required in the "iss" claim, if it isn't empty
+	Issuer string
+	// Audience is required in the "aud" claim, if it isn't empty
+	Audience string
+	// UsernameClaim is the claim which holds the username, "sub" if empty
+	UsernameClaim string
+
+	path string
+	now  func() time.Time
+
+	mu      sync.Mutex
+	keys    []jsonWebKey
+	modTime time.Time
+	size    int64
+}
+
+// jsonWebKey is a public key of a JWK Set
+type jsonWebKey struct {
+	id        string
+	algorithm string // the only algorithm the key may be used with, if not empty
+	key       crypto.PublicKey
+}
+
+// NewJWKSValidator creates a validator for the keys in the JWK Set file
+// at path
+func NewJWKSValidator(path string) (*JWKSValidator, error) {
+	v := &JWKSValidator{path: path, now: time.Now}
+	if _, err := v.keySet(); err != nil {
+		return nil, err
+	}
+	return v, nil
+}
+
+// Validate checks the signature and claims of token,
+// and returns its username
+func (v *JWKSValidator) Validate(token string) (string, error) {
+	/*
+		JWS = BASE64URL(header) "." BASE64URL(payload) "." BASE64URL(signature)
+	*/
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return "", ErrMalformedToken
+	}
+	var header struct {
+		Algorithm string `json:"alg"`
+		KeyID     string `json:"kid"`
+	}
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return "", err
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return "", ErrMalformedToken
+	}
+	keys, err := v.keySet()
+	if err != nil {
+		return "", err
+	}
+	verified := false
+	for _, key := range keys {
+		if (header.KeyID != "" && key.id != header.KeyID) || (key.algorithm != "" && key.algorithm != header.Algorithm) {
+			continue
+		}
+		if verify(header.Algorithm, key.key, []byte(parts[0]+"."+parts[1]), signature) {
+			verified = true
+			break
+		}
+	}
+	if !verified {
+		return "", ErrInvalidSignature
+	}
+
+	var claims map[string]interface{}
+	if err := decodeSegment(parts[1], &claims); err != nil {
+		return "", err
+	}
+	now := v.now()
+	expires, ok := claims["exp"].(json.Number)
+	if !ok || !now.Before(numericDate(expires).Add(clockSkew)) {
+		return "", ErrTokenExpired
+	}
+	if notBefore, ok := claims["nbf"].(json.Number); ok && now.Add(clockSkew).Before(numericDate(notBefore)) {
+		return "", ErrTokenExpired
+	}
+	if v.Issuer != "" && claims["iss"] != v.Issuer {
+		return "", ErrWrongAudience
+	}
+	if v.Audience != "" && !hasAudience(claims["aud"], v.Audience) {
+		return "", ErrWrongAudience
+	}
+	usernameClaim := v.UsernameClaim
+	if usernameClaim == "" {
+		usernameClaim = "sub"
+	}
+	username, _ := claims[usernameClaim].(string)
+	if username == "" {
+		return "", ErrNoUsername
+	}
+	return username, nil
+}
+
+// decodeSegment decodes a base64url encoded JSON segment of a token
+func decodeSegment(segment string, v interface{}) error {
+	data, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return ErrMalformedToken
+	}
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	if err := decoder.Decode(v); err != nil {
+		return ErrMalformedToken
+	}
+	return nil
+}
+
+// numericDate returns the time of a NumericDate,
+// seconds since the epoch
+func numericDate(n json.Number) time.Time {
+	seconds, err := n.Float64()
+	if err != nil {
+		return time.Time{}
+	}
+	return time.Unix(0, 0).Add(time.Duration(seconds * float64(time.Second)))
+}
+
+// hasAudience reports whether the "aud" claim, a string or an array of
+// strings, holds audience
+func hasAudience(claim interface{}, audience string) bool {
+	switch claim := claim.(type) {
+	case string:
+		return claim == audience
+	case []interface{}:
+		for _, a := range claim {
+			if a == audience {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// verify checks the JWS signature (RFC 7518 section 3) of input
+func verify(algorithm string, key crypto.PublicKey, input, signature []byte) bool {
+	hashes := map[string]crypto.Hash{"256": crypto.SHA256, "384": crypto.SHA384, "512": crypto.SHA512}
+	if algorithm == "EdDSA" {
+		key, ok := key.(ed25519.PublicKey)
+		return ok && ed25519.Verify(key, input, signature)
+	}
+	if len(algorithm) != 5 {
+		return false
+	}
+	hash, ok := hashes[algorithm[2:]]
+	if !ok {
+		return false
+	}
+	h := hash.New()
+	h.Write(input)
+	digest := h.Sum(nil)
+
+	switch algorithm[:2] {
+	case "RS":
+		key, ok := key.(*rsa.PublicKey)
+		return ok && rsa.VerifyPKCS1v15(key, hash, digest, signature) == nil
+	case "PS":
+		key, ok := key.(*rsa.PublicKey)
+		return ok && rsa.VerifyPSS(key, hash, digest, signature, &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthEqualsHash}) == nil
+	case "ES":
+		/*
+			the signature is R and S as big-endian integers
+			of the size of the curve each
+		*/
+		key, ok := key.(*ecdsa.PublicKey)
+		if !ok {
+			return false
+		}
+		size := (key.Curve.Params().BitSize + 7) / 8
+		// ES256 is P-256, ES384 is P-384 and ES512 is P-521
+		if len(signature) != 2*size || map[string]int{"256": 32, "384": 48, "512": 66}[algorithm[2:]] != size {
+			return false
+		}
+		r := new(big.Int).SetBytes(signature[:size])
+		s := new(big.Int).SetBytes(signature[size:])
+		return ecdsa.Verify(key, digest, r, s)
+	}
+	return false
+}
+
+// keySet returns the keys of the file, which is read again when it
+// changed. The keys read before are kept if it can't be read.
+func (v *JWKSValidator) keySet() ([]jsonWebKey, error) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	info, err := os.Stat(v.path)
+	if err != nil {
+		if v.keys != nil {
+			return v.keys, nil
+		}
+		return nil, err
+	}
+	if v.keys != nil && info.ModTime().Equal(v.modTime) && info.Size() == v.size {
+		return v.keys, nil
+	}
+	data, err := os.ReadFile(v.path)
+	if err == nil {
+		var keys []jsonWebKey
+		if keys, err = parseKeySet(data); err == nil {
+			v.keys, v.modTime, v.size = keys, info.ModTime(), info.Size()
+		}
+	}
+	if err != nil && v.keys == nil {
+		return nil, err
+	}
+	return v.keys, nil
+}
+
+// parseKeySet returns the signature keys of a JWK Set,
+// keys of other types or for other uses are skipped
+func parseKeySet(data []byte) ([]jsonWebKey, error) {
+	var set struct {
+		Keys []struct {
+			Type      string `json:"kty"`
+			ID        string `json:"kid"`
+			Algorithm string `json:"alg"`
+			Use       string `json:"use"`
+			Curve     string `json:"crv"`
+			N         string `json:"n"`
+			E         string `json:"e"`
+			X         string `json:"x"`
+			Y         string `json:"y"`
+		} `json:"keys"`
+	}
+	if err := json.Unmarshal(data, &set); err != nil {
+		return nil, errors.New("OAuth: invalid JWK Set: " + err.Error())
+	}
+
+	keys := []jsonWebKey{}
+	for _, k := range set.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		var key crypto.PublicKey
+		switch k.Type {
+		case "RSA":
+			n, errN := base64.RawURLEncoding.DecodeString(k.N)
+			e, errE := base64.RawURLEncoding.DecodeString(k.E)
+			exponent := new(big.Int).SetBytes(e)
+			if errN != nil || errE != nil || len(n) == 0 || !exponent.IsInt64() || exponent.Int64() < 3 || exponent.Int64() > 1<<31-1 {
+				return nil, errors.New("OAuth: invalid RSA key " + k.ID)
+			}
+			key = &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(exponent.Int64())}
+		case "EC":
+			curve := map[string]elliptic.Curve{"P-256": elliptic.P256(), "P-384": elliptic.P384(), "P-521": elliptic.P521()}[k.Curve]
+			x, errX := base64.RawURLEncoding.DecodeString(k.X)
+			y, errY := base64.RawURLEncoding.DecodeString(k.Y)
+			if curve == nil || errX != nil || errY != nil {
+				return nil, errors.New("OAuth: invalid EC key " + k.ID)
+			}
+			ecKey := &ecdsa.PublicKey{Curve: curve, X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+			if !curve.IsOnCurve(ecKey.X, ecKey.Y) {
+				return nil, errors.New("OAuth: invalid EC key " + k.ID)
+			}
+			key = ecKey
+		case "OKP":
+			x, err := base64.RawURLEncoding.DecodeString(k.X)
+			if k.Curve != "Ed25519" || err != nil || len(x) != ed25519.PublicKeySize {
+				return nil, errors.New("OAuth: invalid OKP key " + k.ID)
+			}
+			key = ed25519.PublicKey(x)
+		default:
+			continue
+		}
+		keys = append(keys, jsonWebKey{id: k.ID, algorithm: k.Algorithm, key: key})
+	}
+	return keys, nil
+}
@@ -0,0 +1,34 @@
+/*
+Package oauth validates OAuth 2.0 bearer tokens (RFC 6750), for the
+OAUTHBEARER and XOAUTH2 mechanisms of the server.
+
+A TokenValidator returns the user a token was issued to. JWKSValidator
+checks JSON Web Tokens against the keys of the identity provider, which
+are kept in a local file:
+
+	v, err := oauth.NewJWKSValidator("/etc/imap/jwks.json")
+	v.Issuer = "https://id.example.com"
+	v.Audience = "imap"
+	s.Mechanisms["OAUTHBEARER"] = server.OAuthBearer(v)
+*/
+package oauth
+
+import (
+	"errors"
+)
+
+// TokenValidator checks bearer tokens
+type TokenValidator interface {
+	// Validate returns the username which token was issued to,
+	// or an error if the token can't be used
+	Validate(token string) (username string, err error)
+}
+
+// Errors of JWKSValidator
+var (
+	ErrMalformedToken   = errors.New("OAuth: malformed token")
+	ErrInvalidSignature = errors.New("OAuth: invalid signature")
+	ErrTokenExpired     = errors.New("OAuth: token expired or not valid yet")
+	ErrWrongAudience    = errors.New("OAuth: token was issued for another server")
+	ErrNoUsername       = errors.New("OAuth: token has no username")
+)
@@ -0,0 +1,145 @@
+package oauth
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	. "github.com/smartystreets/goconvey/convey"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestJWKSValidator(t *testing.T) {
+
+	encode := base64.RawURLEncoding.EncodeToString
+	rsaKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	ecKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	edPublic, edKey, _ := ed25519.GenerateKey(rand.Reader)
+	otherKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+
+	// sign returns a token with claims, signed with key
+	sign := func(algorithm, kid string, key crypto.Signer, claims map[string]interface{}) string {
+		header, _ := json.Marshal(map[string]string{"alg": algorithm, "kid": kid, "typ": "JWT"})
+		payload, _ := json.Marshal(claims)
+		input := encode(header) + "." + encode(payload)
+		digest := sha256.Sum256([]byte(input))
+		var signature []byte
+		switch key := key.(type) {
+		case *rsa.PrivateKey:
+			signature, _ = rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
+		case *ecdsa.PrivateKey:
+			r, s, _ := ecdsa.Sign(rand.Reader, key, digest[:])
+			signature = append(r.FillBytes(make([]byte, 32)), s.FillBytes(make([]byte, 32))...)
+		case ed25519.PrivateKey:
+			signature = ed25519.Sign(key, []byte(input))
+		}
+		return input + "." + encode(signature)
+	}
+	writeKeySet := func(path string, keys ...map[string]string) {
+		data, _ := json.Marshal(map[string]interface{}{"keys": keys})
+		if err := os.WriteFile(path, data, 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	rsaJWK := map[string]string{"kty": "RSA", "kid": "rsa", "alg": "RS256", "use": "sig",
+		"n": encode(rsaKey.N.Bytes()), "e": encode(big.NewInt(int64(rsaKey.E)).Bytes())}
+	ecJWK := map[string]string{"kty": "EC", "kid": "ec", "crv": "P-256",
+		"x": encode(ecKey.X.FillBytes(make([]byte, 32))), "y": encode(ecKey.Y.FillBytes(make([]byte, 32)))}
+	edJWK := map[string]string{"kty": "OKP", "kid": "ed", "crv": "Ed25519", "x": encode(edPublic)}
+	encryptionJWK := map[string]string{"kty": "EC", "kid": "enc", "use": "enc", "crv": "P-256",
+		"x": encode(otherKey.X.FillBytes(make([]byte, 32))), "y": encode(otherKey.Y.FillBytes(make([]byte, 32)))}
+
+	now := time.Unix(1700000000, 0)
+	claims := func(extra ...interface{}) map[string]interface{} {
+		claims := map[string]interface{}{
+			"iss": "https://id.example.com", "aud": []string{"webmail", "imap"},
+			"sub": "mrc", "email": "mrc@example.com",
+			"iat": now.Unix(), "exp": now.Add(time.Hour).Unix(),
+		}
+		for i := 0; i < len(extra); i += 2 {
+			if extra[i+1] == nil {
+				delete(claims, extra[i].(string))
+			} else {
+				claims[extra[i].(string)] = extra[i+1]
+			}
+		}
+		return claims
+	}
+
+	Convey("Testing JWKS validation", t, func() {
+
+		path := filepath.Join(t.TempDir(), "jwks.json")
+		_, err := NewJWKSValidator(path)
+		So(err, ShouldNotEqual, nil)
+		os.WriteFile(path, []byte(`{"keys": [{"kty": "EC", "crv": "P-256", "x": "AA", "y": "AA"}]}`), 0600)
+		_, err = NewJWKSValidator(path)
+		So(err, ShouldNotEqual, nil)
+
+		writeKeySet(path, rsaJWK, ecJWK, edJWK, encryptionJWK)
+		v, err := NewJWKSValidator(path)
+		So(err, ShouldEqual, nil)
+		v.now = func() time.Time { return now }
+		v.Issuer = "https://id.example.com"
+		v.Audience = "imap"
+
+		for _, token := range []string{
+			sign("RS256", "rsa", rsaKey, claims()),
+			sign("ES256", "ec", ecKey, claims()),
+			sign("ES256", "", ecKey, claims()),
+			sign("EdDSA", "ed", edKey, claims()),
+			sign("RS256", "rsa", rsaKey, claims("aud", "imap", "nbf", now.Add(30*time.Second).Unix())),
+		} {
+			username, err := v.Validate(token)
+			So(err, ShouldEqual, nil)
+			So(username, ShouldEqual, "mrc")
+		}
+
+		v.UsernameClaim = "email"
+		username, err := v.Validate(sign("ES256", "ec", ecKey, claims()))
+		So(err, ShouldEqual, nil)
+		So(username, ShouldEqual, "mrc@example.com")
+		v.UsernameClaim = ""
+
+		valid := sign("RS256", "rsa", rsaKey, claims())
+		for token, expected := range map[string]error{
+			"not a token":                                                             ErrMalformedToken,
+			valid[:len(valid)-4] + "AAAA":                                             ErrInvalidSignature,
+			sign("ES256", "rsa", ecKey, claims()):                                     ErrInvalidSignature,
+			sign("ES256", "enc", otherKey, claims()):                                  ErrInvalidSignature,
+			sign("ES256", "", otherKey, claims()):                                     ErrInvalidSignature,
+			sign("PS256", "rsa", rsaKey, claims()):                                    ErrInvalidSignature,
+			sign("none", "", nil, claims()):                                           ErrInvalidSignature,
+			sign("ES256", "ec", ecKey, claims("exp", nil)):                            ErrTokenExpired,
+			sign("ES256", "ec", ecKey, claims("exp", now.Add(-2*time.Minute).Unix())): ErrTokenExpired,
+			sign("ES256", "ec", ecKey, claims("nbf", now.Add(time.Hour).Unix())):      ErrTokenExpired,
+			sign("ES256", "ec", ecKey, claims("iss", "https://evil.example.com")):     ErrWrongAudience,
+			sign("ES256", "ec", ecKey, claims("aud", "webmail")):                      ErrWrongAudience,
+			sign("ES256", "ec", ecKey, claims("sub", nil)):                            ErrNoUsername,
+		} {
+			_, err := v.Validate(token)
+			So(err, ShouldEqual, expected)
+		}
+
+		// the keys are rotated
+		writeKeySet(path, ecJWK)
+		os.Chtimes(path, now, now)
+		_, err = v.Validate(valid)
+		So(err, ShouldEqual, ErrInvalidSignature)
+		_, err = v.Validate(sign("ES256", "ec", ecKey, claims()))
+		So(err, ShouldEqual, nil)
+
+		// a broken file doesn't lose the keys
+		os.WriteFile(path, []byte("{"), 0600)
+		_, err = v.Validate(sign("ES256", "ec", ecKey, claims()))
+		So(err, ShouldEqual, nil)
+	})
+}
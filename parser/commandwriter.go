@@ -0,0 +1,224 @@
+package parser
+
+import (
+	"bufio"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// CommandWriter writes client commands to a stream.
+// It is the client side counterpart of Reader.
+type CommandWriter struct {
+	out  io.Writer
+	w    *bufio.Writer
+	tags int
+
+	// Continue is called after the "{n}" marker of a literal has been
+	// sent, to wait for the continuation request of the server before
+	// the octets of the literal are sent. It may be nil.
+	Continue func() error
+}
+
+// NewCommandWriter creates a CommandWriter which writes commands to w
+func NewCommandWriter(w io.Writer) *CommandWriter {
+	return &CommandWriter{out: w, w: bufio.NewWriter(w)}
+}
+
+// WriteCommand writes cmd with a new tag, "a001", "a002" and so on,
+// and returns that tag
+func (w *CommandWriter) WriteCommand(cmd Cmd) (string, error) {
+	w.tags++
+	tag := fmt.Sprintf("a%03d", w.tags)
+	return tag, w.Write(Command{Tag: tag, Cmd: cmd})
+}
+
+// Write writes a command with the tag it already has
+func (w *CommandWriter) Write(command Command) error {
+	fields, err := commandFields(command.Cmd)
+	if err != nil {
+		return err
+	}
+	e := encoder{w: w.w, sync: w.Continue}
+	w.w.WriteString(command.Tag)
+	for _, field := range fields {
+		w.w.WriteByte(' ')
+		if err := e.value(field); err != nil {
+			w.w.Reset(w.out)
+			return err
+		}
+	}
+	w.w.WriteString("\r\n")
+	return w.w.Flush()
+}
+
+// WriteDone writes the line which ends IDLE
+func (w *CommandWriter) WriteDone() error {
+	w.w.WriteString("DONE\r\n")
+	return w.w.Flush()
+}
+
+// commandFields returns the name and arguments of cmd,
+// as values for an encoder
+func commandFields(cmd Cmd) ([]interface{}, error) {
+	switch cmd := cmd.(type) {
+	case LogoutCmd:
+		return []interface{}{Atom("LOGOUT")}, nil
+	case CapabilityCmd:
+		return []interface{}{Atom("CAPABILITY")}, nil
+	case NoopCmd:
+		return []interface{}{Atom("NOOP")}, nil
+	case StarttlsCmd:
+		return []interface{}{Atom("STARTTLS")}, nil
+	case LoginCmd:
+		return []interface{}{Atom("LOGIN"), astring(cmd.Username), astring(cmd.Password)}, nil
+	case AuthenticateCmd:
+		fields := []interface{}{Atom("AUTHENTICATE"), Atom(cmd.Mechanism)}
+		if len(cmd.InitialResponse) > 0 {
+			fields = append(fields, Atom(base64.StdEncoding.EncodeToString(cmd.InitialResponse)))
+		} else if cmd.InitialResponse != nil {
+			fields = append(fields, Atom("="))
+		}
+		return fields, nil
+	case SelectCmd:
+		return []interface{}{Atom("SELECT"), astring(cmd.Mailbox)}, nil
+	case ExamineCmd:
+		return []interface{}{Atom("EXAMINE"), astring(cmd.Mailbox)}, nil
+	case CreateCmd:
+		return []interface{}{Atom("CREATE"), astring(cmd.Mailbox)}, nil
+	case DeleteCmd:
+		return []interface{}{Atom("DELETE"), astring(cmd.Mailbox)}, nil
+	case RenameCmd:
+		return []interface{}{Atom("RENAME"), astring(cmd.SourceMailbox), astring(cmd.DestinationMailbox)}, nil
+	case SubscribeCmd:
+		return []interface{}{Atom("SUBSCRIBE"), astring(cmd.Mailbox)}, nil
+	case UnsubscribeCmd:
+		return []interface{}{Atom("UNSUBSCRIBE"), astring(cmd.Mailbox)}, nil
+	case ListCmd:
+		return []interface{}{Atom("LIST"), astring(cmd.Reference), listMailbox(cmd.Mailbox)}, nil
+	case LsubCmd:
+		return []interface{}{Atom("LSUB"), astring(cmd.Reference), listMailbox(cmd.Mailbox)}, nil
+	case StatusCmd:
+		return []interface{}{Atom("STATUS"), astring(cmd.Mailbox), FlagList(cmd.StatusAttributes)}, nil
+	case AppendCmd:
+		fields := []interface{}{Atom("APPEND"), astring(cmd.Mailbox)}
+		if len(cmd.Flags) > 0 {
+			fields = append(fields, FlagList(cmd.Flags))
+		}
+		if !cmd.DateTime.IsZero() {
+			fields = append(fields, cmd.DateTime)
+		}
+		return append(fields, Literal(cmd.Literal)), nil
+	case IdleCmd:
+		return []interface{}{Atom("IDLE")}, nil
+	case CheckCmd:
+		return []interface{}{Atom("CHECK")}, nil
+	case CloseCmd:
+		return []interface{}{Atom("CLOSE")}, nil
+	case ExpungeCmd:
+		return []interface{}{Atom("EXPUNGE")}, nil
+	case SearchCmd:
+		fields := []interface{}{Atom("SEARCH")}
+		if cmd.Charset != "" {
+			fields = append(fields, Atom("CHARSET"), astring(cmd.Charset))
+		}
+		keys, err := searchKeyFields(cmd.Keys)
+		if err != nil {
+			return nil, err
+		}
+		return uid(cmd.Uid, append(fields, keys...)), nil
+	case FetchCmd:
+		var attributes interface{}
+		if len(cmd.Attributes) == 1 {
+			attributes = Atom(cmd.Attributes[0].String())
+		} else {
+			list := []Atom{}
+			for _, attribute := range cmd.Attributes {
+				list = append(list, Atom(attribute.String()))
+			}
+			attributes = list
+		}
+		return uid(cmd.Uid, []interface{}{Atom("FETCH"), Atom(cmd.Sequence.String()), attributes}), nil
+	case StoreCmd:
+		item := cmd.Mode + "FLAGS"
+		if cmd.Silent {
+			item += ".SILENT"
+		}
+		return uid(cmd.Uid, []interface{}{Atom("STORE"), Atom(cmd.Sequence.String()), Atom(item), FlagList(cmd.Flags)}), nil
+	case CopyCmd:
+		return uid(cmd.Uid, []interface{}{Atom("COPY"), Atom(cmd.Sequence.String()), astring(cmd.Mailbox)}), nil
+	}
+	return nil, fmt.Errorf("Writer: can't write command of type %T", cmd)
+}
+
+// uid prefixes the fields of a command with UID when set
+func uid(set bool, fields []interface{}) []interface{} {
+	if !set {
+		return fields
+	}
+	return append([]interface{}{Atom("UID")}, fields...)
+}
+
+// searchKeyFields returns the values for a list of search keys
+func searchKeyFields(keys []SearchKey) (fields []interface{}, err error) {
+	for _, key := range keys {
+		switch key.Name {
+		case "ALL", "ANSWERED", "DELETED", "DRAFT", "FLAGGED", "NEW", "OLD", "RECENT", "SEEN",
+			"UNANSWERED", "UNDELETED", "UNDRAFT", "UNFLAGGED", "UNSEEN":
+			fields = append(fields, Atom(key.Name))
+		case "BCC", "BODY", "CC", "FROM", "SUBJECT", "TEXT", "TO":
+			fields = append(fields, Atom(key.Name), astring(key.Value))
+		case "KEYWORD", "UNKEYWORD":
+			fields = append(fields, Atom(key.Name), Atom(key.Value))
+		case "BEFORE", "ON", "SINCE", "SENTBEFORE", "SENTON", "SENTSINCE":
+			fields = append(fields, Atom(key.Name), Atom(key.Date.Format("2-Jan-2006")))
+		case "LARGER", "SMALLER":
+			fields = append(fields, Atom(key.Name), key.Number)
+		case "HEADER":
+			fields = append(fields, Atom(key.Name), astring(key.Field), astring(key.Value))
+		case "UID":
+			fields = append(fields, Atom(key.Name), Atom(key.Sequence.String()))
+		case "SEQUENCE":
+			fields = append(fields, Atom(key.Sequence.String()))
+		case "NOT", "OR", "AND":
+			var operands []interface{}
+			operands, err = searchKeyFields(key.Keys)
+			if err != nil {
+				return
+			}
+			if key.Name == "AND" {
+				fields = append(fields, operands)
+			} else {
+				fields = append(append(fields, Atom(key.Name)), operands...)
+			}
+		default:
+			err = fmt.Errorf("Writer: unknown search-key %s", key.Name)
+			return
+		}
+	}
+	return
+}
+
+// astring returns s as atom when it can be sent as one, and as string otherwise,
+// which is quoted or sent as literal
+func astring(s string) interface{} {
+	if !canAtom(s) || !IsAtom(s) {
+		return s
+	}
+	return Atom(s)
+}
+
+// listMailbox is like astring, but also allows the list-wildcards "%" and "*" in atoms
+func listMailbox(s string) interface{} {
+	if !canAtom(s) || !IsAtom(strings.NewReplacer("%", "", "*", "").Replace(s)) {
+		return s
+	}
+	return Atom(s)
+}
+
+// canAtom reports whether s can be read back as atom: it must not
+// be empty, NIL or contain brackets, which the tokenizer pairs up
+func canAtom(s string) bool {
+	return s != "" && strings.ToUpper(s) != "NIL" && !strings.ContainsAny(s, "[]")
+}
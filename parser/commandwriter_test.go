@@ -0,0 +1,129 @@
+package parser
+
+import (
+	"bytes"
+	. "github.com/smartystreets/goconvey/convey"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCommandWriter(t *testing.T) {
+
+	Convey("Testing CommandWriter", t, func() {
+
+		buffer := &bytes.Buffer{}
+		w := NewCommandWriter(buffer)
+
+		Convey("Tags and encoding", func() {
+
+			tag, err := w.WriteCommand(LoginCmd{Username: "mrc", Password: "secret"})
+			So(err, ShouldEqual, nil)
+			So(tag, ShouldEqual, "a001")
+			tag, err = w.WriteCommand(SelectCmd{Mailbox: "my mail"})
+			So(err, ShouldEqual, nil)
+			So(tag, ShouldEqual, "a002")
+			_, err = w.WriteCommand(ListCmd{Reference: "", Mailbox: "~/Mail/%"})
+			So(err, ShouldEqual, nil)
+			_, err = w.WriteCommand(FetchCmd{Uid: true, Sequence: SequenceSet{{Start: 2, Stop: 0}}, Attributes: []FetchAttribute{
+				{Name: "FLAGS"},
+				{Name: "BODY", Peek: true, Section: &Section{Part: []uint32{1}, Text: "HEADER.FIELDS", Fields: []string{"DATE", "FROM"}}, Partial: &Partial{Offset: 0, Count: 512}},
+			}})
+			So(err, ShouldEqual, nil)
+			_, err = w.WriteCommand(LoginCmd{Username: "NIL", Password: "café"})
+			So(err, ShouldEqual, nil)
+
+			So(buffer.String(), ShouldEqual, "a001 LOGIN mrc secret\r\n"+
+				"a002 SELECT \"my mail\"\r\n"+
+				"a003 LIST \"\" ~/Mail/%\r\n"+
+				"a004 UID FETCH 2:* (FLAGS BODY.PEEK[1.HEADER.FIELDS (DATE FROM)]<0.512>)\r\n"+
+				"a005 LOGIN \"NIL\" {5}\r\ncafé\r\n")
+		})
+
+		Convey("IDLE ends with DONE", func() {
+
+			_, err := w.WriteCommand(IdleCmd{})
+			So(err, ShouldEqual, nil)
+			So(w.WriteDone(), ShouldEqual, nil)
+			So(buffer.String(), ShouldEqual, "a001 IDLE\r\nDONE\r\n")
+		})
+
+		Convey("Literals wait for the continuation request", func() {
+
+			message := "Subject: afternoon meeting\r\n\r\nHello Joe\r\n"
+			continued := 0
+			w.Continue = func() error {
+				continued++
+				So(buffer.String(), ShouldEndWith, "{41}\r\n")
+				return nil
+			}
+			_, err := w.WriteCommand(AppendCmd{
+				Mailbox:  "saved-messages",
+				Flags:    []string{`\Seen`},
+				DateTime: time.Date(1994, 2, 7, 21, 52, 25, 0, time.FixedZone("", -8*60*60)),
+				Literal:  []byte(message),
+			})
+			So(err, ShouldEqual, nil)
+			So(continued, ShouldEqual, 1)
+			So(buffer.String(), ShouldEqual, "a001 APPEND saved-messages (\\Seen) \" 7-Feb-1994 21:52:25 -0800\" {41}\r\n"+message+"\r\n")
+		})
+
+		Convey("Unknown commands", func() {
+
+			_, err := w.WriteCommand(nil)
+			So(err, ShouldNotEqual, nil)
+			_, err = w.WriteCommand(SearchCmd{Keys: []SearchKey{{Name: "BOGUS"}}})
+			So(err, ShouldNotEqual, nil)
+			So(buffer.String(), ShouldEqual, "")
+		})
+
+		Convey("Round trip", func() {
+
+			date, _ := ParseDateTime("17-Jul-1996 02:44:25 -0700")
+			commands := []Cmd{
+				LogoutCmd{}, CapabilityCmd{}, NoopCmd{}, StarttlsCmd{},
+				LoginCmd{Username: "john doe", Password: `pass "word" \o/`},
+				AuthenticateCmd{Mechanism: "PLAIN"},
+				AuthenticateCmd{Mechanism: "PLAIN", InitialResponse: []byte("\x00mrc\x00secret")},
+				AuthenticateCmd{Mechanism: "EXTERNAL", InitialResponse: []byte{}},
+				SelectCmd{Mailbox: "INBOX"}, ExamineCmd{Mailbox: "[Gmail]/All"},
+				CreateCmd{Mailbox: "owatagusiam/"}, DeleteCmd{Mailbox: "blurdybloop"},
+				RenameCmd{SourceMailbox: "foo", DestinationMailbox: "new\r\nline"},
+				SubscribeCmd{Mailbox: "#news.comp.mail.mime"}, UnsubscribeCmd{Mailbox: "nil"},
+				ListCmd{Reference: "#news.", Mailbox: "comp.mail.*"}, LsubCmd{Reference: "", Mailbox: "%"},
+				StatusCmd{Mailbox: "blurdybloop", StatusAttributes: []string{"UIDNEXT", "MESSAGES"}},
+				AppendCmd{Mailbox: "saved", Flags: []string{}, Literal: []byte("body")},
+				AppendCmd{Mailbox: "saved", Flags: []string{`\Seen`, "$Forwarded"}, DateTime: date, Literal: []byte{}},
+				IdleCmd{}, CheckCmd{}, CloseCmd{}, ExpungeCmd{},
+				SearchCmd{Uid: true, Charset: "UTF-8", Keys: []SearchKey{
+					{Name: "FLAGGED"},
+					{Name: "SINCE", Date: time.Date(1994, 2, 1, 0, 0, 0, 0, time.UTC)},
+					{Name: "NOT", Keys: []SearchKey{{Name: "FROM", Value: "Smith"}}},
+					{Name: "OR", Keys: []SearchKey{{Name: "LARGER", Number: 4096}, {Name: "KEYWORD", Value: "$Junk"}}},
+					{Name: "AND", Keys: []SearchKey{{Name: "HEADER", Field: "X-Mailer", Value: "some client"}, {Name: "UID", Sequence: SequenceSet{{Start: 1, Stop: 0}}}}},
+					{Name: "SEQUENCE", Sequence: SequenceSet{{Start: 2, Stop: 2}, {Start: 4, Stop: 7}}},
+				}},
+				FetchCmd{Sequence: SequenceSet{{Start: 12, Stop: 12}}, Attributes: []FetchAttribute{{Name: "BODY", Section: &Section{}}}},
+				FetchCmd{Uid: true, Sequence: SequenceSet{{Start: 1, Stop: 0}}, Attributes: []FetchAttribute{
+					{Name: "UID"}, {Name: "RFC822.SIZE"},
+					{Name: "BODY", Section: &Section{Part: []uint32{2, 1}, Text: "MIME"}},
+					{Name: "BODY", Peek: true, Section: &Section{Text: "HEADER.FIELDS.NOT", Fields: []string{"Received", "odd name"}}, Partial: &Partial{Offset: 10, Count: 20}},
+				}},
+				StoreCmd{Sequence: SequenceSet{{Start: 2, Stop: 4}}, Mode: "+", Silent: true, Flags: []string{`\Deleted`}},
+				StoreCmd{Uid: true, Sequence: SequenceSet{{Start: 1, Stop: 1}}, Flags: []string{}},
+				CopyCmd{Uid: true, Sequence: SequenceSet{{Start: 2, Stop: 4}}, Mailbox: "meeting"},
+			}
+
+			for _, cmd := range commands {
+				buffer.Reset()
+				tag, err := w.WriteCommand(cmd)
+				So(err, ShouldEqual, nil)
+
+				command, err := Parse(strings.TrimSuffix(buffer.String(), "\r\n"))
+				So(err, ShouldEqual, nil)
+				So(command.Tag, ShouldEqual, tag)
+				So(command.Cmd, ShouldResemble, cmd)
+			}
+		})
+	})
+}
@@ -0,0 +1,52 @@
+/*
+Package parser reads IMAP4rev1 (RFC 3501) client commands.
+
+A server reads commands from a connection with a Reader:
+
+	r := parser.NewReader(conn)
+	r.Continue = func() error {
+		_, err := io.WriteString(conn, "+ Ready for literal data\r\n")
+		return err
+	}
+	for {
+		command, err := r.ReadCommand()
+		...
+		switch cmd := command.Cmd.(type) {
+		case parser.LoginCmd:
+			...
+		}
+	}
+
+A Reader limits the length of command lines and the size of literals,
+see MaxLineLength and MaxLiteralSize.
+
+A single line can be parsed with Parse. Every command is returned as one
+of the *Cmd types of this package, with its arguments already validated
+and decoded: quoted strings are unescaped, literals hold their octets and
+case variants of INBOX are normalized. Invalid commands return a
+*ParseError, whose Response method gives the BAD response to send back.
+
+Responses are written with a Writer, which quotes strings or sends
+them as literals as needed:
+
+	w := parser.NewWriter(conn)
+	w.WriteExists(18)
+	w.WriteStatus(parser.StatusResponse{Tag: "a002", Type: parser.OK, Code: parser.CodeReadWrite, Info: "SELECT completed"})
+
+Clients read those responses with a ResponseReader. Every response is a
+StatusResponse, a DataResponse holding the decoded values of untagged
+data, or a ContinuationResponse:
+
+	r := parser.NewResponseReader(conn)
+	response, err := r.ReadResponse()
+
+and send commands with a CommandWriter, which tags every command and
+encodes it so that Parse gives back the same Cmd:
+
+	w := parser.NewCommandWriter(conn)
+	tag, err := w.WriteCommand(parser.SelectCmd{Mailbox: "INBOX"})
+
+The Is* functions check strings against the grammar rules of RFC 3501,
+for code that has to validate values on its own.
+*/
+package parser
@@ -0,0 +1,67 @@
+package parser
+
+// Reason is the kind of problem found in a command line
+type Reason int
+
+const (
+	ReasonSyntax          Reason = iota // the line can't be split into tokens
+	ReasonTag                           // the tag is missing or invalid
+	ReasonUnknownCommand                // the command name is missing or unknown
+	ReasonArgumentCount                 // too few or too many arguments
+	ReasonInvalidArgument               // an argument doesn't match the grammar
+	ReasonTooLarge                      // a literal exceeds the size limit of the Reader
+)
+
+func (r Reason) String() string {
+	switch r {
+	case ReasonSyntax:
+		return "syntax"
+	case ReasonTag:
+		return "tag"
+	case ReasonUnknownCommand:
+		return "unknown command"
+	case ReasonArgumentCount:
+		return "argument count"
+	case ReasonInvalidArgument:
+		return "invalid argument"
+	case ReasonTooLarge:
+		return "too large"
+	}
+	return "unknown"
+}
+
+// ParseError is the error returned by Parse and ReadCommand
+// for a line which isn't a valid command
+type ParseError struct {
+	Tag      string // tag of the command, empty if none was recognized
+	Command  string // upper case command name, empty if none was recognized
+	Argument int    // index of the invalid argument, -1 if not about a single argument
+	Offset   int    // byte offset in the line of a syntax error, -1 if unknown
+	Reason   Reason
+	Message  string // human readable description
+}
+
+func (e *ParseError) Error() string {
+	return e.Message
+}
+
+// Response returns the BAD response to send for the error:
+// tagged when the tag was recognized, untagged otherwise
+func (e *ParseError) Response() StatusResponse {
+	return StatusResponse{Tag: e.Tag, Type: BAD, Info: e.Message}
+}
+
+// syntaxError returns a ParseError for a line which can't be tokenized
+func syntaxError(offset int, message string) *ParseError {
+	return &ParseError{Argument: -1, Offset: offset, Reason: ReasonSyntax, Message: message}
+}
+
+// countError returns a ParseError for a wrong number of arguments
+func countError(message string) *ParseError {
+	return &ParseError{Argument: -1, Offset: -1, Reason: ReasonArgumentCount, Message: message}
+}
+
+// argumentError returns a ParseError for the argument at index i
+func argumentError(i int, message string) *ParseError {
+	return &ParseError{Argument: i, Offset: -1, Reason: ReasonInvalidArgument, Message: message}
+}
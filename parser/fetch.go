@@ -0,0 +1,217 @@
+package parser
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+)
+
+// fetchMacros are the FETCH macros and the attributes they stand for
+var fetchMacros = map[string][]string{
+	"ALL":  {"FLAGS", "INTERNALDATE", "RFC822.SIZE", "ENVELOPE"},
+	"FAST": {"FLAGS", "INTERNALDATE", "RFC822.SIZE"},
+	"FULL": {"FLAGS", "INTERNALDATE", "RFC822.SIZE", "ENVELOPE", "BODY"},
+}
+
+// parseFetchAttributes parses the second argument of FETCH,
+// which is a macro, a single fetch-att or a list of fetch-att
+func parseFetchAttributes(t token) (attributes []FetchAttribute, err error) {
+	if t.Type == atomToken {
+		if names, ok := fetchMacros[strings.ToUpper(t.Value)]; ok {
+			for _, name := range names {
+				attributes = append(attributes, FetchAttribute{Name: name})
+			}
+			return
+		}
+		var attribute FetchAttribute
+		attribute, err = parseFetchAttribute(t)
+		if err != nil {
+			return
+		}
+		return []FetchAttribute{attribute}, nil
+	}
+
+	if t.Type != listToken || len(t.List) == 0 {
+		err = errors.New("Parser: expected fetch-att or list of fetch-att")
+		return
+	}
+	for _, item := range t.List {
+		var attribute FetchAttribute
+		attribute, err = parseFetchAttribute(item)
+		if err != nil {
+			return
+		}
+		attributes = append(attributes, attribute)
+	}
+	return
+}
+
+/*
+fetch-att       = "ENVELOPE" / "FLAGS" / "INTERNALDATE" /
+                  "RFC822" [".HEADER" / ".SIZE" / ".TEXT"] /
+                  "BODY" ["STRUCTURE"] / "UID" /
+                  "BODY" section ["<" number "." nz-number ">"] /
+                  "BODY.PEEK" section ["<" number "." nz-number ">"]
+*/
+func parseFetchAttribute(t token) (attribute FetchAttribute, err error) {
+	if t.Type != atomToken {
+		err = errors.New("Parser: expected fetch-att, found " + t.Value)
+		return
+	}
+
+	open := strings.IndexByte(t.Value, '[')
+	if open < 0 {
+		attribute.Name = strings.ToUpper(t.Value)
+		switch attribute.Name {
+		case "ENVELOPE", "FLAGS", "INTERNALDATE", "RFC822", "RFC822.HEADER", "RFC822.SIZE", "RFC822.TEXT",
+			"BODY", "BODYSTRUCTURE", "UID":
+			return
+		}
+		err = errors.New("Parser: unknown fetch-att " + t.Value)
+		return
+	}
+
+	switch strings.ToUpper(t.Value[:open]) {
+	case "BODY":
+		attribute.Name = "BODY"
+	case "BODY.PEEK":
+		attribute.Name = "BODY"
+		attribute.Peek = true
+	default:
+		err = errors.New("Parser: unknown fetch-att " + t.Value)
+		return
+	}
+
+	// the tokenizer made sure the brackets are balanced
+	end := strings.LastIndexByte(t.Value, ']')
+	attribute.Section, err = parseSection(t.Value[open+1 : end])
+	if err != nil {
+		return
+	}
+	if end+1 < len(t.Value) {
+		attribute.Partial, err = parsePartial(t.Value[end+1:])
+	}
+	return
+}
+
+/*
+section-spec    = section-msgtext / (section-part ["." section-text])
+section-msgtext = "HEADER" / "HEADER.FIELDS" [".NOT"] SP header-list /
+                  "TEXT"
+header-list     = "(" header-fld-name *(SP header-fld-name) ")"
+section-part    = nz-number *("." nz-number)
+section-text    = section-msgtext / "MIME"
+*/
+func parseSection(s string) (*Section, error) {
+	section := &Section{}
+
+	spec := s
+	if i := strings.IndexByte(s, ' '); i >= 0 {
+		spec = s[:i]
+		tokens, err := tokenize(s[i+1:])
+		if err != nil || len(tokens) != 1 || tokens[0].Type != listToken || len(tokens[0].List) == 0 {
+			return nil, errors.New("Parser: expected header-list in section " + s)
+		}
+		for _, field := range tokens[0].List {
+			if !field.isAString() {
+				return nil, errors.New("Parser: expected header-fld-name in section " + s)
+			}
+			section.Fields = append(section.Fields, field.Value)
+		}
+	}
+
+	parts := []string{}
+	if spec != "" {
+		parts = strings.Split(spec, ".")
+	}
+	for len(parts) > 0 {
+		n, err := strconv.ParseUint(parts[0], 10, 32)
+		if err != nil {
+			break
+		}
+		if n == 0 {
+			return nil, errors.New("Parser: expected nz-number in section-part " + s)
+		}
+		section.Part = append(section.Part, uint32(n))
+		parts = parts[1:]
+	}
+	section.Text = strings.ToUpper(strings.Join(parts, "."))
+
+	valid := false
+	switch section.Text {
+	case "":
+		valid = len(parts) == 0 && len(section.Fields) == 0
+	case "HEADER", "TEXT":
+		valid = len(section.Fields) == 0
+	case "HEADER.FIELDS", "HEADER.FIELDS.NOT":
+		valid = len(section.Fields) > 0
+	case "MIME":
+		valid = len(section.Part) > 0 && len(section.Fields) == 0
+	}
+	if !valid {
+		return nil, errors.New("Parser: invalid section " + s)
+	}
+	return section, nil
+}
+
+/*
+partial         = "<" number "." nz-number ">"
+*/
+func parsePartial(s string) (*Partial, error) {
+	invalid := errors.New("Parser: invalid partial " + s)
+	if len(s) < 2 || s[0] != '<' || s[len(s)-1] != '>' {
+		return nil, invalid
+	}
+	numbers := strings.Split(s[1:len(s)-1], ".")
+	if len(numbers) != 2 {
+		return nil, invalid
+	}
+	offset, err := strconv.ParseUint(numbers[0], 10, 32)
+	if err != nil {
+		return nil, invalid
+	}
+	count, err := strconv.ParseUint(numbers[1], 10, 32)
+	if err != nil || count == 0 {
+		return nil, invalid
+	}
+	return &Partial{Offset: uint32(offset), Count: uint32(count)}, nil
+}
+
+// String returns the fetch-att, like "BODY.PEEK[1.HEADER.FIELDS (DATE FROM)]<0.512>"
+func (attribute FetchAttribute) String() string {
+	s := attribute.Name
+	if attribute.Peek {
+		s += ".PEEK"
+	}
+	if attribute.Section != nil {
+		s += "[" + attribute.Section.String() + "]"
+	}
+	if attribute.Partial != nil {
+		s += "<" + strconv.FormatUint(uint64(attribute.Partial.Offset), 10) + "." +
+			strconv.FormatUint(uint64(attribute.Partial.Count), 10) + ">"
+	}
+	return s
+}
+
+// String returns the section-spec, without the brackets
+func (section Section) String() string {
+	spec := []string{}
+	for _, part := range section.Part {
+		spec = append(spec, strconv.FormatUint(uint64(part), 10))
+	}
+	if section.Text != "" {
+		spec = append(spec, section.Text)
+	}
+	s := strings.Join(spec, ".")
+	if len(section.Fields) > 0 {
+		fields := make([]string, len(section.Fields))
+		for i, field := range section.Fields {
+			fields[i] = field
+			if _, ok := astring(field).(string); ok {
+				fields[i] = `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(field) + `"`
+			}
+		}
+		s += " (" + strings.Join(fields, " ") + ")"
+	}
+	return s
+}
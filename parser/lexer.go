@@ -2,6 +2,7 @@ package parser
 
 import (
 	"errors"
+	"strconv"
 	"strings"
 )
 
@@ -10,35 +11,279 @@ type Argument string
 type lexCommand struct {
 	Tag       string
 	Name      string
-	Arguments []string
+	Arguments []token
+}
+
+type tokenType int
+
+const (
+	atomToken    tokenType = iota // bare word, the parser checks its grammar
+	quotedToken                   // quoted string
+	literalToken                  // literal
+	nilToken                      // NIL
+	listToken                     // parenthesized list
+)
+
+// token is a single lexical element of an IMAP line
+type token struct {
+	Type  tokenType
+	Value string  // text of an atom, NIL or (unescaped) string
+	List  []token // elements of a list
+}
+
+// isAString reports whether the token can be used as astring
+func (t token) isAString() bool {
+	switch t.Type {
+	case quotedToken, literalToken, nilToken:
+		return true
+	case atomToken:
+		return IsAString(t.Value)
+	}
+	return false
+}
+
+// isMailbox reports whether the token can be used as mailbox
+func (t token) isMailbox() bool {
+	return t.isAString()
+}
+
+// isListMailbox reports whether the token can be used as list-mailbox
+func (t token) isListMailbox() bool {
+	switch t.Type {
+	case quotedToken, literalToken, nilToken:
+		return true
+	case atomToken:
+		return IsListMailbox(t.Value)
+	}
+	return false
+}
+
+// isAtom reports whether the token is an atom matching the predicate
+func (t token) isAtom(predicate func(string) bool) bool {
+	return (t.Type == atomToken || t.Type == nilToken) && predicate(t.Value)
+}
+
+// sequenceSet returns the token as sequence-set
+func (t token) sequenceSet() (SequenceSet, bool) {
+	if t.Type != atomToken {
+		return nil, false
+	}
+	set, err := ParseSequenceSet(t.Value)
+	return set, err == nil
 }
 
 // lexLine creates a command struct for an IMAP line
-// which contains the Name of the command and the arguments
+// which contains the Name of the command and the arguments.
+// Literals are expected inline, as sent on the wire:
+// the "{n}" marker followed by CRLF and n octets.
 func lexLine(line string) (c lexCommand, err error) {
-	parts := strings.Split(line, " ")
-	if len(parts) >= 2 {
-		if !isTag(parts[0]) {
-			err = errors.New("Lexer: expected identifier tag")
-			return
+	tokens, err := tokenize(line)
+	if err != nil {
+		// keep the tag and command of a line which can't be tokenized,
+		// so the error can still be answered with a tagged BAD
+		parseErr := err.(*ParseError)
+		fields := strings.SplitN(line, " ", 3)
+		if len(fields) > 1 && IsTag(fields[0]) {
+			parseErr.Tag = fields[0]
+			if fields[1] != "" && isCommand(fields[1]) {
+				parseErr.Command = strings.ToUpper(fields[1])
+			}
 		}
-		c.Tag = parts[0]
-		if !isCommand(parts[1]) {
-			err = errors.New("Lexer: expected valid IMAP command")
+		return
+	}
+	if len(tokens) == 0 || !tokens[0].isAtom(IsTag) {
+		err = &ParseError{Argument: -1, Offset: 0, Reason: ReasonTag, Message: "Lexer: expected identifier tag"}
+		return
+	}
+	c.Tag = tokens[0].Value
+	if len(tokens) < 2 || !tokens[1].isAtom(isCommand) {
+		err = &ParseError{Tag: c.Tag, Argument: -1, Offset: len(c.Tag) + 1, Reason: ReasonUnknownCommand, Message: "Lexer: expected valid IMAP command"}
+		return
+	}
+	c.Name = strings.ToUpper(tokens[1].Value)
+	c.Arguments = tokens[2:]
+	return
+}
+
+// tokenize splits a line into tokens.
+// Errors are returned as *ParseError with the offset of the problem.
+func tokenize(line string) ([]token, error) {
+	l := &tokenizer{s: line}
+	tokens, err := l.tokens()
+	if err != nil {
+		return nil, syntaxError(l.pos, err.Error())
+	}
+	if l.pos < len(l.s) {
+		return nil, syntaxError(l.pos, "Lexer: unexpected ')'")
+	}
+	return tokens, nil
+}
+
+// maxListDepth limits the nesting of parenthesized lists,
+// which are tokenized recursively
+const maxListDepth = 32
+
+type tokenizer struct {
+	s     string
+	pos   int
+	depth int // number of lists around the current position
+}
+
+// tokens reads SP separated tokens until the end of
+// the line or a closing parenthesis
+func (l *tokenizer) tokens() (tokens []token, err error) {
+	for l.pos < len(l.s) && l.s[l.pos] != ')' {
+		if len(tokens) > 0 {
+			if l.s[l.pos] != ' ' {
+				err = errors.New("Lexer: expected SP between arguments")
+				return
+			}
+			l.pos++
+		}
+		var t token
+		t, err = l.token()
+		if err != nil {
 			return
 		}
-		c.Name = strings.ToUpper(parts[1])
+		tokens = append(tokens, t)
+	}
+	return
+}
+
+// token reads the token starting at the current position
+func (l *tokenizer) token() (t token, err error) {
+	if l.pos >= len(l.s) {
+		err = errors.New("Lexer: unexpected end of line")
+		return
 	}
-	if len(parts) > 2 {
-		c.Arguments = parts[2:]
+	switch l.s[l.pos] {
+	case '(':
+		if l.depth >= maxListDepth {
+			err = errors.New("Lexer: lists nested too deeply")
+			return
+		}
+		l.pos++
+		l.depth++
+		t.Type = listToken
+		t.List, err = l.tokens()
+		if err != nil {
+			return
+		}
+		l.depth--
+		if l.pos >= len(l.s) {
+			err = errors.New("Lexer: expected ')' to close list")
+			return
+		}
+		l.pos++
+	case '"':
+		t.Type = quotedToken
+		t.Value, err = l.quoted()
+	case '{':
+		t.Type = literalToken
+		t.Value, err = l.literal()
+	case ' ':
+		err = errors.New("Lexer: unexpected SP")
+	default:
+		t.Value, err = l.atom()
+		if strings.ToUpper(t.Value) == "NIL" {
+			t.Type = nilToken
+		}
 	}
 	return
 }
 
+// sectionPrefixes are the fetch attributes whose section in brackets,
+// like the one of BODY[HEADER.FIELDS (DATE FROM)], is part of the atom
+var sectionPrefixes = []string{"BODY", "BODY.PEEK", "BINARY"}
+
+// atom reads a bare word. A section after one of sectionPrefixes is
+// kept as a whole, elsewhere "[" and "]" are ordinary characters.
+func (l *tokenizer) atom() (string, error) {
+	start := l.pos
+	section := false
+	for ; l.pos < len(l.s); l.pos++ {
+		c := l.s[l.pos]
+		if section {
+			if c == ']' {
+				section = false
+			}
+		} else if c == '[' && isSectionPrefix(l.s[start:l.pos]) {
+			section = true
+		} else if c == ' ' || c == '(' || c == ')' || c == '"' || c == '\r' || c == '\n' {
+			break
+		}
+	}
+	if section {
+		return "", errors.New("Lexer: expected ']'")
+	}
+	return l.s[start:l.pos], nil
+}
+
+// isSectionPrefix reports whether s is one of sectionPrefixes
+func isSectionPrefix(s string) bool {
+	for _, prefix := range sectionPrefixes {
+		if strings.EqualFold(s, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
 /*
+quoted          = DQUOTE *QUOTED-CHAR DQUOTE
+*/
+func (l *tokenizer) quoted() (string, error) {
+	value := []byte{}
+	for l.pos++; l.pos < len(l.s); l.pos++ {
+		switch c := l.s[l.pos]; c {
+		case '"':
+			l.pos++
+			return string(value), nil
+		case '\\':
+			l.pos++
+			if l.pos >= len(l.s) || (l.s[l.pos] != '"' && l.s[l.pos] != '\\') {
+				return "", errors.New("Lexer: invalid escape in quoted string")
+			}
+			value = append(value, l.s[l.pos])
+		case '\r', '\n':
+			return "", errors.New("Lexer: unexpected CRLF in quoted string")
+		default:
+			value = append(value, c)
+		}
+	}
+	return "", errors.New("Lexer: expected '\"' to close quoted string")
+}
+
+/*
+literal         = "{" number "}" CRLF *CHAR8
+*/
+func (l *tokenizer) literal() (string, error) {
+	end := strings.IndexByte(l.s[l.pos:], '}')
+	if end < 0 {
+		return "", errors.New("Lexer: expected '}' to close literal")
+	}
+	end += l.pos + 1
+	size, ok := literalSize(l.s[l.pos:end])
+	if !ok {
+		return "", errors.New("Lexer: invalid literal")
+	}
+	if !strings.HasPrefix(l.s[end:], "\r\n") {
+		return "", errors.New("Lexer: expected CRLF after literal")
+	}
+	end += 2
+	if len(l.s)-end < size {
+		return "", errors.New("Lexer: literal data shorter than announced")
+	}
+	l.pos = end + size
+	return l.s[end:l.pos], nil
+}
+
+/*
+IsTag reports whether s is a valid command tag
+
 tag = 1*<any ASTRING-CHAR except "+">
 */
-func isTag(s string) bool {
+func IsTag(s string) bool {
 	for _, c := range s {
 		if !isAStringChar(c) {
 			return false
@@ -51,6 +296,8 @@ func isTag(s string) bool {
 }
 
 /*
+IsAString reports whether s is an astring, as written on the wire
+
 astring         = 1*ASTRING-CHAR / string
 string          = quoted / literal
 
@@ -65,7 +312,7 @@ CRLF            =  %d13.10
 CHAR8           = %x01-ff
                   ; any OCTET except NUL, %x00
 */
-func isAString(s string) bool {
+func IsAString(s string) bool {
 	if len(s) == 0 {
 		return false
 	}
@@ -79,7 +326,7 @@ func isAString(s string) bool {
 			if s[len(s)-1] != '"' {
 				return false
 			}
-			return isQuoted(s[1 : len(s)-1])
+			return IsQuoted(s[1 : len(s)-1])
 		}
 	case '{':
 		{
@@ -107,13 +354,16 @@ func isAString(s string) bool {
 }
 
 /*
+IsQuoted reports whether s is valid content for a quoted string,
+without the surrounding double quotes
+
 quoted          = DQUOTE *QUOTED-CHAR DQUOTE
 
 QUOTED-CHAR     = <any TEXT-CHAR except quoted-specials> /
 				  "\" quoted-specials
 quoted-specials = DQUOTE / "\"
 */
-func isQuoted(s string) bool {
+func IsQuoted(s string) bool {
 	for i := 0; i < len(s); i++ {
 		if s[i] == '\\' {
 			if !(len(s) > i+1) {
@@ -197,7 +447,8 @@ func isAtomChar(c rune) bool {
 	}
 }
 
-func isAtom(s string) bool {
+// IsAtom reports whether s consists of ATOM-CHARs only
+func IsAtom(s string) bool {
 	for _, c := range s {
 		if !isAtomChar(c) {
 			return false
@@ -207,6 +458,22 @@ func isAtom(s string) bool {
 }
 
 /*
+IsFlag reports whether s is a message flag
+
+flag            = "\Answered" / "\Flagged" / "\Deleted" /
+                  "\Seen" / "\Draft" / flag-keyword / flag-extension
+                    ; Does not include "\Recent"
+flag-extension  = "\" atom
+flag-keyword    = atom
+*/
+func IsFlag(s string) bool {
+	s = strings.TrimPrefix(s, "\\")
+	return len(s) > 0 && IsAtom(s)
+}
+
+/*
+IsMailbox reports whether s is a mailbox name, as written on the wire
+
 mailbox = "INBOX" / astring
 		  ; INBOX is case-insensitive.  All case variants of
 		  ; INBOX (e.g., "iNbOx") MUST be interpreted as INBOX
@@ -216,10 +483,10 @@ mailbox = "INBOX" / astring
 		  ;  Refer to section 5.1 for further
 		  ; semantic details of mailbox names.
 */
-func isMailbox(s string) bool {
+func IsMailbox(s string) bool {
 	if strings.ToUpper(s) == "INBOX" {
 		return true
-	} else if isAString(s) {
+	} else if IsAString(s) {
 		return true
 	} else {
 		return false
@@ -227,13 +494,15 @@ func isMailbox(s string) bool {
 }
 
 /*
+IsListMailbox reports whether s is a LIST/LSUB mailbox pattern
+
 list-mailbox    = 1*list-char / string
 list-char       = ATOM-CHAR / list-wildcards / resp-specials
 list-wildcards  = "%" / "*"
 
 string          = quoted / literal
 */
-func isListMailbox(s string) bool {
+func IsListMailbox(s string) bool {
 	if len(s) == 0 {
 		return false
 	}
@@ -248,12 +517,12 @@ func isListMailbox(s string) bool {
 			if s[len(s)-1] != '"' {
 				return false
 			}
-			return isQuoted(s[1 : len(s)-1])
+			return IsQuoted(s[1 : len(s)-1])
 		}
 	case '{':
 		{
 			// string -> literal
-			return isLiteral(s)
+			return IsLiteral(s)
 		}
 	default:
 		{
@@ -271,13 +540,15 @@ func isListMailbox(s string) bool {
 }
 
 /*
+IsLiteral reports whether s is a literal marker like "{42}"
+
 literal         = "{" number "}" CRLF *CHAR8
 				  ; Number represents the number of CHAR8s
 number          = 1*DIGIT
 				  ; Unsigned 32-bit integer
 				  ; (0 <= n < 4,294,967,296)
 */
-func isLiteral(s string) bool {
+func IsLiteral(s string) bool {
 
 	/*
 		TODO:
@@ -301,6 +572,8 @@ func isLiteral(s string) bool {
 }
 
 /*
+IsDateTime reports whether s is a quoted date-time
+
 date-time       = DQUOTE date-day-fixed "-" date-month "-" date-year SP time SP zone DQUOTE
 
 date-day-fixed  = (SP DIGIT) / 2DIGIT
@@ -324,8 +597,8 @@ zone            = ("+" / "-") 4DIGIT
 
 Example: "31-Dec-2002 14:36:36 -0800"
 */
-func isDateTime(s string) bool {
-	if s[0] != '"' || s[len(s)-1] != '"' {
+func IsDateTime(s string) bool {
+	if len(s) < 2 || s[0] != '"' || s[len(s)-1] != '"' {
 		return false
 	}
 	s = s[1 : len(s)-1]
@@ -381,6 +654,8 @@ func isNzDigit(c rune) bool {
 }
 
 /*
+IsSeqNumber reports whether s is a message sequence number or "*"
+
 seq-number      = nz-number / "*"
                     ; message sequence number (COPY, FETCH, STORE
                     ; commands) or unique identifier (UID COPY,
@@ -398,20 +673,25 @@ seq-number      = nz-number / "*"
                     ; messages in the selected mailbox.  This
                     ; includes "*" if the selected mailbox is empty.
 */
-func isSeqNumber(s string) bool {
-	if len(s) == 1 && s[0] == '*' {
+func IsSeqNumber(s string) bool {
+	if s == "*" {
 		return true
-	} else {
-		for _, c := range s {
-			if !isNzDigit(c) {
-				return false
-			}
+	}
+	if len(s) == 0 || !isNzDigit(rune(s[0])) {
+		return false
+	}
+	for _, c := range s {
+		if !isDigit(c) {
+			return false
 		}
 	}
-	return true
+	_, err := strconv.ParseUint(s, 10, 32)
+	return err == nil
 }
 
 /*
+IsSeqRange reports whether s is a range like "2:4"
+
 seq-range       = seq-number ":" seq-number
                     ; two seq-number values and all values between
                     ; these two regardless of order.
@@ -421,15 +701,17 @@ seq-range       = seq-number ":" seq-number
                     ; 3291:* includes the UID of the last message in
                     ; the mailbox, even if that value is less than 3291.
 */
-func isSeqRange(s string) bool {
+func IsSeqRange(s string) bool {
 	sp := strings.Split(s, ":")
 	if len(sp) != 2 {
 		return false
 	}
-	return isSeqNumber(sp[0]) && isSeqNumber(sp[1])
+	return IsSeqNumber(sp[0]) && IsSeqNumber(sp[1])
 }
 
 /*
+IsSequenceSet reports whether s is a sequence set like "2,4:7,9,12:*"
+
 sequence-set    = (seq-number / seq-range) *("," sequence-set)
 					; set of seq-number values, regardless of order.
 					; Servers MAY coalesce overlaps and/or execute the
@@ -442,12 +724,12 @@ sequence-set    = (seq-number / seq-range) *("," sequence-set)
 					; 10,9,8,7,6,5,4,5,6,7 and MAY be reordered and
 					; overlap coalesced to be 4,5,6,7,8,9,10.
 */
-func isSequenceSet(s string) bool {
+func IsSequenceSet(s string) bool {
 	if len(s) == 0 {
 		return false
 	}
 	for _, seq := range strings.Split(s, ",") {
-		if !isSeqRange(seq) && !isSeqNumber(seq) {
+		if !IsSeqRange(seq) && !IsSeqNumber(seq) {
 			return false
 		}
 	}
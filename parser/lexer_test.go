@@ -2,6 +2,7 @@ package parser
 
 import (
 	. "github.com/smartystreets/goconvey/convey"
+	"strings"
 	"testing"
 )
 
@@ -13,8 +14,8 @@ func TestLexer(t *testing.T) {
 		So(err, ShouldEqual, nil)
 		So(c.Name, ShouldEqual, "FETCH")
 		So(c.Tag, ShouldEqual, "a003")
-		So(c.Arguments[0], ShouldEqual, "12")
-		So(c.Arguments[1], ShouldEqual, "full")
+		So(c.Arguments[0], ShouldResemble, token{Type: atomToken, Value: "12"})
+		So(c.Arguments[1], ShouldResemble, token{Type: atomToken, Value: "full"})
 		So(len(c.Arguments), ShouldEqual, 2)
 
 		c, err = lexLine("a002 NOOP")
@@ -31,6 +32,94 @@ func TestLexer(t *testing.T) {
 		c, err = lexLine("\\a002 test")
 		So(err, ShouldNotEqual, nil)
 
+		// No command
+		c, err = lexLine("a002")
+		So(err, ShouldNotEqual, nil)
+
+	})
+
+	Convey("Testing tokenize", t, func() {
+
+		tokens, err := tokenize(`LOGIN "john doe" "pass \"word\" \\o/"`)
+		So(err, ShouldEqual, nil)
+		So(tokens, ShouldResemble, []token{
+			{Type: atomToken, Value: "LOGIN"},
+			{Type: quotedToken, Value: "john doe"},
+			{Type: quotedToken, Value: `pass "word" \o/`},
+		})
+
+		tokens, err = tokenize(`SELECT ""`)
+		So(err, ShouldEqual, nil)
+		So(tokens[1], ShouldResemble, token{Type: quotedToken, Value: ""})
+
+		tokens, err = tokenize("LOGIN {8}\r\njohn doe {0}\r\n")
+		So(err, ShouldEqual, nil)
+		So(tokens, ShouldResemble, []token{
+			{Type: atomToken, Value: "LOGIN"},
+			{Type: literalToken, Value: "john doe"},
+			{Type: literalToken, Value: ""},
+		})
+
+		tokens, err = tokenize(`nil NIL (a (b NIL) "c d") ()`)
+		So(err, ShouldEqual, nil)
+		So(tokens, ShouldResemble, []token{
+			{Type: nilToken, Value: "nil"},
+			{Type: nilToken, Value: "NIL"},
+			{Type: listToken, List: []token{
+				{Type: atomToken, Value: "a"},
+				{Type: listToken, List: []token{
+					{Type: atomToken, Value: "b"},
+					{Type: nilToken, Value: "NIL"},
+				}},
+				{Type: quotedToken, Value: "c d"},
+			}},
+			{Type: listToken},
+		})
+
+		tokens, err = tokenize(`2:4 (FLAGS BODY.PEEK[HEADER.FIELDS (DATE FROM)]<0.10> \Seen)`)
+		So(err, ShouldEqual, nil)
+		So(tokens, ShouldResemble, []token{
+			{Type: atomToken, Value: "2:4"},
+			{Type: listToken, List: []token{
+				{Type: atomToken, Value: "FLAGS"},
+				{Type: atomToken, Value: "BODY.PEEK[HEADER.FIELDS (DATE FROM)]<0.10>"},
+				{Type: atomToken, Value: `\Seen`},
+			}},
+		})
+
+		// only the section of a fetch attribute is kept together
+		tokens, err = tokenize(`foo[bar user[1] body[TEXT] BINARY[1 2]`)
+		So(err, ShouldEqual, nil)
+		So(tokens, ShouldResemble, []token{
+			{Type: atomToken, Value: "foo[bar"},
+			{Type: atomToken, Value: "user[1]"},
+			{Type: atomToken, Value: "body[TEXT]"},
+			{Type: atomToken, Value: "BINARY[1 2]"},
+		})
+
+		for _, line := range []string{
+			`"unterminated`,
+			`"invalid \escape"`,
+			"\"new\r\nline\"",
+			`(unterminated`,
+			`unopened)`,
+			`a  b`,
+			`a `,
+			`a"b"`,
+			`BODY[unterminated`,
+			`{test}`,
+			`{5}`,
+			"{5}\r\nabc",
+			"{3}\r\nabcd",
+			strings.Repeat("(", maxListDepth+1) + strings.Repeat(")", maxListDepth+1),
+		} {
+			_, err = tokenize(line)
+			So(err, ShouldNotEqual, nil)
+		}
+
+		_, err = tokenize(strings.Repeat("(", maxListDepth) + strings.Repeat(")", maxListDepth))
+		So(err, ShouldEqual, nil)
+
 	})
 
 	Convey("Testing isCommand", t, func() {
@@ -51,14 +140,14 @@ func TestLexer(t *testing.T) {
 		}
 	})
 
-	Convey("Testing isTag", t, func() {
+	Convey("Testing IsTag", t, func() {
 		for _, command := range []string{
 			"a002",
 			"test",
 			"1",
 			"test]",
 		} {
-			So(isTag(command), ShouldEqual, true)
+			So(IsTag(command), ShouldEqual, true)
 		}
 
 		for _, command := range []string{
@@ -73,18 +162,18 @@ func TestLexer(t *testing.T) {
 			string([]byte{0x0, 0x1, 0x2, 0x3, 0x4}),
 			string([]byte{0x7f}),
 		} {
-			So(isTag(command), ShouldEqual, false)
+			So(IsTag(command), ShouldEqual, false)
 		}
 	})
 
-	Convey("Testing isAtom", t, func() {
+	Convey("Testing IsAtom", t, func() {
 		for _, command := range []string{
 			"a002",
 			"test",
 			"1",
 			"test",
 		} {
-			So(isAtom(command), ShouldEqual, true)
+			So(IsAtom(command), ShouldEqual, true)
 		}
 
 		for _, command := range []string{
@@ -101,7 +190,7 @@ func TestLexer(t *testing.T) {
 			string([]byte{0x0, 0x1, 0x2, 0x3, 0x4}),
 			string([]byte{0x7f}),
 		} {
-			So(isAtom(command), ShouldEqual, false)
+			So(IsAtom(command), ShouldEqual, false)
 		}
 	})
 
@@ -115,7 +204,7 @@ func TestLexer(t *testing.T) {
 		}
 	})
 
-	Convey("Testing isQuoted", t, func() {
+	Convey("Testing IsQuoted", t, func() {
 		for _, s := range []string{
 			"a002",
 			"test",
@@ -124,7 +213,7 @@ func TestLexer(t *testing.T) {
 			`\\`,
 			`\"`,
 		} {
-			So(isQuoted(s), ShouldEqual, true)
+			So(IsQuoted(s), ShouldEqual, true)
 		}
 
 		for _, s := range []string{
@@ -133,11 +222,11 @@ func TestLexer(t *testing.T) {
 			`"`,
 			`\`,
 		} {
-			So(isQuoted(s), ShouldNotEqual, true)
+			So(IsQuoted(s), ShouldNotEqual, true)
 		}
 	})
 
-	Convey("Testing isAString", t, func() {
+	Convey("Testing IsAString", t, func() {
 		for _, s := range []string{
 			"a002",
 			"test",
@@ -151,7 +240,7 @@ func TestLexer(t *testing.T) {
 			"{10}",
 			"{1}",
 		} {
-			So(isAString(s), ShouldEqual, true)
+			So(IsAString(s), ShouldEqual, true)
 		}
 
 		for _, s := range []string{
@@ -176,12 +265,12 @@ func TestLexer(t *testing.T) {
 			string([]byte{0x0, 0x1, 0x2, 0x3, 0x4}),
 			string([]byte{0x7f}),
 		} {
-			So(isAString(s), ShouldEqual, false)
+			So(IsAString(s), ShouldEqual, false)
 		}
 
 	})
 
-	Convey("Testing isMailbox", t, func() {
+	Convey("Testing IsMailbox", t, func() {
 		for _, s := range []string{
 			"a002",
 			"test",
@@ -203,7 +292,7 @@ func TestLexer(t *testing.T) {
 			"~smith/Mail/",
 			"archive/",
 		} {
-			So(isMailbox(s), ShouldEqual, true)
+			So(IsMailbox(s), ShouldEqual, true)
 		}
 
 		for _, s := range []string{
@@ -212,11 +301,11 @@ func TestLexer(t *testing.T) {
 			"👎",
 			"π",
 		} {
-			So(isMailbox(s), ShouldNotEqual, true)
+			So(IsMailbox(s), ShouldNotEqual, true)
 		}
 	})
 
-	Convey("Testing isListMailbox", t, func() {
+	Convey("Testing IsListMailbox", t, func() {
 		for _, s := range []string{
 			"a002",
 			"test",
@@ -237,7 +326,7 @@ func TestLexer(t *testing.T) {
 			"/usr/doc/foo",
 			"~fred/Mail/*",
 		} {
-			So(isListMailbox(s), ShouldEqual, true)
+			So(IsListMailbox(s), ShouldEqual, true)
 		}
 
 		for _, s := range []string{
@@ -261,17 +350,17 @@ func TestLexer(t *testing.T) {
 			string([]byte{0x0, 0x1, 0x2, 0x3, 0x4}),
 			string([]byte{0x7f}),
 		} {
-			So(isListMailbox(s), ShouldEqual, false)
+			So(IsListMailbox(s), ShouldEqual, false)
 		}
 
 	})
 
-	Convey("Testing isLiteral", t, func() {
+	Convey("Testing IsLiteral", t, func() {
 		for _, s := range []string{
 			"{10}",
 			"{1}",
 		} {
-			So(isLiteral(s), ShouldEqual, true)
+			So(IsLiteral(s), ShouldEqual, true)
 		}
 
 		for _, s := range []string{
@@ -280,17 +369,17 @@ func TestLexer(t *testing.T) {
 			"{1",
 			"1}",
 		} {
-			So(isLiteral(s), ShouldNotEqual, true)
+			So(IsLiteral(s), ShouldNotEqual, true)
 		}
 	})
 
-	Convey("Testing isDateTime", t, func() {
+	Convey("Testing IsDateTime", t, func() {
 		for _, s := range []string{
 			`"31-Dec-2002 14:36:36 -0800"`,
 			`"31-Dec-2002 14:36:36 +0800"`,
 			`" 1-Dec-2002 14:36:36 -0800"`,
 		} {
-			So(isDateTime(s), ShouldEqual, true)
+			So(IsDateTime(s), ShouldEqual, true)
 		}
 
 		for _, s := range []string{
@@ -308,7 +397,7 @@ func TestLexer(t *testing.T) {
 			`" 1-Dec-2002 14:36:36 =0800"`,
 			`" 1-Dec-2002 143636 -0800"`,
 		} {
-			So(isDateTime(s), ShouldNotEqual, true)
+			So(IsDateTime(s), ShouldNotEqual, true)
 		}
 	})
 
@@ -330,31 +419,37 @@ func TestLexer(t *testing.T) {
 		}
 	})
 
-	Convey("Testing isSeqNumber", t, func() {
+	Convey("Testing IsSeqNumber", t, func() {
 		for _, command := range []string{
 			"2",
 			"22",
+			"10",
+			"205",
+			"4294967295",
 			"*",
 		} {
-			So(isSeqNumber(command), ShouldEqual, true)
+			So(IsSeqNumber(command), ShouldEqual, true)
 		}
 
 		for _, command := range []string{
 			"0",
 			"01",
 			"*b",
+			"",
+			"**",
+			"4294967296",
 		} {
-			So(isSeqNumber(command), ShouldEqual, false)
+			So(IsSeqNumber(command), ShouldEqual, false)
 		}
 	})
 
-	Convey("Testing isSeqRange", t, func() {
+	Convey("Testing IsSeqRange", t, func() {
 		for _, command := range []string{
 			"2:4",
 			"2:*",
 			"12:*",
 		} {
-			So(isSeqRange(command), ShouldEqual, true)
+			So(IsSeqRange(command), ShouldEqual, true)
 		}
 
 		for _, command := range []string{
@@ -362,19 +457,21 @@ func TestLexer(t *testing.T) {
 			"0",
 			"*",
 		} {
-			So(isSeqRange(command), ShouldEqual, false)
+			So(IsSeqRange(command), ShouldEqual, false)
 		}
 	})
 
-	Convey("Testing isSequenceSet", t, func() {
+	Convey("Testing IsSequenceSet", t, func() {
 		for _, command := range []string{
 			"2,4:7,9,12:*",
 			"443:557",
 			"4827313:4828442",
 			"2",
 			"2:4",
+			"10:205",
+			"*:4,5:7",
 		} {
-			So(isSequenceSet(command), ShouldEqual, true)
+			So(IsSequenceSet(command), ShouldEqual, true)
 		}
 
 		for _, command := range []string{
@@ -383,7 +480,7 @@ func TestLexer(t *testing.T) {
 			"a:b",
 			"*:b",
 		} {
-			So(isSequenceSet(command), ShouldEqual, false)
+			So(IsSequenceSet(command), ShouldEqual, false)
 		}
 	})
 
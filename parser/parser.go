@@ -1,20 +1,49 @@
 package parser
 
 import (
+	"encoding/base64"
 	"errors"
 	"strings"
 	"time"
 )
 
+// Command is a parsed client command
+type Command struct {
+	Tag string
+	Cmd Cmd
+}
+
+// Parse parses a single command line, without the trailing CRLF.
+// Literals must be inline, as sent on the wire: the "{n}" marker,
+// followed by CRLF and the n octets of the literal.
+// Invalid lines return a *ParseError, and the tag when it was recognized.
+func Parse(line string) (Command, error) {
+	cmd, tag, err := parseLine(line)
+	return Command{Tag: tag, Cmd: cmd}, err
+}
+
 // parseLine parses a single line and returns the matching IMAP command
 func parseLine(line string) (command Cmd, tag string, err error) {
 
 	lexCommand, err := lexLine(line)
 	if err != nil {
+		tag = err.(*ParseError).Tag
 		return
 	}
-	
+
 	tag = lexCommand.Tag
+	command, err = parseCommand(lexCommand)
+	if parseErr, ok := err.(*ParseError); ok {
+		parseErr.Tag = tag
+		if parseErr.Command == "" {
+			parseErr.Command = lexCommand.Name
+		}
+	}
+	return
+}
+
+// parseCommand returns the IMAP command for a lexed line
+func parseCommand(lexCommand lexCommand) (command Cmd, err error) {
 
 	switch lexCommand.Name {
 
@@ -22,7 +51,7 @@ func parseLine(line string) (command Cmd, tag string, err error) {
 	case "LOGOUT":
 		{
 			if len(lexCommand.Arguments) != 0 {
-				err = errors.New("Parser: expected no arguments for LOGOUT command")
+				err = countError("Parser: expected no arguments for LOGOUT command")
 				return
 			}
 			command = LogoutCmd{}
@@ -30,7 +59,7 @@ func parseLine(line string) (command Cmd, tag string, err error) {
 	case "CAPABILITY":
 		{
 			if len(lexCommand.Arguments) != 0 {
-				err = errors.New("Parser: expected no arguments for CAPABILITY command")
+				err = countError("Parser: expected no arguments for CAPABILITY command")
 				return
 			}
 			command = CapabilityCmd{}
@@ -38,7 +67,7 @@ func parseLine(line string) (command Cmd, tag string, err error) {
 	case "NOOP":
 		{
 			if len(lexCommand.Arguments) != 0 {
-				err = errors.New("Parser: expected no arguments for NOOP command")
+				err = countError("Parser: expected no arguments for NOOP command")
 				return
 			}
 			command = NoopCmd{}
@@ -48,7 +77,7 @@ func parseLine(line string) (command Cmd, tag string, err error) {
 	case "STARTTLS":
 		{
 			if len(lexCommand.Arguments) != 0 {
-				err = errors.New("Parser: expected no arguments for STARTTLS command")
+				err = countError("Parser: expected no arguments for STARTTLS command")
 				return
 			}
 			command = StarttlsCmd{}
@@ -61,41 +90,60 @@ func parseLine(line string) (command Cmd, tag string, err error) {
 				password = astring
 			*/
 			if len(lexCommand.Arguments) != 2 {
-				err = errors.New("Parser: expected two arguments (username, password) for LOGIN command")
+				err = countError("Parser: expected two arguments (username, password) for LOGIN command")
 				return
 			}
-			if !isAString(lexCommand.Arguments[0]) {
-				err = errors.New("Parser: expected first argument (userid) to be astring")
+			if !lexCommand.Arguments[0].isAString() {
+				err = argumentError(0, "Parser: expected first argument (userid) to be astring")
 				return
 			}
-			if !isAString(lexCommand.Arguments[1]) {
-				err = errors.New("Parser: expected second argument (password) to be astring")
+			if !lexCommand.Arguments[1].isAString() {
+				err = argumentError(1, "Parser: expected second argument (password) to be astring")
 				return
 			}
 			command = LoginCmd{
-				Username: lexCommand.Arguments[0],
-				Password: lexCommand.Arguments[1],
+				Username: lexCommand.Arguments[0].Value,
+				Password: lexCommand.Arguments[1].Value,
 			}
 		}
 	case "AUTHENTICATE":
 		{
 			/*
-				authenticate    = "AUTHENTICATE" SP auth-type *(CRLF base64)
+				authenticate    = "AUTHENTICATE" SP auth-type [SP initial-resp] *(CRLF base64)
 				auth-type       = atom
 									; Defined by [SASL]
+				initial-resp    =  (base64 / "=")
+									; "initial response" defined in
+									; Section 5.1 of [RFC4422]
 			*/
-			if len(lexCommand.Arguments) != 1 {
-				err = errors.New("Parser: expected 1 argument (authentication mechanism name) for AUTHENTICATE command")
+			if len(lexCommand.Arguments) != 1 && len(lexCommand.Arguments) != 2 {
+				err = countError("Parser: expected 1 or 2 arguments (authentication mechanism name, initial response) for AUTHENTICATE command")
 				return
 			}
-			if !isAtom(lexCommand.Arguments[0]) {
-				err = errors.New("Parser: expected first argument (authentication mechanism name) to be atom")
+			if !lexCommand.Arguments[0].isAtom(IsAtom) {
+				err = argumentError(0, "Parser: expected first argument (authentication mechanism name) to be atom")
 				return
 			}
 
-			command = AuthenticateCmd{
-				Mechanism: lexCommand.Arguments[0],
+			authenticateCmd := AuthenticateCmd{
+				Mechanism: lexCommand.Arguments[0].Value,
 			}
+			if len(lexCommand.Arguments) == 2 {
+				initialResponse := lexCommand.Arguments[1]
+				if !initialResponse.isAtom(IsAtom) {
+					err = argumentError(1, "Parser: expected second argument (initial response) to be base64")
+					return
+				}
+				if initialResponse.Value == "=" {
+					authenticateCmd.InitialResponse = []byte{}
+				} else if response, decodeErr := base64.StdEncoding.DecodeString(initialResponse.Value); decodeErr == nil {
+					authenticateCmd.InitialResponse = response
+				} else {
+					err = argumentError(1, "Parser: expected second argument (initial response) to be base64")
+					return
+				}
+			}
+			command = authenticateCmd
 		}
 
 	// Client Commands - Authenticated State
@@ -105,16 +153,16 @@ func parseLine(line string) (command Cmd, tag string, err error) {
 				select  = "SELECT" SP mailbox
 			*/
 			if len(lexCommand.Arguments) != 1 {
-				err = errors.New("Parser: expected 1 argument for SELECT command")
+				err = countError("Parser: expected 1 argument for SELECT command")
 				return
 			}
-			if !isMailbox(lexCommand.Arguments[0]) {
-				err = errors.New("Parser: expected first argument (mailbox) for SELECT to be 'INBOX' or astring")
+			if !lexCommand.Arguments[0].isMailbox() {
+				err = argumentError(0, "Parser: expected first argument (mailbox) for SELECT to be 'INBOX' or astring")
 				return
 			}
 
 			command = SelectCmd{
-				Mailbox: parseMailbox(lexCommand.Arguments[0]),
+				Mailbox: ParseMailbox(lexCommand.Arguments[0].Value),
 			}
 		}
 	case "EXAMINE":
@@ -123,16 +171,16 @@ func parseLine(line string) (command Cmd, tag string, err error) {
 				examine = "EXAMINE" SP mailbox
 			*/
 			if len(lexCommand.Arguments) != 1 {
-				err = errors.New("Parser: expected 1 argument for EXAMINE command")
+				err = countError("Parser: expected 1 argument for EXAMINE command")
 				return
 			}
-			if !isMailbox(lexCommand.Arguments[0]) {
-				err = errors.New("Parser: expected first argument (mailbox) for EXAMINE to be 'INBOX' or astring")
+			if !lexCommand.Arguments[0].isMailbox() {
+				err = argumentError(0, "Parser: expected first argument (mailbox) for EXAMINE to be 'INBOX' or astring")
 				return
 			}
 
 			command = ExamineCmd{
-				Mailbox: parseMailbox(lexCommand.Arguments[0]),
+				Mailbox: ParseMailbox(lexCommand.Arguments[0].Value),
 			}
 		}
 	case "CREATE":
@@ -142,16 +190,16 @@ func parseLine(line string) (command Cmd, tag string, err error) {
 				          ; Use of INBOX gives a NO error
 			*/
 			if len(lexCommand.Arguments) != 1 {
-				err = errors.New("Parser: expected 1 argument for CREATE command")
+				err = countError("Parser: expected 1 argument for CREATE command")
 				return
 			}
-			if !isMailbox(lexCommand.Arguments[0]) {
-				err = errors.New("Parser: expected first argument (mailbox) for CREATE to be 'INBOX' or astring")
+			if !lexCommand.Arguments[0].isMailbox() {
+				err = argumentError(0, "Parser: expected first argument (mailbox) for CREATE to be 'INBOX' or astring")
 				return
 			}
 
 			command = CreateCmd{
-				Mailbox: parseMailbox(lexCommand.Arguments[0]),
+				Mailbox: ParseMailbox(lexCommand.Arguments[0].Value),
 			}
 		}
 	case "DELETE":
@@ -161,16 +209,16 @@ func parseLine(line string) (command Cmd, tag string, err error) {
 				          ; Use of INBOX gives a NO error
 			*/
 			if len(lexCommand.Arguments) != 1 {
-				err = errors.New("Parser: expected 1 argument for DELETE command")
+				err = countError("Parser: expected 1 argument for DELETE command")
 				return
 			}
-			if !isMailbox(lexCommand.Arguments[0]) {
-				err = errors.New("Parser: expected first argument (mailbox) for DELETE to be 'INBOX' or astring")
+			if !lexCommand.Arguments[0].isMailbox() {
+				err = argumentError(0, "Parser: expected first argument (mailbox) for DELETE to be 'INBOX' or astring")
 				return
 			}
 
 			command = DeleteCmd{
-				Mailbox: parseMailbox(lexCommand.Arguments[0]),
+				Mailbox: ParseMailbox(lexCommand.Arguments[0].Value),
 			}
 		}
 	case "RENAME":
@@ -180,21 +228,21 @@ func parseLine(line string) (command Cmd, tag string, err error) {
 			             ; Use of INBOX as a destination gives a NO error
 			*/
 			if len(lexCommand.Arguments) != 2 {
-				err = errors.New("Parser: expected 2 argument for RENAME command")
+				err = countError("Parser: expected 2 argument for RENAME command")
 				return
 			}
-			if !isMailbox(lexCommand.Arguments[0]) {
-				err = errors.New("Parser: expected first argument (mailbox) for RENAME to be 'INBOX' or astring")
+			if !lexCommand.Arguments[0].isMailbox() {
+				err = argumentError(0, "Parser: expected first argument (mailbox) for RENAME to be 'INBOX' or astring")
 				return
 			}
-			if !isMailbox(lexCommand.Arguments[1]) {
-				err = errors.New("Parser: expected second argument (mailbox) for RENAME to be 'INBOX' or astring")
+			if !lexCommand.Arguments[1].isMailbox() {
+				err = argumentError(1, "Parser: expected second argument (mailbox) for RENAME to be 'INBOX' or astring")
 				return
 			}
 
 			command = RenameCmd{
-				SourceMailbox:      parseMailbox(lexCommand.Arguments[0]),
-				DestinationMailbox: parseMailbox(lexCommand.Arguments[1]),
+				SourceMailbox:      ParseMailbox(lexCommand.Arguments[0].Value),
+				DestinationMailbox: ParseMailbox(lexCommand.Arguments[1].Value),
 			}
 		}
 	case "SUBSCRIBE":
@@ -203,16 +251,16 @@ func parseLine(line string) (command Cmd, tag string, err error) {
 				subscribe = "SUBSCRIBE" SP mailbox
 			*/
 			if len(lexCommand.Arguments) != 1 {
-				err = errors.New("Parser: expected 1 argument for SUBSCRIBE command")
+				err = countError("Parser: expected 1 argument for SUBSCRIBE command")
 				return
 			}
-			if !isMailbox(lexCommand.Arguments[0]) {
-				err = errors.New("Parser: expected first argument (mailbox) for SUBSCRIBE to be 'INBOX' or astring")
+			if !lexCommand.Arguments[0].isMailbox() {
+				err = argumentError(0, "Parser: expected first argument (mailbox) for SUBSCRIBE to be 'INBOX' or astring")
 				return
 			}
 
 			command = SubscribeCmd{
-				Mailbox: parseMailbox(lexCommand.Arguments[0]),
+				Mailbox: ParseMailbox(lexCommand.Arguments[0].Value),
 			}
 		}
 	case "UNSUBSCRIBE":
@@ -221,16 +269,16 @@ func parseLine(line string) (command Cmd, tag string, err error) {
 				unsubscribe = "UNSUBSCRIBE" SP mailbox
 			*/
 			if len(lexCommand.Arguments) != 1 {
-				err = errors.New("Parser: expected 1 argument for UNSUBSCRIBE command")
+				err = countError("Parser: expected 1 argument for UNSUBSCRIBE command")
 				return
 			}
-			if !isMailbox(lexCommand.Arguments[0]) {
-				err = errors.New("Parser: expected first argument (mailbox) for UNSUBSCRIBE to be 'INBOX' or astring")
+			if !lexCommand.Arguments[0].isMailbox() {
+				err = argumentError(0, "Parser: expected first argument (mailbox) for UNSUBSCRIBE to be 'INBOX' or astring")
 				return
 			}
 
 			command = UnsubscribeCmd{
-				Mailbox: parseMailbox(lexCommand.Arguments[0]),
+				Mailbox: ParseMailbox(lexCommand.Arguments[0].Value),
 			}
 		}
 	case "LIST":
@@ -239,21 +287,21 @@ func parseLine(line string) (command Cmd, tag string, err error) {
 			   list = "LIST" SP mailbox SP list-mailbox
 			*/
 			if len(lexCommand.Arguments) != 2 {
-				err = errors.New("Parser: expected 2 arguments for LIST command")
+				err = countError("Parser: expected 2 arguments for LIST command")
 				return
 			}
-			if !isMailbox(lexCommand.Arguments[0]) {
-				err = errors.New("Parser: expected first argument (reference) for LIST to be 'INBOX' or astring")
+			if !lexCommand.Arguments[0].isMailbox() {
+				err = argumentError(0, "Parser: expected first argument (reference) for LIST to be 'INBOX' or astring")
 				return
 			}
-			if !isListMailbox(lexCommand.Arguments[1]) {
-				err = errors.New("Parser: expected second argument (mailbox) for LIST to be list-mailbox")
+			if !lexCommand.Arguments[1].isListMailbox() {
+				err = argumentError(1, "Parser: expected second argument (mailbox) for LIST to be list-mailbox")
 				return
 			}
 
 			command = ListCmd{
-				Reference: parseMailbox(lexCommand.Arguments[0]),
-				Mailbox:   lexCommand.Arguments[1],
+				Reference: ParseMailbox(lexCommand.Arguments[0].Value),
+				Mailbox:   lexCommand.Arguments[1].Value,
 			}
 		}
 	case "LSUB":
@@ -262,21 +310,21 @@ func parseLine(line string) (command Cmd, tag string, err error) {
 			   lsub = "LSUB" SP mailbox SP list-mailbox
 			*/
 			if len(lexCommand.Arguments) != 2 {
-				err = errors.New("Parser: expected 2 arguments for LSUB command")
+				err = countError("Parser: expected 2 arguments for LSUB command")
 				return
 			}
-			if !isMailbox(lexCommand.Arguments[0]) {
-				err = errors.New("Parser: expected first argument (reference) for LSUB to be 'INBOX' or astring")
+			if !lexCommand.Arguments[0].isMailbox() {
+				err = argumentError(0, "Parser: expected first argument (reference) for LSUB to be 'INBOX' or astring")
 				return
 			}
-			if !isListMailbox(lexCommand.Arguments[1]) {
-				err = errors.New("Parser: expected second argument (mailbox) for LSUB to be list-mailbox")
+			if !lexCommand.Arguments[1].isListMailbox() {
+				err = argumentError(1, "Parser: expected second argument (mailbox) for LSUB to be list-mailbox")
 				return
 			}
 
 			command = LsubCmd{
-				Reference: parseMailbox(lexCommand.Arguments[0]),
-				Mailbox:   lexCommand.Arguments[1],
+				Reference: ParseMailbox(lexCommand.Arguments[0].Value),
+				Mailbox:   lexCommand.Arguments[1].Value,
 			}
 		}
 	case "STATUS":
@@ -286,35 +334,33 @@ func parseLine(line string) (command Cmd, tag string, err error) {
 			   status-att = "MESSAGES" / "RECENT" / "UIDNEXT" / "UIDVALIDITY" / "UNSEEN"
 			*/
 			if len(lexCommand.Arguments) < 1 {
-				err = errors.New("Parser: expected mailbox argument for STATUS command")
+				err = countError("Parser: expected mailbox argument for STATUS command")
 				return
 			}
-			if !isMailbox(lexCommand.Arguments[0]) {
-				err = errors.New("Parser: expected first argument (mailbox) for STATUS to be 'INBOX' or astring")
+			if !lexCommand.Arguments[0].isMailbox() {
+				err = argumentError(0, "Parser: expected first argument (mailbox) for STATUS to be 'INBOX' or astring")
 				return
 			}
-			if len(lexCommand.Arguments) < 2 {
-				err = errors.New("Parser: expected status-att list for STATUS command")
+			if len(lexCommand.Arguments) != 2 {
+				err = countError("Parser: expected status-att list for STATUS command")
 				return
 			}
-			firstAttr := &lexCommand.Arguments[1]
-			lastAttr := &lexCommand.Arguments[len(lexCommand.Arguments)-1]
-			if (*firstAttr)[0] != '(' || (*lastAttr)[len(*lastAttr)-1] != ')' {
-				err = errors.New("Parser: expected status-att list for STATUS command. Didn't find delimiter")
+			if lexCommand.Arguments[1].Type != listToken || len(lexCommand.Arguments[1].List) == 0 {
+				err = argumentError(1, "Parser: expected status-att list for STATUS command. Didn't find delimiter")
 				return
 			}
-			*firstAttr = strings.TrimPrefix(*firstAttr, "(")
-			*lastAttr = strings.TrimSuffix(*lastAttr, ")")
 
-			for _, attr := range lexCommand.Arguments[1:] {
-				switch attr {
-				case "MESSAGES", "RECENT", "UIDNEXT", "UIDVALIDITY", "UNSEEN":
+			attributes := []string{}
+			for _, attr := range lexCommand.Arguments[1].List {
+				name := strings.ToUpper(attr.Value)
+				switch {
+				case attr.Type == atomToken && (name == "MESSAGES" || name == "RECENT" || name == "UIDNEXT" || name == "UIDVALIDITY" || name == "UNSEEN"):
 					{
-						continue
+						attributes = append(attributes, name)
 					}
 				default:
 					{
-						err = errors.New("Parser: unknown status-att for STATUS command: " + attr)
+						err = argumentError(1, "Parser: unknown status-att for STATUS command: "+attr.Value)
 						return
 					}
 
@@ -322,8 +368,8 @@ func parseLine(line string) (command Cmd, tag string, err error) {
 			}
 
 			command = StatusCmd{
-				Mailbox:          parseMailbox(lexCommand.Arguments[0]),
-				StatusAttributes: lexCommand.Arguments[1:],
+				Mailbox:          ParseMailbox(lexCommand.Arguments[0].Value),
+				StatusAttributes: attributes,
 			}
 
 		}
@@ -346,66 +392,77 @@ func parseLine(line string) (command Cmd, tag string, err error) {
 				date-time       = DQUOTE date-day-fixed "-" date-month "-" date-year SP time SP zone DQUOTE
 			*/
 			if len(lexCommand.Arguments) < 2 {
-				err = errors.New("Parser: expected at least two arguments for APPEND command")
+				err = countError("Parser: expected at least two arguments for APPEND command")
 				return
 			}
-			if !isMailbox(lexCommand.Arguments[0]) {
-				err = errors.New("Parser: expected first argument (mailbox) for APPEND to be 'INBOX' or astring")
+			if len(lexCommand.Arguments) > 4 {
+				err = countError("Parser: expected at most four arguments for APPEND command")
 				return
 			}
-			if !isLiteral(lexCommand.Arguments[len(lexCommand.Arguments)-1]) {
-				err = errors.New("Parser: expected last argument for APPEND to be literal")
+			if !lexCommand.Arguments[0].isMailbox() {
+				err = argumentError(0, "Parser: expected first argument (mailbox) for APPEND to be 'INBOX' or astring")
+				return
+			}
+			literal := lexCommand.Arguments[len(lexCommand.Arguments)-1]
+			if literal.Type != literalToken {
+				err = argumentError(len(lexCommand.Arguments)-1, "Parser: expected last argument for APPEND to be literal")
 				return
 			}
 
 			flags := []string{}
 			date := time.Time{}
 
-			if len(lexCommand.Arguments) > 2 {
-				count := 1
-				if lexCommand.Arguments[1][0] == '(' {
-					// flag-list
-					for i, flag := range lexCommand.Arguments[1 : len(lexCommand.Arguments)-1] {
-						flags = append(flags, strings.TrimPrefix(strings.TrimSuffix(flag, ")"), "("))
-						if flag[len(flag)-1] == ')' {
-							// end
-							count = i + 2
-							break
-						}
-					}
-					if count == 1 {
-						err = errors.New("Parser: malformed flaglist APPEND")
-						return
-					}
+			options := lexCommand.Arguments[1 : len(lexCommand.Arguments)-1]
+			if len(options) > 0 && options[0].Type == listToken {
+				// flag-list
+				flags, err = parseFlagList(options[0].List)
+				if err != nil {
+					err = argumentError(1, err.Error())
+					return
 				}
-				if count != len(lexCommand.Arguments)-1 {
-					// date-time is split into args by lexer
-					dateTime := strings.Join(lexCommand.Arguments[count:len(lexCommand.Arguments)-1], " ")
-					if !isDateTime(dateTime) {
-						err = errors.New("Parser: invalid date-time argument for APPEND")
-						return
-					}
-					dateTime = dateTime[1 : len(dateTime)-1]
-					date, err = parseDateTime(strings.TrimPrefix(dateTime, " "))
-					if err != nil {
-						return
-					}
+				options = options[1:]
+			}
+			if len(options) > 0 {
+				if options[0].Type != quotedToken || !IsDateTime(`"`+options[0].Value+`"`) {
+					err = argumentError(len(lexCommand.Arguments)-1-len(options), "Parser: invalid date-time argument for APPEND")
+					return
 				}
+				date, err = ParseDateTime(strings.TrimPrefix(options[0].Value, " "))
+				if err != nil {
+					err = argumentError(len(lexCommand.Arguments)-1-len(options), "Parser: invalid date-time argument for APPEND")
+					return
+				}
+				options = options[1:]
+			}
+			if len(options) > 0 {
+				err = argumentError(len(lexCommand.Arguments)-1-len(options), "Parser: unexpected arguments for APPEND command")
+				return
 			}
 
 			command = AppendCmd{
-				Mailbox:  parseMailbox(lexCommand.Arguments[0]),
-				Literal:  lexCommand.Arguments[len(lexCommand.Arguments)-1],
+				Mailbox:  ParseMailbox(lexCommand.Arguments[0].Value),
+				Literal:  []byte(literal.Value),
 				Flags:    flags,
 				DateTime: date,
 			}
 
 		}
+	case "IDLE":
+		{
+			/*
+				idle       = "IDLE" CRLF "DONE"
+			*/
+			if len(lexCommand.Arguments) != 0 {
+				err = countError("Parser: expected no arguments for IDLE command")
+				return
+			}
+			command = IdleCmd{}
+		}
 	// Client Commands - Selected State
 	case "CHECK":
 		{
 			if len(lexCommand.Arguments) != 0 {
-				err = errors.New("Parser: expected no arguments for CHECK command")
+				err = countError("Parser: expected no arguments for CHECK command")
 				return
 			}
 			command = CheckCmd{}
@@ -413,7 +470,7 @@ func parseLine(line string) (command Cmd, tag string, err error) {
 	case "CLOSE":
 		{
 			if len(lexCommand.Arguments) != 0 {
-				err = errors.New("Parser: expected no arguments for CLOSE command")
+				err = countError("Parser: expected no arguments for CLOSE command")
 				return
 			}
 			command = CloseCmd{}
@@ -421,7 +478,7 @@ func parseLine(line string) (command Cmd, tag string, err error) {
 	case "EXPUNGE":
 		{
 			if len(lexCommand.Arguments) != 0 {
-				err = errors.New("Parser: expected no arguments for EXPUNGE command")
+				err = countError("Parser: expected no arguments for EXPUNGE command")
 				return
 			}
 			command = ExpungeCmd{}
@@ -450,6 +507,37 @@ func parseLine(line string) (command Cmd, tag string, err error) {
 								  "UID" SP sequence-set / "UNDRAFT" / sequence-set /
 								  "(" search-key *(SP search-key) ")"
 			*/
+			arguments := lexCommand.Arguments
+			charset := ""
+			if len(arguments) > 0 && arguments[0].isAtom(func(s string) bool { return strings.ToUpper(s) == "CHARSET" }) {
+				if len(arguments) < 2 || !arguments[1].isAString() {
+					err = argumentError(1, "Parser: expected astring after CHARSET for SEARCH command")
+					return
+				}
+				charset = arguments[1].Value
+				arguments = arguments[2:]
+			}
+			if len(arguments) == 0 {
+				err = countError("Parser: expected search-key for SEARCH command")
+				return
+			}
+
+			var keys []SearchKey
+			for len(arguments) > 0 {
+				index := len(lexCommand.Arguments) - len(arguments)
+				var key SearchKey
+				key, arguments, err = parseSearchKey(arguments)
+				if err != nil {
+					err = argumentError(index, err.Error())
+					return
+				}
+				keys = append(keys, key)
+			}
+
+			command = SearchCmd{
+				Charset: charset,
+				Keys:    keys,
+			}
 		}
 	case "FETCH":
 		{
@@ -474,17 +562,27 @@ func parseLine(line string) (command Cmd, tag string, err error) {
 				section-text    = section-msgtext / "MIME"
 				                    ; text other than actual body part (headers, etc.)
 			*/
-			if len(lexCommand.Arguments) < 2 {
-				err = errors.New("Parser: expected sequence set and args for FETCH command")
+			if len(lexCommand.Arguments) != 2 {
+				err = countError("Parser: expected sequence set and args for FETCH command")
 				return
 			}
-			if !isSequenceSet(lexCommand.Arguments[0]) {
-				err = errors.New("Parser: expected first argument for FATCH command to be sequence-set")
+			sequence, ok := lexCommand.Arguments[0].sequenceSet()
+			if !ok {
+				err = argumentError(0, "Parser: expected first argument for FETCH command to be sequence-set")
+				return
 			}
 
-			// TODO
+			var attributes []FetchAttribute
+			attributes, err = parseFetchAttributes(lexCommand.Arguments[1])
+			if err != nil {
+				err = argumentError(1, err.Error())
+				return
+			}
 
-			command = FetchCmd{}
+			command = FetchCmd{
+				Sequence:   sequence,
+				Attributes: attributes,
+			}
 		}
 	case "STORE":
 		{
@@ -493,44 +591,52 @@ func parseLine(line string) (command Cmd, tag string, err error) {
 				store-att-flags = (["+" / "-"] "FLAGS" [".SILENT"]) SP
 				                  (flag-list / (flag *(SP flag)))
 			*/
-			if len(lexCommand.Arguments) < 2 {
-				err = errors.New("Parser: expected sequence set and store-att-flags for STORE command")
+			if len(lexCommand.Arguments) < 3 {
+				err = countError("Parser: expected sequence set and store-att-flags for STORE command")
 				return
 			}
-			if !isSequenceSet(lexCommand.Arguments[0]) {
-				err = errors.New("Parser: expected first argument for STORE command to be sequence-set")
+			sequence, ok := lexCommand.Arguments[0].sequenceSet()
+			if !ok {
+				err = argumentError(0, "Parser: expected first argument for STORE command to be sequence-set")
 				return
 			}
 
+			if !lexCommand.Arguments[1].isAtom(IsAtom) {
+				err = argumentError(1, "Parser: expected FLAGS for STORE command")
+				return
+			}
+			item := strings.ToUpper(lexCommand.Arguments[1].Value)
+
 			silent := false
-			if strings.HasSuffix(lexCommand.Arguments[1], ".SILENT") {
+			if strings.HasSuffix(item, ".SILENT") {
 				silent = true
-				lexCommand.Arguments[1] = strings.TrimSuffix(lexCommand.Arguments[1], ".SILENT")
+				item = strings.TrimSuffix(item, ".SILENT")
 			}
 
-			if !strings.HasSuffix(lexCommand.Arguments[1], "FLAGS") {
-				err = errors.New("Parser: expected FLAGS for STORE command")
+			if !strings.HasSuffix(item, "FLAGS") {
+				err = argumentError(1, "Parser: expected FLAGS for STORE command")
 				return
 			}
 
-			mode := strings.TrimSuffix(lexCommand.Arguments[1], "FLAGS")
+			mode := strings.TrimSuffix(item, "FLAGS")
 			if mode != "+" && mode != "-" && mode != "" {
-				err = errors.New("Parser: expected '+', '-', or '' as flag mode for FLAG command")
+				err = argumentError(1, "Parser: expected '+', '-', or '' as flag mode for FLAG command")
 				return
 			}
 
-			flags := []string{}
-			if (strings.HasPrefix(lexCommand.Arguments[2], "(") && !strings.HasSuffix(lexCommand.Arguments[len(lexCommand.Arguments)-1], ")")) ||
-				(!strings.HasPrefix(lexCommand.Arguments[2], "(") && strings.HasSuffix(lexCommand.Arguments[len(lexCommand.Arguments)-1], ")")) {
-				err = errors.New("Parser: malformed flaglist for STORE")
-				return
+			flagTokens := lexCommand.Arguments[2:]
+			if len(flagTokens) == 1 && flagTokens[0].Type == listToken {
+				flagTokens = flagTokens[0].List
 			}
-			for _, flag := range lexCommand.Arguments[2:len(lexCommand.Arguments)] {
-				flags = append(flags, strings.TrimPrefix(strings.TrimSuffix(flag, ")"), "("))
+			var flags []string
+			flags, err = parseFlagList(flagTokens)
+			if err != nil {
+				err = argumentError(2, err.Error())
+				return
 			}
 
 			command = StoreCmd{
-				Sequence: lexCommand.Arguments[0],
+				Sequence: sequence,
 				Mode:     mode,
 				Silent:   silent,
 				Flags:    flags,
@@ -542,6 +648,24 @@ func parseLine(line string) (command Cmd, tag string, err error) {
 			/*
 				copy            = "COPY" SP sequence-set SP mailbox
 			*/
+			if len(lexCommand.Arguments) != 2 {
+				err = countError("Parser: expected sequence set and mailbox for COPY command")
+				return
+			}
+			sequence, ok := lexCommand.Arguments[0].sequenceSet()
+			if !ok {
+				err = argumentError(0, "Parser: expected first argument for COPY command to be sequence-set")
+				return
+			}
+			if !lexCommand.Arguments[1].isMailbox() {
+				err = argumentError(1, "Parser: expected second argument (mailbox) for COPY to be 'INBOX' or astring")
+				return
+			}
+
+			command = CopyCmd{
+				Sequence: sequence,
+				Mailbox:  ParseMailbox(lexCommand.Arguments[1].Value),
+			}
 		}
 	case "UID":
 		{
@@ -550,11 +674,51 @@ func parseLine(line string) (command Cmd, tag string, err error) {
 				                    ; Unique identifiers used instead of message
 				                    ; sequence numbers
 			*/
+			if len(lexCommand.Arguments) < 1 || !lexCommand.Arguments[0].isAtom(isCommand) {
+				err = countError("Parser: expected command for UID command")
+				return
+			}
+
+			inner := lexCommand
+			inner.Name = strings.ToUpper(lexCommand.Arguments[0].Value)
+			inner.Arguments = lexCommand.Arguments[1:]
+
+			switch inner.Name {
+			case "COPY", "FETCH", "SEARCH", "STORE":
+				command, err = parseCommand(inner)
+				if parseErr, ok := err.(*ParseError); ok {
+					// report the inner command, with argument indexes of the whole line
+					parseErr.Command = "UID " + inner.Name
+					if parseErr.Argument >= 0 {
+						parseErr.Argument++
+					}
+				}
+			default:
+				err = argumentError(0, "Parser: expected COPY, FETCH, SEARCH or STORE for UID command")
+			}
+			if err != nil {
+				return
+			}
+
+			switch cmd := command.(type) {
+			case CopyCmd:
+				cmd.Uid = true
+				command = cmd
+			case FetchCmd:
+				cmd.Uid = true
+				command = cmd
+			case SearchCmd:
+				cmd.Uid = true
+				command = cmd
+			case StoreCmd:
+				cmd.Uid = true
+				command = cmd
+			}
 		}
 
 	default:
 		{
-			err = errors.New("Unknown command")
+			err = &ParseError{Argument: -1, Offset: -1, Reason: ReasonUnknownCommand, Message: "Parser: unknown command " + lexCommand.Name}
 		}
 	}
 
@@ -562,7 +726,9 @@ func parseLine(line string) (command Cmd, tag string, err error) {
 
 }
 
-func parseMailbox(s string) string {
+// ParseMailbox returns the mailbox name, with all case variants of INBOX
+// normalized to "INBOX"
+func ParseMailbox(s string) string {
 	if strings.ToUpper(s) == "INBOX" {
 		return "INBOX"
 	} else {
@@ -570,6 +736,19 @@ func parseMailbox(s string) string {
 	}
 }
 
-func parseDateTime(s string) (time.Time, error) {
+// parseFlagList returns the flags in a (flag-)list
+func parseFlagList(tokens []token) ([]string, error) {
+	flags := []string{}
+	for _, flag := range tokens {
+		if !flag.isAtom(IsFlag) {
+			return nil, errors.New("Parser: expected flag, found " + flag.Value)
+		}
+		flags = append(flags, flag.Value)
+	}
+	return flags, nil
+}
+
+// ParseDateTime parses the content of a date-time, without the double quotes
+func ParseDateTime(s string) (time.Time, error) {
 	return time.Parse("2-Jan-2006 15:04:05 -0700", s)
 }
@@ -2,11 +2,63 @@ package parser
 
 import (
 	. "github.com/smartystreets/goconvey/convey"
+	"strings"
 	"testing"
+	"time"
 )
 
 func TestParser(t *testing.T) {
 
+	Convey("Testing Parse", t, func() {
+
+		command, err := Parse("a001 SELECT inbox")
+		So(err, ShouldEqual, nil)
+		So(command, ShouldResemble, Command{Tag: "a001", Cmd: SelectCmd{Mailbox: "INBOX"}})
+
+		command, err = Parse("a002 SELECT")
+		So(err, ShouldNotEqual, nil)
+		So(command.Tag, ShouldEqual, "a002")
+		So(command.Cmd, ShouldEqual, nil)
+
+	})
+
+	Convey("Testing ParseError", t, func() {
+
+		tests := []struct {
+			line     string
+			expected ParseError
+		}{
+			{"", ParseError{Argument: -1, Offset: 0, Reason: ReasonTag}},
+			{"+ NOOP", ParseError{Argument: -1, Offset: 0, Reason: ReasonTag}},
+			{"a001", ParseError{Tag: "a001", Argument: -1, Offset: 5, Reason: ReasonUnknownCommand}},
+			{"a001 n00p", ParseError{Tag: "a001", Argument: -1, Offset: 5, Reason: ReasonUnknownCommand}},
+			{"a002 unknowncommand", ParseError{Tag: "a002", Command: "UNKNOWNCOMMAND", Argument: -1, Offset: -1, Reason: ReasonUnknownCommand}},
+			{"a003 select", ParseError{Tag: "a003", Command: "SELECT", Argument: -1, Offset: -1, Reason: ReasonArgumentCount}},
+			{"a004 LOGIN mrc \"secret", ParseError{Tag: "a004", Command: "LOGIN", Argument: -1, Offset: 22, Reason: ReasonSyntax}},
+			{"a005 RENAME foo (bar)", ParseError{Tag: "a005", Command: "RENAME", Argument: 1, Offset: -1, Reason: ReasonInvalidArgument}},
+			{"a006 SEARCH FLAGGED SINCE 1-Feb-1994 BOGUS", ParseError{Tag: "a006", Command: "SEARCH", Argument: 3, Offset: -1, Reason: ReasonInvalidArgument}},
+			{"a007 UID FETCH 1:2 BOGUS", ParseError{Tag: "a007", Command: "UID FETCH", Argument: 2, Offset: -1, Reason: ReasonInvalidArgument}},
+			{"a008 APPEND INBOX (\\Seen) \"bogus\" {0}\r\n", ParseError{Tag: "a008", Command: "APPEND", Argument: 2, Offset: -1, Reason: ReasonInvalidArgument}},
+			{"a009 SEARCH " + strings.Repeat("(", 40), ParseError{Tag: "a009", Command: "SEARCH", Argument: -1, Offset: 44, Reason: ReasonSyntax}},
+		}
+		for _, test := range tests {
+			command, err := Parse(test.line)
+			So(err, ShouldHaveSameTypeAs, &ParseError{})
+			parseErr := err.(*ParseError)
+			So(parseErr.Message, ShouldNotEqual, "")
+			parseErr.Message = ""
+			So(*parseErr, ShouldResemble, test.expected)
+			So(command.Tag, ShouldEqual, test.expected.Tag)
+		}
+
+		_, err := Parse("a001 LOGIN mrc \"secret")
+		So(err.(*ParseError).Response(), ShouldResemble, StatusResponse{Tag: "a001", Type: BAD, Info: err.Error()})
+
+		_, err = Parse("a001")
+		So(err.(*ParseError).Response().Tag, ShouldEqual, "a001")
+
+	})
+
 	Convey("Testing parseLine", t, func() {
 
 		Convey("Testing general stuff", func() {
@@ -78,6 +130,25 @@ func TestParser(t *testing.T) {
 				So(loginCmd.Username, ShouldEqual, "mrc")
 				So(loginCmd.Password, ShouldEqual, "secret")
 
+				cmd, _, err = parseLine(`a001 LOGIN "john doe" "pass \"word\""`)
+				So(err, ShouldEqual, nil)
+				loginCmd = cmd.(LoginCmd)
+				So(loginCmd.Username, ShouldEqual, "john doe")
+				So(loginCmd.Password, ShouldEqual, `pass "word"`)
+
+				cmd, _, err = parseLine("a001 login {4}\r\nmrc  {7}\r\nsec ret")
+				So(err, ShouldEqual, nil)
+				loginCmd = cmd.(LoginCmd)
+				So(loginCmd.Username, ShouldEqual, "mrc ")
+				So(loginCmd.Password, ShouldEqual, "sec ret")
+
+				// brackets are ASTRING-CHARs outside of a section
+				cmd, _, err = parseLine("a001 LOGIN user[1] pw]")
+				So(err, ShouldEqual, nil)
+				loginCmd = cmd.(LoginCmd)
+				So(loginCmd.Username, ShouldEqual, "user[1]")
+				So(loginCmd.Password, ShouldEqual, "pw]")
+
 				// Not enough arguments
 				cmd, _, err = parseLine("a001 login")
 				So(err, ShouldNotEqual, nil)
@@ -102,6 +173,19 @@ func TestParser(t *testing.T) {
 				So(cmd, ShouldHaveSameTypeAs, AuthenticateCmd{})
 				authCmd := cmd.(AuthenticateCmd)
 				So(authCmd.Mechanism, ShouldEqual, "GSSAPI")
+				So(authCmd.InitialResponse, ShouldBeNil)
+
+				// Initial response (SASL-IR)
+				cmd, _, err = parseLine("a001 AUTHENTICATE PLAIN AG1yYwBzZWNyZXQ=")
+				So(err, ShouldEqual, nil)
+				So(cmd, ShouldResemble, AuthenticateCmd{Mechanism: "PLAIN", InitialResponse: []byte("\x00mrc\x00secret")})
+				cmd, _, err = parseLine("a001 AUTHENTICATE EXTERNAL =")
+				So(err, ShouldEqual, nil)
+				So(cmd, ShouldResemble, AuthenticateCmd{Mechanism: "EXTERNAL", InitialResponse: []byte{}})
+				cmd, _, err = parseLine("a001 AUTHENTICATE PLAIN not-base64")
+				So(err, ShouldNotEqual, nil)
+				cmd, _, err = parseLine(`a001 AUTHENTICATE PLAIN "AG1yYwBzZWNyZXQ="`)
+				So(err, ShouldNotEqual, nil)
 
 				// Not enough arguments
 				cmd, _, err = parseLine("a001 AUTHENTICATE")
@@ -159,12 +243,22 @@ func TestParser(t *testing.T) {
 					cmd1 := cmd.(AuthenticatedStateCmd)
 					So(cmd1.GetMailbox(), ShouldEqual, "INBOX")
 
+					cmd, _, err = parseLine("a001 " + test.name + ` "Sent Items"`)
+					So(err, ShouldEqual, nil)
+					cmd1 = cmd.(AuthenticatedStateCmd)
+					So(cmd1.GetMailbox(), ShouldEqual, "Sent Items")
+
 					cmd, _, err = parseLine("a001 " + test.name + " some_inbox")
 					So(err, ShouldEqual, nil)
 					So(cmd, ShouldHaveSameTypeAs, test.instance)
 					cmd1 = cmd.(AuthenticatedStateCmd)
 					So(cmd1.GetMailbox(), ShouldEqual, "some_inbox")
 
+					cmd, _, err = parseLine("a001 " + test.name + " foo[bar")
+					So(err, ShouldEqual, nil)
+					cmd1 = cmd.(AuthenticatedStateCmd)
+					So(cmd1.GetMailbox(), ShouldEqual, "foo[bar")
+
 					// Not enough arguments
 					cmd, _, err = parseLine("a001 " + test.name + "")
 					So(err, ShouldNotEqual, nil)
@@ -336,24 +430,29 @@ func TestParser(t *testing.T) {
 
 			Convey("APPEND", func() {
 
-				cmd, _, err := parseLine("A003 APPEND saved-messages (\\Seen) {310}")
+				cmd, _, err := parseLine("A003 APPEND saved-messages (\\Seen) {12}\r\nHello World!")
 				So(err, ShouldEqual, nil)
 				So(cmd, ShouldHaveSameTypeAs, AppendCmd{})
 				cmd1 := cmd.(AppendCmd)
 				So(cmd1.Mailbox, ShouldEqual, "saved-messages")
 				So(cmd1.Flags, ShouldResemble, []string{"\\Seen"})
+				So(string(cmd1.Literal), ShouldEqual, "Hello World!")
 
-				cmd, _, err = parseLine(`A00027 APPEND A-SPAM-filtered/2002 (\Seen) "31-Dec-2002 14:36:36 -0800" {6663}`)
+				cmd, _, err = parseLine(`A00027 APPEND "Sent Items" (\Seen \Draft) "31-Dec-2002 14:36:36 -0800" {5}` + "\r\nhello")
 				So(err, ShouldEqual, nil)
+				cmd1 = cmd.(AppendCmd)
+				So(cmd1.Mailbox, ShouldEqual, "Sent Items")
+				So(cmd1.Flags, ShouldResemble, []string{"\\Seen", "\\Draft"})
+				So(cmd1.DateTime.Unix(), ShouldEqual, 1041374196)
 
-				cmd, _, err = parseLine(`A00027 APPEND A-SPAM-filtered/2002 "31-Dec-2002 14:36:36 -0800" {6663}`)
+				cmd, _, err = parseLine(`A00027 APPEND A-SPAM-filtered/2002 "31-Dec-2002 14:36:36 -0800" {5}` + "\r\nhello")
 				So(err, ShouldEqual, nil)
 				So(cmd, ShouldHaveSameTypeAs, AppendCmd{})
 				cmd1 = cmd.(AppendCmd)
 				So(cmd1.Mailbox, ShouldEqual, "A-SPAM-filtered/2002")
 				So(cmd1.Flags, ShouldResemble, []string{})
 
-				cmd, _, err = parseLine(`A00027 APPEND A-SPAM-filtered/2002 " 1-Dec-2002 14:36:36 +0800" {6663}`)
+				cmd, _, err = parseLine(`A00027 APPEND A-SPAM-filtered/2002 " 1-Dec-2002 14:36:36 +0800" {5}` + "\r\nhello")
 				So(err, ShouldEqual, nil)
 				So(cmd, ShouldHaveSameTypeAs, AppendCmd{})
 				cmd1 = cmd.(AppendCmd)
@@ -372,7 +471,7 @@ func TestParser(t *testing.T) {
 				So(err, ShouldNotEqual, nil)
 
 				// Non mailbox argument
-				cmd, _, err = parseLine("a001 APPEND test\"test {10}")
+				cmd, _, err = parseLine("a001 APPEND test\"test {5}\r\nhello")
 				So(err, ShouldNotEqual, nil)
 
 				// Non literal argument
@@ -380,11 +479,28 @@ func TestParser(t *testing.T) {
 				So(err, ShouldNotEqual, nil)
 
 				// malformed list
-				cmd, _, err = parseLine("A003 APPEND saved-messages (\\Seen {310}")
+				cmd, _, err = parseLine("A003 APPEND saved-messages (\\Seen {5}\r\nhello")
 				So(err, ShouldNotEqual, nil)
 
 				// malformed time
-				cmd, _, err = parseLine("A003 APPEND saved-messages (\\Seen) \"1-malformed-2002 14:36:36 +0800\" {310}")
+				cmd, _, err = parseLine("A003 APPEND saved-messages (\\Seen) \"1-malformed-2002 14:36:36 +0800\" {5}\r\nhello")
+				So(err, ShouldNotEqual, nil)
+
+				// missing literal data
+				cmd, _, err = parseLine("A003 APPEND saved-messages {310}")
+				So(err, ShouldNotEqual, nil)
+
+				cmd, _, err = parseLine("A003 APPEND saved-messages {310}\r\nhello")
+				So(err, ShouldNotEqual, nil)
+			})
+
+			Convey("IDLE", func() {
+
+				cmd, _, err := parseLine("A002 IDLE")
+				So(err, ShouldEqual, nil)
+				So(cmd, ShouldHaveSameTypeAs, IdleCmd{})
+
+				cmd, _, err = parseLine("A002 IDLE INBOX")
 				So(err, ShouldNotEqual, nil)
 			})
 
@@ -422,11 +538,142 @@ func TestParser(t *testing.T) {
 				So(err, ShouldNotEqual, nil)
 			})
 
+			Convey("SEARCH", func() {
+
+				cmd, _, err := parseLine(`A282 SEARCH FLAGGED SINCE 1-Feb-1994 NOT FROM "Smith"`)
+				So(err, ShouldEqual, nil)
+				So(cmd, ShouldHaveSameTypeAs, SearchCmd{})
+				So(cmd, ShouldResemble, SearchCmd{
+					Keys: []SearchKey{
+						{Name: "FLAGGED"},
+						{Name: "SINCE", Date: time.Date(1994, 2, 1, 0, 0, 0, 0, time.UTC)},
+						{Name: "NOT", Keys: []SearchKey{{Name: "FROM", Value: "Smith"}}},
+					},
+				})
+
+				cmd, _, err = parseLine(`A283 SEARCH CHARSET UTF-8 or (larger 1024 uid 1:*) header "Message-ID" <x@y> 2,4:7 text {5}` + "\r\ncafé")
+				So(err, ShouldEqual, nil)
+				So(cmd, ShouldResemble, SearchCmd{
+					Charset: "UTF-8",
+					Keys: []SearchKey{
+						{Name: "OR", Keys: []SearchKey{
+							{Name: "AND", Keys: []SearchKey{
+								{Name: "LARGER", Number: 1024},
+								{Name: "UID", Sequence: SequenceSet{{Start: 1, Stop: 0}}},
+							}},
+							{Name: "HEADER", Field: "Message-ID", Value: "<x@y>"},
+						}},
+						{Name: "SEQUENCE", Sequence: SequenceSet{{Start: 2, Stop: 2}, {Start: 4, Stop: 7}}},
+						{Name: "TEXT", Value: "café"},
+					},
+				})
+
+				cmd, _, err = parseLine(`A284 SEARCH BEFORE "1-feb-1994" KEYWORD $Forwarded ALL`)
+				So(err, ShouldEqual, nil)
+				So(cmd, ShouldResemble, SearchCmd{
+					Keys: []SearchKey{
+						{Name: "BEFORE", Date: time.Date(1994, 2, 1, 0, 0, 0, 0, time.UTC)},
+						{Name: "KEYWORD", Value: "$Forwarded"},
+						{Name: "ALL"},
+					},
+				})
+
+				for _, line := range []string{
+					"A285 SEARCH",
+					"A285 SEARCH CHARSET UTF-8",
+					"A285 SEARCH CHARSET",
+					"A285 SEARCH UNKNOWN",
+					"A285 SEARCH FROM",
+					"A285 SEARCH FROM (a)",
+					"A285 SEARCH SINCE 31-Foo-1994",
+					"A285 SEARCH LARGER -1",
+					"A285 SEARCH LARGER abc",
+					"A285 SEARCH HEADER Subject",
+					"A285 SEARCH UID abc",
+					"A285 SEARCH NOT",
+					"A285 SEARCH OR ALL",
+					"A285 SEARCH ()",
+					"A285 SEARCH KEYWORD \\Seen",
+					"A285 SEARCH \"ALL\"",
+				} {
+					_, _, err = parseLine(line)
+					So(err, ShouldNotEqual, nil)
+				}
+			})
+
 			Convey("FETCH", func() {
 
 				cmd, _, err := parseLine("A654 FETCH 2:4 (FLAGS BODY[HEADER.FIELDS (DATE FROM)])")
 				So(err, ShouldEqual, nil)
 				So(cmd, ShouldHaveSameTypeAs, FetchCmd{})
+				So(cmd, ShouldResemble, FetchCmd{
+					Sequence: SequenceSet{{Start: 2, Stop: 4}},
+					Attributes: []FetchAttribute{
+						{Name: "FLAGS"},
+						{Name: "BODY", Section: &Section{Text: "HEADER.FIELDS", Fields: []string{"DATE", "FROM"}}},
+					},
+				})
+
+				cmd, _, err = parseLine("a003 fetch 12 full")
+				So(err, ShouldEqual, nil)
+				So(cmd, ShouldResemble, FetchCmd{
+					Sequence: SequenceSet{{Start: 12, Stop: 12}},
+					Attributes: []FetchAttribute{
+						{Name: "FLAGS"},
+						{Name: "INTERNALDATE"},
+						{Name: "RFC822.SIZE"},
+						{Name: "ENVELOPE"},
+						{Name: "BODY"},
+					},
+				})
+
+				cmd, _, err = parseLine("a004 fetch 12 body[header]")
+				So(err, ShouldEqual, nil)
+				So(cmd, ShouldResemble, FetchCmd{
+					Sequence:   SequenceSet{{Start: 12, Stop: 12}},
+					Attributes: []FetchAttribute{{Name: "BODY", Section: &Section{Text: "HEADER"}}},
+				})
+
+				cmd, _, err = parseLine(`A999 FETCH 1:* (uid rfc822.size BODYSTRUCTURE BODY[] BODY.PEEK[1.2.MIME]<0.2048> body.peek[3.header.fields.not ("Received" X-Spam)] BODY[2.TEXT]<100.5> BODY[4])`)
+				So(err, ShouldEqual, nil)
+				So(cmd, ShouldResemble, FetchCmd{
+					Sequence: SequenceSet{{Start: 1, Stop: 0}},
+					Attributes: []FetchAttribute{
+						{Name: "UID"},
+						{Name: "RFC822.SIZE"},
+						{Name: "BODYSTRUCTURE"},
+						{Name: "BODY", Section: &Section{}},
+						{Name: "BODY", Peek: true, Section: &Section{Part: []uint32{1, 2}, Text: "MIME"}, Partial: &Partial{Offset: 0, Count: 2048}},
+						{Name: "BODY", Peek: true, Section: &Section{Part: []uint32{3}, Text: "HEADER.FIELDS.NOT", Fields: []string{"Received", "X-Spam"}}},
+						{Name: "BODY", Section: &Section{Part: []uint32{2}, Text: "TEXT"}, Partial: &Partial{Offset: 100, Count: 5}},
+						{Name: "BODY", Section: &Section{Part: []uint32{4}}},
+					},
+				})
+
+				for _, line := range []string{
+					"A655 FETCH 2:4",
+					"A655 FETCH abc FLAGS",
+					"A655 FETCH 2:4 FLAGS ENVELOPE",
+					"A655 FETCH 2:4 ()",
+					"A655 FETCH 2:4 (ALL)",
+					"A655 FETCH 2:4 UNKNOWN",
+					"A655 FETCH 2:4 \"FLAGS\"",
+					"A655 FETCH 2:4 RFC822[]",
+					"A655 FETCH 2:4 BODY[MIME]",
+					"A655 FETCH 2:4 BODY[0]",
+					"A655 FETCH 2:4 BODY[1.]",
+					"A655 FETCH 2:4 BODY[UNKNOWN]",
+					"A655 FETCH 2:4 BODY[HEADER.FIELDS]",
+					"A655 FETCH 2:4 BODY[HEADER.FIELDS ()]",
+					"A655 FETCH 2:4 BODY[HEADER (DATE)]",
+					"A655 FETCH 2:4 BODY[]<0>",
+					"A655 FETCH 2:4 BODY[]<0.0>",
+					"A655 FETCH 2:4 BODY[]<a.b>",
+					"A655 FETCH 2:4 BODY[]x",
+				} {
+					_, _, err = parseLine(line)
+					So(err, ShouldNotEqual, nil)
+				}
 			})
 
 			Convey("Store", func() {
@@ -435,7 +682,7 @@ func TestParser(t *testing.T) {
 				So(err, ShouldEqual, nil)
 				So(cmd, ShouldHaveSameTypeAs, StoreCmd{})
 				cmd1 := cmd.(StoreCmd)
-				So(cmd1.Sequence, ShouldEqual, "2:4")
+				So(cmd1.Sequence.String(), ShouldEqual, "2:4")
 				So(cmd1.Mode, ShouldEqual, "+")
 				So(cmd1.Silent, ShouldEqual, false)
 				So(cmd1.Flags, ShouldResemble, []string{"\\Deleted"})
@@ -444,7 +691,7 @@ func TestParser(t *testing.T) {
 				So(err, ShouldEqual, nil)
 				So(cmd, ShouldHaveSameTypeAs, StoreCmd{})
 				cmd1 = cmd.(StoreCmd)
-				So(cmd1.Sequence, ShouldEqual, "2:4")
+				So(cmd1.Sequence.String(), ShouldEqual, "2:4")
 				So(cmd1.Mode, ShouldEqual, "")
 				So(cmd1.Silent, ShouldEqual, true)
 				So(cmd1.Flags, ShouldResemble, []string{"\\Deleted", "\\Seen"})
@@ -476,6 +723,74 @@ func TestParser(t *testing.T) {
 				So(err, ShouldNotEqual, nil)
 			})
 
+			Convey("COPY", func() {
+
+				cmd, _, err := parseLine(`A003 COPY 2:4 "Sent Items"`)
+				So(err, ShouldEqual, nil)
+				So(cmd, ShouldResemble, CopyCmd{Sequence: SequenceSet{{Start: 2, Stop: 4}}, Mailbox: "Sent Items"})
+
+				cmd, _, err = parseLine("A003 COPY 2:4 inbox")
+				So(err, ShouldEqual, nil)
+				So(cmd, ShouldResemble, CopyCmd{Sequence: SequenceSet{{Start: 2, Stop: 4}}, Mailbox: "INBOX"})
+
+				for _, line := range []string{
+					"A003 COPY",
+					"A003 COPY 2:4",
+					"A003 COPY 2:4 box other",
+					"A003 COPY box 2:4",
+					"A003 COPY 2:4 (box)",
+				} {
+					_, _, err = parseLine(line)
+					So(err, ShouldNotEqual, nil)
+				}
+			})
+
+			Convey("UID", func() {
+
+				cmd, _, err := parseLine("A999 UID FETCH 4827313:4828442 FLAGS")
+				So(err, ShouldEqual, nil)
+				So(cmd, ShouldResemble, FetchCmd{
+					Uid:        true,
+					Sequence:   SequenceSet{{Start: 4827313, Stop: 4828442}},
+					Attributes: []FetchAttribute{{Name: "FLAGS"}},
+				})
+
+				cmd, _, err = parseLine(`A999 uid copy 443:557 "Sent Items"`)
+				So(err, ShouldEqual, nil)
+				So(cmd, ShouldResemble, CopyCmd{Uid: true, Sequence: SequenceSet{{Start: 443, Stop: 557}}, Mailbox: "Sent Items"})
+
+				cmd, _, err = parseLine("A999 UID SEARCH UID 1:* NOT DELETED")
+				So(err, ShouldEqual, nil)
+				So(cmd, ShouldResemble, SearchCmd{
+					Uid: true,
+					Keys: []SearchKey{
+						{Name: "UID", Sequence: SequenceSet{{Start: 1, Stop: 0}}},
+						{Name: "NOT", Keys: []SearchKey{{Name: "DELETED"}}},
+					},
+				})
+
+				cmd, _, err = parseLine("A999 UID STORE 2:4 +FLAGS.SILENT (\\Deleted)")
+				So(err, ShouldEqual, nil)
+				So(cmd, ShouldResemble, StoreCmd{
+					Uid:      true,
+					Sequence: SequenceSet{{Start: 2, Stop: 4}},
+					Mode:     "+",
+					Silent:   true,
+					Flags:    []string{"\\Deleted"},
+				})
+
+				for _, line := range []string{
+					"A999 UID",
+					"A999 UID NOOP",
+					"A999 UID UID FETCH 1 FLAGS",
+					"A999 UID 1:2 FLAGS",
+					"A999 UID FETCH 1:2",
+				} {
+					_, _, err = parseLine(line)
+					So(err, ShouldNotEqual, nil)
+				}
+			})
+
 		})
 
 	})
@@ -23,7 +23,8 @@ type StarttlsCmd struct {
 }
 
 type AuthenticateCmd struct {
-	Mechanism string
+	Mechanism       string
+	InitialResponse []byte // nil if the client didn't send one, empty for "="
 }
 
 type AuthenticatedStateCmd interface {
@@ -102,7 +103,12 @@ type AppendCmd struct {
 	Mailbox  string
 	Flags    []string
 	DateTime time.Time
-	Literal  string
+	Literal  []byte
+}
+
+// IdleCmd waits for updates of the mailbox (RFC 2177),
+// until the client sends a line with "DONE"
+type IdleCmd struct {
 }
 
 type CheckCmd struct {
@@ -114,12 +120,66 @@ type CloseCmd struct {
 type ExpungeCmd struct {
 }
 
+type SearchCmd struct {
+	Uid     bool // UID SEARCH, which returns unique identifiers
+	Charset string
+	Keys    []SearchKey // all keys have to match
+}
+
+// SearchKey is a node in the tree of search criteria
+type SearchKey struct {
+	// Name is the upper case search-key, like "FROM" or "LARGER".
+	// A bare sequence-set is named "SEQUENCE" and
+	// a parenthesized list of keys is named "AND".
+	Name     string
+	Field    string      // header field name for HEADER
+	Value    string      // astring or flag-keyword argument
+	Date     time.Time   // date argument
+	Number   uint32      // number argument for LARGER and SMALLER
+	Sequence SequenceSet // sequence-set for UID and SEQUENCE
+	Keys     []SearchKey // operands for NOT, OR and AND
+}
+
 type FetchCmd struct {
+	Uid        bool // UID FETCH, Sequence holds unique identifiers
+	Sequence   SequenceSet
+	Attributes []FetchAttribute // macros are expanded
+}
+
+// FetchAttribute is a data item requested by FETCH
+type FetchAttribute struct {
+	// Name is the upper case fetch-att without section and partial,
+	// like "ENVELOPE", "RFC822.SIZE" or "BODY".
+	// BODY.PEEK is named "BODY" with Peek set.
+	Name    string
+	Peek    bool
+	Section *Section // nil when no section was given
+	Partial *Partial // nil when no partial was given
+}
+
+// Section is the part of a message requested by BODY[section]
+type Section struct {
+	Part   []uint32 // section-part, empty for the whole message
+	Text   string   // "HEADER", "HEADER.FIELDS", "HEADER.FIELDS.NOT", "TEXT", "MIME" or ""
+	Fields []string // header-list of HEADER.FIELDS and HEADER.FIELDS.NOT
+}
+
+// Partial is the range of octets requested by BODY[section]<offset.count>
+type Partial struct {
+	Offset uint32
+	Count  uint32
 }
 
 type StoreCmd struct {
-	Sequence string
+	Uid      bool // UID STORE, Sequence holds unique identifiers
+	Sequence SequenceSet
 	Silent   bool
 	Mode     string // "+", "-", or nothing
 	Flags    []string
 }
+
+type CopyCmd struct {
+	Uid      bool // UID COPY, Sequence holds unique identifiers
+	Sequence SequenceSet
+	Mailbox  string
+}
@@ -0,0 +1,162 @@
+package parser
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// Default limits of a Reader, see MaxLineLength and MaxLiteralSize
+const (
+	DefaultMaxLineLength  = 64 * 1024
+	DefaultMaxLiteralSize = 64 * 1024 * 1024
+)
+
+// ErrLineTooLong is returned when a line exceeds MaxLineLength.
+// The rest of the line isn't read, so the stream can't be used anymore.
+var ErrLineTooLong = errors.New("Reader: line too long")
+
+// Reader reads IMAP commands from a stream.
+// Literals are read in full, so a command is only returned
+// once all of its octets have arrived.
+type Reader struct {
+	r *bufio.Reader
+
+	// Continue is called before the octets of a literal are read,
+	// so the server can send its "+" continuation request.
+	// It may be nil.
+	Continue func() error
+
+	// MaxLineLength limits the octets of a command outside of its
+	// literals, and the length of lines read with ReadLine.
+	// Zero means no limit.
+	MaxLineLength int
+
+	// MaxLiteralSize limits the octets of all literals of a command.
+	// A literal which would exceed it is refused with a *ParseError
+	// before Continue is called or anything is allocated for it.
+	// Zero means no limit.
+	MaxLiteralSize int
+}
+
+// NewReader creates a Reader which reads commands from r, with the
+// default limits. r is only wrapped in a bufio.Reader when it isn't one already.
+func NewReader(r io.Reader) *Reader {
+	br, ok := r.(*bufio.Reader)
+	if !ok {
+		br = bufio.NewReader(r)
+	}
+	return &Reader{r: br, MaxLineLength: DefaultMaxLineLength, MaxLiteralSize: DefaultMaxLiteralSize}
+}
+
+// ReadCommand reads the next command from the stream and parses it.
+// A *ParseError leaves the stream at the start of the next command.
+func (r *Reader) ReadCommand() (Command, error) {
+	line, err := r.readLine()
+	if err != nil {
+		return Command{}, err
+	}
+	return Parse(line)
+}
+
+// ReadLine reads a single line without the final CRLF, like the
+// responses of the client during AUTHENTICATE. Literals aren't read.
+func (r *Reader) ReadLine() (string, error) {
+	return r.readPart(r.MaxLineLength)
+}
+
+// readLine reads a complete command line, without the final CRLF.
+// The octets of literals are kept inline, after the CRLF
+// which follows their "{n}" marker.
+func (r *Reader) readLine() (string, error) {
+	line := ""
+	length, literals := 0, 0
+	for {
+		max := 0
+		if r.MaxLineLength > 0 {
+			max = r.MaxLineLength - length
+			if max <= 0 {
+				return "", ErrLineTooLong
+			}
+		}
+		part, err := r.readPart(max)
+		if err != nil {
+			return "", err
+		}
+		length += len(part)
+		line += part
+
+		size, ok := literalSize(part)
+		if !ok {
+			return line, nil
+		}
+		literals += size
+		if r.MaxLiteralSize > 0 && literals > r.MaxLiteralSize {
+			return "", literalError(line, r.MaxLiteralSize)
+		}
+
+		if r.Continue != nil {
+			if err := r.Continue(); err != nil {
+				return "", err
+			}
+		}
+		literal := make([]byte, size)
+		if _, err := io.ReadFull(r.r, literal); err != nil {
+			return "", err
+		}
+		line += "\r\n" + string(literal)
+	}
+}
+
+// readPart reads up to the next LF, and returns what came before it
+// without the CRLF. More than max octets, when max isn't zero,
+// give ErrLineTooLong.
+func (r *Reader) readPart(max int) (string, error) {
+	var part []byte
+	for {
+		chunk, err := r.r.ReadSlice('\n')
+		if max > 0 && len(part)+len(chunk) > max+2 {
+			return "", ErrLineTooLong
+		}
+		part = append(part, chunk...)
+		if err == bufio.ErrBufferFull {
+			continue
+		}
+		if err != nil {
+			return "", err
+		}
+		line := strings.TrimSuffix(strings.TrimSuffix(string(part), "\n"), "\r")
+		if max > 0 && len(line) > max {
+			return "", ErrLineTooLong
+		}
+		return line, nil
+	}
+}
+
+// literalError returns the ParseError for a literal at the end of line
+// which would exceed the limit of max octets
+func literalError(line string, max int) *ParseError {
+	err := &ParseError{Argument: -1, Offset: strings.LastIndex(line, "{"), Reason: ReasonTooLarge,
+		Message: fmt.Sprintf("Reader: literal exceeds the limit of %d octets", max)}
+	if i := strings.IndexByte(line, ' '); i > 0 && IsTag(line[:i]) {
+		err.Tag = line[:i]
+	}
+	return err
+}
+
+// literalSize returns the number of octets announced by
+// a "{n}" marker at the end of line
+func literalSize(line string) (int, bool) {
+	start := strings.LastIndex(line, "{")
+	if start < 0 || !IsLiteral(line[start:]) {
+		return 0, false
+	}
+	size, err := strconv.ParseUint(line[start+1:len(line)-1], 10, 32)
+	if err != nil {
+		return 0, false
+	}
+	return int(size), true
+}
@@ -0,0 +1,165 @@
+package parser
+
+import (
+	"bufio"
+	. "github.com/smartystreets/goconvey/convey"
+	"io"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestReader(t *testing.T) {
+
+	Convey("Testing Reader", t, func() {
+
+		Convey("Simple commands", func() {
+
+			r := NewReader(strings.NewReader("a001 NOOP\r\na002 login mrc secret\r\n"))
+
+			command, err := r.ReadCommand()
+			So(err, ShouldEqual, nil)
+			So(command.Tag, ShouldEqual, "a001")
+			So(command.Cmd, ShouldHaveSameTypeAs, NoopCmd{})
+
+			command, err = r.ReadCommand()
+			So(err, ShouldEqual, nil)
+			So(command.Tag, ShouldEqual, "a002")
+			So(command.Cmd, ShouldResemble, LoginCmd{Username: "mrc", Password: "secret"})
+
+			_, err = r.ReadCommand()
+			So(err, ShouldEqual, io.EOF)
+		})
+
+		Convey("Literals", func() {
+
+			message := "Date: Mon, 7 Feb 1994 21:52:25 -0800 (PST)\r\n" +
+				"Subject: afternoon meeting\r\n" +
+				"\r\n" +
+				"Hello Joe, do you think we can meet at 3:30 tomorrow?\r\n"
+
+			continued := 0
+			r := NewReader(bufio.NewReader(strings.NewReader(
+				"A003 APPEND saved-messages (\\Seen) {" + strconv.Itoa(len(message)) + "}\r\n" + message + "\r\n" +
+					"A004 LOGIN {3}\r\nmrc {6}\r\nsecret\r\n",
+			)))
+			r.Continue = func() error {
+				continued++
+				return nil
+			}
+
+			command, err := r.ReadCommand()
+			So(err, ShouldEqual, nil)
+			So(command.Tag, ShouldEqual, "A003")
+			So(command.Cmd, ShouldHaveSameTypeAs, AppendCmd{})
+			appendCmd := command.Cmd.(AppendCmd)
+			So(appendCmd.Mailbox, ShouldEqual, "saved-messages")
+			So(appendCmd.Flags, ShouldResemble, []string{"\\Seen"})
+			So(string(appendCmd.Literal), ShouldEqual, message)
+			So(continued, ShouldEqual, 1)
+
+			command, err = r.ReadCommand()
+			So(err, ShouldEqual, nil)
+			So(command.Tag, ShouldEqual, "A004")
+			So(command.Cmd, ShouldResemble, LoginCmd{Username: "mrc", Password: "secret"})
+			So(continued, ShouldEqual, 3)
+		})
+
+		Convey("Lines of an AUTHENTICATE exchange", func() {
+
+			r := NewReader(strings.NewReader("a001 AUTHENTICATE PLAIN\r\nAG1yYwBzZWNyZXQ=\r\n*\n{5}\r\n"))
+			command, err := r.ReadCommand()
+			So(err, ShouldEqual, nil)
+			So(command.Cmd, ShouldResemble, AuthenticateCmd{Mechanism: "PLAIN"})
+			for _, expected := range []string{"AG1yYwBzZWNyZXQ=", "*", "{5}"} {
+				line, err := r.ReadLine()
+				So(err, ShouldEqual, nil)
+				So(line, ShouldEqual, expected)
+			}
+			_, err = r.ReadLine()
+			So(err, ShouldEqual, io.EOF)
+		})
+
+		Convey("Truncated literal", func() {
+
+			r := NewReader(bufio.NewReader(strings.NewReader("A003 APPEND saved-messages {310}\r\nhello")))
+			_, err := r.ReadCommand()
+			So(err, ShouldNotEqual, nil)
+		})
+
+		Convey("Literal larger than the limit", func() {
+
+			continued := 0
+			r := NewReader(strings.NewReader("a001 LOGIN {4294967295}\r\na002 LOGIN {6}\r\nfoobar {5}\r\na003 NOOP\r\n"))
+			r.MaxLiteralSize = 10
+			r.Continue = func() error {
+				continued++
+				return nil
+			}
+
+			_, err := r.ReadCommand()
+			So(err, ShouldHaveSameTypeAs, &ParseError{})
+			So(err.(*ParseError).Tag, ShouldEqual, "a001")
+			So(err.(*ParseError).Reason, ShouldEqual, ReasonTooLarge)
+			So(err.(*ParseError).Response().Type, ShouldEqual, BAD)
+			So(continued, ShouldEqual, 0)
+
+			// the limit holds for all literals of a command together
+			_, err = r.ReadCommand()
+			So(err, ShouldHaveSameTypeAs, &ParseError{})
+			So(err.(*ParseError).Tag, ShouldEqual, "a002")
+			So(continued, ShouldEqual, 1)
+
+			command, err := r.ReadCommand()
+			So(err, ShouldEqual, nil)
+			So(command.Tag, ShouldEqual, "a003")
+		})
+
+		Convey("Line longer than the limit", func() {
+
+			r := NewReader(bufio.NewReaderSize(strings.NewReader("a001 NOOP\r\na002 "+strings.Repeat("x", 100)), 16))
+			r.MaxLineLength = 20
+
+			command, err := r.ReadCommand()
+			So(err, ShouldEqual, nil)
+			So(command.Tag, ShouldEqual, "a001")
+
+			_, err = r.ReadCommand()
+			So(err, ShouldEqual, ErrLineTooLong)
+
+			// parts of a command line count together
+			r = NewReader(strings.NewReader("a001 LOGIN {3}\r\nmrc " + strings.Repeat("x", 10) + "\r\n"))
+			r.MaxLineLength = 20
+			_, err = r.ReadCommand()
+			So(err, ShouldEqual, ErrLineTooLong)
+
+			r = NewReader(strings.NewReader(strings.Repeat("x", 30) + "\r\n"))
+			r.MaxLineLength = 20
+			_, err = r.ReadLine()
+			So(err, ShouldEqual, ErrLineTooLong)
+		})
+
+	})
+
+	Convey("Testing literalSize", t, func() {
+
+		size, ok := literalSize("A003 APPEND saved-messages {310}")
+		So(ok, ShouldEqual, true)
+		So(size, ShouldEqual, 310)
+
+		size, ok = literalSize("{0}")
+		So(ok, ShouldEqual, true)
+		So(size, ShouldEqual, 0)
+
+		for _, line := range []string{
+			"A003 NOOP",
+			"A003 APPEND box {31a}",
+			"A003 APPEND box {99999999999}",
+			"A003 APPEND box {310} ",
+		} {
+			_, ok = literalSize(line)
+			So(ok, ShouldEqual, false)
+		}
+	})
+
+}
@@ -0,0 +1,74 @@
+package parser
+
+/*
+response        = *(continue-req / response-data) response-done
+
+response-done   = response-tagged / response-fatal
+response-tagged = tag SP resp-cond-state CRLF
+response-fatal  = "*" SP resp-cond-bye CRLF
+*/
+
+// Status conditions of a StatusResponse
+const (
+	OK      = "OK"
+	NO      = "NO"
+	BAD     = "BAD"
+	PREAUTH = "PREAUTH"
+	BYE     = "BYE"
+)
+
+/*
+resp-text-code  = "ALERT" /
+                  "BADCHARSET" [SP "(" astring *(SP astring) ")" ] /
+                  capability-data / "PARSE" /
+                  "PERMANENTFLAGS" SP "(" [flag-perm *(SP flag-perm)] ")" /
+                  "READ-ONLY" / "READ-WRITE" / "TRYCREATE" /
+                  "UIDNEXT" SP nz-number / "UIDVALIDITY" SP nz-number /
+                  "UNSEEN" SP nz-number /
+                  atom [SP 1*<any TEXT-CHAR except "]">]
+*/
+const (
+	CodeAlert          = "ALERT"
+	CodeBadCharset     = "BADCHARSET"
+	CodeCapability     = "CAPABILITY"
+	CodeParse          = "PARSE"
+	CodePermanentFlags = "PERMANENTFLAGS"
+	CodeReadOnly       = "READ-ONLY"
+	CodeReadWrite      = "READ-WRITE"
+	CodeTryCreate      = "TRYCREATE"
+	CodeUidNext        = "UIDNEXT"
+	CodeUidValidity    = "UIDVALIDITY"
+	CodeUnseen         = "UNSEEN"
+)
+
+// StatusResponse is a response with a status condition, like
+// "a001 OK LOGIN completed" or "* OK [UNSEEN 17] Message 17 is the first unseen message"
+type StatusResponse struct {
+	Tag           string        // empty for untagged responses
+	Type          string        // OK, NO, BAD, PREAUTH or BYE
+	Code          string        // response code, empty if there is none
+	CodeArguments []interface{} // arguments of the response code
+	Info          string        // human readable text
+}
+
+// DataResponse is untagged data sent by the server,
+// like "* 18 EXISTS" or "* 12 FETCH (FLAGS (\Seen))"
+type DataResponse struct {
+	// Fields are the SP separated values after the "*".
+	// Atoms made of digits are returned as uint32, other atoms as Atom,
+	// quoted strings and literals as string, NIL as nil and
+	// parenthesized lists as []interface{}.
+	Fields []interface{}
+}
+
+// ContinuationResponse is a continuation request, like "+ Ready for literal data"
+type ContinuationResponse struct {
+	Info string // human readable text or base64 challenge
+}
+
+// Atom is a value which is written as is, like a flag or a
+// FETCH data item name. Strings are quoted instead.
+type Atom string
+
+// Literal is a value which is always written as literal
+type Literal []byte
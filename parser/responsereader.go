@@ -0,0 +1,148 @@
+package parser
+
+import (
+	"errors"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// ResponseReader reads server responses from a stream.
+// It is the client side counterpart of Writer.
+type ResponseReader struct {
+	r *Reader
+}
+
+// NewResponseReader creates a ResponseReader which reads responses from r
+func NewResponseReader(r io.Reader) *ResponseReader {
+	return &ResponseReader{r: NewReader(r)}
+}
+
+// ReadResponse reads the next response, which is a
+// StatusResponse, DataResponse or ContinuationResponse
+func (r *ResponseReader) ReadResponse() (interface{}, error) {
+	line, err := r.r.readLine()
+	if err != nil {
+		return nil, err
+	}
+	return ParseResponse(line)
+}
+
+/*
+ParseResponse parses a single response line, without the trailing CRLF.
+Literals must be inline, like for Parse.
+
+continue-req    = "+" SP (resp-text / base64) CRLF
+response-data   = "*" SP (resp-cond-state / resp-cond-bye /
+                  mailbox-data / message-data / capability-data) CRLF
+response-tagged = tag SP resp-cond-state CRLF
+*/
+func ParseResponse(line string) (interface{}, error) {
+	if line == "+" || strings.HasPrefix(line, "+ ") {
+		return ContinuationResponse{Info: strings.TrimPrefix(line[1:], " ")}, nil
+	}
+
+	space := strings.IndexByte(line, ' ')
+	if space < 0 {
+		return nil, errors.New("Parser: expected tag and response")
+	}
+	tag := line[:space]
+	rest := line[space+1:]
+	if tag != "*" && !IsTag(tag) {
+		return nil, errors.New("Parser: expected identifier tag")
+	}
+
+	condition := rest
+	if i := strings.IndexByte(rest, ' '); i >= 0 {
+		condition = rest[:i]
+	}
+	switch strings.ToUpper(condition) {
+	case OK, NO, BAD, PREAUTH, BYE:
+		resp, err := parseRespText(strings.TrimPrefix(rest[len(condition):], " "))
+		if err != nil {
+			return nil, err
+		}
+		resp.Type = strings.ToUpper(condition)
+		if tag != "*" {
+			resp.Tag = tag
+		}
+		return resp, nil
+	}
+
+	if tag != "*" {
+		return nil, errors.New("Parser: expected status condition in tagged response")
+	}
+	tokens, err := tokenize(rest)
+	if err != nil {
+		return nil, err
+	}
+	return DataResponse{Fields: tokenValues(tokens)}, nil
+}
+
+/*
+resp-text       = ["[" resp-text-code "]" SP] text
+*/
+func parseRespText(s string) (resp StatusResponse, err error) {
+	if !strings.HasPrefix(s, "[") {
+		resp.Info = s
+		return
+	}
+
+	// find the "]" which ends the code, skipping nested ones like in BODY[TEXT]
+	end := -1
+	for depth, i := 0, 1; i < len(s) && end < 0; i++ {
+		switch {
+		case s[i] == '[':
+			depth++
+		case s[i] == ']' && depth > 0:
+			depth--
+		case s[i] == ']':
+			end = i
+		}
+	}
+	if end < 0 {
+		err = errors.New("Parser: expected ']' to close response code")
+		return
+	}
+	resp.Info = strings.TrimPrefix(s[end+1:], " ")
+
+	code := s[1:end]
+	tokens, tokenErr := tokenize(code)
+	if tokenErr != nil || len(tokens) == 0 || tokens[0].Type != atomToken {
+		// atom [SP 1*<any TEXT-CHAR except "]">]
+		name := code
+		if i := strings.IndexByte(code, ' '); i >= 0 {
+			name = code[:i]
+			resp.CodeArguments = []interface{}{Atom(code[i+1:])}
+		}
+		resp.Code = strings.ToUpper(name)
+		return
+	}
+	resp.Code = strings.ToUpper(tokens[0].Value)
+	if len(tokens) > 1 {
+		resp.CodeArguments = tokenValues(tokens[1:])
+	}
+	return
+}
+
+// tokenValues converts tokens into the values of a DataResponse
+func tokenValues(tokens []token) []interface{} {
+	values := make([]interface{}, len(tokens))
+	for i, t := range tokens {
+		switch t.Type {
+		case nilToken:
+			values[i] = nil
+		case quotedToken, literalToken:
+			values[i] = t.Value
+		case listToken:
+			values[i] = tokenValues(t.List)
+		default:
+			if n, err := strconv.ParseUint(t.Value, 10, 32); err == nil {
+				values[i] = uint32(n)
+			} else {
+				values[i] = Atom(t.Value)
+			}
+		}
+	}
+	return values
+}
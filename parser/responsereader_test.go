@@ -0,0 +1,135 @@
+package parser
+
+import (
+	. "github.com/smartystreets/goconvey/convey"
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestResponseReader(t *testing.T) {
+
+	Convey("Testing ResponseReader", t, func() {
+
+		Convey("Status responses", func() {
+
+			r := NewResponseReader(strings.NewReader("* OK IMAP4rev1 Service Ready\r\n" +
+				"a001 OK LOGIN completed\r\n" +
+				"* OK [UNSEEN 17] Message 17 is the first unseen message\r\n" +
+				"* OK [PERMANENTFLAGS (\\Deleted \\Seen \\*)] Limited\r\n" +
+				"a002 ok [READ-WRITE] SELECT completed\r\n" +
+				"A003 NO [TRYCREATE]\r\n" +
+				"* NO [BADCHARSET (UTF-8 \"KOI8-R\")] unsupported\r\n" +
+				"* OK [X-WEIRD some \"text] here\r\n" +
+				"* BYE\r\n"))
+
+			expected := []StatusResponse{
+				{Type: OK, Info: "IMAP4rev1 Service Ready"},
+				{Tag: "a001", Type: OK, Info: "LOGIN completed"},
+				{Type: OK, Code: CodeUnseen, CodeArguments: []interface{}{uint32(17)}, Info: "Message 17 is the first unseen message"},
+				{Type: OK, Code: CodePermanentFlags, CodeArguments: []interface{}{[]interface{}{Atom(`\Deleted`), Atom(`\Seen`), Atom(`\*`)}}, Info: "Limited"},
+				{Tag: "a002", Type: OK, Code: CodeReadWrite, Info: "SELECT completed"},
+				{Tag: "A003", Type: NO, Code: CodeTryCreate},
+				{Type: NO, Code: CodeBadCharset, CodeArguments: []interface{}{[]interface{}{Atom("UTF-8"), "KOI8-R"}}, Info: "unsupported"},
+				{Type: OK, Code: "X-WEIRD", CodeArguments: []interface{}{Atom(`some "text`)}, Info: "here"},
+				{Type: BYE},
+			}
+			for _, status := range expected {
+				response, err := r.ReadResponse()
+				So(err, ShouldEqual, nil)
+				So(response, ShouldResemble, status)
+			}
+
+			_, err := r.ReadResponse()
+			So(err, ShouldEqual, io.EOF)
+		})
+
+		Convey("Continuation responses", func() {
+
+			response, err := ParseResponse("+ Ready for literal data")
+			So(err, ShouldEqual, nil)
+			So(response, ShouldResemble, ContinuationResponse{Info: "Ready for literal data"})
+
+			response, err = ParseResponse("+")
+			So(err, ShouldEqual, nil)
+			So(response, ShouldResemble, ContinuationResponse{})
+		})
+
+		Convey("Untagged data", func() {
+
+			r := NewResponseReader(strings.NewReader("* 18 EXISTS\r\n" +
+				"* FLAGS (\\Answered \\Flagged \\Deleted \\Seen \\Draft)\r\n" +
+				"* CAPABILITY IMAP4rev1 STARTTLS AUTH=PLAIN\r\n" +
+				"* LIST (\\Noselect) \"/\" ~/Mail/foo\r\n" +
+				"* LIST () NIL INBOX\r\n" +
+				"* SEARCH 2 84 882\r\n" +
+				"* STATUS blurdybloop (MESSAGES 231 UIDNEXT 44292)\r\n"))
+
+			expected := [][]interface{}{
+				{uint32(18), Atom("EXISTS")},
+				{Atom("FLAGS"), []interface{}{Atom(`\Answered`), Atom(`\Flagged`), Atom(`\Deleted`), Atom(`\Seen`), Atom(`\Draft`)}},
+				{Atom("CAPABILITY"), Atom("IMAP4rev1"), Atom("STARTTLS"), Atom("AUTH=PLAIN")},
+				{Atom("LIST"), []interface{}{Atom(`\Noselect`)}, "/", Atom("~/Mail/foo")},
+				{Atom("LIST"), []interface{}{}, nil, Atom("INBOX")},
+				{Atom("SEARCH"), uint32(2), uint32(84), uint32(882)},
+				{Atom("STATUS"), Atom("blurdybloop"), []interface{}{Atom("MESSAGES"), uint32(231), Atom("UIDNEXT"), uint32(44292)}},
+			}
+			for _, fields := range expected {
+				response, err := r.ReadResponse()
+				So(err, ShouldEqual, nil)
+				So(response, ShouldResemble, DataResponse{Fields: fields})
+			}
+		})
+
+		Convey("FETCH responses", func() {
+
+			header := "Date: Wed, 17 Jul 1996 02:23:25 -0700 (PDT)\r\n" +
+				"Subject: IMAP4rev1 WG mtg summary and minutes\r\n" +
+				"\r\n"
+			r := NewResponseReader(strings.NewReader(`* 12 FETCH (FLAGS (\Seen) INTERNALDATE "17-Jul-1996 02:44:25 -0700" ` +
+				`RFC822.SIZE 4286 ENVELOPE ("Wed, 17 Jul 1996 02:23:25 -0700 (PDT)" ` +
+				`"IMAP4rev1 WG mtg summary and minutes" ` +
+				`(("Terry Gray" NIL "gray" "cac.washington.edu")) NIL NIL NIL NIL NIL NIL ` +
+				`"<B27397-0100000@cac.washington.edu>") ` +
+				`BODY ("TEXT" "PLAIN" ("CHARSET" "US-ASCII") NIL NIL "7BIT" 3028 92))` + "\r\n" +
+				"* 12 FETCH (BODY[HEADER] {94}\r\n" + header + ")\r\n" +
+				"a004 OK FETCH completed\r\n"))
+
+			response, err := r.ReadResponse()
+			So(err, ShouldEqual, nil)
+			So(response, ShouldResemble, DataResponse{Fields: []interface{}{uint32(12), Atom("FETCH"), []interface{}{
+				Atom("FLAGS"), []interface{}{Atom(`\Seen`)},
+				Atom("INTERNALDATE"), "17-Jul-1996 02:44:25 -0700",
+				Atom("RFC822.SIZE"), uint32(4286),
+				Atom("ENVELOPE"), []interface{}{
+					"Wed, 17 Jul 1996 02:23:25 -0700 (PDT)",
+					"IMAP4rev1 WG mtg summary and minutes",
+					[]interface{}{[]interface{}{"Terry Gray", nil, "gray", "cac.washington.edu"}},
+					nil, nil, nil, nil, nil, nil,
+					"<B27397-0100000@cac.washington.edu>",
+				},
+				Atom("BODY"), []interface{}{"TEXT", "PLAIN", []interface{}{"CHARSET", "US-ASCII"}, nil, nil, "7BIT", uint32(3028), uint32(92)},
+			}}})
+
+			response, err = r.ReadResponse()
+			So(err, ShouldEqual, nil)
+			So(response, ShouldResemble, DataResponse{Fields: []interface{}{uint32(12), Atom("FETCH"), []interface{}{Atom("BODY[HEADER]"), header}}})
+
+			response, err = r.ReadResponse()
+			So(err, ShouldEqual, nil)
+			So(response, ShouldResemble, StatusResponse{Tag: "a004", Type: OK, Info: "FETCH completed"})
+		})
+
+		Convey("Invalid responses", func() {
+
+			_, err := ParseResponse("a001")
+			So(err, ShouldNotEqual, nil)
+			_, err = ParseResponse("a001 FETCH completed")
+			So(err, ShouldNotEqual, nil)
+			_, err = ParseResponse("* OK [UNSEEN 17 missing bracket")
+			So(err, ShouldNotEqual, nil)
+			_, err = ParseResponse("* 1 FETCH (FLAGS")
+			So(err, ShouldNotEqual, nil)
+		})
+	})
+}
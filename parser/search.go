@@ -0,0 +1,197 @@
+package parser
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// parseSearchKeys parses a list of search keys
+func parseSearchKeys(tokens []token) (keys []SearchKey, err error) {
+	for len(tokens) > 0 {
+		var key SearchKey
+		key, tokens, err = parseSearchKey(tokens)
+		if err != nil {
+			return
+		}
+		keys = append(keys, key)
+	}
+	return
+}
+
+// parseSearchKey parses the first search key in tokens
+// and returns the tokens which follow it
+func parseSearchKey(tokens []token) (key SearchKey, rest []token, err error) {
+	first := tokens[0]
+	rest = tokens[1:]
+
+	if first.Type == listToken {
+		if len(first.List) == 0 {
+			err = errors.New("Parser: expected search-key in parenthesized list")
+			return
+		}
+		key.Name = "AND"
+		key.Keys, err = parseSearchKeys(first.List)
+		return
+	}
+	if first.Type != atomToken {
+		err = errors.New("Parser: expected search-key, found " + first.Value)
+		return
+	}
+
+	key.Name = strings.ToUpper(first.Value)
+
+	// argument returns the next token as argument of the key
+	argument := func() (t token, err error) {
+		if len(rest) == 0 {
+			err = errors.New("Parser: expected argument for search-key " + key.Name)
+			return
+		}
+		t = rest[0]
+		rest = rest[1:]
+		return
+	}
+
+	var arg token
+	switch key.Name {
+	case "ALL", "ANSWERED", "DELETED", "DRAFT", "FLAGGED", "NEW", "OLD", "RECENT", "SEEN",
+		"UNANSWERED", "UNDELETED", "UNDRAFT", "UNFLAGGED", "UNSEEN":
+		{
+			// no arguments
+		}
+	case "BCC", "BODY", "CC", "FROM", "SUBJECT", "TEXT", "TO":
+		{
+			if arg, err = argument(); err != nil {
+				return
+			}
+			if !arg.isAString() {
+				err = errors.New("Parser: expected astring for search-key " + key.Name)
+				return
+			}
+			key.Value = arg.Value
+		}
+	case "KEYWORD", "UNKEYWORD":
+		{
+			if arg, err = argument(); err != nil {
+				return
+			}
+			if !arg.isAtom(IsAtom) {
+				err = errors.New("Parser: expected flag-keyword for search-key " + key.Name)
+				return
+			}
+			key.Value = arg.Value
+		}
+	case "BEFORE", "ON", "SINCE", "SENTBEFORE", "SENTON", "SENTSINCE":
+		{
+			if arg, err = argument(); err != nil {
+				return
+			}
+			if arg.Type != atomToken && arg.Type != quotedToken {
+				err = errors.New("Parser: expected date for search-key " + key.Name)
+				return
+			}
+			key.Date, err = ParseDate(arg.Value)
+			if err != nil {
+				return
+			}
+		}
+	case "LARGER", "SMALLER":
+		{
+			if arg, err = argument(); err != nil {
+				return
+			}
+			var n uint64
+			n, err = strconv.ParseUint(arg.Value, 10, 32)
+			if arg.Type != atomToken || err != nil {
+				err = errors.New("Parser: expected number for search-key " + key.Name)
+				return
+			}
+			key.Number = uint32(n)
+		}
+	case "HEADER":
+		{
+			var field token
+			if field, err = argument(); err != nil {
+				return
+			}
+			if arg, err = argument(); err != nil {
+				return
+			}
+			if !field.isAString() || !arg.isAString() {
+				err = errors.New("Parser: expected header-fld-name and astring for search-key HEADER")
+				return
+			}
+			key.Field = field.Value
+			key.Value = arg.Value
+		}
+	case "UID":
+		{
+			if arg, err = argument(); err != nil {
+				return
+			}
+			var ok bool
+			key.Sequence, ok = arg.sequenceSet()
+			if !ok {
+				err = errors.New("Parser: expected sequence-set for search-key UID")
+				return
+			}
+		}
+	case "NOT":
+		{
+			if len(rest) == 0 {
+				err = errors.New("Parser: expected search-key after NOT")
+				return
+			}
+			var operand SearchKey
+			operand, rest, err = parseSearchKey(rest)
+			if err != nil {
+				return
+			}
+			key.Keys = []SearchKey{operand}
+		}
+	case "OR":
+		{
+			for i := 0; i < 2; i++ {
+				if len(rest) == 0 {
+					err = errors.New("Parser: expected two search-keys after OR")
+					return
+				}
+				var operand SearchKey
+				operand, rest, err = parseSearchKey(rest)
+				if err != nil {
+					return
+				}
+				key.Keys = append(key.Keys, operand)
+			}
+		}
+	default:
+		{
+			var ok bool
+			key.Sequence, ok = first.sequenceSet()
+			if !ok {
+				err = errors.New("Parser: unknown search-key " + first.Value)
+				return
+			}
+			key.Name = "SEQUENCE"
+		}
+	}
+
+	return
+}
+
+/*
+ParseDate parses a date, as used in SEARCH
+
+date            = date-text / DQUOTE date-text DQUOTE
+date-text       = date-day "-" date-month "-" date-year
+date-day        = 1*2DIGIT
+                    ; Day of month
+*/
+func ParseDate(s string) (time.Time, error) {
+	date, err := time.Parse("2-Jan-2006", s)
+	if err != nil {
+		return time.Time{}, errors.New("Parser: invalid date " + s)
+	}
+	return date, nil
+}
@@ -0,0 +1,150 @@
+package parser
+
+import (
+	"errors"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// SeqRange is a range of message sequence numbers or unique identifiers.
+// A zero Start or Stop stands for "*", the largest number in use.
+type SeqRange struct {
+	Start uint32
+	Stop  uint32
+}
+
+// SequenceSet is a set of message sequence numbers or unique identifiers
+type SequenceSet []SeqRange
+
+// ParseSequenceSet parses a sequence-set like "2,4:7,9,12:*".
+// The ranges are kept in the order they were written,
+// use Resolve to get a normalized set.
+func ParseSequenceSet(s string) (SequenceSet, error) {
+	if !IsSequenceSet(s) {
+		return nil, errors.New("Parser: invalid sequence-set " + s)
+	}
+	set := SequenceSet{}
+	for _, seq := range strings.Split(s, ",") {
+		bounds := strings.Split(seq, ":")
+		start := parseSeqNumber(bounds[0])
+		stop := start
+		if len(bounds) == 2 {
+			stop = parseSeqNumber(bounds[1])
+		}
+		set = append(set, SeqRange{Start: start, Stop: stop})
+	}
+	return set, nil
+}
+
+// parseSeqNumber parses a seq-number which passed IsSeqNumber
+func parseSeqNumber(s string) uint32 {
+	if s == "*" {
+		return 0
+	}
+	n, _ := strconv.ParseUint(s, 10, 32)
+	return uint32(n)
+}
+
+// Dynamic reports whether the set contains "*"
+func (set SequenceSet) Dynamic() bool {
+	for _, r := range set {
+		if r.Start == 0 || r.Stop == 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// Resolve returns the set with "*" replaced by max, every range
+// in ascending order, and overlapping or adjacent ranges merged.
+// The ranges of the result are sorted. A max of zero means the
+// mailbox is empty, ranges with "*" are dropped then.
+func (set SequenceSet) Resolve(max uint32) SequenceSet {
+	resolved := SequenceSet{}
+	for _, r := range set {
+		if r.Start == 0 {
+			r.Start = max
+		}
+		if r.Stop == 0 {
+			r.Stop = max
+		}
+		if r.Start == 0 || r.Stop == 0 {
+			// "*" in an empty mailbox
+			continue
+		}
+		if r.Start > r.Stop {
+			r.Start, r.Stop = r.Stop, r.Start
+		}
+		resolved = append(resolved, r)
+	}
+
+	sort.Slice(resolved, func(i, j int) bool {
+		return resolved[i].Start < resolved[j].Start
+	})
+
+	merged := SequenceSet{}
+	for _, r := range resolved {
+		last := len(merged) - 1
+		if last >= 0 && uint64(r.Start) <= uint64(merged[last].Stop)+1 {
+			if r.Stop > merged[last].Stop {
+				merged[last].Stop = r.Stop
+			}
+			continue
+		}
+		merged = append(merged, r)
+	}
+	return merged
+}
+
+// Contains reports whether n is in the set.
+// A range ending in "*" contains every number from its start on,
+// resolve the set first to get exact results.
+func (set SequenceSet) Contains(n uint32) bool {
+	for _, r := range set {
+		start, stop := r.Start, r.Stop
+		if start == 0 || (stop != 0 && start > stop) {
+			start, stop = stop, start
+		}
+		if start == 0 {
+			continue
+		}
+		if n >= start && (stop == 0 || n <= stop) {
+			return true
+		}
+	}
+	return false
+}
+
+// ForEach calls f with every number of the set, with "*" resolved to
+// max, in ascending order and without duplicates, until f returns
+// false. Ranges are walked as they are, the numbers aren't collected.
+func (set SequenceSet) ForEach(max uint32, f func(n uint32) bool) {
+	for _, r := range set.Resolve(max) {
+		for n := uint64(r.Start); n <= uint64(r.Stop); n++ {
+			if !f(uint32(n)) {
+				return
+			}
+		}
+	}
+}
+
+// String returns the set as sequence-set
+func (set SequenceSet) String() string {
+	parts := make([]string, len(set))
+	for i, r := range set {
+		if r.Start == r.Stop {
+			parts[i] = formatSeqNumber(r.Start)
+		} else {
+			parts[i] = formatSeqNumber(r.Start) + ":" + formatSeqNumber(r.Stop)
+		}
+	}
+	return strings.Join(parts, ",")
+}
+
+func formatSeqNumber(n uint32) string {
+	if n == 0 {
+		return "*"
+	}
+	return strconv.FormatUint(uint64(n), 10)
+}
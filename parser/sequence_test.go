@@ -0,0 +1,104 @@
+package parser
+
+import (
+	. "github.com/smartystreets/goconvey/convey"
+	"testing"
+)
+
+func TestSequenceSet(t *testing.T) {
+
+	Convey("Testing ParseSequenceSet", t, func() {
+
+		set, err := ParseSequenceSet("2,4:7,9,12:*")
+		So(err, ShouldEqual, nil)
+		So(set, ShouldResemble, SequenceSet{{2, 2}, {4, 7}, {9, 9}, {12, 0}})
+		So(set.String(), ShouldEqual, "2,4:7,9,12:*")
+		So(set.Dynamic(), ShouldEqual, true)
+
+		set, err = ParseSequenceSet("205:10")
+		So(err, ShouldEqual, nil)
+		So(set, ShouldResemble, SequenceSet{{205, 10}})
+		So(set.Dynamic(), ShouldEqual, false)
+
+		for _, s := range []string{"", "0", "1,", "a:b", "1:2:3", "4294967296"} {
+			_, err = ParseSequenceSet(s)
+			So(err, ShouldNotEqual, nil)
+		}
+	})
+
+	Convey("Testing Resolve", t, func() {
+
+		set, _ := ParseSequenceSet("2,4:7,9,12:*")
+		So(set.Resolve(15).String(), ShouldEqual, "2,4:7,9,12:15")
+
+		// reversed ranges and overlaps
+		set, _ = ParseSequenceSet("*:4,5:7")
+		So(set.Resolve(10), ShouldResemble, SequenceSet{{4, 10}})
+
+		set, _ = ParseSequenceSet("9,3,2:1,5:6,4")
+		So(set.Resolve(10).String(), ShouldEqual, "1:6,9")
+
+		// "*" is smaller than the start of the range
+		set, _ = ParseSequenceSet("3291:*")
+		So(set.Resolve(3000).String(), ShouldEqual, "3000:3291")
+
+		// empty mailbox
+		set, _ = ParseSequenceSet("1,3:*,*")
+		So(set.Resolve(0).String(), ShouldEqual, "1")
+
+		set, _ = ParseSequenceSet("4294967295,1:4294967294")
+		So(set.Resolve(1).String(), ShouldEqual, "1:4294967295")
+	})
+
+	Convey("Testing Contains", t, func() {
+
+		set, _ := ParseSequenceSet("2,7:4,12:*")
+		for _, n := range []uint32{2, 4, 5, 7, 12, 100} {
+			So(set.Contains(n), ShouldEqual, true)
+		}
+		for _, n := range []uint32{0, 1, 3, 8, 11} {
+			So(set.Contains(n), ShouldEqual, false)
+		}
+
+		set = set.Resolve(15)
+		So(set.Contains(15), ShouldEqual, true)
+		So(set.Contains(16), ShouldEqual, false)
+	})
+
+	Convey("Testing ForEach", t, func() {
+
+		set, _ := ParseSequenceSet("*:4,5:7,2")
+		numbers := []uint32{}
+		set.ForEach(10, func(n uint32) bool {
+			numbers = append(numbers, n)
+			return true
+		})
+		So(numbers, ShouldResemble, []uint32{2, 4, 5, 6, 7, 8, 9, 10})
+
+		// it stops when f returns false, also in a huge range
+		set, _ = ParseSequenceSet("4294967290:*")
+		numbers = []uint32{}
+		set.ForEach(4294967295, func(n uint32) bool {
+			numbers = append(numbers, n)
+			return n < 4294967292
+		})
+		So(numbers, ShouldResemble, []uint32{4294967290, 4294967291, 4294967292})
+		numbers = []uint32{}
+		set.ForEach(4294967295, func(n uint32) bool {
+			numbers = append(numbers, n)
+			return true
+		})
+		So(len(numbers), ShouldEqual, 6)
+		So(numbers[5], ShouldEqual, 4294967295)
+	})
+
+	Convey("Testing Resolve of large ranges", t, func() {
+
+		// ranges stay ranges, however many numbers they hold
+		set, _ := ParseSequenceSet("*:4,5:7,2,1:4294967295")
+		So(set.Resolve(10), ShouldResemble, SequenceSet{{Start: 1, Stop: 4294967295}})
+		set, _ = ParseSequenceSet("*:4,5:7,2")
+		So(set.Resolve(10), ShouldResemble, SequenceSet{{Start: 2, Stop: 2}, {Start: 4, Stop: 10}})
+	})
+
+}
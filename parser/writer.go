@@ -0,0 +1,248 @@
+package parser
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Writer writes server responses to a stream.
+// Every response is flushed as soon as it is complete.
+type Writer struct {
+	out io.Writer
+	w   *bufio.Writer
+}
+
+// NewWriter creates a Writer which writes responses to w
+func NewWriter(w io.Writer) *Writer {
+	return &Writer{out: w, w: bufio.NewWriter(w)}
+}
+
+// WriteStatus writes a tagged or untagged status response.
+// Without Info, the text is "completed".
+func (w *Writer) WriteStatus(resp StatusResponse) error {
+	tag := resp.Tag
+	if tag == "" {
+		tag = "*"
+	}
+	w.w.WriteString(tag + " " + resp.Type)
+	if resp.Code != "" {
+		w.w.WriteString(" [" + resp.Code)
+		for _, argument := range resp.CodeArguments {
+			w.w.WriteByte(' ')
+			if err := w.encoder().value(argument); err != nil {
+				return w.discard(err)
+			}
+		}
+		w.w.WriteByte(']')
+	}
+	// resp-text needs at least one TEXT-CHAR
+	info := text(resp.Info)
+	if info == "" {
+		info = "completed"
+	}
+	w.w.WriteString(" " + info)
+	return w.end()
+}
+
+// WriteData writes an untagged response with the given fields,
+// separated by SP. Fields are written as follows:
+//
+//	nil                  NIL
+//	Atom                 as is
+//	string, []byte       quoted string, or literal if it can't be quoted
+//	Literal              literal
+//	integer types        number
+//	time.Time            quoted date-time
+//	[]interface{}        parenthesized list of values
+//	[]Atom               parenthesized list of atoms, like a flag list
+func (w *Writer) WriteData(fields ...interface{}) error {
+	w.w.WriteString("*")
+	for _, field := range fields {
+		w.w.WriteByte(' ')
+		if err := w.encoder().value(field); err != nil {
+			return w.discard(err)
+		}
+	}
+	return w.end()
+}
+
+// WriteContinuation writes a continuation request
+func (w *Writer) WriteContinuation(info string) error {
+	w.w.WriteString("+ " + text(info))
+	return w.end()
+}
+
+// WriteCapability writes the CAPABILITY response
+func (w *Writer) WriteCapability(capabilities []string) error {
+	fields := []interface{}{Atom("CAPABILITY")}
+	for _, capability := range capabilities {
+		fields = append(fields, Atom(capability))
+	}
+	return w.WriteData(fields...)
+}
+
+// WriteExists writes the EXISTS response
+func (w *Writer) WriteExists(n uint32) error {
+	return w.WriteData(n, Atom("EXISTS"))
+}
+
+// WriteRecent writes the RECENT response
+func (w *Writer) WriteRecent(n uint32) error {
+	return w.WriteData(n, Atom("RECENT"))
+}
+
+// WriteExpunge writes the EXPUNGE response
+func (w *Writer) WriteExpunge(seqNum uint32) error {
+	return w.WriteData(seqNum, Atom("EXPUNGE"))
+}
+
+// WriteFlags writes the FLAGS response
+func (w *Writer) WriteFlags(flags []string) error {
+	return w.WriteData(Atom("FLAGS"), FlagList(flags))
+}
+
+// WriteFetch writes a FETCH response with the given data items,
+// as pairs of name and value
+func (w *Writer) WriteFetch(seqNum uint32, items []interface{}) error {
+	return w.WriteData(seqNum, Atom("FETCH"), items)
+}
+
+func (w *Writer) encoder() encoder {
+	return encoder{w: w.w}
+}
+
+// end terminates the response and flushes it
+func (w *Writer) end() error {
+	w.w.WriteString("\r\n")
+	return w.w.Flush()
+}
+
+// discard drops the unfinished response and returns err
+func (w *Writer) discard(err error) error {
+	w.w.Reset(w.out)
+	return err
+}
+
+// FlagList returns flags as a list of atoms
+func FlagList(flags []string) []Atom {
+	list := make([]Atom, len(flags))
+	for i, flag := range flags {
+		list[i] = Atom(flag)
+	}
+	return list
+}
+
+// FormatDateTime returns the content of a date-time, without the double quotes
+func FormatDateTime(t time.Time) string {
+	return t.Format("_2-Jan-2006 15:04:05 -0700")
+}
+
+// encoder writes values to w
+type encoder struct {
+	w *bufio.Writer
+
+	// sync is called after the "{n}" marker of a literal has been
+	// flushed, before its octets are written. It may be nil.
+	sync func() error
+}
+
+// value writes a single value
+func (e encoder) value(value interface{}) error {
+	w := e.w
+	switch value := value.(type) {
+	case nil:
+		w.WriteString("NIL")
+	case Atom:
+		w.WriteString(string(value))
+	case string:
+		return e.string(value)
+	case []byte:
+		return e.string(string(value))
+	case Literal:
+		return e.literal(value)
+	case int:
+		w.WriteString(strconv.Itoa(value))
+	case int64:
+		w.WriteString(strconv.FormatInt(value, 10))
+	case uint32:
+		w.WriteString(strconv.FormatUint(uint64(value), 10))
+	case uint64:
+		w.WriteString(strconv.FormatUint(value, 10))
+	case time.Time:
+		w.WriteString(`"` + FormatDateTime(value) + `"`)
+	case []Atom:
+		w.WriteByte('(')
+		for i, atom := range value {
+			if i > 0 {
+				w.WriteByte(' ')
+			}
+			w.WriteString(string(atom))
+		}
+		w.WriteByte(')')
+	case []interface{}:
+		w.WriteByte('(')
+		for i, item := range value {
+			if i > 0 {
+				w.WriteByte(' ')
+			}
+			if err := e.value(item); err != nil {
+				return err
+			}
+		}
+		w.WriteByte(')')
+	default:
+		return fmt.Errorf("Writer: can't write value of type %T", value)
+	}
+	return nil
+}
+
+// string writes s as quoted string, or as literal
+// if it contains characters which can't be quoted
+func (e encoder) string(s string) error {
+	if !canQuote(s) {
+		return e.literal([]byte(s))
+	}
+	e.w.WriteByte('"')
+	for i := 0; i < len(s); i++ {
+		if s[i] == '"' || s[i] == '\\' {
+			e.w.WriteByte('\\')
+		}
+		e.w.WriteByte(s[i])
+	}
+	e.w.WriteByte('"')
+	return nil
+}
+
+func (e encoder) literal(literal []byte) error {
+	e.w.WriteString("{" + strconv.Itoa(len(literal)) + "}\r\n")
+	if e.sync != nil {
+		if err := e.w.Flush(); err != nil {
+			return err
+		}
+		if err := e.sync(); err != nil {
+			return err
+		}
+	}
+	_, err := e.w.Write(literal)
+	return err
+}
+
+// canQuote reports whether s only contains TEXT-CHARs,
+// so it can be written as quoted string
+func canQuote(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] == 0 || s[i] == '\r' || s[i] == '\n' || s[i] > 0x7f {
+			return false
+		}
+	}
+	return true
+}
+
+// text makes s safe to use as resp-text
+func text(s string) string {
+	return strings.NewReplacer("\r", " ", "\n", " ").Replace(s)
+}
@@ -0,0 +1,139 @@
+package parser
+
+import (
+	"bytes"
+	. "github.com/smartystreets/goconvey/convey"
+	"testing"
+	"time"
+)
+
+func TestWriter(t *testing.T) {
+
+	Convey("Testing Writer", t, func() {
+
+		buffer := &bytes.Buffer{}
+		w := NewWriter(buffer)
+
+		Convey("Status responses", func() {
+
+			So(w.WriteStatus(StatusResponse{Type: OK, Info: "IMAP4rev1 Service Ready"}), ShouldEqual, nil)
+			So(w.WriteStatus(StatusResponse{Tag: "a001", Type: OK, Info: "LOGIN completed"}), ShouldEqual, nil)
+			So(w.WriteStatus(StatusResponse{Type: OK, Code: CodeUnseen, CodeArguments: []interface{}{uint32(17)}, Info: "Message 17 is the first unseen message"}), ShouldEqual, nil)
+			So(w.WriteStatus(StatusResponse{Type: OK, Code: CodeUidValidity, CodeArguments: []interface{}{uint32(3857529045)}, Info: "UIDs valid"}), ShouldEqual, nil)
+			So(w.WriteStatus(StatusResponse{Type: OK, Code: CodePermanentFlags, CodeArguments: []interface{}{FlagList([]string{`\Deleted`, `\Seen`, `\*`})}, Info: "Limited"}), ShouldEqual, nil)
+			So(w.WriteStatus(StatusResponse{Tag: "a002", Type: OK, Code: CodeReadWrite, Info: "SELECT completed"}), ShouldEqual, nil)
+			So(w.WriteStatus(StatusResponse{Tag: "A003", Type: NO, Code: CodeTryCreate}), ShouldEqual, nil)
+			So(w.WriteStatus(StatusResponse{Tag: "A004", Type: OK}), ShouldEqual, nil)
+			So(w.WriteStatus(StatusResponse{Type: BAD, Info: "line\r\nbreak"}), ShouldEqual, nil)
+			So(w.WriteStatus(StatusResponse{Type: BYE, Info: "IMAP4rev1 server terminating connection"}), ShouldEqual, nil)
+
+			So(buffer.String(), ShouldEqual, "* OK IMAP4rev1 Service Ready\r\n"+
+				"a001 OK LOGIN completed\r\n"+
+				"* OK [UNSEEN 17] Message 17 is the first unseen message\r\n"+
+				"* OK [UIDVALIDITY 3857529045] UIDs valid\r\n"+
+				"* OK [PERMANENTFLAGS (\\Deleted \\Seen \\*)] Limited\r\n"+
+				"a002 OK [READ-WRITE] SELECT completed\r\n"+
+				"A003 NO [TRYCREATE] completed\r\n"+
+				"A004 OK completed\r\n"+
+				"* BAD line  break\r\n"+
+				"* BYE IMAP4rev1 server terminating connection\r\n")
+		})
+
+		Convey("Continuation responses", func() {
+
+			So(w.WriteContinuation("Ready for literal data"), ShouldEqual, nil)
+			So(buffer.String(), ShouldEqual, "+ Ready for literal data\r\n")
+		})
+
+		Convey("Untagged data", func() {
+
+			So(w.WriteExists(18), ShouldEqual, nil)
+			So(w.WriteFlags([]string{`\Answered`, `\Flagged`, `\Deleted`, `\Seen`, `\Draft`}), ShouldEqual, nil)
+			So(w.WriteRecent(2), ShouldEqual, nil)
+			So(w.WriteExpunge(3), ShouldEqual, nil)
+			So(w.WriteCapability([]string{"IMAP4rev1", "STARTTLS", "AUTH=PLAIN"}), ShouldEqual, nil)
+			So(w.WriteData(Atom("LIST"), []Atom{`\Noselect`}, "/", "~/Mail/foo"), ShouldEqual, nil)
+
+			So(buffer.String(), ShouldEqual, "* 18 EXISTS\r\n"+
+				"* FLAGS (\\Answered \\Flagged \\Deleted \\Seen \\Draft)\r\n"+
+				"* 2 RECENT\r\n"+
+				"* 3 EXPUNGE\r\n"+
+				"* CAPABILITY IMAP4rev1 STARTTLS AUTH=PLAIN\r\n"+
+				"* LIST (\\Noselect) \"/\" \"~/Mail/foo\"\r\n")
+		})
+
+		Convey("FETCH responses", func() {
+
+			terry := []interface{}{"Terry Gray", nil, "gray", "cac.washington.edu"}
+			So(w.WriteFetch(12, []interface{}{
+				Atom("FLAGS"), FlagList([]string{`\Seen`}),
+				Atom("INTERNALDATE"), time.Date(1996, 7, 17, 2, 44, 25, 0, time.FixedZone("", -7*60*60)),
+				Atom("RFC822.SIZE"), 4286,
+				Atom("ENVELOPE"), []interface{}{
+					"Wed, 17 Jul 1996 02:23:25 -0700 (PDT)",
+					"IMAP4rev1 WG mtg summary and minutes",
+					[]interface{}{terry},
+					[]interface{}{terry},
+					[]interface{}{terry},
+					[]interface{}{[]interface{}{nil, nil, "imap", "cac.washington.edu"}},
+					[]interface{}{
+						[]interface{}{nil, nil, "minutes", "CNRI.Reston.VA.US"},
+						[]interface{}{"John Klensin", nil, "KLENSIN", "MIT.EDU"},
+					},
+					nil,
+					nil,
+					"<B27397-0100000@cac.washington.edu>",
+				},
+				Atom("BODY"), []interface{}{"TEXT", "PLAIN", []interface{}{"CHARSET", "US-ASCII"}, nil, nil, "7BIT", 3028, 92},
+			}), ShouldEqual, nil)
+
+			header := "Date: Wed, 17 Jul 1996 02:23:25 -0700 (PDT)\r\n" +
+				"From: Terry Gray <gray@cac.washington.edu>\r\n" +
+				"Subject: IMAP4rev1 WG mtg summary and minutes\r\n" +
+				"To: imap@cac.washington.edu\r\n" +
+				"cc: minutes@CNRI.Reston.VA.US, John Klensin <KLENSIN@MIT.EDU>\r\n" +
+				"Message-Id: <B27397-0100000@cac.washington.edu>\r\n" +
+				"MIME-Version: 1.0\r\n" +
+				"Content-Type: TEXT/PLAIN; CHARSET=US-ASCII\r\n" +
+				"\r\n"
+			So(w.WriteFetch(12, []interface{}{Atom("BODY[HEADER]"), Literal(header)}), ShouldEqual, nil)
+
+			So(w.WriteFetch(12, []interface{}{Atom("FLAGS"), FlagList([]string{`\Seen`, `\Deleted`})}), ShouldEqual, nil)
+
+			So(buffer.String(), ShouldEqual, `* 12 FETCH (FLAGS (\Seen) INTERNALDATE "17-Jul-1996 02:44:25 -0700" `+
+				`RFC822.SIZE 4286 ENVELOPE ("Wed, 17 Jul 1996 02:23:25 -0700 (PDT)" `+
+				`"IMAP4rev1 WG mtg summary and minutes" `+
+				`(("Terry Gray" NIL "gray" "cac.washington.edu")) `+
+				`(("Terry Gray" NIL "gray" "cac.washington.edu")) `+
+				`(("Terry Gray" NIL "gray" "cac.washington.edu")) `+
+				`((NIL NIL "imap" "cac.washington.edu")) `+
+				`((NIL NIL "minutes" "CNRI.Reston.VA.US") `+
+				`("John Klensin" NIL "KLENSIN" "MIT.EDU")) NIL NIL `+
+				`"<B27397-0100000@cac.washington.edu>") `+
+				`BODY ("TEXT" "PLAIN" ("CHARSET" "US-ASCII") NIL NIL "7BIT" 3028 92))`+"\r\n"+
+				"* 12 FETCH (BODY[HEADER] {342}\r\n"+header+")\r\n"+
+				"* 12 FETCH (FLAGS (\\Seen \\Deleted))\r\n")
+		})
+
+		Convey("Strings", func() {
+
+			So(w.WriteData("", `say "hi" \o/`, "new\r\nline", "café", []byte("bytes"), Literal("lit"), uint64(1), int64(-1)), ShouldEqual, nil)
+			So(buffer.String(), ShouldEqual, "* \"\" \"say \\\"hi\\\" \\\\o/\" {9}\r\nnew\r\nline {5}\r\ncafé \"bytes\" {3}\r\nlit 1 -1\r\n")
+		})
+
+		Convey("Dates", func() {
+
+			So(w.WriteData(time.Date(2002, 12, 1, 14, 36, 36, 0, time.FixedZone("", 8*60*60))), ShouldEqual, nil)
+			So(buffer.String(), ShouldEqual, "* \" 1-Dec-2002 14:36:36 +0800\"\r\n")
+		})
+
+		Convey("Unsupported values", func() {
+
+			So(w.WriteData(Atom("FOO"), struct{}{}), ShouldNotEqual, nil)
+			So(w.WriteExists(1), ShouldEqual, nil)
+			So(buffer.String(), ShouldEqual, "* 1 EXISTS\r\n")
+		})
+
+	})
+
+}
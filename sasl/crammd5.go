@@ -0,0 +1,69 @@
+package sasl
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"time"
+)
+
+// cramMD5Server implements CRAM-MD5 (RFC 2195)
+type cramMD5Server struct {
+	hostname  string
+	secret    func(username string) (string, error)
+	challenge []byte
+	done      bool
+}
+
+// NewCramMD5Server creates the server side of CRAM-MD5, which proves
+// that the client knows the password without sending it. hostname is
+// part of the challenge, secret returns the password of username.
+func NewCramMD5Server(hostname string, secret func(username string) (string, error)) Server {
+	return &cramMD5Server{hostname: hostname, secret: secret}
+}
+
+func (s *cramMD5Server) Next(response []byte) ([]byte, bool, error) {
+	if s.done {
+		return nil, false, ErrUnexpectedResponse
+	}
+	if s.challenge == nil {
+		if response != nil {
+			// the server sends the first challenge
+			s.done = true
+			return nil, false, ErrUnexpectedResponse
+		}
+		random := make([]byte, 8)
+		if _, err := rand.Read(random); err != nil {
+			return nil, false, err
+		}
+		s.challenge = []byte(fmt.Sprintf("<%x.%d@%s>", random, time.Now().Unix(), s.hostname))
+		return s.challenge, false, nil
+	}
+	if response == nil {
+		return s.challenge, false, nil
+	}
+	s.done = true
+
+	/*
+		response  = username SP digest
+		digest    = 32(DIGIT / %x61-66)    ; lower-case hex of HMAC-MD5
+	*/
+	i := bytes.LastIndexByte(response, ' ')
+	if i <= 0 {
+		return nil, false, ErrInvalidResponse
+	}
+	username, digest := string(response[:i]), response[i+1:]
+	secret, err := s.secret(username)
+	if err != nil {
+		return nil, false, err
+	}
+	mac := hmac.New(md5.New, []byte(secret))
+	mac.Write(s.challenge)
+	if !hmac.Equal(bytes.ToLower(digest), []byte(hex.EncodeToString(mac.Sum(nil)))) {
+		return nil, false, ErrInvalidCredentials
+	}
+	return nil, true, nil
+}
@@ -0,0 +1,41 @@
+package sasl
+
+import (
+	"bytes"
+)
+
+// externalServer implements EXTERNAL (RFC 4422 appendix A)
+type externalServer struct {
+	authenticate func(identity string) error
+	done         bool
+}
+
+// NewExternalServer creates the server side of EXTERNAL, which relies
+// on credentials from outside of SASL, like a TLS client certificate.
+// authenticate checks them, and whether they may act as identity when
+// that isn't empty.
+func NewExternalServer(authenticate func(identity string) error) Server {
+	return &externalServer{authenticate: authenticate}
+}
+
+func (s *externalServer) Next(response []byte) ([]byte, bool, error) {
+	if s.done {
+		return nil, false, ErrUnexpectedResponse
+	}
+	if response == nil {
+		// the client sends the authorization identity, if any
+		return []byte{}, false, nil
+	}
+	s.done = true
+
+	/*
+		message   = [authz-id]
+	*/
+	if bytes.IndexByte(response, 0) >= 0 {
+		return nil, false, ErrInvalidResponse
+	}
+	if err := s.authenticate(string(response)); err != nil {
+		return nil, false, err
+	}
+	return nil, true, nil
+}
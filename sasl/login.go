@@ -0,0 +1,35 @@
+package sasl
+
+// loginServer implements LOGIN, which sends the username and the
+// password in separate responses (draft-murchison-sasl-login)
+type loginServer struct {
+	authenticate func(username, password string) error
+	username     *string
+	done         bool
+}
+
+// NewLoginServer creates the server side of LOGIN,
+// authenticate checks the password of username
+func NewLoginServer(authenticate func(username, password string) error) Server {
+	return &loginServer{authenticate: authenticate}
+}
+
+func (s *loginServer) Next(response []byte) ([]byte, bool, error) {
+	switch {
+	case s.done:
+		return nil, false, ErrUnexpectedResponse
+	case response == nil && s.username == nil:
+		return []byte("Username:"), false, nil
+	case response == nil:
+		return []byte("Password:"), false, nil
+	case s.username == nil:
+		username := string(response)
+		s.username = &username
+		return []byte("Password:"), false, nil
+	}
+	s.done = true
+	if err := s.authenticate(*s.username, string(response)); err != nil {
+		return nil, false, err
+	}
+	return nil, true, nil
+}
@@ -0,0 +1,155 @@
+package sasl
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+)
+
+// OAuthError rejects a token. The mechanisms send it to the client as
+// JSON (RFC 7628 section 3.2.2), and fail once the client responds.
+type OAuthError struct {
+	Status              string `json:"status"`
+	Scope               string `json:"scope,omitempty"`
+	OpenIDConfiguration string `json:"openid-configuration,omitempty"`
+}
+
+func (e *OAuthError) Error() string {
+	return "SASL: token rejected: " + e.Status
+}
+
+// oauthServer implements OAUTHBEARER and XOAUTH2,
+// which only differ in the message of the client
+type oauthServer struct {
+	parse        func(message []byte) (identity, token string, err error)
+	authenticate func(identity, token string) error
+	rejected     bool // the error was sent, the client has to respond
+	done         bool
+}
+
+// NewOAuthBearerServer creates the server side of OAUTHBEARER
+// (RFC 7628). authenticate checks token, and whether it was issued to
+// identity when that isn't empty. When it returns an *OAuthError, the
+// error is sent to the client before the exchange fails.
+func NewOAuthBearerServer(authenticate func(identity, token string) error) Server {
+	return &oauthServer{parse: parseOAuthBearer, authenticate: authenticate}
+}
+
+// NewXOAuth2Server creates the server side of XOAUTH2, which Google
+// defined before OAUTHBEARER. authenticate checks whether token was
+// issued to username, like for NewOAuthBearerServer.
+func NewXOAuth2Server(authenticate func(username, token string) error) Server {
+	return &oauthServer{parse: parseXOAuth2, authenticate: authenticate}
+}
+
+func (s *oauthServer) Next(response []byte) ([]byte, bool, error) {
+	if s.done {
+		return nil, false, ErrUnexpectedResponse
+	}
+	if s.rejected {
+		// the response to the error doesn't matter
+		s.done = true
+		return nil, false, ErrInvalidCredentials
+	}
+	if response == nil {
+		// the client sends everything in its first response
+		return []byte{}, false, nil
+	}
+
+	identity, token, err := s.parse(response)
+	if err != nil {
+		s.done = true
+		return nil, false, err
+	}
+	if err := s.authenticate(identity, token); err != nil {
+		rejection, ok := err.(*OAuthError)
+		if !ok {
+			s.done = true
+			return nil, false, err
+		}
+		s.rejected = true
+		challenge, err := json.Marshal(rejection)
+		return challenge, false, err
+	}
+	s.done = true
+	return nil, true, nil
+}
+
+// parseOAuthBearer returns the authorization identity and the token of
+// the message of an OAUTHBEARER client
+func parseOAuthBearer(message []byte) (string, string, error) {
+	/*
+		kvsep          = %x01
+		key            = 1*(ALPHA)
+		value          = *(VCHAR / SP / HTAB / CR / LF )
+		kvpair         = key "=" value kvsep
+		client-resp    = (gs2-header kvsep *kvpair kvsep) / kvsep
+	*/
+	parts := bytes.SplitN(message, []byte{1}, 2)
+	if len(parts) != 2 {
+		return "", "", ErrInvalidResponse
+	}
+
+	/*
+		gs2-header     = gs2-cbind-flag "," [ authzid ] ","
+		gs2-cbind-flag = "n" / "y"      ; channel binding isn't supported
+	*/
+	header := strings.Split(string(parts[0]), ",")
+	if len(header) != 3 || (header[0] != "n" && header[0] != "y") || header[2] != "" {
+		return "", "", ErrInvalidResponse
+	}
+	identity := ""
+	if header[1] != "" {
+		var ok bool
+		if identity, ok = saslname(header[1], "a="); !ok {
+			return "", "", ErrInvalidResponse
+		}
+	}
+
+	token, err := bearerToken(parts[1])
+	return identity, token, err
+}
+
+// parseXOAuth2 returns the username and the token of the message of
+// an XOAUTH2 client
+func parseXOAuth2(message []byte) (string, string, error) {
+	/*
+		message        = "user=" username %x01 "auth=Bearer " token %x01 %x01
+	*/
+	parts := bytes.SplitN(message, []byte{1}, 2)
+	if len(parts) != 2 || !bytes.HasPrefix(parts[0], []byte("user=")) || len(parts[0]) == len("user=") {
+		return "", "", ErrInvalidResponse
+	}
+	token, err := bearerToken(parts[1])
+	return string(parts[0][len("user="):]), token, err
+}
+
+// bearerToken returns the token of the "auth" pair of pairs, which are
+// ended by %x01 each, and by another %x01 altogether
+func bearerToken(pairs []byte) (string, error) {
+	/*
+		auth-value     = "Bearer" 1*SP b64token
+		b64token       = 1*( ALPHA / DIGIT / "-" / "." / "_" / "~" / "+" / "/" ) *"="
+	*/
+	if !bytes.HasSuffix(pairs, []byte{1, 1}) {
+		return "", ErrInvalidResponse
+	}
+	token := ""
+	for _, pair := range strings.Split(string(pairs[:len(pairs)-2]), "\x01") {
+		keyValue := strings.SplitN(pair, "=", 2)
+		if len(keyValue) != 2 || keyValue[0] == "" {
+			return "", ErrInvalidResponse
+		}
+		if keyValue[0] == "auth" {
+			credentials := strings.SplitN(keyValue[1], " ", 2)
+			if len(credentials) != 2 || !strings.EqualFold(credentials[0], "Bearer") {
+				return "", ErrInvalidResponse
+			}
+			token = strings.TrimLeft(credentials[1], " ")
+		}
+	}
+	if token == "" {
+		return "", ErrInvalidResponse
+	}
+	return token, nil
+}
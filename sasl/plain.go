@@ -0,0 +1,41 @@
+package sasl
+
+import (
+	"bytes"
+)
+
+// plainServer implements PLAIN (RFC 4616)
+type plainServer struct {
+	authenticate func(identity, username, password string) error
+	done         bool
+}
+
+// NewPlainServer creates the server side of PLAIN. authenticate checks
+// the password of username, and whether it may act as identity when
+// that isn't empty.
+func NewPlainServer(authenticate func(identity, username, password string) error) Server {
+	return &plainServer{authenticate: authenticate}
+}
+
+func (s *plainServer) Next(response []byte) ([]byte, bool, error) {
+	if s.done {
+		return nil, false, ErrUnexpectedResponse
+	}
+	if response == nil {
+		// the client sends everything in its first response
+		return []byte{}, false, nil
+	}
+	s.done = true
+
+	/*
+		message   = [authzid] UTF8NUL authcid UTF8NUL passwd
+	*/
+	parts := bytes.Split(response, []byte{0})
+	if len(parts) != 3 || len(parts[1]) == 0 || len(parts[2]) == 0 {
+		return nil, false, ErrInvalidResponse
+	}
+	if err := s.authenticate(string(parts[0]), string(parts[1]), string(parts[2])); err != nil {
+		return nil, false, err
+	}
+	return nil, true, nil
+}
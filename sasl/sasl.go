@@ -0,0 +1,41 @@
+/*
+Package sasl implements the server side of SASL (RFC 4422)
+mechanisms, for the AUTHENTICATE command.
+
+A Server runs the exchange of a single authentication. It is given
+each response of the client, and returns the challenge to send next:
+
+	s := sasl.NewPlainServer(authenticate)
+	challenge, done, err := s.Next(nil)
+	for err == nil && !done {
+		// send challenge, read response
+		challenge, done, err = s.Next(response)
+	}
+
+Mechanisms check credentials through the function they are created
+with, so they don't depend on how users are stored.
+*/
+package sasl
+
+import (
+	"errors"
+)
+
+// Server is the server side of a mechanism, for a single exchange
+type Server interface {
+	// Next takes the next response of the client, which is nil when
+	// the client didn't send one yet, and returns the challenge to send.
+	// done is set once the client is authenticated, challenge then
+	// holds additional data for the client, if any. Errors end the
+	// exchange, the client isn't authenticated.
+	Next(response []byte) (challenge []byte, done bool, err error)
+}
+
+// Errors which mechanisms return for responses they can't use, or
+// credentials which they check themselves. Errors of the functions
+// which check credentials are returned as is.
+var (
+	ErrInvalidResponse    = errors.New("SASL: invalid response")
+	ErrUnexpectedResponse = errors.New("SASL: unexpected response")
+	ErrInvalidCredentials = errors.New("SASL: invalid credentials")
+)
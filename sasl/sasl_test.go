@@ -0,0 +1,356 @@
+package sasl
+
+import (
+	"encoding/base64"
+	"errors"
+	. "github.com/smartystreets/goconvey/convey"
+	"hash"
+	"strings"
+	"testing"
+)
+
+func TestMechanisms(t *testing.T) {
+
+	errWrongPassword := errors.New("wrong password")
+	authenticated := ""
+	authenticate := func(identity, username, password string) error {
+		if password != "secret" {
+			return errWrongPassword
+		}
+		authenticated = identity + "/" + username
+		return nil
+	}
+
+	Convey("Testing PLAIN", t, func() {
+
+		s := NewPlainServer(authenticate)
+		challenge, done, err := s.Next(nil)
+		So(err, ShouldEqual, nil)
+		So(done, ShouldBeFalse)
+		So(challenge, ShouldResemble, []byte{})
+		_, done, err = s.Next([]byte("\x00mrc\x00secret"))
+		So(err, ShouldEqual, nil)
+		So(done, ShouldBeTrue)
+		So(authenticated, ShouldEqual, "/mrc")
+		_, _, err = s.Next([]byte("\x00mrc\x00secret"))
+		So(err, ShouldEqual, ErrUnexpectedResponse)
+
+		// as initial response, with an authorization identity
+		_, done, err = NewPlainServer(authenticate).Next([]byte("admin\x00mrc\x00secret"))
+		So(err, ShouldEqual, nil)
+		So(done, ShouldBeTrue)
+		So(authenticated, ShouldEqual, "admin/mrc")
+
+		_, _, err = NewPlainServer(authenticate).Next([]byte("\x00mrc\x00wrong"))
+		So(err, ShouldEqual, errWrongPassword)
+		for _, response := range []string{"", "mrc secret", "\x00mrc", "\x00\x00secret", "\x00mrc\x00", "a\x00b\x00c\x00d"} {
+			_, _, err = NewPlainServer(authenticate).Next([]byte(response))
+			So(err, ShouldEqual, ErrInvalidResponse)
+		}
+	})
+
+	Convey("Testing LOGIN", t, func() {
+
+		s := NewLoginServer(func(username, password string) error {
+			return authenticate("", username, password)
+		})
+		challenge, done, err := s.Next(nil)
+		So(string(challenge), ShouldEqual, "Username:")
+		challenge, done, err = s.Next([]byte("tim"))
+		So(string(challenge), ShouldEqual, "Password:")
+		So(done, ShouldBeFalse)
+		_, done, err = s.Next([]byte("secret"))
+		So(err, ShouldEqual, nil)
+		So(done, ShouldBeTrue)
+		So(authenticated, ShouldEqual, "/tim")
+		_, _, err = s.Next([]byte("again"))
+		So(err, ShouldEqual, ErrUnexpectedResponse)
+
+		// the username as initial response
+		s = NewLoginServer(func(username, password string) error {
+			return authenticate("", username, password)
+		})
+		challenge, _, _ = s.Next([]byte("mrc"))
+		So(string(challenge), ShouldEqual, "Password:")
+		_, _, err = s.Next([]byte("wrong"))
+		So(err, ShouldEqual, errWrongPassword)
+	})
+
+	Convey("Testing CRAM-MD5", t, func() {
+
+		secret := func(username string) (string, error) {
+			if username != "tim" {
+				return "", errWrongPassword
+			}
+			return "tanstaaftanstaaf", nil
+		}
+
+		s := NewCramMD5Server("postoffice.reston.mci.net", secret)
+		challenge, done, err := s.Next(nil)
+		So(err, ShouldEqual, nil)
+		So(done, ShouldBeFalse)
+		So(string(challenge), ShouldStartWith, "<")
+		So(string(challenge), ShouldEndWith, "@postoffice.reston.mci.net>")
+
+		// the example of RFC 2195
+		s.(*cramMD5Server).challenge = []byte("<1896.697170952@postoffice.reston.mci.net>")
+		_, done, err = s.Next([]byte("tim b913a602c7eda7a495b4e6e7334d3890"))
+		So(err, ShouldEqual, nil)
+		So(done, ShouldBeTrue)
+
+		for response, expected := range map[string]error{
+			"tim b913a602c7eda7a495b4e6e7334d3891": ErrInvalidCredentials,
+			"tim B913A602C7EDA7A495B4E6E7334D3890": nil,
+			"joe b913a602c7eda7a495b4e6e7334d3890": errWrongPassword,
+			"b913a602c7eda7a495b4e6e7334d3890":     ErrInvalidResponse,
+		} {
+			s := NewCramMD5Server("postoffice.reston.mci.net", secret)
+			s.Next(nil)
+			s.(*cramMD5Server).challenge = []byte("<1896.697170952@postoffice.reston.mci.net>")
+			_, _, err = s.Next([]byte(response))
+			So(err, ShouldEqual, expected)
+		}
+
+		// the server sends the first challenge
+		_, _, err = NewCramMD5Server("localhost", secret).Next([]byte("tim " + strings.Repeat("0", 32)))
+		So(err, ShouldEqual, ErrUnexpectedResponse)
+	})
+
+	Convey("Testing EXTERNAL", t, func() {
+
+		identity := "-"
+		errNotAllowed := errors.New("not allowed")
+		authenticate := func(id string) error {
+			if id == "root" {
+				return errNotAllowed
+			}
+			identity = id
+			return nil
+		}
+		s := NewExternalServer(authenticate)
+		challenge, done, err := s.Next(nil)
+		So(err, ShouldEqual, nil)
+		So(done, ShouldBeFalse)
+		So(challenge, ShouldResemble, []byte{})
+		_, done, err = s.Next([]byte{})
+		So(err, ShouldEqual, nil)
+		So(done, ShouldBeTrue)
+		So(identity, ShouldEqual, "")
+		_, _, err = s.Next([]byte{})
+		So(err, ShouldEqual, ErrUnexpectedResponse)
+
+		_, done, err = NewExternalServer(authenticate).Next([]byte("admin"))
+		So(done, ShouldBeTrue)
+		So(identity, ShouldEqual, "admin")
+		_, _, err = NewExternalServer(authenticate).Next([]byte("root"))
+		So(err, ShouldEqual, errNotAllowed)
+		_, _, err = NewExternalServer(authenticate).Next([]byte("ad\x00min"))
+		So(err, ShouldEqual, ErrInvalidResponse)
+	})
+}
+
+func TestScram(t *testing.T) {
+
+	// clientProof computes the proof of a client which knows password
+	clientProof := func(h func() hash.Hash, password string, salt []byte, authMessage string) string {
+		clientKey := computeHMAC(h, hi(h, []byte(password), salt, 4096), []byte("Client Key"))
+		stored := h()
+		stored.Write(clientKey)
+		signature := computeHMAC(h, stored.Sum(nil), []byte(authMessage))
+		for i := range clientKey {
+			clientKey[i] ^= signature[i]
+		}
+		return base64.StdEncoding.EncodeToString(clientKey)
+	}
+
+	for _, vector := range []struct {
+		name, hash, salt         string
+		clientNonce, serverNonce string
+		proof, verifier          string
+	}{
+		// RFC 5802 section 5
+		{"SCRAM-SHA-1", "SHA-1", "QSXCR+Q6sek8bf92", "fyko+d2lbbFgONRv9qkxdawL", "3rfcNHYJY1ZVvWVs7j",
+			"v0X8v3Bz2T0CJGbJQyF0X+HI4Ts=", "rmF9pqV8S7suAoZWja4dJRkFsKQ="},
+		// RFC 7677 section 3
+		{"SCRAM-SHA-256", "SHA-256", "W22ZaJ0SNY7soEsUEjb6gQ==", "rOprNGfwEbeRWgbNEkqO", "%hvYDpWUa2RaTCAfuxFIlj)hNlF$k0",
+			"dHzbZapWIk4jUhN+Ute9ytag9zjfMHgsqmmiz7AndVQ=", "6rriTRBi23WpRR/wtup+mMhUZUn/dB5nLTJRsjl95G4="},
+	} {
+
+		Convey("Testing "+vector.name, t, func() {
+
+			h := ScramHashes[vector.hash]
+			salt, _ := base64.StdEncoding.DecodeString(vector.salt)
+			errNoSuchUser := errors.New("no such user")
+			credentials := func(username string) (ScramCredentials, error) {
+				if username != "user" {
+					return ScramCredentials{}, errNoSuchUser
+				}
+				return NewScramCredentials(h, "pencil", salt, 4096), nil
+			}
+			authenticated := ""
+			login := func(identity, username string) error {
+				authenticated = identity + "/" + username
+				return nil
+			}
+			newServer := func(plus bool, bindings map[string][]byte) Server {
+				s := NewScramServer(h, plus, bindings, credentials, login)
+				s.(*scramServer).nonce = vector.serverNonce
+				return s
+			}
+			nonce := vector.clientNonce + vector.serverNonce
+			serverFirst := "r=" + nonce + ",s=" + vector.salt + ",i=4096"
+
+			s := newServer(false, nil)
+			challenge, done, err := s.Next(nil)
+			So(err, ShouldEqual, nil)
+			So(done, ShouldBeFalse)
+			So(challenge, ShouldResemble, []byte{})
+			challenge, done, err = s.Next([]byte("n,,n=user,r=" + vector.clientNonce))
+			So(err, ShouldEqual, nil)
+			So(done, ShouldBeFalse)
+			So(string(challenge), ShouldEqual, serverFirst)
+			challenge, done, err = s.Next([]byte("c=biws,r=" + nonce + ",p=" + vector.proof))
+			So(err, ShouldEqual, nil)
+			So(done, ShouldBeTrue)
+			So(string(challenge), ShouldEqual, "v="+vector.verifier)
+			So(authenticated, ShouldEqual, "/user")
+			_, _, err = s.Next([]byte{})
+			So(err, ShouldEqual, ErrUnexpectedResponse)
+
+			for _, final := range []struct {
+				response string
+				expected error
+			}{
+				{"c=biws,r=" + nonce + ",p=" + base64.StdEncoding.EncodeToString(make([]byte, h().Size())), ErrInvalidCredentials},
+				{"c=biws,r=" + vector.clientNonce + ",p=" + vector.proof, ErrInvalidResponse},
+				{"c=eSws,r=" + nonce + ",p=" + vector.proof, ErrChannelBinding},
+				{"c=biws,r=" + nonce, ErrInvalidResponse},
+			} {
+				s := newServer(false, nil)
+				s.Next([]byte("n,,n=user,r=" + vector.clientNonce))
+				_, _, err = s.Next([]byte(final.response))
+				So(err, ShouldEqual, final.expected)
+			}
+
+			for first, expected := range map[string]error{
+				"n,,n=joe,r=abc":             errNoSuchUser,
+				"n,,n=user":                  ErrInvalidResponse,
+				"n,,n=user,r=":               ErrInvalidResponse,
+				"n,a=a=b,n=user,r=x":         ErrInvalidResponse,
+				"x,,n=user,r=abc":            ErrInvalidResponse,
+				"p=tls-unique,,n=user,r=abc": ErrChannelBinding,
+			} {
+				_, _, err = newServer(false, nil).Next([]byte(first))
+				So(err, ShouldEqual, expected)
+			}
+
+			// the client thinks that the server doesn't support channel
+			// binding, because the -PLUS variant was removed from the list
+			bindings := map[string][]byte{"tls-exporter": []byte("keying material")}
+			_, _, err = newServer(false, bindings).Next([]byte("y,,n=user,r=abc"))
+			So(err, ShouldEqual, ErrChannelBinding)
+			_, _, err = newServer(false, nil).Next([]byte("y,,n=user,r=abc"))
+			So(err, ShouldEqual, nil)
+			_, _, err = newServer(true, bindings).Next([]byte("n,,n=user,r=abc"))
+			So(err, ShouldEqual, ErrChannelBinding)
+
+			// -PLUS, with an authorization identity
+			for data, expected := range map[string]error{
+				"keying material": nil,
+				"other material":  ErrChannelBinding,
+			} {
+				authenticated = ""
+				s = newServer(true, bindings)
+				clientFirst := "n=user,r=" + vector.clientNonce
+				gs2Header := "p=tls-exporter,a=adm=2Cin=3D,"
+				_, _, err = s.Next([]byte(gs2Header + clientFirst))
+				So(err, ShouldEqual, nil)
+				withoutProof := "c=" + base64.StdEncoding.EncodeToString([]byte(gs2Header+data)) + ",r=" + nonce
+				proof := clientProof(h, "pencil", salt, clientFirst+","+serverFirst+","+withoutProof)
+				_, done, err = s.Next([]byte(withoutProof + ",p=" + proof))
+				So(err, ShouldEqual, expected)
+				if expected == nil {
+					So(done, ShouldBeTrue)
+					So(authenticated, ShouldEqual, "adm,in=/user")
+				}
+			}
+		})
+	}
+}
+
+func TestOAuth(t *testing.T) {
+
+	authenticated := ""
+	authenticate := func(identity, token string) error {
+		if token != "vF9dft4qmTc2Nvb3RlckBhbHRhdmlzdGEuY29tCg==" {
+			return &OAuthError{Status: "invalid_token", Scope: "example_scope"}
+		}
+		authenticated = identity
+		return nil
+	}
+
+	Convey("Testing OAUTHBEARER", t, func() {
+
+		// the example of RFC 7628 section 4.1
+		s := NewOAuthBearerServer(authenticate)
+		challenge, done, err := s.Next(nil)
+		So(err, ShouldEqual, nil)
+		So(done, ShouldBeFalse)
+		So(challenge, ShouldResemble, []byte{})
+		_, done, err = s.Next([]byte("n,a=user@example.com,\x01host=server.example.com\x01port=143\x01" +
+			"auth=Bearer vF9dft4qmTc2Nvb3RlckBhbHRhdmlzdGEuY29tCg==\x01\x01"))
+		So(err, ShouldEqual, nil)
+		So(done, ShouldBeTrue)
+		So(authenticated, ShouldEqual, "user@example.com")
+		_, _, err = s.Next([]byte("\x01"))
+		So(err, ShouldEqual, ErrUnexpectedResponse)
+
+		// the failure of RFC 7628 section 4.3
+		s = NewOAuthBearerServer(authenticate)
+		challenge, done, err = s.Next([]byte("n,,\x01auth=Bearer wrong\x01\x01"))
+		So(err, ShouldEqual, nil)
+		So(done, ShouldBeFalse)
+		So(string(challenge), ShouldEqual, `{"status":"invalid_token","scope":"example_scope"}`)
+		_, _, err = s.Next([]byte("\x01"))
+		So(err, ShouldEqual, ErrInvalidCredentials)
+
+		errBackend := errors.New("backend failed")
+		_, _, err = NewOAuthBearerServer(func(identity, token string) error { return errBackend }).Next([]byte("n,,\x01auth=Bearer token\x01\x01"))
+		So(err, ShouldEqual, errBackend)
+
+		for _, response := range []string{
+			"\x01",
+			"n,,\x01auth=Bearer token\x01",
+			"n,,\x01host=server.example.com\x01\x01",
+			"n,,\x01auth=Basic dXNlcjpwYXNz\x01\x01",
+			"p=tls-unique,,\x01auth=Bearer token\x01\x01",
+			"n,user,\x01auth=Bearer token\x01\x01",
+			"n,,\x01auth\x01\x01",
+		} {
+			_, _, err = NewOAuthBearerServer(authenticate).Next([]byte(response))
+			So(err, ShouldEqual, ErrInvalidResponse)
+		}
+	})
+
+	Convey("Testing XOAUTH2", t, func() {
+
+		s := NewXOAuth2Server(authenticate)
+		_, done, err := s.Next([]byte("user=someuser@example.com\x01auth=Bearer vF9dft4qmTc2Nvb3RlckBhbHRhdmlzdGEuY29tCg==\x01\x01"))
+		So(err, ShouldEqual, nil)
+		So(done, ShouldBeTrue)
+		So(authenticated, ShouldEqual, "someuser@example.com")
+
+		s = NewXOAuth2Server(authenticate)
+		challenge, done, err := s.Next([]byte("user=someuser@example.com\x01auth=Bearer wrong\x01\x01"))
+		So(err, ShouldEqual, nil)
+		So(done, ShouldBeFalse)
+		So(string(challenge), ShouldStartWith, `{"status":"invalid_token"`)
+		_, _, err = s.Next([]byte{})
+		So(err, ShouldEqual, ErrInvalidCredentials)
+
+		for _, response := range []string{"user=\x01auth=Bearer token\x01\x01", "auth=Bearer token\x01\x01", "user=someuser@example.com\x01\x01"} {
+			_, _, err = NewXOAuth2Server(authenticate).Next([]byte(response))
+			So(err, ShouldEqual, ErrInvalidResponse)
+		}
+	})
+}
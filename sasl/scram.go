@@ -0,0 +1,295 @@
+package sasl
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"hash"
+	"strconv"
+	"strings"
+)
+
+// ScramHashes are the hash functions of the SCRAM mechanisms, by the
+// name which follows "SCRAM-" in the name of the mechanism
+var ScramHashes = map[string]func() hash.Hash{
+	"SHA-1":   sha1.New,
+	"SHA-256": sha256.New,
+}
+
+// ErrChannelBinding is returned when the channel binding of the client
+// doesn't match the connection, which may have been intercepted
+var ErrChannelBinding = errors.New("SASL: channel binding doesn't match")
+
+// ScramCredentials are what a server stores of a password for SCRAM
+// (RFC 5802 section 3), the password can't be recovered from them
+type ScramCredentials struct {
+	Salt       []byte
+	Iterations int
+	StoredKey  []byte
+	ServerKey  []byte
+}
+
+// NewScramCredentials derives the credentials of password with hash h
+func NewScramCredentials(h func() hash.Hash, password string, salt []byte, iterations int) ScramCredentials {
+	/*
+		SaltedPassword  := Hi(Normalize(password), salt, i)
+		ClientKey       := HMAC(SaltedPassword, "Client Key")
+		StoredKey       := H(ClientKey)
+		ServerKey       := HMAC(SaltedPassword, "Server Key")
+	*/
+	salted := hi(h, []byte(password), salt, iterations)
+	stored := h()
+	stored.Write(computeHMAC(h, salted, []byte("Client Key")))
+	return ScramCredentials{
+		Salt:       salt,
+		Iterations: iterations,
+		StoredKey:  stored.Sum(nil),
+		ServerKey:  computeHMAC(h, salted, []byte("Server Key")),
+	}
+}
+
+// hi is PBKDF2 with HMAC of h, for a single block
+func hi(h func() hash.Hash, password, salt []byte, iterations int) []byte {
+	u := computeHMAC(h, password, append(append([]byte{}, salt...), 0, 0, 0, 1))
+	result := append([]byte{}, u...)
+	for i := 1; i < iterations; i++ {
+		u = computeHMAC(h, password, u)
+		for j := range result {
+			result[j] ^= u[j]
+		}
+	}
+	return result
+}
+
+func computeHMAC(h func() hash.Hash, key, message []byte) []byte {
+	mac := hmac.New(h, key)
+	mac.Write(message)
+	return mac.Sum(nil)
+}
+
+// scramServer implements SCRAM (RFC 5802),
+// and with plus its -PLUS variant with channel binding
+type scramServer struct {
+	hash        func() hash.Hash
+	plus        bool
+	bindings    map[string][]byte
+	credentials func(username string) (ScramCredentials, error)
+	login       func(identity, username string) error
+
+	nonce       string // of the server
+	fullNonce   string // of the client followed by the one of the server
+	identity    string
+	username    string
+	gs2Header   string
+	clientFirst string // client-first-message-bare
+	serverFirst string
+	stored      ScramCredentials
+	step        int
+}
+
+// NewScramServer creates the server side of SCRAM with hash h, like
+// SCRAM-SHA-256 with sha256.New, or of its -PLUS variant when plus is
+// set. bindings holds the channel binding data of the connection by
+// type, like "tls-exporter", it is nil if there is none. The -PLUS
+// variant requires the client to bind to one of them. credentials
+// returns the credentials of username, login is called with the
+// authorization identity, "" if the client didn't send one, once the
+// client proved that it knows the password of username.
+func NewScramServer(h func() hash.Hash, plus bool, bindings map[string][]byte,
+	credentials func(username string) (ScramCredentials, error), login func(identity, username string) error) Server {
+	return &scramServer{hash: h, plus: plus, bindings: bindings, credentials: credentials, login: login}
+}
+
+func (s *scramServer) Next(response []byte) ([]byte, bool, error) {
+	if response == nil {
+		if s.step == 0 {
+			// the client sends the first message
+			return []byte{}, false, nil
+		}
+		return nil, false, ErrUnexpectedResponse
+	}
+	s.step++
+	switch s.step {
+	case 1:
+		challenge, err := s.first(string(response))
+		if err != nil {
+			s.step = 3
+			return nil, false, err
+		}
+		return challenge, false, nil
+	case 2:
+		s.step = 3
+		challenge, err := s.final(string(response))
+		if err != nil {
+			return nil, false, err
+		}
+		return challenge, true, nil
+	}
+	return nil, false, ErrUnexpectedResponse
+}
+
+// first handles the client-first-message and returns the
+// server-first-message
+func (s *scramServer) first(message string) ([]byte, error) {
+	/*
+		client-first-message = gs2-header client-first-message-bare
+		gs2-header      = gs2-cbind-flag "," [ authzid ] ","
+		gs2-cbind-flag  = ("p=" cb-name) / "n" / "y"
+		authzid         = "a=" saslname
+		client-first-message-bare = [reserved-mext ","] username "," nonce ["," extensions]
+	*/
+	fields := strings.SplitN(message, ",", 3)
+	if len(fields) != 3 {
+		return nil, ErrInvalidResponse
+	}
+	flag, authzid := fields[0], fields[1]
+	switch {
+	case strings.HasPrefix(flag, "p="):
+		if _, ok := s.bindings[flag[2:]]; !ok || !s.plus {
+			return nil, ErrChannelBinding
+		}
+	case flag == "y":
+		// the client supports channel binding, but thinks that the
+		// server doesn't: the list of mechanisms was tampered with
+		if len(s.bindings) > 0 || s.plus {
+			return nil, ErrChannelBinding
+		}
+	case flag == "n":
+		if s.plus {
+			return nil, ErrChannelBinding
+		}
+	default:
+		return nil, ErrInvalidResponse
+	}
+	if authzid != "" {
+		identity, ok := saslname(authzid, "a=")
+		if !ok {
+			return nil, ErrInvalidResponse
+		}
+		s.identity = identity
+	}
+	s.gs2Header = flag + "," + authzid + ","
+	s.clientFirst = fields[2]
+
+	attributes := strings.Split(s.clientFirst, ",")
+	if len(attributes) < 2 {
+		return nil, ErrInvalidResponse
+	}
+	username, ok := saslname(attributes[0], "n=")
+	if !ok || username == "" || !strings.HasPrefix(attributes[1], "r=") || !isNonce(attributes[1][2:]) {
+		return nil, ErrInvalidResponse
+	}
+	s.username = username
+
+	stored, err := s.credentials(username)
+	if err != nil {
+		return nil, err
+	}
+	s.stored = stored
+	if s.nonce == "" {
+		random := make([]byte, 18)
+		if _, err := rand.Read(random); err != nil {
+			return nil, err
+		}
+		s.nonce = base64.StdEncoding.EncodeToString(random)
+	}
+
+	/*
+		server-first-message = [reserved-mext ","] nonce "," salt "," iteration-count ["," extensions]
+	*/
+	s.fullNonce = attributes[1][2:] + s.nonce
+	s.serverFirst = "r=" + s.fullNonce + ",s=" + base64.StdEncoding.EncodeToString(stored.Salt) +
+		",i=" + strconv.Itoa(stored.Iterations)
+	return []byte(s.serverFirst), nil
+}
+
+// final checks the client-final-message and returns the
+// server-final-message
+func (s *scramServer) final(message string) ([]byte, error) {
+	/*
+		client-final-message-without-proof = channel-binding "," nonce ["," extensions]
+		client-final-message = client-final-message-without-proof "," proof
+		channel-binding = "c=" base64       ; of gs2-header and cbind-data
+		proof           = "p=" base64
+	*/
+	i := strings.LastIndex(message, ",p=")
+	if i < 0 {
+		return nil, ErrInvalidResponse
+	}
+	withoutProof := message[:i]
+	proof, err := base64.StdEncoding.DecodeString(message[i+3:])
+	if err != nil {
+		return nil, ErrInvalidResponse
+	}
+	attributes := strings.Split(withoutProof, ",")
+	if len(attributes) < 2 || !strings.HasPrefix(attributes[0], "c=") {
+		return nil, ErrInvalidResponse
+	}
+	if attributes[1] != "r="+s.fullNonce {
+		return nil, ErrInvalidResponse
+	}
+	binding, err := base64.StdEncoding.DecodeString(attributes[0][2:])
+	if err != nil {
+		return nil, ErrInvalidResponse
+	}
+	expected := []byte(s.gs2Header)
+	if strings.HasPrefix(s.gs2Header, "p=") {
+		expected = append(expected, s.bindings[strings.SplitN(s.gs2Header[2:], ",", 2)[0]]...)
+	}
+	if !hmac.Equal(binding, expected) {
+		return nil, ErrChannelBinding
+	}
+
+	/*
+		AuthMessage     := client-first-message-bare + "," + server-first-message + "," + client-final-message-without-proof
+		ClientSignature := HMAC(StoredKey, AuthMessage)
+		ClientKey       := ClientProof XOR ClientSignature
+		ServerSignature := HMAC(ServerKey, AuthMessage)
+	*/
+	authMessage := []byte(s.clientFirst + "," + s.serverFirst + "," + withoutProof)
+	signature := computeHMAC(s.hash, s.stored.StoredKey, authMessage)
+	if len(proof) != len(signature) {
+		return nil, ErrInvalidCredentials
+	}
+	for i := range proof {
+		proof[i] ^= signature[i]
+	}
+	stored := s.hash()
+	stored.Write(proof)
+	if !hmac.Equal(stored.Sum(nil), s.stored.StoredKey) {
+		return nil, ErrInvalidCredentials
+	}
+	if err := s.login(s.identity, s.username); err != nil {
+		return nil, err
+	}
+
+	/*
+		server-final-message = (server-error / verifier) ["," extensions]
+		verifier        = "v=" base64
+	*/
+	verifier := computeHMAC(s.hash, s.stored.ServerKey, authMessage)
+	return []byte("v=" + base64.StdEncoding.EncodeToString(verifier)), nil
+}
+
+// saslname decodes the value of attribute, which starts with prefix.
+// "=2C" and "=3D" stand for "," and "=", other "=" are invalid.
+func saslname(attribute, prefix string) (string, bool) {
+	if !strings.HasPrefix(attribute, prefix) {
+		return "", false
+	}
+	value := attribute[len(prefix):]
+	decoded := strings.NewReplacer("=2C", ",", "=3D", "=").Replace(value)
+	if strings.Count(decoded, "=") != strings.Count(value, "=3D") {
+		return "", false
+	}
+	return decoded, true
+}
+
+// isNonce reports whether s is a valid nonce: printable characters
+// except ","
+func isNonce(s string) bool {
+	return s != "" && strings.IndexFunc(s, func(r rune) bool { return r < 0x21 || r > 0x7e || r == ',' }) < 0
+}
@@ -0,0 +1,441 @@
+package server
+
+import (
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"github.com/gopistolet/imap/backend"
+	"github.com/gopistolet/imap/oauth"
+	"github.com/gopistolet/imap/parser"
+	"github.com/gopistolet/imap/sasl"
+	"os"
+	"sort"
+	"strings"
+)
+
+// Mechanism creates the server side of a SASL mechanism, for an
+// AUTHENTICATE exchange on c. It calls c.Login with the user it
+// authenticated.
+type Mechanism func(c *AuthConn) sasl.Server
+
+// AuthConn is a connection during an AUTHENTICATE exchange
+type AuthConn struct {
+	Backend backend.Backend
+	TLS     *tls.ConnectionState // nil if the connection isn't secured
+
+	// ChannelBindings holds the channel binding data of the TLS
+	// connection by type, like "tls-exporter", nil without TLS
+	ChannelBindings map[string][]byte
+
+	user backend.User
+}
+
+// Login makes user the user of the connection,
+// once the exchange completes
+func (c *AuthConn) Login(user backend.User) {
+	c.user = user
+}
+
+// login logs in username, which acts as identity if it isn't empty
+func (c *AuthConn) login(identity, username, password string) error {
+	var user backend.User
+	var err error
+	if identity == "" || identity == username {
+		user, err = c.Backend.Login(username, password)
+	} else if b, ok := c.Backend.(backend.AuthorizationBackend); ok {
+		user, err = b.LoginAs(identity, username, password)
+	} else {
+		err = backend.ErrInvalidCredentials
+	}
+	if err != nil {
+		return err
+	}
+	c.Login(user)
+	return nil
+}
+
+// plaintextMechanisms send the password, or a token, as is,
+// they are disabled like LOGIN until the connection is secured
+var plaintextMechanisms = map[string]bool{"PLAIN": true, "LOGIN": true, "OAUTHBEARER": true, "XOAUTH2": true}
+
+// defaultMechanisms returns the mechanisms which b supports: PLAIN and
+// LOGIN, CRAM-MD5 if it is a backend.SecretBackend, and SCRAM-SHA-1,
+// SCRAM-SHA-256 and their -PLUS variants if it is a backend.ScramBackend
+func defaultMechanisms(b backend.Backend) map[string]Mechanism {
+	mechanisms := map[string]Mechanism{
+		"PLAIN": func(c *AuthConn) sasl.Server {
+			return sasl.NewPlainServer(c.login)
+		},
+		"LOGIN": func(c *AuthConn) sasl.Server {
+			return sasl.NewLoginServer(func(username, password string) error {
+				return c.login("", username, password)
+			})
+		},
+	}
+	if b, ok := b.(backend.SecretBackend); ok {
+		mechanisms["CRAM-MD5"] = func(c *AuthConn) sasl.Server {
+			var username, secret string
+			s := sasl.NewCramMD5Server(hostname(), func(name string) (string, error) {
+				var err error
+				username = name
+				secret, err = b.Secret(name)
+				return secret, err
+			})
+			// the client proved that it knows the password
+			return loginWhenDone{s, func() error { return c.login("", username, secret) }}
+		}
+	}
+	if b, ok := b.(backend.ScramBackend); ok {
+		for hash := range sasl.ScramHashes {
+			mechanisms["SCRAM-"+hash] = scramMechanism(b, hash, false)
+			mechanisms["SCRAM-"+hash+"-PLUS"] = scramMechanism(b, hash, true)
+		}
+	}
+	return mechanisms
+}
+
+// scramMechanism returns SCRAM with hash, or its -PLUS variant
+// with channel binding
+func scramMechanism(b backend.ScramBackend, hash string, plus bool) Mechanism {
+	return func(c *AuthConn) sasl.Server {
+		credentials := func(username string) (sasl.ScramCredentials, error) {
+			return b.ScramCredentials(username, hash)
+		}
+		return sasl.NewScramServer(sasl.ScramHashes[hash], plus, c.ChannelBindings, credentials, func(identity, username string) error {
+			// LoginAs would need the password
+			if identity != "" && identity != username {
+				return backend.ErrInvalidCredentials
+			}
+			user, err := b.User(username)
+			if err != nil {
+				return err
+			}
+			c.Login(user)
+			return nil
+		})
+	}
+}
+
+// errNoUserBackend is returned by the OAuth mechanisms and EXTERNAL
+// when the backend isn't a backend.UserBackend
+var errNoUserBackend = errors.New("Server: the backend can't return users without their password")
+
+// OAuthBearer returns OAUTHBEARER (RFC 7628), which logs in the user
+// validator returns for the bearer token of the client. The Backend of
+// the Server has to be a backend.UserBackend.
+func OAuthBearer(validator oauth.TokenValidator) Mechanism {
+	return func(c *AuthConn) sasl.Server {
+		return sasl.NewOAuthBearerServer(func(identity, token string) error {
+			return c.oauthLogin(validator, identity, token)
+		})
+	}
+}
+
+// XOAuth2 returns XOAUTH2, the variant of OAUTHBEARER which clients
+// of Google implement, see OAuthBearer
+func XOAuth2(validator oauth.TokenValidator) Mechanism {
+	return func(c *AuthConn) sasl.Server {
+		return sasl.NewXOAuth2Server(func(username, token string) error {
+			return c.oauthLogin(validator, username, token)
+		})
+	}
+}
+
+// oauthLogin logs in the user of token, which has to be identity
+// unless that is empty. Rejected tokens are reported to the client.
+func (c *AuthConn) oauthLogin(validator oauth.TokenValidator, identity, token string) error {
+	b, ok := c.Backend.(backend.UserBackend)
+	if !ok {
+		return errNoUserBackend
+	}
+	invalid := &sasl.OAuthError{Status: "invalid_token"}
+	username, err := validator.Validate(token)
+	if err != nil || (identity != "" && identity != username) {
+		return invalid
+	}
+	user, err := b.User(username)
+	if err == backend.ErrInvalidCredentials {
+		return invalid
+	} else if err != nil {
+		return err
+	}
+	c.Login(user)
+	return nil
+}
+
+// CertificateMapper returns the username of a verified TLS client
+// certificate, or an error if it can't be used to log in
+type CertificateMapper func(cert *x509.Certificate) (string, error)
+
+// CommonName is a CertificateMapper which returns the common name of
+// the subject of the certificate
+func CommonName(cert *x509.Certificate) (string, error) {
+	if cert.Subject.CommonName == "" {
+		return "", backend.ErrInvalidCredentials
+	}
+	return cert.Subject.CommonName, nil
+}
+
+// EmailAddress is a CertificateMapper which returns the first email
+// address of the subject alternative names of the certificate
+func EmailAddress(cert *x509.Certificate) (string, error) {
+	if len(cert.EmailAddresses) == 0 {
+		return "", backend.ErrInvalidCredentials
+	}
+	return cert.EmailAddresses[0], nil
+}
+
+// External returns EXTERNAL (RFC 4422 appendix A), which logs in the
+// user mapper returns for the verified client certificate of the TLS
+// connection. When the client sends an authorization identity,
+// authorize tells whether that user may act as identity, users can't
+// act as others if it is nil. The TLSConfig of the Server has to
+// verify client certificates, see tls.Config.ClientAuth, and the
+// Backend has to be a backend.UserBackend.
+func External(mapper CertificateMapper, authorize func(identity, username string) bool) Mechanism {
+	return func(c *AuthConn) sasl.Server {
+		return sasl.NewExternalServer(func(identity string) error {
+			b, ok := c.Backend.(backend.UserBackend)
+			if !ok {
+				return errNoUserBackend
+			}
+			cert := clientCertificate(c.TLS)
+			if cert == nil {
+				return backend.ErrInvalidCredentials
+			}
+			username, err := mapper(cert)
+			if err != nil {
+				return backend.ErrInvalidCredentials
+			}
+			if identity != "" && identity != username {
+				if authorize == nil || !authorize(identity, username) {
+					return backend.ErrInvalidCredentials
+				}
+				username = identity
+			}
+			user, err := b.User(username)
+			if err != nil {
+				return err
+			}
+			c.Login(user)
+			return nil
+		})
+	}
+}
+
+// clientCertificate returns the verified certificate of the client of
+// a TLS connection, or nil
+func clientCertificate(state *tls.ConnectionState) *x509.Certificate {
+	if state == nil || len(state.VerifiedChains) == 0 || len(state.VerifiedChains[0]) == 0 {
+		return nil
+	}
+	return state.VerifiedChains[0][0]
+}
+
+// isChannelBindingMechanism reports whether name is a -PLUS variant,
+// which can only be used on TLS connections
+func isChannelBindingMechanism(name string) bool {
+	return strings.HasSuffix(name, "-PLUS")
+}
+
+// channelBindings returns the channel binding data of a TLS connection
+// which sent the certificate served, by type. Without it, there is no
+// tls-server-end-point.
+func channelBindings(served *x509.Certificate, state *tls.ConnectionState) map[string][]byte {
+	bindings := map[string][]byte{}
+	// RFC 9266, the keying material isn't unique for TLS 1.2 connections
+	// without extended master secret, Go refuses to export it then
+	if data, err := state.ExportKeyingMaterial("EXPORTER-Channel-Binding", nil, 32); err == nil {
+		bindings["tls-exporter"] = data
+	}
+	// RFC 5929, the hash of the certificate of the server with the hash
+	// function of its signature, where MD5 and SHA-1 are replaced by
+	// SHA-256. Other signatures, like Ed25519, have no binding.
+	if served != nil {
+		var sum []byte
+		switch served.SignatureAlgorithm {
+		case x509.MD5WithRSA, x509.SHA1WithRSA, x509.DSAWithSHA1, x509.ECDSAWithSHA1,
+			x509.SHA256WithRSA, x509.DSAWithSHA256, x509.ECDSAWithSHA256, x509.SHA256WithRSAPSS:
+			hash := sha256.Sum256(served.Raw)
+			sum = hash[:]
+		case x509.SHA384WithRSA, x509.ECDSAWithSHA384, x509.SHA384WithRSAPSS:
+			hash := sha512.Sum384(served.Raw)
+			sum = hash[:]
+		case x509.SHA512WithRSA, x509.ECDSAWithSHA512, x509.SHA512WithRSAPSS:
+			hash := sha512.Sum512(served.Raw)
+			sum = hash[:]
+		}
+		if sum != nil {
+			bindings["tls-server-end-point"] = sum
+		}
+	}
+	return bindings
+}
+
+// selectCertificate returns the certificate for the handshake of hello,
+// like crypto/tls picks it: from getCertificate if there are no
+// certificates or the client sent a server name and getCertificate
+// has one, or else the first of certificates which the client supports
+func selectCertificate(getCertificate func(*tls.ClientHelloInfo) (*tls.Certificate, error), certificates []tls.Certificate, hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	if getCertificate != nil && (len(certificates) == 0 || hello.ServerName != "") {
+		if cert, err := getCertificate(hello); err != nil || cert != nil {
+			return cert, err
+		}
+	}
+	if len(certificates) == 0 {
+		return nil, errNoCertificates
+	}
+	for i := range certificates {
+		if len(certificates) == 1 || hello.SupportsCertificate(&certificates[i]) == nil {
+			return &certificates[i], nil
+		}
+	}
+	return &certificates[0], nil
+}
+
+var errNoCertificates = errors.New("Server: no TLS certificate configured")
+
+// leaf returns the parsed leaf of cert, or nil
+func leaf(cert *tls.Certificate) *x509.Certificate {
+	if cert.Leaf != nil || len(cert.Certificate) == 0 {
+		return cert.Leaf
+	}
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return nil
+	}
+	return leaf
+}
+
+// loginWhenDone calls login once the exchange of a mechanism which
+// checks credentials itself completed
+type loginWhenDone struct {
+	sasl.Server
+	login func() error
+}
+
+func (s loginWhenDone) Next(response []byte) ([]byte, bool, error) {
+	challenge, done, err := s.Server.Next(response)
+	if err == nil && done {
+		if err := s.login(); err != nil {
+			return nil, false, err
+		}
+	}
+	return challenge, done, err
+}
+
+func hostname() string {
+	hostname, err := os.Hostname()
+	if err != nil {
+		return "localhost"
+	}
+	return hostname
+}
+
+// tlsState returns the state of the TLS connection,
+// nil if the connection isn't secured
+func (c *conn) tlsState() *tls.ConnectionState {
+	tlsConn, secure := c.c.(*tls.Conn)
+	if !secure {
+		return nil
+	}
+	state := tlsConn.ConnectionState()
+	return &state
+}
+
+// mechanisms returns the names of the mechanisms which can be used
+// on the connection, sorted
+func (c *conn) mechanisms() []string {
+	names := []string{}
+	for name := range c.server.Mechanisms {
+		if plaintextMechanisms[name] && c.loginDisabled() {
+			continue
+		}
+		if isChannelBindingMechanism(name) && !c.secure {
+			continue
+		}
+		if name == "EXTERNAL" && clientCertificate(c.tlsState()) == nil {
+			continue
+		}
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// authenticate runs the exchange of AUTHENTICATE: challenges are sent
+// in continuation requests, each response of the client is a line of
+// base64, or "*" to cancel. The initial response of the command, if
+// any, is the first response (SASL-IR).
+func (c *conn) authenticate(cmd parser.AuthenticateCmd) parser.StatusResponse {
+	name := strings.ToUpper(cmd.Mechanism)
+	mechanism := c.server.Mechanisms[name]
+	if mechanism == nil {
+		return no("Unsupported authentication mechanism")
+	}
+	if plaintextMechanisms[name] && c.loginDisabled() {
+		return no(name + " is disabled, use STARTTLS first")
+	}
+	if isChannelBindingMechanism(name) && !c.secure {
+		return no(name + " needs TLS")
+	}
+
+	authConn := &AuthConn{Backend: c.server.Backend, TLS: c.tlsState()}
+	if authConn.TLS != nil {
+		authConn.ChannelBindings = channelBindings(c.served, authConn.TLS)
+	}
+	s := mechanism(authConn)
+
+	response := cmd.InitialResponse
+	for {
+		challenge, done, err := s.Next(response)
+		if err != nil {
+			return c.authenticationFailed(err)
+		}
+		if done && len(challenge) == 0 {
+			break
+		}
+		if err := c.writer.WriteContinuation(base64.StdEncoding.EncodeToString(challenge)); err != nil {
+			return no("Authentication failed")
+		}
+		line, err := c.reader.ReadLine()
+		if err != nil {
+			return no("Authentication failed")
+		}
+		if line == "*" {
+			return bad("AUTHENTICATE cancelled")
+		}
+		if response, err = base64.StdEncoding.DecodeString(line); err != nil {
+			return bad("Invalid base64 in response")
+		}
+		if done {
+			// the response to the additional data of the mechanism
+			if len(response) > 0 {
+				return bad("Unexpected response")
+			}
+			break
+		}
+	}
+
+	if authConn.user == nil {
+		return no("Authentication failed")
+	}
+	c.user = authConn.user
+	return ok("AUTHENTICATE completed")
+}
+
+// authenticationFailed returns the response for an error of a mechanism
+func (c *conn) authenticationFailed(err error) parser.StatusResponse {
+	switch err {
+	case sasl.ErrInvalidResponse, sasl.ErrUnexpectedResponse:
+		return bad("Invalid response")
+	case sasl.ErrInvalidCredentials:
+		return no("Invalid credentials")
+	case sasl.ErrChannelBinding:
+		return no("Channel binding doesn't match")
+	}
+	return c.no(err)
+}
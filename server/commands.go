@@ -0,0 +1,452 @@
+package server
+
+import (
+	"github.com/gopistolet/imap/backend"
+	"github.com/gopistolet/imap/parser"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// handle executes a command which is valid in the current state,
+// and returns the tagged response to complete it with
+func (c *conn) handle(command parser.Command) (response parser.StatusResponse) {
+	switch cmd := command.Cmd.(type) {
+
+	// Client Commands - Any State
+	case parser.CapabilityCmd:
+		response = c.capability()
+	case parser.NoopCmd:
+		response = ok("NOOP completed")
+	case parser.LogoutCmd:
+		response = c.logout()
+
+	// Client Commands - Not Authenticated State
+	case parser.StarttlsCmd:
+		response = c.starttls()
+	case parser.AuthenticateCmd:
+		response = c.authenticate(cmd)
+	case parser.LoginCmd:
+		response = c.login(cmd)
+
+	// Client Commands - Authenticated State
+	case parser.SelectCmd:
+		response = c.selectMailbox(cmd.Mailbox, false)
+	case parser.ExamineCmd:
+		response = c.selectMailbox(cmd.Mailbox, true)
+	case parser.CreateCmd:
+		response = c.create(cmd)
+	case parser.DeleteCmd:
+		response = c.delete(cmd)
+	case parser.RenameCmd:
+		response = c.rename(cmd)
+	case parser.SubscribeCmd:
+		response = c.subscribe(cmd.Mailbox, true)
+	case parser.UnsubscribeCmd:
+		response = c.subscribe(cmd.Mailbox, false)
+	case parser.ListCmd:
+		response = c.list(cmd.Reference, cmd.Mailbox, false)
+	case parser.LsubCmd:
+		response = c.list(cmd.Reference, cmd.Mailbox, true)
+	case parser.StatusCmd:
+		response = c.status(cmd)
+	case parser.AppendCmd:
+		response = c.append(cmd)
+	case parser.IdleCmd:
+		response = c.idle()
+
+	// Client Commands - Selected State
+	case parser.CheckCmd:
+		response = ok("CHECK completed")
+	case parser.CloseCmd:
+		response = c.closeMailbox()
+	case parser.ExpungeCmd:
+		response = c.expunge()
+	case parser.SearchCmd:
+		response = c.search(cmd)
+	case parser.FetchCmd:
+		response = c.fetch(cmd)
+	case parser.StoreCmd:
+		response = c.store(cmd)
+	case parser.CopyCmd:
+		response = c.copy(cmd)
+	}
+
+	if c.mailbox != nil {
+		c.update(updateMode(command.Cmd))
+	}
+	response.Tag = command.Tag
+	return
+}
+
+// updateMode returns how the client is told about the changes of the
+// selected mailbox after cmd: NOOP and CHECK are how clients poll for
+// them. EXPUNGE responses aren't allowed after FETCH, STORE and SEARCH
+// (RFC 3501 section 7.4.1), the UID variants excepted.
+func updateMode(cmd parser.Cmd) (poll, expunge bool) {
+	switch cmd := cmd.(type) {
+	case parser.NoopCmd, parser.CheckCmd, parser.IdleCmd, parser.ExpungeCmd:
+		return true, true
+	case parser.FetchCmd:
+		return false, cmd.Uid
+	case parser.StoreCmd:
+		return false, cmd.Uid
+	case parser.SearchCmd:
+		return false, cmd.Uid
+	}
+	return false, true
+}
+
+// capabilities returns the capabilities of the server,
+// which depend on the state of the connection
+func (c *conn) capabilities() []string {
+	capabilities := []string{"IMAP4rev1", "IDLE"}
+	if c.session.State == NotAuthenticatedState {
+		if c.server.TLSConfig != nil && !c.secure {
+			capabilities = append(capabilities, "STARTTLS")
+		}
+		capabilities = append(capabilities, "SASL-IR")
+		for _, name := range c.mechanisms() {
+			capabilities = append(capabilities, "AUTH="+name)
+		}
+		if c.loginDisabled() {
+			capabilities = append(capabilities, "LOGINDISABLED")
+		}
+	}
+	return capabilities
+}
+
+// loginDisabled reports whether LOGIN has to wait for STARTTLS,
+// so the password isn't sent in plaintext
+func (c *conn) loginDisabled() bool {
+	return c.server.TLSConfig != nil && !c.secure && !c.server.AllowInsecureAuth
+}
+
+func (c *conn) capability() parser.StatusResponse {
+	c.writer.WriteCapability(c.capabilities())
+	return ok("CAPABILITY completed")
+}
+
+func (c *conn) logout() parser.StatusResponse {
+	c.writer.WriteStatus(parser.StatusResponse{Type: parser.BYE, Info: "IMAP4rev1 Server logging out"})
+	return ok("LOGOUT completed")
+}
+
+// starttls only answers the command, the handshake follows
+// once the response has been sent
+func (c *conn) starttls() parser.StatusResponse {
+	if c.server.TLSConfig == nil {
+		return bad("STARTTLS not supported")
+	}
+	if c.secure {
+		return bad("TLS already active")
+	}
+	return ok("Begin TLS negotiation now")
+}
+
+func (c *conn) login(cmd parser.LoginCmd) parser.StatusResponse {
+	if c.loginDisabled() {
+		return no("LOGIN is disabled, use STARTTLS first")
+	}
+	user, err := c.server.Backend.Login(cmd.Username, cmd.Password)
+	if err != nil {
+		return c.no(err)
+	}
+	c.user = user
+	return ok("LOGIN completed")
+}
+
+func (c *conn) selectMailbox(name string, readOnly bool) parser.StatusResponse {
+	command := "SELECT"
+	if readOnly {
+		command = "EXAMINE"
+	}
+
+	// a failed SELECT closes the mailbox which was selected before
+	c.unselect()
+	mailbox, err := c.user.GetMailbox(name)
+	if err != nil {
+		return c.no(err)
+	}
+	if err := mailbox.Select(readOnly); err != nil {
+		return c.no(err)
+	}
+	status, err := mailbox.Status()
+	if err != nil {
+		return c.no(err)
+	}
+	if err := c.open(mailbox); err != nil {
+		return c.no(err)
+	}
+
+	c.writer.WriteExists(uint32(len(c.view)))
+	c.writer.WriteRecent(status.Recent)
+	if status.FirstUnseen > 0 {
+		c.writer.WriteStatus(parser.StatusResponse{Type: parser.OK, Code: parser.CodeUnseen,
+			CodeArguments: []interface{}{status.FirstUnseen}, Info: "Message " + strconv.FormatUint(uint64(status.FirstUnseen), 10) + " is first unseen"})
+	}
+	c.writer.WriteStatus(parser.StatusResponse{Type: parser.OK, Code: parser.CodeUidValidity,
+		CodeArguments: []interface{}{status.UidValidity}, Info: "UIDs valid"})
+	c.writer.WriteStatus(parser.StatusResponse{Type: parser.OK, Code: parser.CodeUidNext,
+		CodeArguments: []interface{}{status.UidNext}, Info: "Predicted next UID"})
+	c.writer.WriteFlags(status.Flags)
+	permanentFlags := status.PermanentFlags
+	if readOnly {
+		permanentFlags = []string{}
+	}
+	c.writer.WriteStatus(parser.StatusResponse{Type: parser.OK, Code: parser.CodePermanentFlags,
+		CodeArguments: []interface{}{parser.FlagList(permanentFlags)}, Info: "Limited"})
+
+	response := ok(command + " completed")
+	response.Code = parser.CodeReadWrite
+	if readOnly {
+		response.Code = parser.CodeReadOnly
+	}
+	return response
+}
+
+func (c *conn) create(cmd parser.CreateCmd) parser.StatusResponse {
+	name := strings.TrimSuffix(cmd.Mailbox, backend.Delimiter)
+	if name == "INBOX" || name == "" {
+		return no("Can't create INBOX")
+	}
+	if err := c.user.CreateMailbox(name); err != nil {
+		return c.no(err)
+	}
+	return ok("CREATE completed")
+}
+
+func (c *conn) delete(cmd parser.DeleteCmd) parser.StatusResponse {
+	if cmd.Mailbox == "INBOX" {
+		return no("Can't delete INBOX")
+	}
+	if err := c.user.DeleteMailbox(cmd.Mailbox); err != nil {
+		return c.no(err)
+	}
+	return ok("DELETE completed")
+}
+
+func (c *conn) rename(cmd parser.RenameCmd) parser.StatusResponse {
+	if cmd.DestinationMailbox == "INBOX" {
+		return no("Can't rename to INBOX")
+	}
+	if err := c.user.RenameMailbox(cmd.SourceMailbox, cmd.DestinationMailbox); err != nil {
+		return c.no(err)
+	}
+	return ok("RENAME completed")
+}
+
+func (c *conn) subscribe(name string, subscribed bool) parser.StatusResponse {
+	command := "SUBSCRIBE"
+	if !subscribed {
+		command = "UNSUBSCRIBE"
+	}
+	if err := c.user.SetSubscribed(name, subscribed); err != nil {
+		return c.no(err)
+	}
+	return ok(command + " completed")
+}
+
+func (c *conn) list(reference, pattern string, subscribed bool) parser.StatusResponse {
+	command := "LIST"
+	if subscribed {
+		command = "LSUB"
+	}
+
+	if pattern == "" {
+		// the hierarchy delimiter and root name of the reference
+		root := ""
+		if i := strings.Index(reference, backend.Delimiter); i >= 0 {
+			root = reference[:i+1]
+		}
+		c.writer.WriteData(parser.Atom(command), parser.FlagList([]string{`\Noselect`}), backend.Delimiter, root)
+		return ok(command + " completed")
+	}
+
+	mailboxes, err := c.user.ListMailboxes(subscribed)
+	if err != nil {
+		return c.no(err)
+	}
+	for _, mailbox := range mailboxes {
+		if matchMailbox(mailbox.Name, reference+pattern) {
+			c.writer.WriteData(parser.Atom(command), parser.FlagList(mailbox.Attributes), backend.Delimiter, mailbox.Name)
+		}
+	}
+	return ok(command + " completed")
+}
+
+func (c *conn) status(cmd parser.StatusCmd) parser.StatusResponse {
+	mailbox, err := c.user.GetMailbox(cmd.Mailbox)
+	if err != nil {
+		return c.no(err)
+	}
+	status, err := mailbox.Status()
+	if err != nil {
+		return c.no(err)
+	}
+
+	items := []interface{}{}
+	for _, attribute := range cmd.StatusAttributes {
+		var value uint32
+		switch attribute {
+		case "MESSAGES":
+			value = status.Messages
+		case "RECENT":
+			value = status.Recent
+		case "UIDNEXT":
+			value = status.UidNext
+		case "UIDVALIDITY":
+			value = status.UidValidity
+		case "UNSEEN":
+			value = status.Unseen
+		}
+		items = append(items, parser.Atom(attribute), value)
+	}
+	c.writer.WriteData(parser.Atom("STATUS"), cmd.Mailbox, items)
+	return ok("STATUS completed")
+}
+
+func (c *conn) append(cmd parser.AppendCmd) parser.StatusResponse {
+	mailbox, err := c.user.GetMailbox(cmd.Mailbox)
+	if err != nil {
+		return tryCreate(c.no(err), err)
+	}
+	date := cmd.DateTime
+	if date.IsZero() {
+		date = time.Now()
+	}
+	if err := mailbox.Append(cmd.Flags, date, cmd.Literal); err != nil {
+		return c.no(err)
+	}
+	return ok("APPEND completed")
+}
+
+func (c *conn) closeMailbox() parser.StatusResponse {
+	if !c.session.ReadOnly {
+		if _, err := c.mailbox.Expunge(); err != nil {
+			return c.no(err)
+		}
+	}
+	c.unselect()
+	return ok("CLOSE completed")
+}
+
+// expunge leaves the EXPUNGE responses to update, which also reports
+// the messages which others removed
+func (c *conn) expunge() parser.StatusResponse {
+	if _, err := c.mailbox.Expunge(); err != nil {
+		return c.no(err)
+	}
+	return ok("EXPUNGE completed")
+}
+
+func (c *conn) search(cmd parser.SearchCmd) parser.StatusResponse {
+	switch strings.ToUpper(cmd.Charset) {
+	case "", "US-ASCII", "UTF-8":
+	default:
+		response := no("Unsupported charset")
+		response.Code = parser.CodeBadCharset
+		response.CodeArguments = []interface{}{[]interface{}{parser.Atom("US-ASCII"), parser.Atom("UTF-8")}}
+		return response
+	}
+
+	keys, err := c.uidKeys(cmd.Keys)
+	if err != nil {
+		return bad("Invalid sequence number")
+	}
+	results, err := c.mailbox.Search(true, keys)
+	if err != nil {
+		return c.no(err)
+	}
+	fields := []interface{}{parser.Atom("SEARCH")}
+	for _, uid := range results {
+		if !cmd.Uid {
+			if uid = c.seqNum(uid); uid == 0 {
+				continue
+			}
+		}
+		fields = append(fields, uid)
+	}
+	c.writer.WriteData(fields...)
+	return ok(uidPrefix(cmd.Uid) + "SEARCH completed")
+}
+
+func (c *conn) store(cmd parser.StoreCmd) parser.StatusResponse {
+	uids, err := c.uids(cmd.Uid, cmd.Sequence)
+	if err != nil {
+		return bad("Invalid sequence number")
+	}
+	messages, err := c.mailbox.Store(true, uids, cmd.Mode, cmd.Flags)
+	if err != nil {
+		return c.no(err)
+	}
+	messages = c.renumber(messages)
+	c.told(messages)
+	if !cmd.Silent {
+		for _, message := range messages {
+			items := []interface{}{parser.Atom("FLAGS"), parser.FlagList(message.Flags)}
+			if cmd.Uid {
+				items = append(items, parser.Atom("UID"), message.Uid)
+			}
+			c.writer.WriteFetch(message.SeqNum, items)
+		}
+	}
+	return ok(uidPrefix(cmd.Uid) + "STORE completed")
+}
+
+func (c *conn) copy(cmd parser.CopyCmd) parser.StatusResponse {
+	uids, err := c.uids(cmd.Uid, cmd.Sequence)
+	if err != nil {
+		return bad("Invalid sequence number")
+	}
+	if err := c.mailbox.Copy(true, uids, cmd.Mailbox); err != nil {
+		return tryCreate(c.no(err), err)
+	}
+	return ok(uidPrefix(cmd.Uid) + "COPY completed")
+}
+
+// no returns the NO response for an error of the backend
+func (c *conn) no(err error) parser.StatusResponse {
+	switch err {
+	case backend.ErrInvalidCredentials:
+		return no("Invalid credentials")
+	case backend.ErrNoSuchMailbox:
+		return no("No such mailbox")
+	case backend.ErrMailboxAlreadyExists:
+		return no("Mailbox already exists")
+	case backend.ErrInvalidMailboxName:
+		return no("Invalid mailbox name")
+	case backend.ErrHasChildren:
+		return no("Mailbox has children")
+	}
+	c.server.logf("imap: %v", err)
+	return no("Server error")
+}
+
+// tryCreate adds the TRYCREATE code to the response of an APPEND
+// or COPY to a mailbox which doesn't exist
+func tryCreate(response parser.StatusResponse, err error) parser.StatusResponse {
+	if err == backend.ErrNoSuchMailbox {
+		response.Code = parser.CodeTryCreate
+	}
+	return response
+}
+
+func ok(info string) parser.StatusResponse {
+	return parser.StatusResponse{Type: parser.OK, Info: info}
+}
+
+func no(info string) parser.StatusResponse {
+	return parser.StatusResponse{Type: parser.NO, Info: info}
+}
+
+func bad(info string) parser.StatusResponse {
+	return parser.StatusResponse{Type: parser.BAD, Info: info}
+}
+
+func uidPrefix(uid bool) string {
+	if uid {
+		return "UID "
+	}
+	return ""
+}
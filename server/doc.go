@@ -0,0 +1,30 @@
+/*
+Package server implements the server side of IMAP4rev1 (RFC 3501).
+
+A Session tracks the state of a connection: Check refuses commands
+which aren't valid in the current state, Transition moves to the next
+state once a command has completed.
+
+A Server serves IMAP connections from a backend.Backend, which provides
+the users, their mailboxes and messages:
+
+	s := server.NewServer(b)
+	err := s.Serve(listener)
+
+With a TLSConfig, clients can secure their connection with STARTTLS,
+and LOGIN is refused until they did. AUTHENTICATE runs the SASL
+mechanisms of the Server, see package sasl. Backends which store
+salted credentials get SCRAM, with channel binding to the TLS connection
+in the -PLUS variants. OAuthBearer and XOAuth2 add mechanisms for
+OAuth tokens, see package oauth, and External one for TLS client
+certificates. ServeTLS serves connections which
+start with the TLS handshake, like on port 993.
+
+Sessions are told about the changes which others make to their selected
+mailbox: after every command when the mailbox publishes them on a
+backend.Bus, see backend.WatchedMailbox, and otherwise when the client
+polls with NOOP or CHECK. IDLE reports them while the client waits.
+Messages keep the sequence numbers the client knows until it has been
+sent their EXPUNGE, which doesn't happen after FETCH, STORE or SEARCH.
+*/
+package server
@@ -0,0 +1,160 @@
+package server
+
+import (
+	"github.com/gopistolet/imap/backend"
+	"github.com/gopistolet/imap/parser"
+	"strconv"
+)
+
+func (c *conn) fetch(cmd parser.FetchCmd) parser.StatusResponse {
+	attributes := cmd.Attributes
+	if cmd.Uid && !hasAttribute(attributes, "UID") {
+		// UID FETCH always returns the UID
+		attributes = append([]parser.FetchAttribute{{Name: "UID"}}, attributes...)
+	}
+
+	body, seen := false, false
+	for _, attribute := range attributes {
+		switch attribute.Name {
+		case "UID", "FLAGS", "INTERNALDATE", "RFC822.SIZE":
+		default:
+			body = true
+		}
+		if attribute.Name == "RFC822" || attribute.Name == "RFC822.TEXT" ||
+			(attribute.Name == "BODY" && attribute.Section != nil && !attribute.Peek) {
+			seen = true
+		}
+	}
+
+	uids, err := c.uids(cmd.Uid, cmd.Sequence)
+	if err != nil {
+		return bad("Invalid sequence number")
+	}
+	messages, err := c.mailbox.Fetch(true, uids, body)
+	if err != nil {
+		return c.no(err)
+	}
+	messages = c.renumber(messages)
+
+	if seen && !c.session.ReadOnly {
+		// fetching the text sets \Seen, the client is told about the new flags
+		changed := false
+		messages, changed, err = c.setSeen(messages)
+		if err != nil {
+			return c.no(err)
+		}
+		if changed && !hasAttribute(attributes, "FLAGS") {
+			attributes = append(attributes, parser.FetchAttribute{Name: "FLAGS"})
+		}
+	}
+
+	for _, message := range messages {
+		c.writer.WriteFetch(message.SeqNum, fetchItems(&message, attributes))
+	}
+	if hasAttribute(attributes, "FLAGS") {
+		c.told(messages)
+	}
+	return ok(uidPrefix(cmd.Uid) + "FETCH completed")
+}
+
+// setSeen sets the \Seen flag of messages which don't have it yet,
+// and returns the messages with their new flags and whether any changed
+func (c *conn) setSeen(messages []backend.Message) ([]backend.Message, bool, error) {
+	unseen := parser.SequenceSet{}
+	for _, message := range messages {
+		if !message.HasFlag(`\Seen`) {
+			unseen = append(unseen, parser.SeqRange{Start: message.Uid, Stop: message.Uid})
+		}
+	}
+	if len(unseen) == 0 {
+		return messages, false, nil
+	}
+
+	changed, err := c.mailbox.Store(true, unseen, "+", []string{`\Seen`})
+	if err != nil {
+		return nil, false, err
+	}
+	flags := map[uint32][]string{}
+	for _, message := range changed {
+		flags[message.Uid] = message.Flags
+	}
+	for i := range messages {
+		if f, ok := flags[messages[i].Uid]; ok {
+			messages[i].Flags = f
+		}
+	}
+	return messages, true, nil
+}
+
+// fetchItems returns the data items of a FETCH response,
+// as pairs of name and value
+func fetchItems(message *backend.Message, attributes []parser.FetchAttribute) []interface{} {
+	var structure *part
+	parsed := func() *part {
+		if structure == nil {
+			structure = parseMessage(message.Body)
+		}
+		return structure
+	}
+
+	items := []interface{}{}
+	for _, attribute := range attributes {
+		name := parser.Atom(attribute.Name)
+		var value interface{}
+		switch attribute.Name {
+		case "UID":
+			value = message.Uid
+		case "FLAGS":
+			value = parser.FlagList(message.Flags)
+		case "INTERNALDATE":
+			value = message.InternalDate
+		case "RFC822.SIZE":
+			value = message.Size
+		case "ENVELOPE":
+			value = parsed().envelope()
+		case "BODYSTRUCTURE":
+			value = parsed().bodyStructure(true)
+		case "RFC822":
+			value = parser.Literal(message.Body)
+		case "RFC822.HEADER":
+			value = parser.Literal(parsed().header)
+		case "RFC822.TEXT":
+			value = parser.Literal(parsed().body)
+		case "BODY":
+			if attribute.Section == nil {
+				value = parsed().bodyStructure(false)
+				break
+			}
+			name = parser.Atom("BODY[" + attribute.Section.String() + "]")
+			content := parsed().section(attribute.Section)
+			if attribute.Partial != nil {
+				name += parser.Atom("<" + strconv.FormatUint(uint64(attribute.Partial.Offset), 10) + ">")
+				content = partial(content, attribute.Partial)
+			}
+			value = parser.Literal(content)
+		}
+		items = append(items, name, value)
+	}
+	return items
+}
+
+// partial returns the octets of content requested by a partial
+func partial(content []byte, p *parser.Partial) []byte {
+	if uint64(p.Offset) >= uint64(len(content)) {
+		return []byte{}
+	}
+	content = content[p.Offset:]
+	if uint64(p.Count) < uint64(len(content)) {
+		content = content[:p.Count]
+	}
+	return content
+}
+
+func hasAttribute(attributes []parser.FetchAttribute, name string) bool {
+	for _, attribute := range attributes {
+		if attribute.Name == name {
+			return true
+		}
+	}
+	return false
+}
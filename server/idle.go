@@ -0,0 +1,55 @@
+package server
+
+import (
+	"errors"
+	"github.com/gopistolet/imap/parser"
+	"strings"
+	"time"
+)
+
+// idlePoll is how often IDLE checks the selected mailbox for changes
+// which it doesn't publish
+var idlePoll = time.Minute
+
+var errNotDone = errors.New("Server: IDLE not ended with DONE")
+
+// idle reports the changes of the selected mailbox as they happen,
+// until the client sends DONE (RFC 2177)
+func (c *conn) idle() parser.StatusResponse {
+	if c.mailbox != nil {
+		c.update(true, true)
+	}
+	if err := c.writer.WriteContinuation("idling"); err != nil {
+		return bad("IDLE failed")
+	}
+	done := make(chan error, 1)
+	go func() {
+		line, err := c.reader.ReadLine()
+		if err == nil && !strings.EqualFold(line, "DONE") {
+			err = errNotDone
+		}
+		done <- err
+	}()
+
+	var published <-chan struct{}
+	if c.updates != nil {
+		published = c.updates.Ready()
+	}
+	poll := time.NewTicker(idlePoll)
+	defer poll.Stop()
+	for {
+		select {
+		case err := <-done:
+			if err != nil {
+				return bad("Expected DONE")
+			}
+			return ok("IDLE terminated")
+		case <-published:
+			c.update(false, true)
+		case <-poll.C:
+			if c.mailbox != nil {
+				c.update(true, true)
+			}
+		}
+	}
+}
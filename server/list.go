@@ -0,0 +1,42 @@
+package server
+
+import (
+	"github.com/gopistolet/imap/backend"
+	"strings"
+)
+
+// matchMailbox reports whether a mailbox name matches a LIST pattern:
+// "*" matches zero or more characters, "%" does too but not
+// the hierarchy delimiter. INBOX matches case-insensitively.
+func matchMailbox(name, pattern string) bool {
+	if name == "INBOX" && len(pattern) >= 5 && strings.EqualFold(pattern[:5], "INBOX") {
+		pattern = "INBOX" + pattern[5:]
+	}
+	return match(name, pattern)
+}
+
+// match reports whether name matches pattern. It fills in, from the
+// end of pattern, which suffixes of name match each suffix of pattern,
+// so every wildcard costs a single pass over name.
+func match(name, pattern string) bool {
+	// next[i] reports whether name[i:] matches the rest of the pattern
+	next := make([]bool, len(name)+1)
+	next[len(name)] = true
+	current := make([]bool, len(name)+1)
+	for j := len(pattern) - 1; j >= 0; j-- {
+		switch c := pattern[j]; c {
+		case '*', '%':
+			current[len(name)] = next[len(name)]
+			for i := len(name) - 1; i >= 0; i-- {
+				current[i] = next[i] || (current[i+1] && (c == '*' || !strings.HasPrefix(name[i:], backend.Delimiter)))
+			}
+		default:
+			current[len(name)] = false
+			for i := len(name) - 1; i >= 0; i-- {
+				current[i] = name[i] == c && next[i+1]
+			}
+		}
+		next, current = current, next
+	}
+	return next[0]
+}
@@ -0,0 +1,391 @@
+package server
+
+import (
+	"bytes"
+	"github.com/gopistolet/imap/parser"
+	"mime"
+	"net/mail"
+	"sort"
+	"strings"
+)
+
+// part is a MIME entity: a message, a body part of a multipart,
+// or the message encapsulated in a message/rfc822 part
+type part struct {
+	raw    []byte  // header and body
+	header []byte  // header, including the empty line which ends it
+	body   []byte  // everything after the header
+	fields []field // fields of the header
+
+	mediaType string            // upper case, like "TEXT"
+	subtype   string            // upper case, like "PLAIN"
+	params    map[string]string // Content-Type parameters, with lower case names
+
+	parts   []*part // body parts of a multipart
+	message *part   // encapsulated message of a message/rfc822 part
+}
+
+// field is a header field
+type field struct {
+	name  string
+	raw   string // the field as it is in the header, with CRLFs
+	value string // the unfolded value
+}
+
+// maxPartDepth limits the nesting of multiparts and encapsulated
+// messages, which are parsed recursively
+const maxPartDepth = 32
+
+// parseMessage parses a message into its MIME structure
+func parseMessage(raw []byte) *part {
+	return parsePart(raw, "text/plain", 0)
+}
+
+// parsePart parses a MIME entity at depth, defaultType is its content
+// type when the header has no (valid) Content-Type field. Past
+// maxPartDepth, multiparts and messages are opaque leaf parts.
+func parsePart(raw []byte, defaultType string, depth int) *part {
+	p := &part{raw: raw}
+	p.header, p.body = splitHeader(raw)
+	p.fields = parseFields(p.header)
+
+	mediaType, params, err := mime.ParseMediaType(p.get("Content-Type"))
+	if err != nil || !strings.Contains(mediaType, "/") {
+		mediaType, params = defaultType, map[string]string{}
+	}
+	if mediaType == "text/plain" && params["charset"] == "" {
+		params["charset"] = "us-ascii"
+	}
+	slash := strings.Index(mediaType, "/")
+	p.mediaType = strings.ToUpper(mediaType[:slash])
+	p.subtype = strings.ToUpper(mediaType[slash+1:])
+	p.params = params
+
+	nested := p.mediaType == "MULTIPART" || (p.mediaType == "MESSAGE" && p.subtype == "RFC822")
+	if nested && depth >= maxPartDepth {
+		p.mediaType, p.subtype, p.params = "APPLICATION", "OCTET-STREAM", map[string]string{}
+		return p
+	}
+
+	switch {
+	case p.mediaType == "MULTIPART" && params["boundary"] != "":
+		childType := "text/plain"
+		if p.subtype == "DIGEST" {
+			childType = "message/rfc822"
+		}
+		for _, child := range splitMultipart(p.body, params["boundary"]) {
+			p.parts = append(p.parts, parsePart(child, childType, depth+1))
+		}
+	case p.mediaType == "MESSAGE" && p.subtype == "RFC822":
+		p.message = parsePart(p.body, "text/plain", depth+1)
+	}
+	return p
+}
+
+// splitHeader splits an entity at the empty line which ends the header
+func splitHeader(raw []byte) (header, body []byte) {
+	for i := 0; i < len(raw); {
+		end := bytes.IndexByte(raw[i:], '\n')
+		if end < 0 {
+			break
+		}
+		line := raw[i : i+end+1]
+		i += end + 1
+		if len(bytes.TrimRight(line, "\r\n")) == 0 {
+			return raw[:i], raw[i:]
+		}
+	}
+	return raw, nil
+}
+
+// parseFields returns the fields of a header,
+// lines starting with white space continue the field before them
+func parseFields(header []byte) []field {
+	fields := []field{}
+	for _, line := range strings.SplitAfter(string(header), "\n") {
+		trimmed := strings.TrimRight(line, "\r\n")
+		if trimmed == "" {
+			continue
+		}
+		if (line[0] == ' ' || line[0] == '\t') && len(fields) > 0 {
+			last := &fields[len(fields)-1]
+			last.raw += line
+			last.value += " " + strings.TrimSpace(trimmed)
+			continue
+		}
+		colon := strings.IndexByte(trimmed, ':')
+		if colon < 0 {
+			continue
+		}
+		fields = append(fields, field{
+			name:  strings.TrimSpace(trimmed[:colon]),
+			raw:   line,
+			value: strings.TrimSpace(trimmed[colon+1:]),
+		})
+	}
+	return fields
+}
+
+// splitMultipart returns the body parts of a multipart body
+func splitMultipart(body []byte, boundary string) [][]byte {
+	delimiter := "--" + boundary
+	parts := [][]byte{}
+	start := -1 // start of the current part, -1 before the first delimiter
+	for i := 0; i < len(body); {
+		end := bytes.IndexByte(body[i:], '\n')
+		next := len(body)
+		if end >= 0 {
+			next = i + end + 1
+		}
+		line := strings.TrimRight(string(body[i:next]), " \t\r\n")
+		if line == delimiter || line == delimiter+"--" {
+			if start >= 0 {
+				// the CRLF before the delimiter belongs to the delimiter
+				stop := i
+				if stop > start && body[stop-1] == '\n' {
+					stop--
+					if stop > start && body[stop-1] == '\r' {
+						stop--
+					}
+				}
+				parts = append(parts, body[start:stop])
+			}
+			if line != delimiter {
+				return parts
+			}
+			start = next
+		}
+		i = next
+	}
+	if start >= 0 && start < len(body) {
+		// no close delimiter
+		parts = append(parts, body[start:])
+	}
+	return parts
+}
+
+// get returns the value of the first field with name, or ""
+func (p *part) get(name string) string {
+	for _, f := range p.fields {
+		if strings.EqualFold(f.name, name) {
+			return f.value
+		}
+	}
+	return ""
+}
+
+// child returns body part n, counting from 1
+func (p *part) child(n uint32) *part {
+	if p.message != nil {
+		// the parts of a message/rfc822 are those of the encapsulated message
+		p = p.message
+	}
+	if len(p.parts) > 0 {
+		if n > uint32(len(p.parts)) {
+			return nil
+		}
+		return p.parts[n-1]
+	}
+	if n == 1 {
+		// a message which isn't multipart only has part 1, its body
+		return p
+	}
+	return nil
+}
+
+// section returns the content of a BODY[section], or nil if the
+// message doesn't have the section
+func (p *part) section(section *parser.Section) []byte {
+	target := p
+	for _, n := range section.Part {
+		if target = target.child(n); target == nil {
+			return nil
+		}
+	}
+
+	switch section.Text {
+	case "":
+		if len(section.Part) == 0 {
+			return target.raw
+		}
+		return target.body
+	case "MIME":
+		return target.header
+	}
+
+	// HEADER and TEXT of a part are those of its encapsulated message
+	if len(section.Part) > 0 {
+		if target.message == nil {
+			return nil
+		}
+		target = target.message
+	}
+	switch section.Text {
+	case "HEADER":
+		return target.header
+	case "TEXT":
+		return target.body
+	}
+
+	not := section.Text == "HEADER.FIELDS.NOT"
+	filtered := &bytes.Buffer{}
+	for _, f := range target.fields {
+		listed := false
+		for _, name := range section.Fields {
+			if strings.EqualFold(f.name, name) {
+				listed = true
+			}
+		}
+		if listed != not {
+			filtered.WriteString(f.raw)
+		}
+	}
+	filtered.WriteString("\r\n")
+	return filtered.Bytes()
+}
+
+/*
+envelope        = "(" env-date SP env-subject SP env-from SP
+                  env-sender SP env-reply-to SP env-to SP env-cc SP
+                  env-bcc SP env-in-reply-to SP env-message-id ")"
+*/
+func (p *part) envelope() []interface{} {
+	from := addressList(p.get("From"))
+	sender := addressList(p.get("Sender"))
+	if sender == nil {
+		sender = from
+	}
+	replyTo := addressList(p.get("Reply-To"))
+	if replyTo == nil {
+		replyTo = from
+	}
+	return []interface{}{
+		nstring(p.get("Date")),
+		nstring(p.get("Subject")),
+		from,
+		sender,
+		replyTo,
+		addressList(p.get("To")),
+		addressList(p.get("Cc")),
+		addressList(p.get("Bcc")),
+		nstring(p.get("In-Reply-To")),
+		nstring(p.get("Message-Id")),
+	}
+}
+
+/*
+address         = "(" addr-name SP addr-adl SP addr-mailbox SP
+                  addr-host ")"
+*/
+func addressList(value string) interface{} {
+	if value == "" {
+		return nil
+	}
+	addresses, err := mail.ParseAddressList(value)
+	if err != nil || len(addresses) == 0 {
+		return nil
+	}
+	list := []interface{}{}
+	for _, address := range addresses {
+		mailbox, host := address.Address, ""
+		if at := strings.LastIndex(address.Address, "@"); at >= 0 {
+			mailbox, host = address.Address[:at], address.Address[at+1:]
+		}
+		list = append(list, []interface{}{nstring(address.Name), nil, mailbox, host})
+	}
+	return list
+}
+
+/*
+body            = "(" (body-type-1part / body-type-mpart) ")"
+body-type-1part = (body-type-basic / body-type-msg / body-type-text)
+                  [SP body-ext-1part]
+body-type-mpart = 1*body SP media-subtype
+                  [SP body-ext-mpart]
+
+The extension data is only returned for BODYSTRUCTURE.
+*/
+func (p *part) bodyStructure(extended bool) []interface{} {
+	if len(p.parts) > 0 {
+		structure := []interface{}{}
+		for _, child := range p.parts {
+			structure = append(structure, child.bodyStructure(extended))
+		}
+		structure = append(structure, p.subtype)
+		if extended {
+			structure = append(structure, paramList(p.params), p.disposition(), nil)
+		}
+		return structure
+	}
+
+	encoding := strings.ToUpper(p.get("Content-Transfer-Encoding"))
+	if encoding == "" {
+		encoding = "7BIT"
+	}
+	structure := []interface{}{
+		p.mediaType,
+		p.subtype,
+		paramList(p.params),
+		nstring(p.get("Content-Id")),
+		nstring(p.get("Content-Description")),
+		encoding,
+		uint32(len(p.body)),
+	}
+	switch {
+	case p.message != nil:
+		structure = append(structure, p.message.envelope(), p.message.bodyStructure(extended), lines(p.body))
+	case p.mediaType == "TEXT":
+		structure = append(structure, lines(p.body))
+	}
+	if extended {
+		structure = append(structure, nstring(p.get("Content-MD5")), p.disposition(), nil)
+	}
+	return structure
+}
+
+/*
+body-fld-dsp    = "(" string SP body-fld-param ")" / nil
+*/
+func (p *part) disposition() interface{} {
+	disposition, params, err := mime.ParseMediaType(p.get("Content-Disposition"))
+	if err != nil {
+		return nil
+	}
+	return []interface{}{strings.ToUpper(disposition), paramList(params)}
+}
+
+/*
+body-fld-param  = "(" string SP string *(SP string SP string) ")" / nil
+*/
+func paramList(params map[string]string) interface{} {
+	if len(params) == 0 {
+		return nil
+	}
+	names := []string{}
+	for name := range params {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	list := []interface{}{}
+	for _, name := range names {
+		list = append(list, strings.ToUpper(name), params[name])
+	}
+	return list
+}
+
+// lines returns the number of lines in body
+func lines(body []byte) uint32 {
+	n := bytes.Count(body, []byte("\n"))
+	if len(body) > 0 && body[len(body)-1] != '\n' {
+		n++
+	}
+	return uint32(n)
+}
+
+// nstring returns s, or nil for NIL when it is empty
+func nstring(s string) interface{} {
+	if s == "" {
+		return nil
+	}
+	return s
+}
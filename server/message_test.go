@@ -0,0 +1,148 @@
+package server
+
+import (
+	"bytes"
+	"github.com/gopistolet/imap/parser"
+	. "github.com/smartystreets/goconvey/convey"
+	"strings"
+	"testing"
+)
+
+func TestMessage(t *testing.T) {
+
+	Convey("Testing a single part message", t, func() {
+
+		header := "Date: Wed, 17 Jul 1996 02:23:25 -0700 (PDT)\r\n" +
+			"From: Terry Gray <gray@cac.washington.edu>\r\n" +
+			"Subject: IMAP4rev1 WG mtg summary and minutes\r\n" +
+			"To: imap@cac.washington.edu\r\n" +
+			"cc: minutes@CNRI.Reston.VA.US,\r\n John Klensin <KLENSIN@MIT.EDU>\r\n" +
+			"Message-Id: <B27397-0100000@cac.washington.edu>\r\n" +
+			"MIME-Version: 1.0\r\n" +
+			"Content-Type: TEXT/PLAIN; CHARSET=US-ASCII\r\n" +
+			"\r\n"
+		body := "Hello\r\nWorld\r\n"
+		p := parseMessage([]byte(header + body))
+
+		terry := []interface{}{[]interface{}{"Terry Gray", nil, "gray", "cac.washington.edu"}}
+		So(p.envelope(), ShouldResemble, []interface{}{
+			"Wed, 17 Jul 1996 02:23:25 -0700 (PDT)",
+			"IMAP4rev1 WG mtg summary and minutes",
+			terry, terry, terry,
+			[]interface{}{[]interface{}{nil, nil, "imap", "cac.washington.edu"}},
+			[]interface{}{
+				[]interface{}{nil, nil, "minutes", "CNRI.Reston.VA.US"},
+				[]interface{}{"John Klensin", nil, "KLENSIN", "MIT.EDU"},
+			},
+			nil, nil,
+			"<B27397-0100000@cac.washington.edu>",
+		})
+		So(p.bodyStructure(false), ShouldResemble, []interface{}{"TEXT", "PLAIN", []interface{}{"CHARSET", "US-ASCII"}, nil, nil, "7BIT", uint32(14), uint32(2)})
+
+		So(string(p.section(&parser.Section{})), ShouldEqual, header+body)
+		So(string(p.section(&parser.Section{Text: "HEADER"})), ShouldEqual, header)
+		So(string(p.section(&parser.Section{Text: "TEXT"})), ShouldEqual, body)
+		So(string(p.section(&parser.Section{Part: []uint32{1}})), ShouldEqual, body)
+		So(string(p.section(&parser.Section{Text: "HEADER.FIELDS", Fields: []string{"CC", "Subject"}})), ShouldEqual,
+			"Subject: IMAP4rev1 WG mtg summary and minutes\r\n"+
+				"cc: minutes@CNRI.Reston.VA.US,\r\n John Klensin <KLENSIN@MIT.EDU>\r\n\r\n")
+		So(string(p.section(&parser.Section{Text: "HEADER.FIELDS.NOT", Fields: []string{"Date", "From", "Subject", "To", "cc", "Message-ID", "MIME-Version"}})), ShouldEqual,
+			"Content-Type: TEXT/PLAIN; CHARSET=US-ASCII\r\n\r\n")
+		So(p.section(&parser.Section{Part: []uint32{2}}), ShouldBeNil)
+	})
+
+	Convey("Testing a multipart message", t, func() {
+
+		attached := "Subject: forwarded\r\n" +
+			"\r\n" +
+			"original text"
+		message := "From: a@example.com\r\n" +
+			"Subject: parts\r\n" +
+			"Content-Type: multipart/mixed; boundary=\"xyz\"\r\n" +
+			"\r\n" +
+			"preamble\r\n" +
+			"--xyz\r\n" +
+			"\r\n" +
+			"first part\r\n" +
+			"--xyz\r\n" +
+			"Content-Type: text/html; charset=utf-8\r\n" +
+			"Content-Transfer-Encoding: quoted-printable\r\n" +
+			"Content-Disposition: inline\r\n" +
+			"\r\n" +
+			"<p>second</p>\r\n" +
+			"--xyz\r\n" +
+			"Content-Type: message/rfc822\r\n" +
+			"\r\n" +
+			attached + "\r\n" +
+			"--xyz--\r\n" +
+			"epilogue\r\n"
+		p := parseMessage([]byte(message))
+
+		So(len(p.parts), ShouldEqual, 3)
+		So(string(p.section(&parser.Section{Part: []uint32{1}})), ShouldEqual, "first part")
+		So(string(p.section(&parser.Section{Part: []uint32{2}, Text: "MIME"})), ShouldEqual,
+			"Content-Type: text/html; charset=utf-8\r\nContent-Transfer-Encoding: quoted-printable\r\nContent-Disposition: inline\r\n\r\n")
+		So(string(p.section(&parser.Section{Part: []uint32{3}})), ShouldEqual, attached)
+		So(string(p.section(&parser.Section{Part: []uint32{3}, Text: "HEADER"})), ShouldEqual, "Subject: forwarded\r\n\r\n")
+		So(string(p.section(&parser.Section{Part: []uint32{3, 1}})), ShouldEqual, "original text")
+		So(p.section(&parser.Section{Part: []uint32{1}, Text: "TEXT"}), ShouldBeNil)
+		So(p.section(&parser.Section{Part: []uint32{4}}), ShouldBeNil)
+
+		So(p.bodyStructure(false), ShouldResemble, []interface{}{
+			[]interface{}{"TEXT", "PLAIN", []interface{}{"CHARSET", "us-ascii"}, nil, nil, "7BIT", uint32(10), uint32(1)},
+			[]interface{}{"TEXT", "HTML", []interface{}{"CHARSET", "utf-8"}, nil, nil, "QUOTED-PRINTABLE", uint32(13), uint32(1)},
+			[]interface{}{"MESSAGE", "RFC822", nil, nil, nil, "7BIT", uint32(len(attached)),
+				[]interface{}{nil, "forwarded", nil, nil, nil, nil, nil, nil, nil, nil},
+				[]interface{}{"TEXT", "PLAIN", []interface{}{"CHARSET", "us-ascii"}, nil, nil, "7BIT", uint32(13), uint32(1)},
+				uint32(3),
+			},
+			"MIXED",
+		})
+
+		extended := p.bodyStructure(true)
+		So(extended[len(extended)-3:], ShouldResemble, []interface{}{[]interface{}{"BOUNDARY", "xyz"}, nil, nil})
+		So(extended[1].([]interface{})[8:], ShouldResemble, []interface{}{nil, []interface{}{"INLINE", nil}, nil})
+	})
+
+	Convey("Testing deeply nested messages", t, func() {
+
+		raw := strings.Repeat("Content-Type: message/rfc822\r\n\r\n", 100000) + "Hello\r\n"
+		p := parseMessage([]byte(raw))
+		depth := 0
+		for p.message != nil {
+			p = p.message
+			depth++
+		}
+		So(depth, ShouldEqual, maxPartDepth)
+		So(p.mediaType+"/"+p.subtype, ShouldEqual, "APPLICATION/OCTET-STREAM")
+		So(p.parts, ShouldBeNil)
+
+		var buffer bytes.Buffer
+		w := parser.NewWriter(&buffer)
+		So(w.WriteFetch(1, []interface{}{parser.Atom("BODYSTRUCTURE"), parseMessage([]byte(raw)).bodyStructure(true)}), ShouldEqual, nil)
+		So(buffer.String(), ShouldContainSubstring, `("APPLICATION" "OCTET-STREAM" NIL NIL NIL "7BIT" `)
+	})
+
+	Convey("Testing matchMailbox", t, func() {
+
+		So(matchMailbox("INBOX", "inbox"), ShouldBeTrue)
+		So(matchMailbox("INBOX", "*"), ShouldBeTrue)
+		So(matchMailbox("work/reports", "*"), ShouldBeTrue)
+		So(matchMailbox("work/reports", "%"), ShouldBeFalse)
+		So(matchMailbox("work/reports", "work/%"), ShouldBeTrue)
+		So(matchMailbox("work/reports/2016", "work/%"), ShouldBeFalse)
+		So(matchMailbox("work/reports/2016", "work/*16"), ShouldBeTrue)
+		So(matchMailbox("work", "w%k"), ShouldBeTrue)
+		So(matchMailbox("Work", "work"), ShouldBeFalse)
+		So(matchMailbox("a", ""), ShouldBeFalse)
+		So(matchMailbox("", "*%"), ShouldBeTrue)
+		So(matchMailbox("work/reports", "%/%"), ShouldBeTrue)
+		So(matchMailbox("work/reports/2016", "%/%"), ShouldBeFalse)
+		So(matchMailbox("work/reports/2016", "*/%"), ShouldBeTrue)
+
+		// wildcard-heavy patterns take a single pass over the name per wildcard
+		name := strings.Repeat("a", 10000)
+		So(matchMailbox(name, "*a*a*a*a*a*a*a*a*a*a*a*a*a*a*a*a*b"), ShouldBeFalse)
+		So(matchMailbox(name, "%a%a%a%a%a%a%a%a%a%a%a%a%a%a%a%a%"), ShouldBeTrue)
+	})
+}
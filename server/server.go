@@ -0,0 +1,216 @@
+package server
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"github.com/gopistolet/imap/backend"
+	"github.com/gopistolet/imap/parser"
+	"io"
+	"log"
+	"net"
+)
+
+// Server serves IMAP connections from the mailboxes of a Backend
+type Server struct {
+	Backend backend.Backend
+
+	// TLSConfig enables STARTTLS, and is used by ServeTLS.
+	// Without it, connections are never secured.
+	TLSConfig *tls.Config
+
+	// AllowInsecureAuth allows LOGIN and plaintext SASL mechanisms on
+	// connections which aren't secured, even though STARTTLS is
+	// available. Without TLSConfig, they are always allowed.
+	AllowInsecureAuth bool
+
+	// Mechanisms are the SASL mechanisms for AUTHENTICATE, by name
+	// in upper case. NewServer adds PLAIN, LOGIN, and CRAM-MD5 when
+	// the backend is a backend.SecretBackend.
+	Mechanisms map[string]Mechanism
+
+	// MaxLineLength and MaxLiteralSize limit the commands of clients,
+	// like the fields of parser.Reader. Zero means the defaults of the
+	// parser package. A longer line ends the connection, a larger
+	// literal is refused with BAD before the client is asked for it.
+	MaxLineLength  int
+	MaxLiteralSize int
+
+	// ErrorLog logs errors of connections. If nil,
+	// the standard logger of the log package is used.
+	ErrorLog *log.Logger
+}
+
+// NewServer creates a Server for the mailboxes of b
+func NewServer(b backend.Backend) *Server {
+	return &Server{Backend: b, Mechanisms: defaultMechanisms(b)}
+}
+
+// Serve accepts connections on l, and serves each
+// of them in its own goroutine
+func (s *Server) Serve(l net.Listener) error {
+	for {
+		c, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		go s.ServeConn(c)
+	}
+}
+
+// ServeTLS accepts connections on l like Serve, but every connection
+// is secured with TLSConfig right away, like on port 993
+func (s *Server) ServeTLS(l net.Listener) error {
+	if s.TLSConfig == nil {
+		return errNoTLSConfig
+	}
+	for {
+		c, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		go func() {
+			conn := &conn{server: s}
+			conn.setConn(conn.tlsServer(c))
+			conn.serve()
+		}()
+	}
+}
+
+var errNoTLSConfig = errors.New("Server: TLSConfig is needed for TLS")
+
+// ServeConn serves a single connection until the client logs out
+// or the connection is closed. It closes c when done.
+func (s *Server) ServeConn(c net.Conn) {
+	newConn(s, c).serve()
+}
+
+func (s *Server) logf(format string, v ...interface{}) {
+	if s.ErrorLog != nil {
+		s.ErrorLog.Printf(format, v...)
+	} else {
+		log.Printf(format, v...)
+	}
+}
+
+// conn is a connection of a client
+type conn struct {
+	server  *Server
+	c       net.Conn
+	reader  *parser.Reader
+	writer  *parser.Writer
+	session Session
+	secure  bool              // c is a TLS connection
+	served  *x509.Certificate // certificate sent in the TLS handshake, nil if unknown
+
+	user     backend.User
+	mailbox  backend.Mailbox       // selected mailbox
+	updates  *backend.Subscription // changes of mailbox, if it publishes them
+	view     []backend.Message     // messages of mailbox with UID and flags, as last told to the client
+	expunged map[uint32]bool       // UIDs of messages which were removed, the client wasn't told yet
+}
+
+func newConn(s *Server, c net.Conn) *conn {
+	conn := &conn{server: s}
+	conn.setConn(c)
+	return conn
+}
+
+// setConn makes c the connection to read commands from and write
+// responses to. Anything buffered from the previous one is dropped.
+func (c *conn) setConn(nc net.Conn) {
+	_, c.secure = nc.(*tls.Conn)
+	c.c = nc
+	c.writer = parser.NewWriter(nc)
+	c.reader = parser.NewReader(nc)
+	if c.server.MaxLineLength > 0 {
+		c.reader.MaxLineLength = c.server.MaxLineLength
+	}
+	if c.server.MaxLiteralSize > 0 {
+		c.reader.MaxLiteralSize = c.server.MaxLiteralSize
+	}
+	c.reader.Continue = func() error {
+		return c.writer.WriteContinuation("Ready for literal data")
+	}
+}
+
+// tlsServer returns nc secured with TLSConfig. The handshake uses a
+// copy of it, which records the certificate it sends in served for
+// the tls-server-end-point channel binding.
+func (c *conn) tlsServer(nc net.Conn) *tls.Conn {
+	config := c.server.TLSConfig.Clone()
+	getCertificate, certificates := config.GetCertificate, config.Certificates
+	// without Certificates, crypto/tls always asks GetCertificate
+	config.Certificates = nil
+	config.GetCertificate = func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+		cert, err := selectCertificate(getCertificate, certificates, hello)
+		if err == nil && cert != nil {
+			c.served = leaf(cert)
+		}
+		return cert, err
+	}
+	return tls.Server(nc, config)
+}
+
+// startTLS performs the TLS handshake after the client was told to
+// go ahead with STARTTLS. Commands which the client sent before it
+// are dropped, they were pipelined in plaintext.
+func (c *conn) startTLS() error {
+	tlsConn := c.tlsServer(c.c)
+	if err := tlsConn.Handshake(); err != nil {
+		return err
+	}
+	c.setConn(tlsConn)
+	return nil
+}
+
+func (c *conn) serve() {
+	defer c.close()
+
+	if err := c.writer.WriteStatus(parser.StatusResponse{Type: parser.OK, Info: "IMAP4rev1 Service Ready"}); err != nil {
+		return
+	}
+
+	for c.session.State != LogoutState {
+		command, err := c.reader.ReadCommand()
+		if err != nil {
+			if parseErr, ok := err.(*parser.ParseError); ok {
+				err = c.writer.WriteStatus(parseErr.Response())
+			} else if err == parser.ErrLineTooLong {
+				c.writer.WriteStatus(parser.StatusResponse{Type: parser.BYE, Info: "Line too long"})
+			} else if err != io.EOF {
+				c.server.logf("imap: reading from %s: %v", c.c.RemoteAddr(), err)
+			}
+			if err != nil {
+				return
+			}
+			continue
+		}
+
+		response, ok := c.session.Check(command)
+		if ok {
+			response = c.handle(command)
+			c.session.Transition(command, response.Type == parser.OK)
+		}
+		if err := c.writer.WriteStatus(response); err != nil {
+			return
+		}
+		if _, starttls := command.Cmd.(parser.StarttlsCmd); starttls && response.Type == parser.OK {
+			if err := c.startTLS(); err != nil {
+				c.server.logf("imap: TLS handshake with %s: %v", c.c.RemoteAddr(), err)
+				return
+			}
+		}
+	}
+}
+
+// close ends the session of the user and closes the connection
+func (c *conn) close() {
+	c.unselect()
+	if c.user != nil {
+		if err := c.user.Logout(); err != nil {
+			c.server.logf("imap: logout of %s: %v", c.user.Username(), err)
+		}
+	}
+	c.c.Close()
+}
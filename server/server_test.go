@@ -0,0 +1,901 @@
+package server
+
+import (
+	"bufio"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/hex"
+	"github.com/gopistolet/imap/backend"
+	"github.com/gopistolet/imap/backend/memory"
+	"github.com/gopistolet/imap/oauth"
+	"github.com/gopistolet/imap/parser"
+	"github.com/gopistolet/imap/sasl"
+	. "github.com/smartystreets/goconvey/convey"
+	"io"
+	"math/big"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testBackend has a single user "mrc" with password "secret",
+// and a single mailbox INBOX
+type testBackend struct {
+	messages []backend.Message
+}
+
+func (b *testBackend) Login(username, password string) (backend.User, error) {
+	if username != "mrc" || password != "secret" {
+		return nil, backend.ErrInvalidCredentials
+	}
+	return testUser{b}, nil
+}
+
+type testUser struct {
+	b *testBackend
+}
+
+func (u testUser) Username() string { return "mrc" }
+func (u testUser) ListMailboxes(subscribed bool) ([]backend.MailboxInfo, error) {
+	return []backend.MailboxInfo{{Name: "INBOX", Attributes: []string{}}}, nil
+}
+func (u testUser) GetMailbox(name string) (backend.Mailbox, error) {
+	if name != "INBOX" {
+		return nil, backend.ErrNoSuchMailbox
+	}
+	return testMailbox{u.b}, nil
+}
+func (u testUser) CreateMailbox(name string) error           { return backend.ErrMailboxAlreadyExists }
+func (u testUser) DeleteMailbox(name string) error           { return backend.ErrNoSuchMailbox }
+func (u testUser) RenameMailbox(existing, new string) error  { return backend.ErrNoSuchMailbox }
+func (u testUser) SetSubscribed(name string, sub bool) error { return nil }
+func (u testUser) Logout() error                             { return nil }
+
+type testMailbox struct {
+	b *testBackend
+}
+
+func (m testMailbox) Name() string { return "INBOX" }
+func (m testMailbox) Status() (backend.MailboxStatus, error) {
+	return backend.MailboxStatus{
+		Messages:       uint32(len(m.b.messages)),
+		UidNext:        uint32(len(m.b.messages) + 1),
+		UidValidity:    1,
+		Flags:          []string{`\Seen`, `\Deleted`},
+		PermanentFlags: []string{`\Seen`, `\Deleted`},
+	}, nil
+}
+func (m testMailbox) Select(readOnly bool) error { return nil }
+func (m testMailbox) Fetch(uid bool, set parser.SequenceSet, body bool) ([]backend.Message, error) {
+	return backend.Filter(m.b.messages, uid, set), nil
+}
+func (m testMailbox) Search(uid bool, keys []parser.SearchKey) ([]uint32, error) {
+	return backend.Search(m.b.messages, uid, keys), nil
+}
+func (m testMailbox) Append(flags []string, date time.Time, body []byte) error {
+	n := uint32(len(m.b.messages) + 1)
+	m.b.messages = append(m.b.messages, backend.Message{SeqNum: n, Uid: n, Flags: flags, InternalDate: date, Size: uint32(len(body)), Body: body})
+	return nil
+}
+func (m testMailbox) Store(uid bool, set parser.SequenceSet, mode string, flags []string) ([]backend.Message, error) {
+	changed := backend.Filter(m.b.messages, uid, set)
+	for i := range changed {
+		message := &m.b.messages[changed[i].SeqNum-1]
+		message.Flags = backend.ApplyFlags(message.Flags, mode, flags)
+		changed[i].Flags = message.Flags
+	}
+	return changed, nil
+}
+func (m testMailbox) Copy(uid bool, set parser.SequenceSet, dest string) error {
+	return backend.ErrNoSuchMailbox
+}
+func (m testMailbox) Expunge() ([]uint32, error) {
+	expunged := []uint32{}
+	kept := []backend.Message{}
+	for _, message := range m.b.messages {
+		if message.HasFlag(`\Deleted`) {
+			expunged = append(expunged, uint32(len(kept)+1))
+			continue
+		}
+		message.SeqNum = uint32(len(kept) + 1)
+		kept = append(kept, message)
+	}
+	m.b.messages = kept
+	return expunged, nil
+}
+
+// secretBackend is a testBackend which offers CRAM-MD5
+type secretBackend struct {
+	*testBackend
+}
+
+func (b secretBackend) Secret(username string) (string, error) {
+	if username != "mrc" {
+		return "", backend.ErrInvalidCredentials
+	}
+	return "secret", nil
+}
+
+// scramBackend is a testBackend which offers SCRAM
+type scramBackend struct {
+	*testBackend
+}
+
+func (b scramBackend) User(username string) (backend.User, error) {
+	if username != "mrc" {
+		return nil, backend.ErrInvalidCredentials
+	}
+	return testUser{b.testBackend}, nil
+}
+
+func (b scramBackend) ScramCredentials(username, hash string) (sasl.ScramCredentials, error) {
+	if username != "mrc" {
+		return sasl.ScramCredentials{}, backend.ErrInvalidCredentials
+	}
+	return sasl.NewScramCredentials(sasl.ScramHashes[hash], "secret", []byte("salt"), 4096), nil
+}
+
+// testValidator maps tokens to usernames
+type testValidator map[string]string
+
+func (v testValidator) Validate(token string) (string, error) {
+	username, ok := v[token]
+	if !ok {
+		return "", oauth.ErrInvalidSignature
+	}
+	return username, nil
+}
+
+// testConn runs a server for b on one end of a pipe,
+// and returns the reader and writer of the client end
+func testConn(b backend.Backend) (*bufio.Reader, io.Writer) {
+	client, server := net.Pipe()
+	go NewServer(b).ServeConn(server)
+	return bufio.NewReader(client), client
+}
+
+// testCertificate returns a self-signed certificate made from template
+func testCertificate(template *x509.Certificate) tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		panic(err)
+	}
+	template.SerialNumber = big.NewInt(1)
+	template.NotBefore = time.Now().Add(-time.Hour)
+	template.NotAfter = time.Now().Add(time.Hour)
+	template.KeyUsage = x509.KeyUsageDigitalSignature
+	cert, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		panic(err)
+	}
+	leaf, _ := x509.ParseCertificate(cert)
+	return tls.Certificate{Certificate: [][]byte{cert}, PrivateKey: key, Leaf: leaf}
+}
+
+// testTLSConfig returns the configuration of a server
+// with a self-signed certificate for localhost
+func testTLSConfig() *tls.Config {
+	cert := testCertificate(&x509.Certificate{
+		Subject:     pkix.Name{CommonName: "localhost"},
+		DNSNames:    []string{"localhost"},
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	})
+	return &tls.Config{Certificates: []tls.Certificate{cert}}
+}
+
+// readResponse reads lines up to and including the tagged one,
+// literals are read as part of their line
+func readResponse(r *bufio.Reader, tag string) string {
+	response := ""
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return response + "<" + err.Error() + ">"
+		}
+		response += line
+		if i := strings.LastIndex(line, "{"); i >= 0 && strings.HasSuffix(line, "}\r\n") {
+			n, _ := strconv.Atoi(line[i+1 : len(line)-3])
+			literal := make([]byte, n)
+			io.ReadFull(r, literal)
+			response += string(literal)
+			continue
+		}
+		if strings.HasPrefix(line, tag+" ") {
+			return response
+		}
+	}
+}
+
+func TestServer(t *testing.T) {
+
+	Convey("Testing Server", t, func() {
+
+		date := time.Date(1996, 7, 17, 2, 44, 25, 0, time.FixedZone("", -7*60*60))
+		b := &testBackend{messages: []backend.Message{
+			{SeqNum: 1, Uid: 1, Flags: []string{`\Seen`}, InternalDate: date, Size: 33, Body: []byte("Subject: first\r\n\r\nHello there\r\n")},
+			{SeqNum: 2, Uid: 2, Flags: []string{}, InternalDate: date, Size: 30, Body: []byte("Subject: second\r\n\r\nGoodbye\r\n")},
+		}}
+		r, w := testConn(b)
+		conversation := func(tag, command string) string {
+			io.WriteString(w, tag+" "+command+"\r\n")
+			return readResponse(r, tag)
+		}
+
+		greeting, _ := r.ReadString('\n')
+		So(greeting, ShouldEqual, "* OK IMAP4rev1 Service Ready\r\n")
+
+		So(conversation("a001", "CAPABILITY"), ShouldEqual, "* CAPABILITY IMAP4rev1 IDLE SASL-IR AUTH=LOGIN AUTH=PLAIN\r\na001 OK CAPABILITY completed\r\n")
+		So(conversation("a002", "SELECT INBOX"), ShouldEqual, "a002 BAD Not authenticated\r\n")
+		So(conversation("a003", "LOGIN mrc wrong"), ShouldEqual, "a003 NO Invalid credentials\r\n")
+		So(conversation("a004", "LOGIN mrc secret"), ShouldEqual, "a004 OK LOGIN completed\r\n")
+		So(conversation("a005", "bogus"), ShouldEqual, "a005 BAD Parser: unknown command BOGUS\r\n")
+		So(conversation("a006", "FETCH 1 FLAGS"), ShouldEqual, "a006 BAD No mailbox selected\r\n")
+		So(conversation("a007", "SELECT missing"), ShouldEqual, "a007 NO No such mailbox\r\n")
+
+		So(conversation("a008", "SELECT INBOX"), ShouldEqual, "* 2 EXISTS\r\n"+
+			"* 0 RECENT\r\n"+
+			"* OK [UIDVALIDITY 1] UIDs valid\r\n"+
+			"* OK [UIDNEXT 3] Predicted next UID\r\n"+
+			"* FLAGS (\\Seen \\Deleted)\r\n"+
+			"* OK [PERMANENTFLAGS (\\Seen \\Deleted)] Limited\r\n"+
+			"a008 OK [READ-WRITE] SELECT completed\r\n")
+
+		So(conversation("a009", "FETCH 1:* (FLAGS RFC822.SIZE)"), ShouldEqual, "* 1 FETCH (FLAGS (\\Seen) RFC822.SIZE 33)\r\n"+
+			"* 2 FETCH (FLAGS () RFC822.SIZE 30)\r\n"+
+			"a009 OK FETCH completed\r\n")
+		So(conversation("a010", "UID FETCH 2 BODY[TEXT]"), ShouldEqual, "* 2 FETCH (UID 2 BODY[TEXT] {9}\r\nGoodbye\r\n FLAGS (\\Seen))\r\n"+
+			"a010 OK UID FETCH completed\r\n")
+		So(conversation("a011", "SEARCH SUBJECT first"), ShouldEqual, "* SEARCH 1\r\na011 OK SEARCH completed\r\n")
+		So(conversation("a012", "STORE 2 +FLAGS (\\Deleted)"), ShouldEqual, "* 2 FETCH (FLAGS (\\Seen \\Deleted))\r\na012 OK STORE completed\r\n")
+		So(conversation("a013", "COPY 1 elsewhere"), ShouldEqual, "a013 NO [TRYCREATE] No such mailbox\r\n")
+		So(conversation("a014", "EXPUNGE"), ShouldEqual, "* 2 EXPUNGE\r\na014 OK EXPUNGE completed\r\n")
+
+		io.WriteString(w, "a015 APPEND INBOX {11}\r\n")
+		continuation, _ := r.ReadString('\n')
+		So(continuation, ShouldEqual, "+ Ready for literal data\r\n")
+		io.WriteString(w, "Subject: x\r\n")
+		So(readResponse(r, "a015"), ShouldEqual, "* 2 EXISTS\r\n* 0 RECENT\r\na015 OK APPEND completed\r\n")
+
+		So(conversation("a016", "LIST \"\" *"), ShouldEqual, "* LIST () \"/\" \"INBOX\"\r\na016 OK LIST completed\r\n")
+		So(conversation("a017", "LIST \"\" \"\""), ShouldEqual, "* LIST (\\Noselect) \"/\" \"\"\r\na017 OK LIST completed\r\n")
+		So(conversation("a018", "LOGOUT"), ShouldEqual, "* BYE IMAP4rev1 Server logging out\r\na018 OK LOGOUT completed\r\n")
+
+		_, err := r.ReadString('\n')
+		So(err, ShouldEqual, io.EOF)
+	})
+}
+
+func TestLimits(t *testing.T) {
+
+	Convey("Testing limits of commands", t, func() {
+
+		client, server := net.Pipe()
+		s := NewServer(&testBackend{})
+		s.MaxLineLength = 100
+		s.MaxLiteralSize = 1000
+		go s.ServeConn(server)
+		r := bufio.NewReader(client)
+		r.ReadString('\n')
+
+		io.WriteString(client, "a001 LOGIN {4294967295}\r\n")
+		So(readResponse(r, "a001"), ShouldEqual, "a001 BAD Reader: literal exceeds the limit of 1000 octets\r\n")
+
+		go io.WriteString(client, "a002 "+strings.Repeat("x", 200)+"\r\n")
+		line, _ := r.ReadString('\n')
+		So(line, ShouldEqual, "* BYE Line too long\r\n")
+		_, err := r.ReadString('\n')
+		So(err, ShouldEqual, io.EOF)
+	})
+}
+
+func TestTLS(t *testing.T) {
+
+	config := testTLSConfig()
+	clientConfig := &tls.Config{InsecureSkipVerify: true}
+
+	Convey("Testing STARTTLS", t, func() {
+
+		s := NewServer(&testBackend{})
+		client, server := net.Pipe()
+		go s.ServeConn(server)
+		r, w := bufio.NewReader(client), io.Writer(client)
+		conversation := func(tag, command string) string {
+			io.WriteString(w, tag+" "+command+"\r\n")
+			return readResponse(r, tag)
+		}
+		r.ReadString('\n')
+
+		So(conversation("a001", "STARTTLS"), ShouldEqual, "a001 BAD STARTTLS not supported\r\n")
+		s.TLSConfig = config
+		So(conversation("a002", "CAPABILITY"), ShouldEqual, "* CAPABILITY IMAP4rev1 IDLE STARTTLS SASL-IR LOGINDISABLED\r\na002 OK CAPABILITY completed\r\n")
+		So(conversation("a003", "LOGIN mrc secret"), ShouldEqual, "a003 NO LOGIN is disabled, use STARTTLS first\r\n")
+
+		// the pipelined LOGIN was sent in plaintext, it is dropped
+		So(conversation("a004", "STARTTLS\r\na005 LOGIN mrc secret"), ShouldEqual, "a004 OK Begin TLS negotiation now\r\n")
+		tlsClient := tls.Client(client, clientConfig)
+		So(tlsClient.Handshake(), ShouldEqual, nil)
+		r, w = bufio.NewReader(tlsClient), tlsClient
+
+		So(conversation("a006", "CAPABILITY"), ShouldEqual, "* CAPABILITY IMAP4rev1 IDLE SASL-IR AUTH=LOGIN AUTH=PLAIN\r\na006 OK CAPABILITY completed\r\n")
+		So(conversation("a007", "STARTTLS"), ShouldEqual, "a007 BAD TLS already active\r\n")
+		So(conversation("a008", "LOGIN mrc secret"), ShouldEqual, "a008 OK LOGIN completed\r\n")
+		So(conversation("a009", "STARTTLS"), ShouldEqual, "a009 BAD Already authenticated\r\n")
+		So(conversation("a010", "LOGOUT"), ShouldEqual, "* BYE IMAP4rev1 Server logging out\r\na010 OK LOGOUT completed\r\n")
+	})
+
+	Convey("Testing insecure LOGIN", t, func() {
+
+		s := NewServer(&testBackend{})
+		s.TLSConfig = config
+		s.AllowInsecureAuth = true
+		client, server := net.Pipe()
+		go s.ServeConn(server)
+		r := bufio.NewReader(client)
+		r.ReadString('\n')
+
+		io.WriteString(client, "a001 CAPABILITY\r\n")
+		So(readResponse(r, "a001"), ShouldEqual, "* CAPABILITY IMAP4rev1 IDLE STARTTLS SASL-IR AUTH=LOGIN AUTH=PLAIN\r\na001 OK CAPABILITY completed\r\n")
+		io.WriteString(client, "a002 LOGIN mrc secret\r\n")
+		So(readResponse(r, "a002"), ShouldEqual, "a002 OK LOGIN completed\r\n")
+		client.Close()
+	})
+
+	Convey("Testing implicit TLS", t, func() {
+
+		So(NewServer(&testBackend{}).ServeTLS(nil), ShouldEqual, errNoTLSConfig)
+
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		So(err, ShouldEqual, nil)
+		defer l.Close()
+		s := NewServer(&testBackend{})
+		s.TLSConfig = config
+		go s.ServeTLS(l)
+
+		c, err := tls.Dial("tcp", l.Addr().String(), clientConfig)
+		So(err, ShouldEqual, nil)
+		defer c.Close()
+		r := bufio.NewReader(c)
+		greeting, _ := r.ReadString('\n')
+		So(greeting, ShouldEqual, "* OK IMAP4rev1 Service Ready\r\n")
+		io.WriteString(c, "a001 CAPABILITY\r\n")
+		So(readResponse(r, "a001"), ShouldEqual, "* CAPABILITY IMAP4rev1 IDLE SASL-IR AUTH=LOGIN AUTH=PLAIN\r\na001 OK CAPABILITY completed\r\n")
+		io.WriteString(c, "a002 STARTTLS\r\n")
+		So(readResponse(r, "a002"), ShouldEqual, "a002 BAD TLS already active\r\n")
+		io.WriteString(c, "a003 LOGIN mrc secret\r\n")
+		So(readResponse(r, "a003"), ShouldEqual, "a003 OK LOGIN completed\r\n")
+	})
+}
+
+func TestAuthenticate(t *testing.T) {
+
+	encode := func(s string) string {
+		return base64.StdEncoding.EncodeToString([]byte(s))
+	}
+
+	Convey("Testing AUTHENTICATE", t, func() {
+
+		s := NewServer(secretBackend{&testBackend{}})
+		client, server := net.Pipe()
+		go s.ServeConn(server)
+		r := bufio.NewReader(client)
+		send := func(line string) {
+			io.WriteString(client, line+"\r\n")
+		}
+		line := func() string {
+			line, _ := r.ReadString('\n')
+			return line
+		}
+		line()
+
+		send("a001 CAPABILITY")
+		So(readResponse(r, "a001"), ShouldEqual, "* CAPABILITY IMAP4rev1 IDLE SASL-IR AUTH=CRAM-MD5 AUTH=LOGIN AUTH=PLAIN\r\na001 OK CAPABILITY completed\r\n")
+		send("a002 AUTHENTICATE X-UNKNOWN")
+		So(readResponse(r, "a002"), ShouldEqual, "a002 NO Unsupported authentication mechanism\r\n")
+
+		send("a003 AUTHENTICATE plain")
+		So(line(), ShouldEqual, "+ \r\n")
+		send("*")
+		So(readResponse(r, "a003"), ShouldEqual, "a003 BAD AUTHENTICATE cancelled\r\n")
+		send("a004 AUTHENTICATE PLAIN")
+		line()
+		send("not base64!")
+		So(readResponse(r, "a004"), ShouldEqual, "a004 BAD Invalid base64 in response\r\n")
+		send("a005 AUTHENTICATE PLAIN")
+		line()
+		send(encode("mrc secret"))
+		So(readResponse(r, "a005"), ShouldEqual, "a005 BAD Invalid response\r\n")
+		send("a006 AUTHENTICATE PLAIN")
+		line()
+		send(encode("\x00mrc\x00wrong"))
+		So(readResponse(r, "a006"), ShouldEqual, "a006 NO Invalid credentials\r\n")
+
+		// the backend doesn't let users act as others
+		send("a007 AUTHENTICATE PLAIN")
+		line()
+		send(encode("admin\x00mrc\x00secret"))
+		So(readResponse(r, "a007"), ShouldEqual, "a007 NO Invalid credentials\r\n")
+
+		send("a008 AUTHENTICATE LOGIN")
+		So(line(), ShouldEqual, "+ "+encode("Username:")+"\r\n")
+		send(encode("mrc"))
+		So(line(), ShouldEqual, "+ "+encode("Password:")+"\r\n")
+		send(encode("secret"))
+		So(readResponse(r, "a008"), ShouldEqual, "a008 OK AUTHENTICATE completed\r\n")
+
+		send("a009 AUTHENTICATE PLAIN")
+		So(readResponse(r, "a009"), ShouldEqual, "a009 BAD Already authenticated\r\n")
+		send("a010 SELECT INBOX")
+		So(readResponse(r, "a010"), ShouldEndWith, "a010 OK [READ-WRITE] SELECT completed\r\n")
+		client.Close()
+	})
+
+	Convey("Testing SASL-IR", t, func() {
+
+		r, w := testConn(secretBackend{&testBackend{}})
+		r.ReadString('\n')
+
+		// CRAM-MD5 starts with a challenge of the server
+		io.WriteString(w, "a001 AUTHENTICATE CRAM-MD5 =\r\n")
+		So(readResponse(r, "a001"), ShouldEqual, "a001 BAD Invalid response\r\n")
+		io.WriteString(w, "a002 AUTHENTICATE PLAIN %%%\r\n")
+		So(readResponse(r, "a002"), ShouldStartWith, "a002 BAD ")
+		io.WriteString(w, "a003 AUTHENTICATE PLAIN "+encode("\x00mrc\x00secret")+"\r\n")
+		So(readResponse(r, "a003"), ShouldEqual, "a003 OK AUTHENTICATE completed\r\n")
+	})
+
+	Convey("Testing CRAM-MD5", t, func() {
+
+		s := NewServer(secretBackend{&testBackend{}})
+		s.TLSConfig = testTLSConfig()
+		client, server := net.Pipe()
+		go s.ServeConn(server)
+		r := bufio.NewReader(client)
+		r.ReadString('\n')
+
+		// it doesn't need TLS, unlike PLAIN and LOGIN
+		io.WriteString(client, "a001 CAPABILITY\r\n")
+		So(readResponse(r, "a001"), ShouldEqual, "* CAPABILITY IMAP4rev1 IDLE STARTTLS SASL-IR AUTH=CRAM-MD5 LOGINDISABLED\r\na001 OK CAPABILITY completed\r\n")
+		io.WriteString(client, "a002 AUTHENTICATE PLAIN\r\n")
+		So(readResponse(r, "a002"), ShouldEqual, "a002 NO PLAIN is disabled, use STARTTLS first\r\n")
+
+		io.WriteString(client, "a003 AUTHENTICATE CRAM-MD5\r\n")
+		line, _ := r.ReadString('\n')
+		So(line, ShouldStartWith, "+ ")
+		challenge, err := base64.StdEncoding.DecodeString(strings.TrimSuffix(line[2:], "\r\n"))
+		So(err, ShouldEqual, nil)
+		So(string(challenge), ShouldStartWith, "<")
+		mac := hmac.New(md5.New, []byte("secret"))
+		mac.Write(challenge)
+		io.WriteString(client, encode("mrc "+hex.EncodeToString(mac.Sum(nil)))+"\r\n")
+		So(readResponse(r, "a003"), ShouldEqual, "a003 OK AUTHENTICATE completed\r\n")
+		client.Close()
+	})
+
+	conversation := func(r *bufio.Reader, w io.Writer, tag, command string) string {
+		io.WriteString(w, tag+" "+command+"\r\n")
+		return readResponse(r, tag)
+	}
+	// connect runs s on one end of a pipe, and returns the client end
+	// after the greeting
+	connect := func(s *Server) net.Conn {
+		client, server := net.Pipe()
+		go s.ServeConn(server)
+		greeting := make([]byte, len("* OK IMAP4rev1 Service Ready\r\n"))
+		io.ReadFull(client, greeting)
+		return client
+	}
+
+	// scram runs SCRAM-SHA-256 as the client with password "secret",
+	// with the channel binding flag "n" or the type cb and its data
+	scram := func(r *bufio.Reader, w io.Writer, tag, mechanism, cb string, data []byte) string {
+		challenge := func() (string, bool) {
+			line, _ := r.ReadString('\n')
+			if !strings.HasPrefix(line, "+ ") {
+				return line, false
+			}
+			challenge, _ := base64.StdEncoding.DecodeString(strings.TrimSuffix(line[2:], "\r\n"))
+			return string(challenge), true
+		}
+		io.WriteString(w, tag+" AUTHENTICATE "+mechanism+"\r\n")
+		if line, ok := challenge(); !ok {
+			return line
+		}
+		gs2Header := "n,,"
+		if cb != "n" {
+			gs2Header = "p=" + cb + ",,"
+		}
+		clientFirst := "n=mrc,r=clientnonce"
+		io.WriteString(w, encode(gs2Header+clientFirst)+"\r\n")
+		serverFirst, ok := challenge()
+		if !ok {
+			return serverFirst
+		}
+		withoutProof := "c=" + encode(gs2Header+string(data)) + "," + strings.Split(serverFirst, ",")[0]
+
+		// SaltedPassword is Hi("secret", "salt", 4096)
+		mac := hmac.New(sha256.New, []byte("secret"))
+		mac.Write([]byte("salt\x00\x00\x00\x01"))
+		u := mac.Sum(nil)
+		salted := append([]byte{}, u...)
+		for i := 1; i < 4096; i++ {
+			mac = hmac.New(sha256.New, []byte("secret"))
+			mac.Write(u)
+			u = mac.Sum(nil)
+			for j := range u {
+				salted[j] ^= u[j]
+			}
+		}
+		mac = hmac.New(sha256.New, salted)
+		mac.Write([]byte("Client Key"))
+		proof := mac.Sum(nil)
+		storedKey := sha256.Sum256(proof)
+		mac = hmac.New(sha256.New, storedKey[:])
+		mac.Write([]byte(clientFirst + "," + serverFirst + "," + withoutProof))
+		for i, b := range mac.Sum(nil) {
+			proof[i] ^= b
+		}
+		io.WriteString(w, encode(withoutProof+",p="+base64.StdEncoding.EncodeToString(proof))+"\r\n")
+		serverFinal, ok := challenge()
+		if !ok {
+			return serverFinal
+		}
+		So(serverFinal, ShouldStartWith, "v=")
+		io.WriteString(w, "\r\n")
+		return readResponse(r, tag)
+	}
+
+	Convey("Testing SCRAM", t, func() {
+
+		s := NewServer(scramBackend{&testBackend{}})
+		s.TLSConfig = testTLSConfig()
+		client := connect(s)
+		defer client.Close()
+		r, w := bufio.NewReader(client), io.Writer(client)
+
+		// it doesn't need TLS, the password isn't sent
+		So(conversation(r, w, "a001", "CAPABILITY"), ShouldEqual, "* CAPABILITY IMAP4rev1 IDLE STARTTLS SASL-IR AUTH=SCRAM-SHA-1 AUTH=SCRAM-SHA-256 LOGINDISABLED\r\na001 OK CAPABILITY completed\r\n")
+		So(conversation(r, w, "a002", "AUTHENTICATE SCRAM-SHA-256-PLUS"), ShouldEqual, "a002 NO SCRAM-SHA-256-PLUS needs TLS\r\n")
+		So(scram(r, w, "a003", "SCRAM-SHA-256", "tls-exporter", nil), ShouldEqual, "a003 NO Channel binding doesn't match\r\n")
+		So(scram(r, w, "a004", "SCRAM-SHA-256", "n", nil), ShouldEqual, "a004 OK AUTHENTICATE completed\r\n")
+		// LOGINDISABLED is only about the not authenticated state
+		So(conversation(r, w, "a005", "CAPABILITY"), ShouldEqual, "* CAPABILITY IMAP4rev1 IDLE\r\na005 OK CAPABILITY completed\r\n")
+	})
+
+	for _, cb := range []string{"tls-exporter", "tls-server-end-point"} {
+
+		Convey("Testing SCRAM-SHA-256-PLUS with "+cb, t, func() {
+
+			s := NewServer(scramBackend{&testBackend{}})
+			s.TLSConfig = testTLSConfig()
+			client := connect(s)
+			defer client.Close()
+			So(conversation(bufio.NewReader(client), client, "a001", "STARTTLS"), ShouldEqual, "a001 OK Begin TLS negotiation now\r\n")
+			tlsClient := tls.Client(client, &tls.Config{InsecureSkipVerify: true})
+			So(tlsClient.Handshake(), ShouldEqual, nil)
+			r, w := bufio.NewReader(tlsClient), io.Writer(tlsClient)
+			So(conversation(r, w, "a002", "CAPABILITY"), ShouldEqual, "* CAPABILITY IMAP4rev1 IDLE SASL-IR AUTH=LOGIN AUTH=PLAIN AUTH=SCRAM-SHA-1 AUTH=SCRAM-SHA-1-PLUS AUTH=SCRAM-SHA-256 AUTH=SCRAM-SHA-256-PLUS\r\na002 OK CAPABILITY completed\r\n")
+
+			state := tlsClient.ConnectionState()
+			data, err := state.ExportKeyingMaterial("EXPORTER-Channel-Binding", nil, 32)
+			So(err, ShouldEqual, nil)
+			if cb == "tls-server-end-point" {
+				// the certificate is signed with ECDSA and SHA-256
+				sum := sha256.Sum256(state.PeerCertificates[0].Raw)
+				data = sum[:]
+			}
+			So(scram(r, w, "a003", "SCRAM-SHA-256-PLUS", cb, []byte("other")), ShouldEqual, "a003 NO Channel binding doesn't match\r\n")
+			// the -PLUS variant was offered, a client which doesn't bind
+			// to the channel can't have seen it
+			So(scram(r, w, "a004", "SCRAM-SHA-256-PLUS", "n", nil), ShouldEqual, "a004 NO Channel binding doesn't match\r\n")
+			So(scram(r, w, "a005", "SCRAM-SHA-256-PLUS", cb, data), ShouldEqual, "a005 OK AUTHENTICATE completed\r\n")
+			So(conversation(r, w, "a006", "SELECT INBOX"), ShouldEndWith, "a006 OK [READ-WRITE] SELECT completed\r\n")
+		})
+	}
+
+	Convey("Testing tls-server-end-point with the certificate served", t, func() {
+
+		// GetCertificate gives another certificate on every call,
+		// like one which is renewed
+		certificates := []tls.Certificate{testTLSConfig().Certificates[0], testTLSConfig().Certificates[0]}
+		calls := 0
+		s := NewServer(scramBackend{&testBackend{}})
+		s.TLSConfig = &tls.Config{GetCertificate: func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+			calls++
+			return &certificates[(calls-1)%2], nil
+		}}
+		starttls := func(client net.Conn) *tls.Conn {
+			So(conversation(bufio.NewReader(client), client, "a001", "STARTTLS"), ShouldEqual, "a001 OK Begin TLS negotiation now\r\n")
+			tlsClient := tls.Client(client, &tls.Config{InsecureSkipVerify: true})
+			So(tlsClient.Handshake(), ShouldEqual, nil)
+			return tlsClient
+		}
+		endPoint := func(tlsClient *tls.Conn) []byte {
+			sum := sha256.Sum256(tlsClient.ConnectionState().PeerCertificates[0].Raw)
+			return sum[:]
+		}
+
+		client := connect(s)
+		defer client.Close()
+		tlsClient := starttls(client)
+		So(scram(bufio.NewReader(tlsClient), tlsClient, "a002", "SCRAM-SHA-256-PLUS", "tls-server-end-point", endPoint(tlsClient)), ShouldEqual, "a002 OK AUTHENTICATE completed\r\n")
+		So(calls, ShouldEqual, 1)
+
+		// a connection secured before ServeConn has no certificate recorded
+		client, server := net.Pipe()
+		defer client.Close()
+		go s.ServeConn(tls.Server(server, s.TLSConfig))
+		tlsClient = tls.Client(client, &tls.Config{InsecureSkipVerify: true})
+		r := bufio.NewReader(tlsClient)
+		r.ReadString('\n')
+		So(scram(r, tlsClient, "a001", "SCRAM-SHA-256-PLUS", "tls-server-end-point", endPoint(tlsClient)), ShouldEqual, "a001 NO Channel binding doesn't match\r\n")
+		state := tlsClient.ConnectionState()
+		data, _ := state.ExportKeyingMaterial("EXPORTER-Channel-Binding", nil, 32)
+		So(scram(r, tlsClient, "a002", "SCRAM-SHA-256-PLUS", "tls-exporter", data), ShouldEqual, "a002 OK AUTHENTICATE completed\r\n")
+	})
+
+	Convey("Testing the hash functions of tls-server-end-point", t, func() {
+
+		client, server := net.Pipe()
+		defer client.Close()
+		go tls.Server(server, testTLSConfig()).Handshake()
+		tlsClient := tls.Client(client, &tls.Config{InsecureSkipVerify: true})
+		So(tlsClient.Handshake(), ShouldEqual, nil)
+		state := tlsClient.ConnectionState()
+
+		raw := []byte("certificate")
+		sha256Sum, sha384Sum := sha256.Sum256(raw), sha512.Sum384(raw)
+		endPoint := func(algorithm x509.SignatureAlgorithm) []byte {
+			return channelBindings(&x509.Certificate{Raw: raw, SignatureAlgorithm: algorithm}, &state)["tls-server-end-point"]
+		}
+		So(endPoint(x509.MD5WithRSA), ShouldResemble, sha256Sum[:])
+		So(endPoint(x509.ECDSAWithSHA1), ShouldResemble, sha256Sum[:])
+		So(endPoint(x509.ECDSAWithSHA256), ShouldResemble, sha256Sum[:])
+		So(endPoint(x509.SHA384WithRSAPSS), ShouldResemble, sha384Sum[:])
+		So(endPoint(x509.SHA512WithRSA), ShouldHaveLength, 64)
+		So(endPoint(x509.PureEd25519), ShouldBeNil)
+		So(endPoint(x509.UnknownSignatureAlgorithm), ShouldBeNil)
+		So(channelBindings(nil, &state), ShouldContainKey, "tls-exporter")
+	})
+
+	Convey("Testing OAUTHBEARER and XOAUTH2", t, func() {
+
+		s := NewServer(scramBackend{&testBackend{}})
+		validator := testValidator{"good": "mrc", "other": "joe"}
+		s.Mechanisms = map[string]Mechanism{"OAUTHBEARER": OAuthBearer(validator), "XOAUTH2": XOAuth2(validator)}
+		client := connect(s)
+		defer client.Close()
+		r := bufio.NewReader(client)
+
+		So(conversation(r, client, "a001", "CAPABILITY"), ShouldEqual, "* CAPABILITY IMAP4rev1 IDLE SASL-IR AUTH=OAUTHBEARER AUTH=XOAUTH2\r\na001 OK CAPABILITY completed\r\n")
+
+		// the error is sent as JSON, the client responds with %x01
+		for i, token := range []string{"bad", "other"} {
+			tag := "a00" + strconv.Itoa(2+i)
+			io.WriteString(client, tag+" AUTHENTICATE OAUTHBEARER "+encode("n,,\x01auth=Bearer "+token+"\x01\x01")+"\r\n")
+			line, _ := r.ReadString('\n')
+			So(line, ShouldEqual, "+ "+encode(`{"status":"invalid_token"}`)+"\r\n")
+			io.WriteString(client, encode("\x01")+"\r\n")
+			So(readResponse(r, tag), ShouldEqual, tag+" NO Invalid credentials\r\n")
+		}
+
+		// the token was issued to another user
+		io.WriteString(client, "a004 AUTHENTICATE OAUTHBEARER "+encode("n,a=joe,\x01auth=Bearer good\x01\x01")+"\r\n")
+		line, _ := r.ReadString('\n')
+		So(line, ShouldStartWith, "+ ")
+		io.WriteString(client, encode("\x01")+"\r\n")
+		So(readResponse(r, "a004"), ShouldEqual, "a004 NO Invalid credentials\r\n")
+
+		So(conversation(r, client, "a005", "AUTHENTICATE XOAUTH2 "+encode("user=mrc\x01auth=Bearer good\x01\x01")), ShouldEqual, "a005 OK AUTHENTICATE completed\r\n")
+		So(conversation(r, client, "a006", "SELECT INBOX"), ShouldEndWith, "a006 OK [READ-WRITE] SELECT completed\r\n")
+	})
+
+	Convey("Testing OAUTHBEARER without TLS", t, func() {
+
+		s := NewServer(scramBackend{&testBackend{}})
+		s.TLSConfig = testTLSConfig()
+		s.Mechanisms["OAUTHBEARER"] = OAuthBearer(testValidator{"good": "mrc"})
+		client := connect(s)
+		defer client.Close()
+		r := bufio.NewReader(client)
+
+		// the token can be used like a password
+		So(conversation(r, client, "a001", "AUTHENTICATE OAUTHBEARER"), ShouldEqual, "a001 NO OAUTHBEARER is disabled, use STARTTLS first\r\n")
+	})
+
+	Convey("Testing EXTERNAL", t, func() {
+
+		clientCert := testCertificate(&x509.Certificate{
+			Subject:        pkix.Name{CommonName: "mrc"},
+			EmailAddresses: []string{"svc@example.com"},
+			ExtKeyUsage:    []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		})
+		s := NewServer(scramBackend{&testBackend{}})
+		s.TLSConfig = testTLSConfig()
+		s.TLSConfig.ClientAuth = tls.VerifyClientCertIfGiven
+		s.TLSConfig.ClientCAs = x509.NewCertPool()
+		s.TLSConfig.ClientCAs.AddCert(clientCert.Leaf)
+		s.Mechanisms = map[string]Mechanism{"EXTERNAL": External(CommonName, nil)}
+		// dial connects over TLS, with cert if it isn't nil
+		dial := func(cert *tls.Certificate) (*bufio.Reader, io.Writer) {
+			client, server := net.Pipe()
+			go s.ServeConn(tls.Server(server, s.TLSConfig))
+			config := &tls.Config{InsecureSkipVerify: true}
+			if cert != nil {
+				config.Certificates = []tls.Certificate{*cert}
+			}
+			tlsClient := tls.Client(client, config)
+			r := bufio.NewReader(tlsClient)
+			r.ReadString('\n')
+			return r, tlsClient
+		}
+
+		r, w := dial(nil)
+		So(conversation(r, w, "a001", "CAPABILITY"), ShouldEqual, "* CAPABILITY IMAP4rev1 IDLE SASL-IR\r\na001 OK CAPABILITY completed\r\n")
+		So(conversation(r, w, "a002", "AUTHENTICATE EXTERNAL ="), ShouldEqual, "a002 NO Invalid credentials\r\n")
+
+		r, w = dial(&clientCert)
+		So(conversation(r, w, "a001", "CAPABILITY"), ShouldEqual, "* CAPABILITY IMAP4rev1 IDLE SASL-IR AUTH=EXTERNAL\r\na001 OK CAPABILITY completed\r\n")
+		So(conversation(r, w, "a002", "AUTHENTICATE EXTERNAL "+encode("joe")), ShouldEqual, "a002 NO Invalid credentials\r\n")
+		So(conversation(r, w, "a003", "AUTHENTICATE EXTERNAL ="), ShouldEqual, "a003 OK AUTHENTICATE completed\r\n")
+
+		// the service account acts as mrc
+		s.Mechanisms["EXTERNAL"] = External(EmailAddress, func(identity, username string) bool {
+			return username == "svc@example.com" && identity == "mrc"
+		})
+		r, w = dial(&clientCert)
+		So(conversation(r, w, "a001", "AUTHENTICATE EXTERNAL ="), ShouldEqual, "a001 NO Invalid credentials\r\n")
+		So(conversation(r, w, "a002", "AUTHENTICATE EXTERNAL "+encode("root")), ShouldEqual, "a002 NO Invalid credentials\r\n")
+		So(conversation(r, w, "a003", "AUTHENTICATE EXTERNAL "+encode("mrc")), ShouldEqual, "a003 OK AUTHENTICATE completed\r\n")
+		So(conversation(r, w, "a004", "SELECT INBOX"), ShouldEndWith, "a004 OK [READ-WRITE] SELECT completed\r\n")
+	})
+}
+
+func TestIdle(t *testing.T) {
+
+	Convey("Testing IDLE", t, func() {
+
+		b := memory.New()
+		b.AddUser("mrc", "secret")
+		r, w := testConn(b)
+		other, otherW := testConn(b)
+		r.ReadString('\n')
+		other.ReadString('\n')
+		conversation := func(r *bufio.Reader, w io.Writer, tag, command string) string {
+			io.WriteString(w, tag+" "+command+"\r\n")
+			return readResponse(r, tag)
+		}
+		// lines reads the next n lines
+		lines := func(n int) string {
+			response := ""
+			for i := 0; i < n; i++ {
+				line, _ := r.ReadString('\n')
+				response += line
+			}
+			return response
+		}
+
+		So(conversation(r, w, "a001", "IDLE"), ShouldEqual, "a001 BAD Not authenticated\r\n")
+		So(conversation(r, w, "a002", "LOGIN mrc secret"), ShouldEqual, "a002 OK LOGIN completed\r\n")
+		So(conversation(other, otherW, "b001", "LOGIN mrc secret"), ShouldEqual, "b001 OK LOGIN completed\r\n")
+
+		// without a mailbox there is nothing to report
+		io.WriteString(w, "a003 IDLE\r\n")
+		So(lines(1), ShouldEqual, "+ idling\r\n")
+		io.WriteString(w, "done\r\n")
+		So(readResponse(r, "a003"), ShouldEqual, "a003 OK IDLE terminated\r\n")
+
+		So(conversation(r, w, "a004", "SELECT INBOX"), ShouldEndWith, "a004 OK [READ-WRITE] SELECT completed\r\n")
+		io.WriteString(w, "a005 IDLE\r\n")
+		So(lines(1), ShouldEqual, "+ idling\r\n")
+
+		io.WriteString(otherW, "b002 APPEND INBOX {11}\r\n")
+		other.ReadString('\n')
+		io.WriteString(otherW, "Subject: x\r\n")
+		So(readResponse(other, "b002"), ShouldEqual, "b002 OK APPEND completed\r\n")
+		So(lines(2), ShouldEqual, "* 1 EXISTS\r\n* 1 RECENT\r\n")
+		io.WriteString(otherW, "b003 APPEND INBOX (\\Seen) {11}\r\n")
+		other.ReadString('\n')
+		io.WriteString(otherW, "Subject: y\r\n")
+		So(readResponse(other, "b003"), ShouldEqual, "b003 OK APPEND completed\r\n")
+		So(lines(2), ShouldEqual, "* 2 EXISTS\r\n* 2 RECENT\r\n")
+
+		So(conversation(other, otherW, "b004", "SELECT INBOX"), ShouldContainSubstring, "* 0 RECENT\r\n")
+		So(conversation(other, otherW, "b005", "STORE 1 +FLAGS.SILENT (\\Deleted)"), ShouldEqual, "b005 OK STORE completed\r\n")
+		So(lines(1), ShouldEqual, "* 1 FETCH (FLAGS (\\Deleted \\Recent))\r\n")
+		So(conversation(other, otherW, "b006", "EXPUNGE"), ShouldEqual, "* 1 EXPUNGE\r\nb006 OK EXPUNGE completed\r\n")
+		So(lines(1), ShouldEqual, "* 1 EXPUNGE\r\n")
+		So(conversation(other, otherW, "b007", "STORE 1 -FLAGS.SILENT (\\Seen)"), ShouldEqual, "b007 OK STORE completed\r\n")
+		So(lines(1), ShouldEqual, "* 1 FETCH (FLAGS (\\Recent))\r\n")
+
+		io.WriteString(w, "DONE\r\n")
+		So(readResponse(r, "a005"), ShouldEqual, "a005 OK IDLE terminated\r\n")
+		So(conversation(r, w, "a006", "FETCH 1:* UID"), ShouldEqual, "* 1 FETCH (UID 2)\r\na006 OK FETCH completed\r\n")
+
+		io.WriteString(w, "a007 IDLE\r\n")
+		So(lines(1), ShouldEqual, "+ idling\r\n")
+		io.WriteString(w, "a008 NOOP\r\n")
+		So(readResponse(r, "a007"), ShouldEqual, "a007 BAD Expected DONE\r\n")
+	})
+}
+
+func TestUpdates(t *testing.T) {
+
+	Convey("Testing updates of other sessions", t, func() {
+
+		b := memory.New()
+		b.AddUser("mrc", "secret")
+		u, _ := b.Login("mrc", "secret")
+		inbox, _ := u.GetMailbox("INBOX")
+		for _, subject := range []string{"one", "two", "three"} {
+			inbox.Append(nil, time.Now(), []byte("Subject: "+subject+"\r\n\r\n"))
+		}
+		r, w := testConn(b)
+		other, otherW := testConn(b)
+		r.ReadString('\n')
+		other.ReadString('\n')
+		conversation := func(r *bufio.Reader, w io.Writer, tag, command string) string {
+			io.WriteString(w, tag+" "+command+"\r\n")
+			return readResponse(r, tag)
+		}
+
+		conversation(r, w, "a001", "LOGIN mrc secret")
+		So(conversation(r, w, "a002", "SELECT INBOX"), ShouldStartWith, "* 3 EXISTS\r\n* 3 RECENT\r\n")
+		conversation(other, otherW, "b001", "LOGIN mrc secret")
+		So(conversation(other, otherW, "b002", "SELECT INBOX"), ShouldStartWith, "* 3 EXISTS\r\n* 0 RECENT\r\n")
+
+		So(conversation(other, otherW, "b003", "STORE 2 +FLAGS.SILENT (\\Deleted)"), ShouldEqual, "b003 OK STORE completed\r\n")
+		So(conversation(r, w, "a003", "NOOP"), ShouldEqual, "* 2 FETCH (FLAGS (\\Deleted \\Recent))\r\na003 OK NOOP completed\r\n")
+		So(conversation(r, w, "a004", "NOOP"), ShouldEqual, "a004 OK NOOP completed\r\n")
+		So(conversation(other, otherW, "b004", "EXPUNGE"), ShouldEqual, "* 2 EXPUNGE\r\nb004 OK EXPUNGE completed\r\n")
+
+		// the messages keep their sequence numbers until the client
+		// is told, which FETCH, STORE and SEARCH don't do
+		So(conversation(r, w, "a005", "FETCH 3 UID"), ShouldEqual, "* 3 FETCH (UID 3)\r\na005 OK FETCH completed\r\n")
+		So(conversation(r, w, "a006", "FETCH 2 UID"), ShouldEqual, "a006 OK FETCH completed\r\n")
+		So(conversation(r, w, "a007", "SEARCH 2:3"), ShouldEqual, "* SEARCH 3\r\na007 OK SEARCH completed\r\n")
+		So(conversation(r, w, "a008", "STORE 3 +FLAGS (\\Flagged)"), ShouldEqual, "* 3 FETCH (FLAGS (\\Flagged \\Recent))\r\na008 OK STORE completed\r\n")
+		So(conversation(r, w, "a009", "UID FETCH 3 FLAGS"), ShouldEqual, "* 3 FETCH (UID 3 FLAGS (\\Flagged \\Recent))\r\n"+
+			"* 2 EXPUNGE\r\n"+
+			"a009 OK UID FETCH completed\r\n")
+		So(conversation(r, w, "a010", "FETCH 2 UID"), ShouldEqual, "* 2 FETCH (UID 3)\r\na010 OK FETCH completed\r\n")
+
+		So(conversation(other, otherW, "b005", "FETCH 2 UID"), ShouldEqual, "* 2 FETCH (UID 3)\r\n"+
+			"* 2 FETCH (FLAGS (\\Flagged))\r\n"+
+			"b005 OK FETCH completed\r\n")
+
+		// more changes than the session queues, it compares the mailbox
+		// even after a command which doesn't poll
+		for i := 0; i < 1500; i++ {
+			mode := "+"
+			if i%2 == 1 {
+				mode = "-"
+			}
+			inbox.Store(true, parser.SequenceSet{{Start: 1, Stop: 1}}, mode, []string{`\Seen`})
+		}
+		inbox.Append(nil, time.Now(), []byte("Subject: four\r\n\r\n"))
+		So(conversation(r, w, "a011", "UID FETCH 1 UID"), ShouldEqual, "* 1 FETCH (UID 1)\r\n* 3 EXISTS\r\n* 3 RECENT\r\na011 OK UID FETCH completed\r\n")
+		inbox.Store(true, parser.SequenceSet{{Start: 1, Stop: 1}}, "+", []string{`\Seen`})
+		So(conversation(r, w, "a012", "NOOP"), ShouldEqual, "* 1 FETCH (FLAGS (\\Seen \\Recent))\r\na012 OK NOOP completed\r\n")
+
+		// sequence numbers beyond the messages the client knows are an
+		// error, UIDs of messages which don't exist aren't
+		So(conversation(r, w, "a013", "FETCH 4 UID"), ShouldEqual, "a013 BAD Invalid sequence number\r\n")
+		So(conversation(r, w, "a014", "STORE 2:4 +FLAGS (\\Flagged)"), ShouldEqual, "a014 BAD Invalid sequence number\r\n")
+		So(conversation(r, w, "a015", "COPY 4,1 INBOX"), ShouldEqual, "a015 BAD Invalid sequence number\r\n")
+		So(conversation(r, w, "a016", "SEARCH OR 1 NOT 5"), ShouldEqual, "a016 BAD Invalid sequence number\r\n")
+		So(conversation(r, w, "a017", "UID FETCH 4:10 UID"), ShouldEqual, "* 3 FETCH (UID 4)\r\na017 OK UID FETCH completed\r\n")
+		So(conversation(r, w, "a018", "UID FETCH 10 UID"), ShouldEqual, "a018 OK UID FETCH completed\r\n")
+		So(conversation(r, w, "a019", "FETCH 3:* UID"), ShouldEqual, "* 3 FETCH (UID 4)\r\na019 OK FETCH completed\r\n")
+	})
+}
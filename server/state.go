@@ -0,0 +1,116 @@
+package server
+
+import (
+	"github.com/gopistolet/imap/parser"
+)
+
+// State is the state of an IMAP connection (RFC 3501 section 3)
+type State int
+
+const (
+	NotAuthenticatedState State = iota
+	AuthenticatedState
+	SelectedState
+	LogoutState
+)
+
+func (s State) String() string {
+	switch s {
+	case NotAuthenticatedState:
+		return "not authenticated"
+	case AuthenticatedState:
+		return "authenticated"
+	case SelectedState:
+		return "selected"
+	case LogoutState:
+		return "logout"
+	}
+	return "unknown"
+}
+
+// Session keeps track of the state of a connection,
+// and of the mailbox which is selected in the selected state
+type Session struct {
+	State    State
+	Mailbox  string // selected mailbox
+	ReadOnly bool   // mailbox was selected with EXAMINE
+}
+
+// Check reports whether command may be executed in the current state.
+// If it may not, the returned response has to be sent instead.
+func (s *Session) Check(command parser.Command) (parser.StatusResponse, bool) {
+	refuse := func(typ, info string) (parser.StatusResponse, bool) {
+		return parser.StatusResponse{Tag: command.Tag, Type: typ, Info: info}, false
+	}
+
+	if s.State == LogoutState {
+		return refuse(parser.BAD, "Logging out")
+	}
+
+	switch command.Cmd.(type) {
+
+	// Client Commands - Any State
+	case parser.CapabilityCmd, parser.NoopCmd, parser.LogoutCmd:
+
+	// Client Commands - Not Authenticated State
+	case parser.StarttlsCmd, parser.AuthenticateCmd, parser.LoginCmd:
+		if s.State != NotAuthenticatedState {
+			return refuse(parser.BAD, "Already authenticated")
+		}
+
+	// Client Commands - Authenticated State
+	case parser.SelectCmd, parser.ExamineCmd, parser.CreateCmd, parser.DeleteCmd, parser.RenameCmd,
+		parser.SubscribeCmd, parser.UnsubscribeCmd, parser.ListCmd, parser.LsubCmd, parser.StatusCmd, parser.AppendCmd,
+		parser.IdleCmd:
+		if s.State == NotAuthenticatedState {
+			return refuse(parser.BAD, "Not authenticated")
+		}
+
+	// Client Commands - Selected State
+	case parser.CheckCmd, parser.CloseCmd, parser.SearchCmd, parser.FetchCmd, parser.CopyCmd:
+		if s.State != SelectedState {
+			return refuse(parser.BAD, "No mailbox selected")
+		}
+	case parser.ExpungeCmd, parser.StoreCmd:
+		if s.State != SelectedState {
+			return refuse(parser.BAD, "No mailbox selected")
+		}
+		if s.ReadOnly {
+			return refuse(parser.NO, "Mailbox is read-only")
+		}
+
+	default:
+		return refuse(parser.BAD, "Unsupported command")
+	}
+
+	return parser.StatusResponse{}, true
+}
+
+// Transition changes the state after command has been executed.
+// ok tells whether it completed successfully.
+func (s *Session) Transition(command parser.Command, ok bool) {
+	switch cmd := command.Cmd.(type) {
+	case parser.LoginCmd, parser.AuthenticateCmd:
+		if ok {
+			s.State = AuthenticatedState
+		}
+	case parser.SelectCmd, parser.ExamineCmd:
+		// a failed SELECT closes the mailbox which was selected before
+		s.State = AuthenticatedState
+		s.Mailbox = ""
+		s.ReadOnly = false
+		if ok {
+			s.State = SelectedState
+			s.Mailbox = cmd.(parser.AuthenticatedStateCmd).GetMailbox()
+			_, s.ReadOnly = cmd.(parser.ExamineCmd)
+		}
+	case parser.CloseCmd:
+		if ok {
+			s.State = AuthenticatedState
+			s.Mailbox = ""
+			s.ReadOnly = false
+		}
+	case parser.LogoutCmd:
+		s.State = LogoutState
+	}
+}
@@ -0,0 +1,97 @@
+package server
+
+import (
+	"github.com/gopistolet/imap/parser"
+	. "github.com/smartystreets/goconvey/convey"
+	"testing"
+)
+
+func TestSession(t *testing.T) {
+
+	Convey("Testing Session", t, func() {
+
+		session := &Session{}
+		command := func(cmd parser.Cmd) parser.Command {
+			return parser.Command{Tag: "a001", Cmd: cmd}
+		}
+		allowed := func(cmd parser.Cmd) bool {
+			_, ok := session.Check(command(cmd))
+			return ok
+		}
+
+		Convey("Not Authenticated State", func() {
+
+			So(session.State, ShouldEqual, NotAuthenticatedState)
+			So(allowed(parser.CapabilityCmd{}), ShouldBeTrue)
+			So(allowed(parser.NoopCmd{}), ShouldBeTrue)
+			So(allowed(parser.StarttlsCmd{}), ShouldBeTrue)
+			So(allowed(parser.LoginCmd{}), ShouldBeTrue)
+			So(allowed(parser.AuthenticateCmd{}), ShouldBeTrue)
+
+			response, ok := session.Check(command(parser.SelectCmd{Mailbox: "INBOX"}))
+			So(ok, ShouldBeFalse)
+			So(response, ShouldResemble, parser.StatusResponse{Tag: "a001", Type: parser.BAD, Info: "Not authenticated"})
+			So(allowed(parser.FetchCmd{}), ShouldBeFalse)
+			So(allowed(parser.IdleCmd{}), ShouldBeFalse)
+
+			session.Transition(command(parser.LoginCmd{}), false)
+			So(session.State, ShouldEqual, NotAuthenticatedState)
+			session.Transition(command(parser.LoginCmd{}), true)
+			So(session.State, ShouldEqual, AuthenticatedState)
+		})
+
+		Convey("Authenticated State", func() {
+
+			session.State = AuthenticatedState
+			So(allowed(parser.LoginCmd{}), ShouldBeFalse)
+			So(allowed(parser.StarttlsCmd{}), ShouldBeFalse)
+			So(allowed(parser.ListCmd{}), ShouldBeTrue)
+			So(allowed(parser.AppendCmd{}), ShouldBeTrue)
+			So(allowed(parser.IdleCmd{}), ShouldBeTrue)
+
+			response, ok := session.Check(command(parser.ExpungeCmd{}))
+			So(ok, ShouldBeFalse)
+			So(response.Type, ShouldEqual, parser.BAD)
+
+			session.Transition(command(parser.SelectCmd{Mailbox: "INBOX"}), true)
+			So(session.State, ShouldEqual, SelectedState)
+			So(session.Mailbox, ShouldEqual, "INBOX")
+			So(session.ReadOnly, ShouldBeFalse)
+		})
+
+		Convey("Selected State", func() {
+
+			session.Transition(command(parser.ExamineCmd{Mailbox: "blurdybloop"}), true)
+			So(session.State, ShouldEqual, SelectedState)
+			So(session.ReadOnly, ShouldBeTrue)
+			So(allowed(parser.FetchCmd{}), ShouldBeTrue)
+			So(allowed(parser.CopyCmd{}), ShouldBeTrue)
+			So(allowed(parser.SelectCmd{}), ShouldBeTrue)
+
+			response, ok := session.Check(command(parser.StoreCmd{}))
+			So(ok, ShouldBeFalse)
+			So(response.Type, ShouldEqual, parser.NO)
+			So(allowed(parser.ExpungeCmd{}), ShouldBeFalse)
+
+			session.Transition(command(parser.SelectCmd{Mailbox: "INBOX"}), true)
+			So(session.ReadOnly, ShouldBeFalse)
+			So(allowed(parser.StoreCmd{}), ShouldBeTrue)
+
+			session.Transition(command(parser.SelectCmd{Mailbox: "missing"}), false)
+			So(session.State, ShouldEqual, AuthenticatedState)
+			So(session.Mailbox, ShouldEqual, "")
+
+			session.Transition(command(parser.SelectCmd{Mailbox: "INBOX"}), true)
+			session.Transition(command(parser.CloseCmd{}), true)
+			So(session.State, ShouldEqual, AuthenticatedState)
+		})
+
+		Convey("Logout State", func() {
+
+			session.Transition(command(parser.LogoutCmd{}), true)
+			So(session.State, ShouldEqual, LogoutState)
+			So(allowed(parser.NoopCmd{}), ShouldBeFalse)
+			So(allowed(nil), ShouldBeFalse)
+		})
+	})
+}
@@ -0,0 +1,263 @@
+package server
+
+import (
+	"errors"
+	"github.com/gopistolet/imap/backend"
+	"github.com/gopistolet/imap/parser"
+	"sort"
+)
+
+// all is the sequence set of all messages
+var all = parser.SequenceSet{{Start: 1, Stop: 0}}
+
+var errSeqNum = errors.New("Server: sequence number of a message the client doesn't know")
+
+// open makes mailbox the selected mailbox, and reads the messages
+// the client is told about
+func (c *conn) open(mailbox backend.Mailbox) error {
+	var updates *backend.Subscription
+	if watched, ok := mailbox.(backend.WatchedMailbox); ok {
+		// subscribe before reading, so no change gets lost in between
+		updates = watched.Watch()
+	}
+	messages, err := mailbox.Fetch(false, all, false)
+	if err != nil {
+		if updates != nil {
+			updates.Close()
+		}
+		return err
+	}
+	c.mailbox = mailbox
+	c.updates = updates
+	c.view = messages
+	c.expunged = map[uint32]bool{}
+	return nil
+}
+
+// unselect closes the selected mailbox, if any
+func (c *conn) unselect() {
+	if c.updates != nil {
+		c.updates.Close()
+	}
+	c.mailbox = nil
+	c.updates = nil
+	c.view = nil
+	c.expunged = nil
+}
+
+// seqNum returns the sequence number of the message with uid as the
+// client knows it, or 0 if the client doesn't know the message
+func (c *conn) seqNum(uid uint32) uint32 {
+	i := sort.Search(len(c.view), func(i int) bool { return c.view[i].Uid >= uid })
+	if i < len(c.view) && c.view[i].Uid == uid {
+		return uint32(i + 1)
+	}
+	return 0
+}
+
+// uids returns the UIDs of the messages in set, which has UIDs when
+// uid is set, and otherwise sequence numbers as the client knows them.
+// The mailbox may have renumbered its messages since, when others
+// removed some. UIDs of messages which don't exist are ignored, but
+// sequence numbers of messages the client doesn't know are an error.
+func (c *conn) uids(uid bool, set parser.SequenceSet) (parser.SequenceSet, error) {
+	if uid {
+		return set, nil
+	}
+	max := uint32(len(c.view))
+	if resolved := set.Resolve(max); len(resolved) > 0 && resolved[len(resolved)-1].Stop > max {
+		return nil, errSeqNum
+	}
+	uids := parser.SequenceSet{}
+	set.ForEach(max, func(n uint32) bool {
+		uid := c.view[n-1].Uid
+		if last := len(uids) - 1; last >= 0 && uids[last].Stop+1 == uid {
+			uids[last].Stop = uid
+		} else {
+			uids = append(uids, parser.SeqRange{Start: uid, Stop: uid})
+		}
+		return true
+	})
+	return uids, nil
+}
+
+// uidKeys returns keys with the sequence sets of the client
+// replaced by the UIDs of their messages
+func (c *conn) uidKeys(keys []parser.SearchKey) ([]parser.SearchKey, error) {
+	replaced := make([]parser.SearchKey, len(keys))
+	for i, key := range keys {
+		var err error
+		if key.Name == "SEQUENCE" {
+			key.Name = "UID"
+			if key.Sequence, err = c.uids(false, key.Sequence); err != nil {
+				return nil, err
+			}
+		}
+		if key.Keys != nil {
+			if key.Keys, err = c.uidKeys(key.Keys); err != nil {
+				return nil, err
+			}
+		}
+		replaced[i] = key
+	}
+	return replaced, nil
+}
+
+// renumber replaces the sequence numbers of messages with the ones the
+// client knows, dropping the messages which it doesn't know yet
+func (c *conn) renumber(messages []backend.Message) []backend.Message {
+	known := []backend.Message{}
+	for _, message := range messages {
+		if message.SeqNum = c.seqNum(message.Uid); message.SeqNum > 0 {
+			known = append(known, message)
+		}
+	}
+	return known
+}
+
+// told records that the client was told the flags of messages
+func (c *conn) told(messages []backend.Message) {
+	for _, message := range messages {
+		if n := c.seqNum(message.Uid); n > 0 {
+			c.view[n-1].Flags = message.Flags
+		}
+	}
+}
+
+// update tells the client about the changes of the selected mailbox
+// after a command. Mailboxes which don't publish their changes are
+// compared with what the client knows when poll is set, and otherwise
+// only checked for new messages. EXPUNGE responses are held back
+// unless expunge is set, since they would renumber the messages while
+// the client may still refer to them by sequence number.
+func (c *conn) update(poll, expunge bool) {
+	updates := []backend.Update{}
+	if c.updates != nil {
+		updates = c.updates.Updates()
+		if c.updates.Resync() {
+			// too many changes to queue, they were dropped
+			poll = true
+		}
+	}
+	if poll {
+		updates = append(updates, c.compare()...)
+	} else if c.updates == nil {
+		if status, err := c.mailbox.Status(); err == nil && status.Messages > uint32(len(c.view)-len(c.expunged)) {
+			updates = append(updates, backend.Update{Type: backend.UpdateExists})
+		}
+	}
+
+	exists := false
+	flagged := parser.SequenceSet{}
+	for _, update := range updates {
+		switch update.Type {
+		case backend.UpdateExists:
+			exists = true
+		case backend.UpdateFlags:
+			flagged = append(flagged, parser.SeqRange{Start: update.Uid, Stop: update.Uid})
+		case backend.UpdateExpunge:
+			if c.seqNum(update.Uid) > 0 {
+				c.expunged[update.Uid] = true
+			}
+		}
+	}
+
+	if expunge && len(c.expunged) > 0 {
+		// each EXPUNGE renumbers the messages after it
+		kept := []backend.Message{}
+		for _, message := range c.view {
+			if c.expunged[message.Uid] {
+				c.writer.WriteExpunge(uint32(len(kept) + 1))
+				continue
+			}
+			kept = append(kept, message)
+		}
+		c.view = kept
+		c.expunged = map[uint32]bool{}
+	}
+
+	if len(flagged) > 0 {
+		messages, err := c.mailbox.Fetch(true, flagged, false)
+		if err == nil {
+			for _, message := range c.renumber(messages) {
+				if known := &c.view[message.SeqNum-1]; !sameFlags(known.Flags, message.Flags) {
+					c.writer.WriteFetch(message.SeqNum, []interface{}{parser.Atom("FLAGS"), parser.FlagList(message.Flags)})
+					known.Flags = message.Flags
+				}
+			}
+		}
+	}
+
+	if exists {
+		c.added()
+	}
+}
+
+// added tells the client about the messages which were added
+// after the ones it knows
+func (c *conn) added() {
+	last := uint32(0)
+	if len(c.view) > 0 {
+		last = c.view[len(c.view)-1].Uid
+	}
+	messages, err := c.mailbox.Fetch(true, parser.SequenceSet{{Start: last + 1, Stop: 0}}, false)
+	if err != nil {
+		return
+	}
+	n := len(c.view)
+	for _, message := range messages {
+		if message.Uid > last {
+			c.view = append(c.view, message)
+		}
+	}
+	if len(c.view) == n {
+		return
+	}
+	c.writer.WriteExists(uint32(len(c.view)))
+	if status, err := c.mailbox.Status(); err == nil {
+		c.writer.WriteRecent(status.Recent)
+	}
+}
+
+// compare returns the changes between the messages of the selected
+// mailbox and the ones the client knows, for mailboxes which don't
+// publish them or are changed from outside of the server
+func (c *conn) compare() []backend.Update {
+	messages, err := c.mailbox.Fetch(false, all, false)
+	if err != nil {
+		return nil
+	}
+	current := map[uint32]backend.Message{}
+	for _, message := range messages {
+		current[message.Uid] = message
+	}
+
+	updates := []backend.Update{}
+	for _, known := range c.view {
+		message, ok := current[known.Uid]
+		if !ok {
+			updates = append(updates, backend.Update{Type: backend.UpdateExpunge, Uid: known.Uid})
+		} else if !sameFlags(known.Flags, message.Flags) {
+			updates = append(updates, backend.Update{Type: backend.UpdateFlags, Uid: known.Uid})
+		}
+	}
+	if len(messages) > 0 && (len(c.view) == 0 || messages[len(messages)-1].Uid > c.view[len(c.view)-1].Uid) {
+		updates = append(updates, backend.Update{Type: backend.UpdateExists})
+	}
+	return updates
+}
+
+// sameFlags reports whether a and b hold the same flags,
+// in any order
+func sameFlags(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	m := &backend.Message{Flags: b}
+	for _, flag := range a {
+		if !m.HasFlag(flag) {
+			return false
+		}
+	}
+	return true
+}